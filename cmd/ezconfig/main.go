@@ -7,14 +7,19 @@ import (
 	"github.com/gilankpam/openipc-gs-web/internal/air_unit/handler"
 	"github.com/gilankpam/openipc-gs-web/internal/air_unit/service"
 	"github.com/gilankpam/openipc-gs-web/internal/config"
+	"github.com/gilankpam/openipc-gs-web/internal/metrics"
 )
 
 func main() {
 	// Initialize Config
 	cfg := config.NewServiceConfig()
 
+	// Initialize Metrics
+	registry := metrics.NewRegistry()
+	registry.RegisterSystemMetrics("ezconfig")
+
 	// Initialize Service
-	svc := service.NewConfigService(cfg)
+	svc := service.NewConfigService(cfg).WithMetrics(registry)
 
 	// Initialize Handler
 	h := handler.NewHandler(svc)
@@ -100,6 +105,9 @@ func main() {
 		w.Write([]byte("pong"))
 	})
 
+	// Prometheus metrics
+	mux.Handle("/metrics", registry)
+
 	// Start Server
 	log.Println("Starting OpenIPC EZConfig API on :8080")
 	if err := http.ListenAndServe(":8080", mux); err != nil {
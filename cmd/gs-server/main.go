@@ -10,9 +10,11 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/gilankpam/openipc-gs-web/internal/gs/handler"
 	"github.com/gilankpam/openipc-gs-web/internal/gs/service"
+	"github.com/gilankpam/openipc-gs-web/internal/metrics"
 )
 
 func main() {
@@ -21,16 +23,140 @@ func main() {
 		airUnitAddr = flag.String("airunit", "http://192.168.1.10:8080", "Address of the Air Unit API")
 		staticDir   = flag.String("static", "./web/dist", "Directory containing static frontend files")
 		configFile  = flag.String("config", "/etc/wifibroadcast.cfg", "Path to wifibroadcast.cfg")
-		rtpPort     = flag.Int("rtp-port", 5601, "UDP port to receive RTP H265 stream")
+		rtpPort     = flag.Int("rtp-port", 5601, "UDP port to receive the RTP H264/H265 stream")
+		kfRequest   = flag.String("keyframe-request", service.KeyframeRequestAlink, "How to request keyframes from the air unit: alink, majestic or none")
+		alinkAddr   = flag.String("alink-addr", "10.5.0.10:9999", "UDP address of alink on the air unit, for keyframe requests")
+		rtspPort    = flag.Int("rtsp-port", 0, "TCP port to serve the video over RTSP at /live, e.g. 8554 (0 to disable)")
+		streamMode  = flag.String("stream-mode", service.StreamModeSample, "How video is sent to browsers: sample (reassemble frames) or rtp (forward packets)")
+		maxViewers  = flag.Int("max-viewers", 0, "Maximum number of WebRTC viewers (0 for no limit)")
+		iceServers  = flag.String("ice-servers", "", "Comma separated STUN/TURN URLs for WebRTC, e.g. stun:192.168.1.20:3478 (empty for host candidates only)")
+		iceUser     = flag.String("ice-username", "", "Username for the TURN servers in -ice-servers")
+		icePass     = flag.String("ice-credential", "", "Credential for the TURN servers in -ice-servers")
+		iceIfaces   = flag.String("ice-interfaces", "", "Comma separated interfaces to offer WebRTC host candidates on, e.g. wlan0,usb0 (empty for all)")
+		iceNATIPs   = flag.String("ice-nat-ips", "", "Comma separated public IPs to advertise instead of the host's, as ip or ip/local-ip")
+		icePorts    = flag.String("ice-port-range", "", "UDP port range for WebRTC, e.g. 50000-50100 (empty for any)")
+		iceUDPPort  = flag.Int("ice-udp-port", 0, "Serve all WebRTC peers on this single UDP port (0 to disable)")
+		iceTCPPort  = flag.Int("ice-tcp-port", 0, "Also accept WebRTC over TCP on this port (0 to disable)")
+		turnPort    = flag.Int("turn-port", 0, "UDP/TCP port to run an embedded TURN relay on, e.g. 3478 (0 to disable)")
+		turnRelayIP = flag.String("turn-relay-ip", "", "IP the TURN relay is reached at (empty for the first IPv4 address)")
+		turnTTL     = flag.Duration("turn-credential-ttl", 12*time.Hour, "How long TURN credentials handed to viewers stay valid")
+		statsKeep   = flag.Duration("stats-retention", time.Hour, "How long link statistics history is kept in memory")
+		sessionsDir = flag.String("sessions-dir", "", "Directory to record flight sessions to (empty to disable)")
+		sessionFmt  = flag.String("session-format", service.SessionFormatNDJSON, "Session recording format: ndjson or csv")
+		sessionIdle = flag.Duration("session-quiet", 10*time.Second, "End a session after this long without packets")
+		osdPort     = flag.Int("osd-port", 0, "UDP port to receive MSP DisplayPort OSD frames (0 to disable)")
+		inputsFile  = flag.String("stream-inputs-config", "", "JSON file storing additional video inputs (empty to keep them in memory)")
+		inputLabel  = flag.String("rtp-label", "Main", "Label of the video input received on -rtp-port")
+		outputsFile = flag.String("stream-outputs-config", "", "JSON file storing UDP stream outputs (empty to keep them in memory)")
+		alertsFile  = flag.String("alerts-config", "", "JSON file storing alert rules and webhooks (empty to keep them in memory)")
+		dvrDir      = flag.String("dvr-dir", "", "Directory to record the received video to (empty to disable)")
+		dvrSegment  = flag.Duration("dvr-segment", time.Minute, "Length of each recorded video file")
+		dvrQuota    = flag.Int64("dvr-quota-mb", 4096, "Disk space recordings may use before the oldest are deleted, in MB (0 for no limit)")
+		dvrAuto     = flag.Bool("dvr-auto", false, "Record whenever the video link is up")
+		mavlinkPort = flag.Int("mavlink-port", 0, "UDP port to receive MAVLink telemetry for recording subtitles (0 to disable)")
+		noSignal    = flag.Duration("no-signal-timeout", 3*time.Second, "Restart video ingest after this long without a complete frame (0 to disable)")
 	)
 	flag.Parse()
 
+	// Metrics Registry
+	registry := metrics.NewRegistry()
+	registry.RegisterSystemMetrics("gs")
+
+	// Requests to the Air Unit, proxied or our own, share one instrumented transport
+	airUnitTransport := metrics.InstrumentTransport(nil,
+		registry.NewHistogram("gs_airunit_proxy_request_duration_seconds", "Latency of requests to the Air Unit.", metrics.DefaultLatencyBuckets, "code"),
+		registry.NewCounter("gs_airunit_proxy_errors_total", "Failed requests to the Air Unit.", "reason"),
+	)
+
+	// Keyframe requests to the air unit
+	var keyframeRequester func() error
+	switch *kfRequest {
+	case service.KeyframeRequestAlink:
+		keyframeRequester = service.AlinkKeyframeRequester(*alinkAddr)
+	case service.KeyframeRequestMajestic:
+		requester, err := service.MajesticKeyframeRequester(*airUnitAddr)
+		if err != nil {
+			log.Fatalf("Invalid Air Unit URL: %v", err)
+		}
+		keyframeRequester = requester
+	case service.KeyframeRequestNone:
+	default:
+		log.Fatalf("Unsupported keyframe request method %q", *kfRequest)
+	}
+
 	// Initialize Streaming Server
-	streamServer := service.NewStreamServer(*rtpPort)
+	streamOutputs, err := service.NewStreamOutputs(*outputsFile)
+	if err != nil {
+		log.Fatalf("Failed to create stream outputs: %v", err)
+	}
+	defer streamOutputs.Close()
+	streamServer, err := service.NewStreamServer(*rtpPort).
+		WithCodecSource(service.AirUnitCodecSource(*airUnitAddr, airUnitTransport)).
+		WithKeyframeRequester(keyframeRequester).
+		WithOutputs(streamOutputs).
+		WithMaxPeers(*maxViewers).
+		WithMode(*streamMode)
+	if err != nil {
+		log.Fatalf("Invalid stream mode: %v", err)
+	}
+	iceConfig := service.ICEConfig{
+		Interfaces: splitList(*iceIfaces),
+		NAT1To1IPs: splitList(*iceNATIPs),
+		UDPMuxPort: *iceUDPPort,
+		TCPMuxPort: *iceTCPPort,
+	}
+	if iceConfig.Servers, err = service.ParseICEServers(splitList(*iceServers), *iceUser, *icePass); err != nil {
+		log.Fatalf("Invalid ICE servers: %v", err)
+	}
+	if iceConfig.PortMin, iceConfig.PortMax, err = service.ParsePortRange(*icePorts); err != nil {
+		log.Fatalf("Invalid ICE port range: %v", err)
+	}
+	if _, err := streamServer.WithICE(iceConfig); err != nil {
+		log.Fatalf("Invalid ICE configuration: %v", err)
+	}
+
+	// Initialize TURN Server
+	if *turnPort > 0 {
+		turnServer, err := service.NewTURNServer(*turnPort, *turnRelayIP, *turnTTL)
+		if err != nil {
+			log.Fatalf("Failed to create TURN server: %v", err)
+		}
+		if err := turnServer.Start(); err != nil {
+			log.Fatalf("Failed to start TURN server: %v", err)
+		}
+		defer turnServer.Stop()
+		turnServer.RegisterMetrics(registry)
+		streamServer.WithTURN(turnServer)
+	}
 	if err := streamServer.Start(); err != nil {
 		log.Fatalf("Failed to start streaming server: %v", err)
 	}
 	defer streamServer.Stop()
+	streamServer.RegisterMetrics(registry)
+
+	// Initialize additional video inputs
+	streamInputs, err := service.NewStreamInputs(streamServer, *inputLabel, *inputsFile)
+	if err != nil {
+		log.Fatalf("Failed to create stream inputs: %v", err)
+	}
+	defer streamInputs.Close()
+	streamInputs.RegisterMetrics(registry)
+
+	// Initialize Stream Analyzer
+	streamAnalyzer := service.NewStreamAnalyzer(streamServer).
+		WithVideoSettingsSource(service.AirUnitVideoSettingsSource(*airUnitAddr, airUnitTransport))
+	streamAnalyzer.Start()
+	defer streamAnalyzer.Stop()
+
+	// Initialize RTSP Server
+	if *rtspPort > 0 {
+		rtspServer := service.NewRTSPServer(streamServer, *rtspPort)
+		if err := rtspServer.Start(); err != nil {
+			log.Fatalf("Failed to start RTSP server: %v", err)
+		}
+		defer rtspServer.Stop()
+		rtspServer.RegisterMetrics(registry)
+	}
 
 	// Parse Air Unit URL
 	airUnitURL, err := url.Parse(*airUnitAddr)
@@ -46,14 +172,79 @@ func main() {
 		// Ensure Host header matches the target
 		req.Host = airUnitURL.Host
 	}
+	proxy.Transport = airUnitTransport
 
 	// Initialize Radio Handler
 	radioHandler := handler.NewRadioHandler(proxy, *configFile)
 
 	// Initialize Stats Service
-	statsService := service.NewWFBStatsService()
+	statsService := service.NewWFBStatsService().WithHistoryRetention(*statsKeep)
 	statsService.Start()
 	defer statsService.Stop()
+	statsService.RegisterMetrics(registry)
+
+	// Initialize Session Recorder
+	var sessionRecorder *service.SessionRecorder
+	if *sessionsDir != "" {
+		sessionRecorder, err = service.NewSessionRecorder(statsService, *sessionsDir, *sessionFmt, *sessionIdle)
+		if err != nil {
+			log.Fatalf("Failed to create session recorder: %v", err)
+		}
+		sessionRecorder.Start()
+		defer sessionRecorder.Stop()
+	}
+
+	// Initialize Alerts
+	alertService, err := service.NewAlertService(statsService, *alertsFile)
+	if err != nil {
+		log.Fatalf("Failed to create alert service: %v", err)
+	}
+	alertService.Start()
+	defer alertService.Stop()
+
+	// Initialize Stream Watchdog
+	if *noSignal > 0 {
+		streamWatchdog := service.NewStreamWatchdog(streamServer, *noSignal).
+			WithEvents(statsService.PushEvent)
+		streamWatchdog.Start()
+		defer streamWatchdog.Stop()
+		streamWatchdog.RegisterMetrics(registry)
+	}
+
+	// Initialize MAVLink telemetry
+	var mavlinkService *service.MAVLinkService
+	if *mavlinkPort > 0 {
+		mavlinkService = service.NewMAVLinkService(*mavlinkPort)
+		if err := mavlinkService.Start(); err != nil {
+			log.Fatalf("Failed to start MAVLink service: %v", err)
+		}
+		defer mavlinkService.Stop()
+	}
+
+	// Initialize DVR
+	var dvrRecorder *service.DVRRecorder
+	if *dvrDir != "" {
+		dvrRecorder, err = service.NewDVRRecorder(streamServer, *dvrDir, *dvrSegment, *dvrQuota*1024*1024)
+		if err != nil {
+			log.Fatalf("Failed to create DVR: %v", err)
+		}
+		dvrRecorder.WithAuto(*dvrAuto).WithTelemetry(statsService, mavlinkService).Start()
+		defer dvrRecorder.Stop()
+		dvrRecorder.RegisterMetrics(registry)
+	}
+
+	// Initialize OSD Service
+	var osdService *service.OSDService
+	if *osdPort > 0 {
+		osdService = service.NewOSDService(*osdPort)
+		if err := osdService.Start(); err != nil {
+			log.Fatalf("Failed to start OSD service: %v", err)
+		}
+		defer osdService.Stop()
+	}
+
+	// Prometheus metrics
+	http.Handle("/metrics", registry)
 
 	// Serve Static Files or Proxy API
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -64,7 +255,55 @@ func main() {
 		if strings.HasPrefix(r.URL.Path, "/api/") {
 			// WebRTC signaling endpoint
 			if r.URL.Path == "/api/v1/stream/offer" {
-				streamServer.HandleSignaling(w, r)
+				streamInputs.HandleSignaling(w, r)
+				return
+			}
+			if strings.HasPrefix(r.URL.Path, "/api/v1/stream/inputs") {
+				id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/stream/inputs"), "/")
+				if id == "" {
+					streamInputs.HandleInputs(w, r)
+				} else {
+					streamInputs.HandleInput(w, r, id)
+				}
+				return
+			}
+			if strings.HasPrefix(r.URL.Path, "/api/v1/stream/whep") {
+				id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/stream/whep"), "/")
+				if id == "" {
+					streamInputs.HandleWHEP(w, r)
+				} else {
+					streamInputs.HandleWHEPSession(w, r, id)
+				}
+				return
+			}
+			if strings.HasPrefix(r.URL.Path, "/api/v1/stream/peers") {
+				id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/stream/peers"), "/")
+				if id == "" {
+					streamInputs.HandlePeers(w, r)
+				} else {
+					streamInputs.HandlePeer(w, r, id)
+				}
+				return
+			}
+			if r.URL.Path == "/api/v1/stream/info" {
+				streamAnalyzer.HandleInfo(w, r)
+				return
+			}
+			if r.URL.Path == "/api/v1/stream/ice" {
+				streamServer.HandleICEServers(w, r)
+				return
+			}
+			if r.URL.Path == "/api/v1/stream/fmp4" {
+				streamServer.HandleFMP4(w, r)
+				return
+			}
+			if strings.HasPrefix(r.URL.Path, "/api/v1/stream/outputs") {
+				id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/stream/outputs"), "/")
+				if id == "" {
+					streamOutputs.HandleOutputs(w, r)
+				} else {
+					streamOutputs.HandleOutput(w, r, id)
+				}
 				return
 			}
 			// Radio Settings update
@@ -84,6 +323,80 @@ func main() {
 				json.NewEncoder(w).Encode(stats)
 				return
 			}
+			if r.URL.Path == "/api/v1/stats/reset" {
+				statsService.HandleReset(w, r)
+				return
+			}
+			if r.URL.Path == "/api/v1/stats/history" {
+				statsService.HandleHistory(w, r)
+				return
+			}
+			if sessionRecorder != nil && strings.HasPrefix(r.URL.Path, "/api/v1/stats/sessions") {
+				id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/stats/sessions"), "/")
+				if id == "" {
+					sessionRecorder.HandleSessions(w, r)
+				} else {
+					sessionRecorder.HandleSession(w, r, id)
+				}
+				return
+			}
+			if r.URL.Path == "/api/v1/stats/stream" {
+				statsService.HandleStream(w, r)
+				return
+			}
+			// DVR recordings
+			if dvrRecorder != nil && strings.HasPrefix(r.URL.Path, "/api/v1/recordings") {
+				switch id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/recordings"), "/"); id {
+				case "":
+					dvrRecorder.HandleRecordings(w, r)
+				case "status":
+					dvrRecorder.HandleStatus(w, r)
+				case "start":
+					dvrRecorder.HandleStart(w, r)
+				case "stop":
+					dvrRecorder.HandleStop(w, r)
+				default:
+					dvrRecorder.HandleRecording(w, r, id)
+				}
+				return
+			}
+			// Alerts
+			if r.URL.Path == "/api/v1/alerts" {
+				alertService.HandleActive(w, r)
+				return
+			}
+			if r.URL.Path == "/api/v1/alerts/log" {
+				alertService.HandleLog(w, r)
+				return
+			}
+			if r.URL.Path == "/api/v1/alerts/cue" {
+				alertService.HandleCue(w, r)
+				return
+			}
+			if r.URL.Path == "/api/v1/alerts/webhooks" {
+				alertService.HandleWebhooks(w, r)
+				return
+			}
+			if strings.HasPrefix(r.URL.Path, "/api/v1/alerts/rules") {
+				id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/alerts/rules"), "/")
+				if id == "" {
+					alertService.HandleRules(w, r)
+				} else {
+					alertService.HandleRule(w, r, id)
+				}
+				return
+			}
+			// MSP DisplayPort OSD
+			if osdService != nil {
+				if r.URL.Path == "/api/v1/osd" {
+					osdService.HandleSnapshot(w, r)
+					return
+				}
+				if r.URL.Path == "/api/v1/osd/stream" {
+					osdService.HandleStream(w, r)
+					return
+				}
+			}
 
 			// Proxy other requests to Air Unit
 			proxy.ServeHTTP(w, r)
@@ -116,3 +429,14 @@ func main() {
 		log.Fatalf("Server failed: %v", err)
 	}
 }
+
+// splitList splits a comma separated flag value, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -8,12 +8,17 @@ import (
 	"time"
 
 	"github.com/gilankpam/openipc-gs-web/internal/config"
+	"github.com/gilankpam/openipc-gs-web/internal/metrics"
 	"github.com/gilankpam/openipc-gs-web/internal/models"
 )
 
 type ConfigService struct {
 	config    *config.ServiceConfig
 	initDPath string
+
+	// Optional metrics, nil unless WithMetrics is called
+	configChanges   *metrics.Counter
+	serviceCommands *metrics.Counter
 }
 
 func NewConfigService(cfg *config.ServiceConfig) *ConfigService {
@@ -27,6 +32,34 @@ func NewConfigService(cfg *config.ServiceConfig) *ConfigService {
 	}
 }
 
+// WithMetrics exports config change and service restart counters to reg
+func (s *ConfigService) WithMetrics(reg *metrics.Registry) *ConfigService {
+	s.configChanges = reg.NewCounter("ezconfig_config_changes_total", "Configuration updates by section and result.", "section", "result")
+	s.serviceCommands = reg.NewCounter("ezconfig_service_commands_total", "Service start/stop/restart commands by outcome.", "service", "action", "result")
+	return s
+}
+
+// countConfigChange records the outcome of a config update. It is deferred
+// with a pointer to the named error result of the update.
+func (s *ConfigService) countConfigChange(section string, err *error) {
+	if s.configChanges != nil {
+		s.configChanges.Inc(section, resultLabel(*err))
+	}
+}
+
+func (s *ConfigService) countServiceCommand(name, action string, err error) {
+	if s.serviceCommands != nil {
+		s.serviceCommands.Inc(name, action, resultLabel(err))
+	}
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
 // --- Radio (WFB) ---
 
 func (s *ConfigService) GetRadioSettings() (*models.RadioSettings, error) {
@@ -46,7 +79,9 @@ func (s *ConfigService) GetRadioSettings() (*models.RadioSettings, error) {
 	}, nil
 }
 
-func (s *ConfigService) UpdateRadioSettings(settings *models.RadioSettings) error {
+func (s *ConfigService) UpdateRadioSettings(settings *models.RadioSettings) (err error) {
+	defer s.countConfigChange("radio", &err)
+
 	wfb, err := s.config.LoadWFB()
 	if err != nil {
 		return err
@@ -97,7 +132,9 @@ func (s *ConfigService) GetVideoSettings() (*models.VideoSettings, error) {
 	}, nil
 }
 
-func (s *ConfigService) UpdateVideoSettings(settings *models.VideoSettings) error {
+func (s *ConfigService) UpdateVideoSettings(settings *models.VideoSettings) (err error) {
+	defer s.countConfigChange("video", &err)
+
 	conf, err := s.config.LoadMajestic()
 	if err != nil {
 		return err
@@ -144,7 +181,9 @@ func (s *ConfigService) GetCameraSettings() (*models.CameraSettings, error) {
 	}, nil
 }
 
-func (s *ConfigService) UpdateCameraSettings(settings *models.CameraSettings) error {
+func (s *ConfigService) UpdateCameraSettings(settings *models.CameraSettings) (err error) {
+	defer s.countConfigChange("camera", &err)
+
 	conf, err := s.config.LoadMajestic()
 	if err != nil {
 		return err
@@ -191,7 +230,9 @@ func (s *ConfigService) GetTelemetrySettings() (*models.TelemetrySettings, error
 	}, nil
 }
 
-func (s *ConfigService) UpdateTelemetrySettings(settings *models.TelemetrySettings) error {
+func (s *ConfigService) UpdateTelemetrySettings(settings *models.TelemetrySettings) (err error) {
+	defer s.countConfigChange("telemetry", &err)
+
 	wfb, err := s.config.LoadWFB()
 	if err != nil {
 		return err
@@ -238,7 +279,9 @@ func (s *ConfigService) GetAdaptiveLinkSettings() (*models.AdaptiveLinkSettings,
 	}, nil
 }
 
-func (s *ConfigService) UpdateAdaptiveLinkSettings(settings *models.AdaptiveLinkSettings) error {
+func (s *ConfigService) UpdateAdaptiveLinkSettings(settings *models.AdaptiveLinkSettings) (err error) {
+	defer s.countConfigChange("adaptive_link", &err)
+
 	// 1. Load existing config
 	config, err := s.config.LoadAlink()
 	if err != nil {
@@ -366,7 +409,9 @@ func (s *ConfigService) startAlinkProcess() error {
 		// Testing mode: use dummy command
 		cmd = exec.Command("sh", "-c", "echo 'Starting alink_drone'")
 	}
-	return cmd.Start()
+	err := cmd.Start()
+	s.countServiceCommand("alink_drone", "start", err)
+	return err
 }
 
 func (s *ConfigService) killAlinkProcess() error {
@@ -383,7 +428,9 @@ func (s *ConfigService) killAlinkProcess() error {
 
 func (s *ConfigService) runServiceCommand(name, action string) error {
 	cmd := exec.Command(filepath.Join(s.initDPath, name), action)
-	return cmd.Run()
+	err := cmd.Run()
+	s.countServiceCommand(name, action, err)
+	return err
 }
 
 func (s *ConfigService) restartService(name string) error {
@@ -408,7 +455,9 @@ func (s *ConfigService) GetTxProfiles() ([]models.TxProfile, error) {
 	return s.config.LoadTxProfiles()
 }
 
-func (s *ConfigService) UpdateTxProfiles(profiles []models.TxProfile) error {
+func (s *ConfigService) UpdateTxProfiles(profiles []models.TxProfile) (err error) {
+	defer s.countConfigChange("txprofiles", &err)
+
 	if err := s.config.SaveTxProfiles(profiles); err != nil {
 		return err
 	}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gilankpam/openipc-gs-web/internal/config"
+	"github.com/gilankpam/openipc-gs-web/internal/metrics"
+	"github.com/gilankpam/openipc-gs-web/internal/models"
+)
+
+func TestConfigServiceMetrics(t *testing.T) {
+	tmpDir := t.TempDir()
+	initD := filepath.Join(tmpDir, "init.d")
+	if err := os.Mkdir(initD, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fake majestic init script that always succeeds
+	if err := os.WriteFile(filepath.Join(initD, "S95majestic"), []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	majesticPath := filepath.Join(tmpDir, "majestic.yaml")
+	if err := os.WriteFile(majesticPath, []byte("video0:\n  fps: 60\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("INIT_D_PATH", initD)
+	cfg := &config.ServiceConfig{
+		MajesticPath: majesticPath,
+		WFBPath:      filepath.Join(tmpDir, "missing.yaml"),
+	}
+
+	reg := metrics.NewRegistry()
+	svc := NewConfigService(cfg).WithMetrics(reg)
+
+	fps := 90
+	if err := svc.UpdateVideoSettings(&models.VideoSettings{Fps: &fps}); err != nil {
+		t.Fatalf("UpdateVideoSettings failed: %v", err)
+	}
+	channel := 36
+	if err := svc.UpdateRadioSettings(&models.RadioSettings{Channel: &channel}); err == nil {
+		t.Fatal("Expected UpdateRadioSettings to fail without wfb.yaml")
+	}
+
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	body := string(data)
+
+	for _, line := range []string{
+		`ezconfig_config_changes_total{section="video",result="ok"} 1`,
+		`ezconfig_config_changes_total{section="radio",result="error"} 1`,
+		`ezconfig_service_commands_total{service="S95majestic",action="restart",result="ok"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Missing line %q in:\n%s", line, body)
+		}
+	}
+}
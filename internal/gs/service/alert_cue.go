@@ -0,0 +1,63 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+const cueSampleRate = 8000
+
+// cueTone is a beep followed by silence
+type cueTone struct {
+	freq  float64
+	onMs  int
+	offMs int
+}
+
+// alertCues are the WAV files served for each severity: more urgent alerts
+// beep more often and higher
+var alertCues = map[string][]byte{
+	AlertSeverityInfo:     generateCue([]cueTone{{880, 150, 0}}),
+	AlertSeverityWarning:  generateCue([]cueTone{{660, 150, 100}, {660, 150, 0}}),
+	AlertSeverityCritical: generateCue([]cueTone{{1200, 100, 60}, {1200, 100, 60}, {1200, 100, 60}, {1200, 100, 0}}),
+}
+
+// generateCue renders tones as an 8 kHz, 8-bit mono PCM WAV file
+func generateCue(tones []cueTone) []byte {
+	var samples []byte
+	for _, t := range tones {
+		on := cueSampleRate * t.onMs / 1000
+		// Short fade in and out so the beep doesn't click
+		fade := cueSampleRate * 5 / 1000
+		for i := 0; i < on; i++ {
+			gain := 1.0
+			if i < fade {
+				gain = float64(i) / float64(fade)
+			} else if on-i < fade {
+				gain = float64(on-i) / float64(fade)
+			}
+			v := math.Sin(2*math.Pi*t.freq*float64(i)/cueSampleRate) * gain * 100
+			samples = append(samples, byte(128+int(v)))
+		}
+		for i := 0; i < cueSampleRate*t.offMs/1000; i++ {
+			samples = append(samples, 128)
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+len(samples)))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(16))            // fmt chunk size
+	binary.Write(&buf, binary.LittleEndian, uint16(1))             // PCM
+	binary.Write(&buf, binary.LittleEndian, uint16(1))             // mono
+	binary.Write(&buf, binary.LittleEndian, uint32(cueSampleRate)) // sample rate
+	binary.Write(&buf, binary.LittleEndian, uint32(cueSampleRate)) // byte rate
+	binary.Write(&buf, binary.LittleEndian, uint16(1))             // block align
+	binary.Write(&buf, binary.LittleEndian, uint16(8))             // bits per sample
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(len(samples)))
+	buf.Write(samples)
+	return buf.Bytes()
+}
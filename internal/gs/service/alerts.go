@@ -0,0 +1,772 @@
+package service
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Alert severities, in increasing order
+const (
+	AlertSeverityInfo     = "info"
+	AlertSeverityWarning  = "warning"
+	AlertSeverityCritical = "critical"
+)
+
+// Alert states
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+const (
+	// alertEvalInterval is how often rules are evaluated between updates,
+	// so "for" durations and staleness are noticed without new stats
+	alertEvalInterval = 250 * time.Millisecond
+	// alertStaleAfter is how long without a video update before the link
+	// counts as silent: rates read as zero and signal levels as unknown
+	alertStaleAfter = 3 * time.Second
+	alertLogSize    = 500
+	webhookTimeout  = 3 * time.Second
+)
+
+var alertRuleIDPattern = regexp.MustCompile(`^[0-9A-Za-z_-]+$`)
+
+var alertSeverityRank = map[string]int{
+	AlertSeverityInfo:     0,
+	AlertSeverityWarning:  1,
+	AlertSeverityCritical: 2,
+}
+
+// alertMetrics are the values rules can watch, read from the video stream.
+// NaN means the value is unknown and the rule is left as it is.
+var alertMetrics = map[string]func(st *WFBStreamStats) float64{
+	"rssi_avg":     func(st *WFBStreamStats) float64 { return meanInt8(st.Rssi) },
+	"rssi_best":    func(st *WFBStreamStats) float64 { return maxInt8(st.Rssi) },
+	"snr_avg":      func(st *WFBStreamStats) float64 { return meanInt8(st.Snr) },
+	"snr_best":     func(st *WFBStreamStats) float64 { return maxInt8(st.Snr) },
+	"packets":      func(st *WFBStreamStats) float64 { return float64(st.VideoPacketsPerSec) },
+	"lost":         func(st *WFBStreamStats) float64 { return float64(st.LostPacketsPerSec) },
+	"fec_rec":      func(st *WFBStreamStats) float64 { return float64(st.FecPacketsPerSec) },
+	"bad":          func(st *WFBStreamStats) float64 { return float64(st.BadBlocksPerSec) },
+	"flow":         func(st *WFBStreamStats) float64 { return float64(st.LinkFlowBytesPerSec) },
+	"mcs":          func(st *WFBStreamStats) float64 { return float64(st.McsIndex) },
+	"loss_percent": func(st *WFBStreamStats) float64 { return st.LossPercent },
+}
+
+// AlertRule describes a condition on a link metric.
+// Op is one of <, <=, >, >= or "decrease", which fires when the metric
+// drops by more than Threshold between two updates (e.g. an MCS change).
+type AlertRule struct {
+	ID        string  `json:"id"`
+	Name      string  `json:"name"`
+	Metric    string  `json:"metric"`
+	Op        string  `json:"op"`
+	Threshold float64 `json:"threshold"`
+	// How long the condition must hold before firing
+	ForSec float64 `json:"for_sec"`
+	// How far past the threshold the metric must recover before resolving
+	Hysteresis float64 `json:"hysteresis"`
+	// Minimum time between two alerts of this rule
+	CooldownSec float64 `json:"cooldown_sec"`
+	Severity    string  `json:"severity"`
+	Enabled     bool    `json:"enabled"`
+}
+
+func (r *AlertRule) validate() error {
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	if _, ok := alertMetrics[r.Metric]; !ok {
+		return fmt.Errorf("unknown metric %q", r.Metric)
+	}
+	switch r.Op {
+	case "<", "<=", ">", ">=", "decrease":
+	default:
+		return fmt.Errorf("unknown op %q", r.Op)
+	}
+	if _, ok := alertSeverityRank[r.Severity]; !ok {
+		return fmt.Errorf("unknown severity %q", r.Severity)
+	}
+	if r.ForSec < 0 || r.CooldownSec < 0 || r.Hysteresis < 0 {
+		return errors.New("for_sec, cooldown_sec and hysteresis can't be negative")
+	}
+	return nil
+}
+
+// AlertWebhook is a local HTTP endpoint that alerts are POSTed to as JSON
+type AlertWebhook struct {
+	URL string `json:"url"`
+	// Only alerts of at least this severity are sent (default: all)
+	MinSeverity string `json:"min_severity,omitempty"`
+}
+
+// Alert is a rule firing or resolving
+type Alert struct {
+	ID        uint64    `json:"id"`
+	Time      time.Time `json:"time"`
+	RuleID    string    `json:"rule_id"`
+	RuleName  string    `json:"rule_name"`
+	Metric    string    `json:"metric"`
+	Severity  string    `json:"severity"`
+	State     string    `json:"state"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Message   string    `json:"message"`
+}
+
+// alertConfig is the persisted rules file
+type alertConfig struct {
+	Rules    []*AlertRule   `json:"rules"`
+	Webhooks []AlertWebhook `json:"webhooks"`
+}
+
+// ruleState tracks the evaluation of one rule
+type ruleState struct {
+	pendingSince time.Time
+	active       bool
+	lastFired    time.Time
+	prev         float64
+	havePrev     bool
+}
+
+// defaultAlertRules are used until rules are configured
+func defaultAlertRules() []*AlertRule {
+	return []*AlertRule{
+		{ID: "low-rssi", Name: "Low RSSI", Metric: "rssi_avg", Op: "<", Threshold: -80, ForSec: 2, Hysteresis: 3, CooldownSec: 10, Severity: AlertSeverityWarning, Enabled: true},
+		{ID: "packet-loss", Name: "Packet loss", Metric: "lost", Op: ">", Threshold: 20, ForSec: 1, Hysteresis: 5, CooldownSec: 10, Severity: AlertSeverityWarning, Enabled: true},
+		{ID: "no-packets", Name: "No packets", Metric: "packets", Op: "<=", Threshold: 0, ForSec: 1, CooldownSec: 5, Severity: AlertSeverityCritical, Enabled: true},
+		{ID: "mcs-drop", Name: "MCS dropped", Metric: "mcs", Op: "decrease", CooldownSec: 5, Severity: AlertSeverityInfo, Enabled: true},
+	}
+}
+
+// AlertService evaluates alert rules against the live video stream stats
+// and delivers alerts to the stats stream, the alert log and webhooks
+type AlertService struct {
+	stats      *WFBStatsService
+	configPath string
+	client     *http.Client
+
+	mu       sync.Mutex
+	rules    []*AlertRule
+	webhooks []AlertWebhook
+	state    map[string]*ruleState
+	latest   WFBStreamStats
+	latestAt time.Time
+	log      []Alert
+	nextID   uint64
+
+	running bool
+	stopCh  chan struct{}
+}
+
+// NewAlertService creates an alert service. Rules and webhooks are loaded
+// from configPath when it exists and saved there on every change; an empty
+// path keeps them in memory only.
+func NewAlertService(stats *WFBStatsService, configPath string) (*AlertService, error) {
+	s := &AlertService{
+		stats:      stats,
+		configPath: configPath,
+		client:     &http.Client{Timeout: webhookTimeout},
+		rules:      defaultAlertRules(),
+		state:      map[string]*ruleState{},
+		stopCh:     make(chan struct{}),
+	}
+
+	if configPath == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alerts config: %w", err)
+	}
+	var cfg alertConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse alerts config: %w", err)
+	}
+	for _, rule := range cfg.Rules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("invalid alert rule %q: %w", rule.ID, err)
+		}
+	}
+	s.rules = cfg.Rules
+	s.webhooks = cfg.Webhooks
+	return s, nil
+}
+
+func (s *AlertService) Start() {
+	s.running = true
+	sub := s.stats.Subscribe()
+	go s.run(sub)
+}
+
+func (s *AlertService) Stop() {
+	if !s.running {
+		return
+	}
+	s.running = false
+	close(s.stopCh)
+}
+
+func (s *AlertService) run(sub *Subscription[*WFBStats]) {
+	defer sub.Close()
+
+	ticker := time.NewTicker(alertEvalInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case stats, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if !stats.PrimaryUpdated() {
+				continue
+			}
+			s.observe(stats.WFBStreamStats, time.Now())
+		case now := <-ticker.C:
+			s.evaluate(now)
+		}
+	}
+}
+
+// observe records a video stream update and evaluates the rules against it
+func (s *AlertService) observe(stats WFBStreamStats, now time.Time) {
+	s.mu.Lock()
+	s.latest = stats
+	s.latestAt = now
+	s.mu.Unlock()
+	s.evaluate(now)
+}
+
+// evaluate checks every enabled rule against the latest stats
+func (s *AlertService) evaluate(now time.Time) {
+	s.mu.Lock()
+	current := s.current(now)
+	if current == nil {
+		s.mu.Unlock()
+		return
+	}
+	var alerts []Alert
+	for _, rule := range s.rules {
+		if !rule.Enabled {
+			continue
+		}
+		value := alertMetrics[rule.Metric](current)
+		if state := s.evaluateRule(rule, value, now); state != "" {
+			alerts = append(alerts, s.record(rule, state, value, now))
+		}
+	}
+	s.mu.Unlock()
+
+	for _, alert := range alerts {
+		s.deliver(alert)
+	}
+}
+
+// current returns the stats rules are evaluated against, nil until wfb-ng
+// reported once. Once wfb-ng goes quiet the rates read as zero and the
+// signal as unknown.
+func (s *AlertService) current(now time.Time) *WFBStreamStats {
+	if s.latestAt.IsZero() {
+		return nil
+	}
+	if now.Sub(s.latestAt) < alertStaleAfter {
+		return &s.latest
+	}
+	return &WFBStreamStats{McsIndex: s.latest.McsIndex, LossPercent: s.latest.LossPercent}
+}
+
+// evaluateRule advances the state of a rule and returns the state it
+// changed to, if any
+func (s *AlertService) evaluateRule(rule *AlertRule, value float64, now time.Time) string {
+	st := s.state[rule.ID]
+	if st == nil {
+		st = &ruleState{}
+		s.state[rule.ID] = st
+	}
+	if math.IsNaN(value) {
+		st.pendingSince = time.Time{}
+		return ""
+	}
+
+	var cond, clear bool
+	switch rule.Op {
+	case "<":
+		cond, clear = value < rule.Threshold, value >= rule.Threshold+rule.Hysteresis
+	case "<=":
+		cond, clear = value <= rule.Threshold, value > rule.Threshold+rule.Hysteresis
+	case ">":
+		cond, clear = value > rule.Threshold, value <= rule.Threshold-rule.Hysteresis
+	case ">=":
+		cond, clear = value >= rule.Threshold, value < rule.Threshold-rule.Hysteresis
+	case "decrease":
+		// An event rather than a level, "for" doesn't apply
+		cond = st.havePrev && value < st.prev-rule.Threshold
+		clear = !cond
+		st.prev, st.havePrev = value, true
+	}
+
+	if st.active {
+		if clear {
+			st.active = false
+			return AlertResolved
+		}
+		return ""
+	}
+	if !cond {
+		st.pendingSince = time.Time{}
+		return ""
+	}
+	if rule.Op != "decrease" {
+		if st.pendingSince.IsZero() {
+			st.pendingSince = now
+		}
+		if now.Sub(st.pendingSince) < secondsToDuration(rule.ForSec) {
+			return ""
+		}
+	}
+	if !st.lastFired.IsZero() && now.Sub(st.lastFired) < secondsToDuration(rule.CooldownSec) {
+		return ""
+	}
+
+	st.active = true
+	st.lastFired = now
+	st.pendingSince = time.Time{}
+	return AlertFiring
+}
+
+// record appends an alert to the log
+func (s *AlertService) record(rule *AlertRule, state string, value float64, now time.Time) Alert {
+	s.nextID++
+	alert := Alert{
+		ID:        s.nextID,
+		Time:      now,
+		RuleID:    rule.ID,
+		RuleName:  rule.Name,
+		Metric:    rule.Metric,
+		Severity:  rule.Severity,
+		State:     state,
+		Value:     value,
+		Threshold: rule.Threshold,
+	}
+	if state == AlertFiring {
+		alert.Message = fmt.Sprintf("%s: %s %g %s %g", rule.Name, rule.Metric, value, rule.Op, rule.Threshold)
+	} else {
+		alert.Message = fmt.Sprintf("%s resolved: %s %g", rule.Name, rule.Metric, value)
+	}
+
+	s.log = append(s.log, alert)
+	if len(s.log) > alertLogSize {
+		s.log = s.log[len(s.log)-alertLogSize:]
+	}
+	return alert
+}
+
+// deliver pushes an alert to the UI and the webhooks
+func (s *AlertService) deliver(alert Alert) {
+	log.Printf("Alert: %s", alert.Message)
+	s.stats.PushEvent("alert", alert)
+
+	s.mu.Lock()
+	webhooks := s.webhooks
+	s.mu.Unlock()
+
+	for _, hook := range webhooks {
+		if hook.MinSeverity != "" && alertSeverityRank[alert.Severity] < alertSeverityRank[hook.MinSeverity] {
+			continue
+		}
+		go s.sendWebhook(hook.URL, alert)
+	}
+}
+
+func (s *AlertService) sendWebhook(url string, alert Alert) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return
+	}
+	resp, err := s.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Alert webhook %s failed: %v", url, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Alert webhook %s returned %d", url, resp.StatusCode)
+	}
+}
+
+// resolve clears the state of a rule that is changed or removed, logging
+// a resolution if it was firing. Must be called with s.mu held.
+func (s *AlertService) resolve(rule *AlertRule, now time.Time) (Alert, bool) {
+	st := s.state[rule.ID]
+	delete(s.state, rule.ID)
+	if st == nil || !st.active {
+		return Alert{}, false
+	}
+	value := 0.0
+	if current := s.current(now); current != nil {
+		value = alertMetrics[rule.Metric](current)
+	}
+	if math.IsNaN(value) {
+		value = 0
+	}
+	return s.record(rule, AlertResolved, value, now), true
+}
+
+// Rules returns a copy of the configured rules
+func (s *AlertService) Rules() []AlertRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rules := make([]AlertRule, len(s.rules))
+	for i, rule := range s.rules {
+		rules[i] = *rule
+	}
+	return rules
+}
+
+// Active returns the rules currently firing
+func (s *AlertService) Active() []AlertRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	active := []AlertRule{}
+	for _, rule := range s.rules {
+		if st := s.state[rule.ID]; st != nil && st.active {
+			active = append(active, *rule)
+		}
+	}
+	return active
+}
+
+// Log returns up to limit of the most recent alerts, newest first
+func (s *AlertService) Log(limit int) []Alert {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if limit <= 0 || limit > len(s.log) {
+		limit = len(s.log)
+	}
+	alerts := make([]Alert, 0, limit)
+	for i := len(s.log) - 1; i >= 0 && len(alerts) < limit; i-- {
+		alerts = append(alerts, s.log[i])
+	}
+	return alerts
+}
+
+// AddRule validates and stores a new rule
+func (s *AlertService) AddRule(rule AlertRule) (AlertRule, error) {
+	if err := rule.validate(); err != nil {
+		return rule, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rule.ID == "" {
+		rule.ID = newRandomID()
+	} else if !alertRuleIDPattern.MatchString(rule.ID) {
+		return rule, fmt.Errorf("invalid rule id %q", rule.ID)
+	}
+	if s.findRule(rule.ID) >= 0 {
+		return rule, fmt.Errorf("rule %s already exists", rule.ID)
+	}
+	s.rules = append(s.rules, &rule)
+	return rule, s.save()
+}
+
+// UpdateRule replaces an existing rule, restarting its evaluation
+func (s *AlertService) UpdateRule(id string, rule AlertRule) (AlertRule, error) {
+	rule.ID = id
+	if err := rule.validate(); err != nil {
+		return rule, err
+	}
+
+	s.mu.Lock()
+	i := s.findRule(id)
+	if i < 0 {
+		s.mu.Unlock()
+		return rule, os.ErrNotExist
+	}
+	resolved, ok := s.resolve(s.rules[i], time.Now())
+	s.rules[i] = &rule
+	err := s.save()
+	s.mu.Unlock()
+
+	if ok {
+		s.deliver(resolved)
+	}
+	return rule, err
+}
+
+// DeleteRule removes a rule
+func (s *AlertService) DeleteRule(id string) error {
+	s.mu.Lock()
+	i := s.findRule(id)
+	if i < 0 {
+		s.mu.Unlock()
+		return os.ErrNotExist
+	}
+	resolved, ok := s.resolve(s.rules[i], time.Now())
+	s.rules = append(s.rules[:i], s.rules[i+1:]...)
+	err := s.save()
+	s.mu.Unlock()
+
+	if ok {
+		s.deliver(resolved)
+	}
+	return err
+}
+
+// Webhooks returns the configured webhooks
+func (s *AlertService) Webhooks() []AlertWebhook {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]AlertWebhook{}, s.webhooks...)
+}
+
+// SetWebhooks replaces the configured webhooks
+func (s *AlertService) SetWebhooks(webhooks []AlertWebhook) error {
+	for _, hook := range webhooks {
+		if hook.URL == "" {
+			return errors.New("webhook url is required")
+		}
+		if _, ok := alertSeverityRank[hook.MinSeverity]; hook.MinSeverity != "" && !ok {
+			return fmt.Errorf("unknown severity %q", hook.MinSeverity)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.webhooks = webhooks
+	return s.save()
+}
+
+func (s *AlertService) findRule(id string) int {
+	for i, rule := range s.rules {
+		if rule.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// save writes rules and webhooks to the config file. Must be called with s.mu held.
+func (s *AlertService) save() error {
+	if s.configPath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(alertConfig{Rules: s.rules, Webhooks: s.webhooks}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.configPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save alerts config: %w", err)
+	}
+	return os.Rename(tmp, s.configPath)
+}
+
+// HandleRules serves GET (list) and POST (create) /api/v1/alerts/rules
+func (s *AlertService) HandleRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Rules())
+	case http.MethodPost:
+		var rule AlertRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		created, err := s.AddRule(rule)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleRule serves GET, PUT and DELETE /api/v1/alerts/rules/{id}
+func (s *AlertService) HandleRule(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		for _, rule := range s.Rules() {
+			if rule.ID == id {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(rule)
+				return
+			}
+		}
+		http.Error(w, "Rule not found", http.StatusNotFound)
+	case http.MethodPut:
+		var rule AlertRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		updated, err := s.UpdateRule(id, rule)
+		if os.IsNotExist(err) {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(updated)
+	case http.MethodDelete:
+		err := s.DeleteRule(id)
+		if os.IsNotExist(err) {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleWebhooks serves GET and PUT /api/v1/alerts/webhooks
+func (s *AlertService) HandleWebhooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Webhooks())
+	case http.MethodPut:
+		var webhooks []AlertWebhook
+		if err := json.NewDecoder(r.Body).Decode(&webhooks); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := s.SetWebhooks(webhooks); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(webhooks)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleActive serves GET /api/v1/alerts, the rules currently firing
+func (s *AlertService) HandleActive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Active())
+}
+
+// HandleLog serves GET /api/v1/alerts/log?limit=, newest first
+func (s *AlertService) HandleLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid 'limit' parameter", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Log(limit))
+}
+
+// HandleCue serves GET /api/v1/alerts/cue?severity= as a short WAV tone
+// pattern. Without a severity it plays the cue of the most severe alert
+// currently firing, or returns 204 when nothing is firing, so a buzzer box
+// can simply poll it.
+func (s *AlertService) HandleCue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	severity := r.URL.Query().Get("severity")
+	if severity == "" {
+		rank := -1
+		for _, rule := range s.Active() {
+			if alertSeverityRank[rule.Severity] > rank {
+				rank = alertSeverityRank[rule.Severity]
+				severity = rule.Severity
+			}
+		}
+		if severity == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	cue, ok := alertCues[severity]
+	if !ok {
+		http.Error(w, "Unknown severity", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "audio/wav")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Alert-Severity", severity)
+	w.Write(cue)
+}
+
+// newRandomID returns a short random hex identifier
+func newRandomID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func secondsToDuration(sec float64) time.Duration {
+	return time.Duration(sec * float64(time.Second))
+}
+
+func meanInt8(values []int8) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+	sum := 0
+	for _, v := range values {
+		sum += int(v)
+	}
+	return float64(sum) / float64(len(values))
+}
+
+func maxInt8(values []int8) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+	m := values[0]
+	for _, v := range values[1:] {
+		m = max(m, v)
+	}
+	return float64(m)
+}
@@ -0,0 +1,229 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAlertService(t *testing.T, rules ...*AlertRule) *AlertService {
+	t.Helper()
+	s, err := NewAlertService(NewWFBStatsService(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.rules = rules
+	return s
+}
+
+func lastAlert(s *AlertService) *Alert {
+	if alerts := s.Log(1); len(alerts) == 1 {
+		return &alerts[0]
+	}
+	return nil
+}
+
+func TestAlertRuleForHysteresisCooldown(t *testing.T) {
+	s := newTestAlertService(t, &AlertRule{
+		ID: "rssi", Name: "Low RSSI", Metric: "rssi_avg", Op: "<", Threshold: -80,
+		ForSec: 2, Hysteresis: 3, CooldownSec: 10, Severity: AlertSeverityWarning, Enabled: true,
+	})
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(sec float64) time.Time { return start.Add(secondsToDuration(sec)) }
+	rssi := func(v int8, sec float64) { s.observe(WFBStreamStats{Rssi: []int8{v, v}}, at(sec)) }
+
+	// Must stay below the threshold for 2s
+	rssi(-85, 0)
+	rssi(-79, 1)
+	rssi(-85, 2)
+	rssi(-85, 3.5)
+	if len(s.Log(0)) != 0 {
+		t.Fatalf("Expected no alert before 2s, got %+v", s.Log(0))
+	}
+	rssi(-85, 4)
+	if a := lastAlert(s); a == nil || a.State != AlertFiring || a.Value != -85 {
+		t.Fatalf("Expected firing alert, got %+v", a)
+	}
+	if len(s.Active()) != 1 {
+		t.Error("Expected rule to be active")
+	}
+
+	// Hysteresis: -79 is above the threshold but not by 3 dB
+	rssi(-79, 5)
+	if lastAlert(s).State != AlertFiring {
+		t.Fatal("Expected alert to stay firing within hysteresis")
+	}
+	rssi(-76, 6)
+	if a := lastAlert(s); a.State != AlertResolved {
+		t.Fatalf("Expected resolved alert, got %+v", a)
+	}
+
+	// Cooldown: the condition holds again but the rule fired 10s ago
+	rssi(-85, 7)
+	rssi(-85, 10)
+	if lastAlert(s).State != AlertResolved {
+		t.Fatal("Expected no alert within cooldown")
+	}
+	rssi(-85, 14)
+	if a := lastAlert(s); a.State != AlertFiring || len(s.Log(0)) != 3 {
+		t.Fatalf("Expected alert after cooldown, got %+v", s.Log(0))
+	}
+}
+
+func TestAlertRuleStaleAndDecrease(t *testing.T) {
+	s := newTestAlertService(t,
+		&AlertRule{ID: "silent", Name: "No packets", Metric: "packets", Op: "<=", Threshold: 0, ForSec: 1, Severity: AlertSeverityCritical, Enabled: true},
+		&AlertRule{ID: "mcs", Name: "MCS dropped", Metric: "mcs", Op: "decrease", Severity: AlertSeverityInfo, Enabled: true},
+		&AlertRule{ID: "off", Name: "Disabled", Metric: "packets", Op: ">", Threshold: 0, Severity: AlertSeverityInfo},
+	)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// Nothing is evaluated before wfb-ng reports
+	s.evaluate(start.Add(time.Minute))
+	if len(s.Log(0)) != 0 {
+		t.Fatal("Expected no alerts before the first update")
+	}
+
+	s.observe(WFBStreamStats{VideoPacketsPerSec: 900, McsIndex: 3}, start)
+	s.observe(WFBStreamStats{VideoPacketsPerSec: 900, McsIndex: 1}, start.Add(time.Second))
+	if a := lastAlert(s); a == nil || a.RuleID != "mcs" || a.State != AlertFiring {
+		t.Fatalf("Expected MCS drop alert, got %+v", a)
+	}
+	s.evaluate(start.Add(1250 * time.Millisecond))
+	if a := lastAlert(s); a.RuleID != "mcs" || a.State != AlertResolved {
+		t.Fatalf("Expected MCS drop to resolve, got %+v", a)
+	}
+
+	// wfb-ng stops reporting: packets read as zero once stale
+	s.evaluate(start.Add(4 * time.Second))
+	s.evaluate(start.Add(5 * time.Second))
+	if a := lastAlert(s); a.RuleID != "silent" || a.State != AlertFiring {
+		t.Fatalf("Expected no packets alert, got %+v", a)
+	}
+	for _, a := range s.Log(0) {
+		if a.RuleID == "off" {
+			t.Error("Disabled rule fired")
+		}
+	}
+}
+
+func TestAlertWebhooksAndPush(t *testing.T) {
+	received := make(chan Alert, 4)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a Alert
+		json.NewDecoder(r.Body).Decode(&a)
+		received <- a
+	}))
+	defer hook.Close()
+
+	s := newTestAlertService(t, &AlertRule{ID: "loss", Name: "Loss", Metric: "lost", Op: ">", Threshold: 20, Severity: AlertSeverityWarning, Enabled: true})
+	if err := s.SetWebhooks([]AlertWebhook{{URL: hook.URL}, {URL: hook.URL + "/critical", MinSeverity: AlertSeverityCritical}}); err != nil {
+		t.Fatal(err)
+	}
+	events := s.stats.events.subscribe()
+	defer events.Close()
+
+	s.observe(WFBStreamStats{LostPacketsPerSec: 50}, time.Now())
+
+	select {
+	case a := <-received:
+		if a.RuleID != "loss" || a.Value != 50 {
+			t.Errorf("Unexpected webhook payload %+v", a)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Webhook not called")
+	}
+	select {
+	case a := <-received:
+		t.Errorf("Critical-only webhook received a warning: %+v", a)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	select {
+	case ev := <-events.C:
+		if ev.name != "alert" {
+			t.Errorf("Expected alert event, got %q", ev.name)
+		}
+	default:
+		t.Error("Alert not pushed to the stats stream")
+	}
+}
+
+func TestAlertRulesAPI(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alerts.json")
+	s, err := NewAlertService(NewWFBStatsService(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Rules()) != len(defaultAlertRules()) {
+		t.Fatalf("Expected default rules, got %d", len(s.Rules()))
+	}
+
+	do := func(method, body string, handle func(http.ResponseWriter, *http.Request)) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handle(rec, httptest.NewRequest(method, "/", strings.NewReader(body)))
+		return rec
+	}
+
+	rec := do(http.MethodPost, `{"name":"Hot link","metric":"bad","op":">","threshold":5,"severity":"critical","enabled":true}`, s.HandleRules)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Create returned %d: %s", rec.Code, rec.Body)
+	}
+	var created AlertRule
+	json.NewDecoder(rec.Body).Decode(&created)
+	if created.ID == "" {
+		t.Fatal("Expected generated id")
+	}
+
+	if rec := do(http.MethodPost, `{"name":"x","metric":"nope","op":">","severity":"info"}`, s.HandleRules); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unknown metric, got %d", rec.Code)
+	}
+
+	handleRule := func(id string) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) { s.HandleRule(w, r, id) }
+	}
+	if rec := do(http.MethodPut, `{"name":"Hot link","metric":"bad","op":">","threshold":10,"severity":"warning","enabled":true}`, handleRule(created.ID)); rec.Code != http.StatusOK {
+		t.Fatalf("Update returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodDelete, "", handleRule("low-rssi")); rec.Code != http.StatusNoContent {
+		t.Fatalf("Delete returned %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "", handleRule("low-rssi")); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 after delete, got %d", rec.Code)
+	}
+
+	// Rules survive a restart
+	reloaded, err := NewAlertService(NewWFBStatsService(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := reloaded.Rules()
+	if len(rules) != len(defaultAlertRules()) || rules[len(rules)-1].Threshold != 10 {
+		t.Errorf("Unexpected reloaded rules: %+v", rules)
+	}
+}
+
+func TestAlertCue(t *testing.T) {
+	s := newTestAlertService(t, &AlertRule{ID: "loss", Name: "Loss", Metric: "lost", Op: ">", Threshold: 20, Severity: AlertSeverityCritical, Enabled: true})
+
+	rec := httptest.NewRecorder()
+	s.HandleCue(rec, httptest.NewRequest(http.MethodGet, "/api/v1/alerts/cue", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 with nothing firing, got %d", rec.Code)
+	}
+
+	s.observe(WFBStreamStats{LostPacketsPerSec: 50}, time.Now())
+	rec = httptest.NewRecorder()
+	s.HandleCue(rec, httptest.NewRequest(http.MethodGet, "/api/v1/alerts/cue", nil))
+	body := rec.Body.Bytes()
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Alert-Severity") != AlertSeverityCritical {
+		t.Fatalf("Expected critical cue, got %d %q", rec.Code, rec.Header().Get("X-Alert-Severity"))
+	}
+	if len(body) < 44 || string(body[:4]) != "RIFF" || string(body[8:12]) != "WAVE" {
+		t.Error("Expected a WAV file")
+	}
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Subscription receives values published by a service feed
+type Subscription[T any] struct {
+	C      <-chan T
+	ch     chan T
+	lagged atomic.Bool
+	b      *broadcaster[T]
+}
+
+// Lagged reports whether values were dropped since the last call because
+// the subscriber did not keep up. The flag is cleared when read.
+func (s *Subscription[T]) Lagged() bool {
+	return s.lagged.Swap(false)
+}
+
+// Close unsubscribes and closes the channel
+func (s *Subscription[T]) Close() {
+	s.b.unsubscribe(s)
+}
+
+// broadcaster fans values out to any number of subscribers.
+// Publishing never blocks: when a subscriber's buffer is full the oldest
+// queued value is discarded to make room and the subscriber is marked lagged.
+type broadcaster[T any] struct {
+	mu   sync.Mutex
+	subs map[*Subscription[T]]struct{}
+	size int
+}
+
+func newBroadcaster[T any](size int) *broadcaster[T] {
+	return &broadcaster[T]{
+		subs: make(map[*Subscription[T]]struct{}),
+		size: size,
+	}
+}
+
+func (b *broadcaster[T]) subscribe() *Subscription[T] {
+	ch := make(chan T, b.size)
+	sub := &Subscription[T]{C: ch, ch: ch, b: b}
+
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+func (b *broadcaster[T]) unsubscribe(sub *Subscription[T]) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+func (b *broadcaster[T]) publish(v T) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subs {
+		select {
+		case sub.ch <- v:
+			continue
+		default:
+		}
+
+		// Slow subscriber: drop the oldest value and retry once
+		select {
+		case <-sub.ch:
+		default:
+		}
+		select {
+		case sub.ch <- v:
+		default:
+		}
+		sub.lagged.Store(true)
+	}
+}
+
+func (b *broadcaster[T]) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
@@ -0,0 +1,627 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gilankpam/openipc-gs-web/internal/metrics"
+)
+
+const (
+	// dvrLinkTimeout is how long without frames before the link counts as down
+	dvrLinkTimeout = 3 * time.Second
+	// dvrFileExt is the extension of recorded segments
+	dvrFileExt = ".ts"
+)
+
+var recordingIDPattern = regexp.MustCompile(`^[0-9]{8}-[0-9]{6}(-[0-9]+)?$`)
+
+// RecordingSummary describes a recorded video segment
+type RecordingSummary struct {
+	ID               string    `json:"id"`
+	Codec            string    `json:"codec"`
+	Active           bool      `json:"active"`
+	Start            time.Time `json:"start"`
+	End              time.Time `json:"end"`
+	DurationSec      float64   `json:"duration_sec"`
+	Frames           int       `json:"frames"`
+	IncompleteFrames int       `json:"incomplete_frames"`
+	SizeBytes        int64     `json:"size_bytes"`
+	// Subtitles is true when a telemetry subtitle file was written alongside
+	Subtitles bool `json:"subtitles"`
+}
+
+// DVRStatus is the recorder state reported by the API
+type DVRStatus struct {
+	// Recording is true while a segment is being written
+	Recording bool `json:"recording"`
+	// Armed is true after recording was started through the API
+	Armed bool `json:"armed"`
+	// Auto records whenever video is received
+	Auto       bool              `json:"auto"`
+	LinkUp     bool              `json:"link_up"`
+	Current    *RecordingSummary `json:"current,omitempty"`
+	UsedBytes  int64             `json:"used_bytes"`
+	QuotaBytes int64             `json:"quota_bytes"`
+	SegmentSec float64           `json:"segment_sec"`
+}
+
+type dvrSegment struct {
+	summary RecordingSummary
+	file    *os.File
+	buf     *bufio.Writer
+	mux     *tsMuxer
+	subs    *subtitleWriter
+	lastTS  uint32
+	pts     int64
+}
+
+// DVRRecorder writes the received video to segmented MPEG-TS files. Every
+// segment starts on a keyframe and plays on its own. The oldest segments
+// are deleted to stay within the disk quota.
+type DVRRecorder struct {
+	dir     string
+	stream  *StreamServer
+	segment time.Duration
+	quota   int64
+	stats   *WFBStatsService
+	mavlink *MAVLinkService
+
+	mu        sync.Mutex
+	auto      bool
+	armed     bool
+	hold      bool // auto recording stopped through the API until the link drops
+	lastFrame time.Time
+	active    *dvrSegment
+	usedBytes int64
+	running   bool
+	stopCh    chan struct{}
+}
+
+// NewDVRRecorder creates a recorder storing segments of the given length in
+// dir. A quota of 0 means no limit.
+func NewDVRRecorder(stream *StreamServer, dir string, segment time.Duration, quota int64) (*DVRRecorder, error) {
+	if segment <= 0 {
+		return nil, fmt.Errorf("segment length must be positive")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create recordings dir: %w", err)
+	}
+	return &DVRRecorder{
+		dir:     dir,
+		stream:  stream,
+		segment: segment,
+		quota:   quota,
+		stopCh:  make(chan struct{}),
+	}, nil
+}
+
+// WithAuto records whenever video is received, starting when the link comes
+// up and stopping when it drops
+func (r *DVRRecorder) WithAuto(auto bool) *DVRRecorder {
+	r.auto = auto
+	return r
+}
+
+// WithTelemetry writes an SRT subtitle file next to each recording showing
+// the link stats, and flight data when mavlink isn't nil
+func (r *DVRRecorder) WithTelemetry(stats *WFBStatsService, mavlink *MAVLinkService) *DVRRecorder {
+	r.stats = stats
+	r.mavlink = mavlink
+	return r
+}
+
+func (r *DVRRecorder) Start() {
+	r.running = true
+	sub := r.stream.SubscribeFrames()
+	r.enforceQuota()
+	go r.run(sub)
+}
+
+func (r *DVRRecorder) Stop() {
+	if !r.running {
+		return
+	}
+	r.running = false
+	close(r.stopCh)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeSegment()
+}
+
+func (r *DVRRecorder) run(sub *Subscription[*VideoFrame]) {
+	defer sub.Close()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case frame, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			r.record(frame, time.Now())
+		case now := <-ticker.C:
+			r.expire(now)
+			r.enforceQuota()
+		}
+	}
+}
+
+// record writes a frame if recording is wanted, starting segments on keyframes
+func (r *DVRRecorder) record(frame *VideoFrame, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastFrame = now
+	if !r.armed && !(r.auto && !r.hold) {
+		r.closeSegment()
+		return
+	}
+
+	seg := r.active
+	keyframe := frame.Keyframe && frame.Complete
+	if seg != nil && (frame.Codec != seg.summary.Codec || (keyframe && now.Sub(seg.summary.Start) >= r.segment)) {
+		r.closeSegment()
+		seg = nil
+	}
+	if seg == nil {
+		// Players need a keyframe to start from
+		if !keyframe {
+			return
+		}
+		var err error
+		if seg, err = r.openSegment(frame.Codec, now); err != nil {
+			log.Printf("Failed to start recording: %v", err)
+			return
+		}
+	} else {
+		// RTP timestamps wrap and restart with the air unit, so advance by
+		// the frame interval and fall back to a typical one when it's off
+		delta := int64(int32(frame.Timestamp - seg.lastTS))
+		if delta <= 0 || delta > int64(maxFrameDuration*rtpVideoClockRate/time.Second) {
+			delta = int64(defaultFrameDuration * rtpVideoClockRate / time.Second)
+		}
+		seg.pts += delta
+	}
+	seg.lastTS = frame.Timestamp
+
+	if err := seg.mux.WriteFrame(frame.AccessUnit, seg.pts); err != nil {
+		log.Printf("Failed to write recording: %v", err)
+		r.closeSegment()
+		return
+	}
+	seg.summary.Frames++
+	if !frame.Complete {
+		seg.summary.IncompleteFrames++
+	}
+	if seg.subs != nil && seg.subs.Due(seg.pts) {
+		r.writeSubtitle(seg, now)
+	}
+	seg.summary.End = now
+	seg.summary.DurationSec = float64(seg.pts) / rtpVideoClockRate
+}
+
+// expire ends the segment once the link dropped
+func (r *DVRRecorder) expire(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now.Sub(r.lastFrame) < dvrLinkTimeout {
+		return
+	}
+	if r.active != nil {
+		log.Printf("Video link lost, stopping recording %s", r.active.summary.ID)
+		r.closeSegment()
+	}
+	// Auto recording resumes when the link comes back
+	r.hold = false
+}
+
+// writeSubtitle adds a cue with the current link stats and telemetry
+func (r *DVRRecorder) writeSubtitle(seg *dvrSegment, now time.Time) {
+	stats, err := r.stats.GetStats()
+	if err != nil {
+		return
+	}
+	var telemetry *MAVLinkTelemetry
+	if r.mavlink != nil {
+		if t, ok := r.mavlink.Telemetry(now); ok {
+			telemetry = &t
+		}
+	}
+	if err := seg.subs.Write(seg.pts, subtitleText(stats, telemetry)); err != nil {
+		log.Printf("Failed to write subtitles: %v", err)
+		seg.subs.Close()
+		seg.subs = nil
+	}
+}
+
+func (r *DVRRecorder) openSegment(codec string, now time.Time) (*dvrSegment, error) {
+	id := now.Format("20060102-150405")
+	for i := 1; ; i++ {
+		if _, err := os.Stat(r.dataPath(id)); os.IsNotExist(err) {
+			break
+		}
+		id = fmt.Sprintf("%s-%d", now.Format("20060102-150405"), i)
+	}
+	f, err := os.Create(r.dataPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bufio.NewWriterSize(f, 64*1024)
+	r.active = &dvrSegment{
+		summary: RecordingSummary{
+			ID:     id,
+			Codec:  codec,
+			Active: true,
+			Start:  now,
+			End:    now,
+		},
+		file: f,
+		buf:  buf,
+		mux:  newTSMuxer(buf, codec),
+	}
+	if r.stats != nil {
+		subs, err := newSubtitleWriter(r.subtitlePath(id))
+		if err != nil {
+			log.Printf("Failed to create subtitles: %v", err)
+		} else {
+			r.active.subs = subs
+			r.active.summary.Subtitles = true
+		}
+	}
+	log.Printf("Started recording %s (%s)", id, codec)
+	return r.active, nil
+}
+
+func (r *DVRRecorder) closeSegment() {
+	seg := r.active
+	if seg == nil {
+		return
+	}
+	r.active = nil
+
+	seg.buf.Flush()
+	seg.file.Close()
+	if seg.subs != nil {
+		seg.subs.Close()
+	}
+
+	seg.summary.Active = false
+	if info, err := os.Stat(r.dataPath(seg.summary.ID)); err == nil {
+		seg.summary.SizeBytes = info.Size()
+	}
+	data, err := json.MarshalIndent(seg.summary, "", "  ")
+	if err == nil {
+		err = os.WriteFile(r.summaryPath(seg.summary.ID), data, 0644)
+	}
+	if err != nil {
+		log.Printf("Failed to write recording summary: %v", err)
+	}
+	log.Printf("Finished recording %s (%.0fs)", seg.summary.ID, seg.summary.DurationSec)
+}
+
+// StartRecording records until StopRecording, whether or not auto
+// recording is on. Recording begins with the next keyframe.
+func (r *DVRRecorder) StartRecording() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.armed = true
+	r.hold = false
+}
+
+// StopRecording ends the current segment. In auto mode recording resumes
+// the next time the link comes up.
+func (r *DVRRecorder) StopRecording() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.armed = false
+	if r.auto {
+		r.hold = true
+	}
+	r.closeSegment()
+}
+
+// SetAuto turns auto recording on or off
+func (r *DVRRecorder) SetAuto(auto bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.auto = auto
+	r.hold = false
+	if !auto && !r.armed {
+		r.closeSegment()
+	}
+}
+
+// Status returns the recorder state
+func (r *DVRRecorder) Status() DVRStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := DVRStatus{
+		Recording:  r.active != nil,
+		Armed:      r.armed,
+		Auto:       r.auto,
+		LinkUp:     time.Since(r.lastFrame) < dvrLinkTimeout,
+		UsedBytes:  r.usedBytes,
+		QuotaBytes: r.quota,
+		SegmentSec: r.segment.Seconds(),
+	}
+	if r.active != nil {
+		current := r.activeSummary()
+		status.Current = &current
+	}
+	return status
+}
+
+// activeSummary returns the summary of the segment being written
+func (r *DVRRecorder) activeSummary() RecordingSummary {
+	summary := r.active.summary
+	if info, err := r.active.file.Stat(); err == nil {
+		summary.SizeBytes = info.Size() + int64(r.active.buf.Buffered())
+	}
+	return summary
+}
+
+// Recordings returns all recorded segments, newest first. Segments left
+// without a summary by a crash are listed with what the file tells.
+func (r *DVRRecorder) Recordings() ([]RecordingSummary, error) {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	var active *RecordingSummary
+	if r.active != nil {
+		summary := r.activeSummary()
+		active = &summary
+	}
+	r.mu.Unlock()
+
+	recordings := []RecordingSummary{}
+	for _, e := range entries {
+		id := strings.TrimSuffix(e.Name(), dvrFileExt)
+		if e.IsDir() || id == e.Name() || !recordingIDPattern.MatchString(id) {
+			continue
+		}
+		if active != nil && active.ID == id {
+			recordings = append(recordings, *active)
+			continue
+		}
+
+		var summary RecordingSummary
+		data, err := os.ReadFile(r.summaryPath(id))
+		if err != nil || json.Unmarshal(data, &summary) != nil {
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			start, _ := time.ParseInLocation("20060102-150405", id[:15], time.Local)
+			summary = RecordingSummary{ID: id, Start: start, End: info.ModTime()}
+			if _, err := os.Stat(r.subtitlePath(id)); err == nil {
+				summary.Subtitles = true
+			}
+		}
+		if info, err := e.Info(); err == nil {
+			summary.SizeBytes = info.Size()
+		}
+		recordings = append(recordings, summary)
+	}
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].ID > recordings[j].ID
+	})
+	return recordings, nil
+}
+
+// DeleteRecording removes a finished segment and its summary
+func (r *DVRRecorder) DeleteRecording(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.active != nil && r.active.summary.ID == id {
+		return fmt.Errorf("recording %s is still being written", id)
+	}
+	if err := os.Remove(r.dataPath(id)); err != nil {
+		return err
+	}
+	for _, path := range []string{r.summaryPath(id), r.subtitlePath(id)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// enforceQuota deletes the oldest finished segments until the recordings
+// fit the quota
+func (r *DVRRecorder) enforceQuota() {
+	recordings, err := r.Recordings()
+	if err != nil {
+		log.Printf("Failed to list recordings: %v", err)
+		return
+	}
+
+	var used int64
+	for _, rec := range recordings {
+		used += rec.SizeBytes
+	}
+	// Oldest last
+	for i := len(recordings) - 1; i >= 0 && r.quota > 0 && used > r.quota; i-- {
+		rec := recordings[i]
+		if rec.Active {
+			continue
+		}
+		if err := r.DeleteRecording(rec.ID); err != nil {
+			log.Printf("Failed to delete recording %s: %v", rec.ID, err)
+			continue
+		}
+		log.Printf("Deleted recording %s to stay within the disk quota", rec.ID)
+		used -= rec.SizeBytes
+	}
+
+	r.mu.Lock()
+	r.usedBytes = used
+	r.mu.Unlock()
+}
+
+// RegisterMetrics exposes the recorder state
+func (r *DVRRecorder) RegisterMetrics(reg *metrics.Registry) {
+	reg.NewGaugeFunc("gs_dvr_recording", "Whether video is being recorded.", func() float64 {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.active != nil {
+			return 1
+		}
+		return 0
+	})
+	reg.NewGaugeFunc("gs_dvr_disk_usage_bytes", "Disk space used by recordings.", func() float64 {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return float64(r.usedBytes)
+	})
+}
+
+// HandleRecordings serves GET /api/v1/recordings
+func (r *DVRRecorder) HandleRecordings(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	recordings, err := r.Recordings()
+	if err != nil {
+		log.Printf("Error listing recordings: %v", err)
+		http.Error(w, "Failed to list recordings", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recordings)
+}
+
+// HandleStatus serves GET and PUT /api/v1/recordings/status. PUT takes
+// {"auto": bool}.
+func (r *DVRRecorder) HandleStatus(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var body struct {
+			Auto *bool `json:"auto"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Auto == nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		r.SetAuto(*body.Auto)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Status())
+}
+
+// HandleStart serves POST /api/v1/recordings/start
+func (r *DVRRecorder) HandleStart(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.StartRecording()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Status())
+}
+
+// HandleStop serves POST /api/v1/recordings/stop
+func (r *DVRRecorder) HandleStop(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.StopRecording()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Status())
+}
+
+// HandleRecording serves GET (download) and DELETE /api/v1/recordings/{id},
+// and GET /api/v1/recordings/{id}/subtitles
+func (r *DVRRecorder) HandleRecording(w http.ResponseWriter, req *http.Request, id string) {
+	id, subtitles := strings.CutSuffix(id, "/subtitles")
+	if !recordingIDPattern.MatchString(id) {
+		http.Error(w, "Invalid recording id", http.StatusBadRequest)
+		return
+	}
+	if subtitles {
+		r.handleSubtitles(w, req, id)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		path := r.dataPath(id)
+		if _, err := os.Stat(path); err != nil {
+			http.Error(w, "Recording not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+		http.ServeFile(w, req, path)
+	case http.MethodDelete:
+		if err := r.DeleteRecording(id); err != nil {
+			if os.IsNotExist(err) {
+				http.Error(w, "Recording not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *DVRRecorder) handleSubtitles(w http.ResponseWriter, req *http.Request, id string) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := r.subtitlePath(id)
+	if _, err := os.Stat(path); err != nil {
+		http.Error(w, "Subtitles not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-subrip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	http.ServeFile(w, req, path)
+}
+
+func (r *DVRRecorder) dataPath(id string) string {
+	return filepath.Join(r.dir, id+dvrFileExt)
+}
+
+func (r *DVRRecorder) summaryPath(id string) string {
+	return filepath.Join(r.dir, id+".json")
+}
+
+// subtitlePath has the recording's name so players pick the subtitles up
+func (r *DVRRecorder) subtitlePath(id string) string {
+	return filepath.Join(r.dir, id+".srt")
+}
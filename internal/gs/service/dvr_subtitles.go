@@ -0,0 +1,100 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// subtitleInterval is how often a subtitle is written, in 90kHz units
+const subtitleInterval = rtpVideoClockRate
+
+// subtitleWriter writes one SRT cue per second of video next to a recording.
+// Cue times follow the video timestamps so they stay in sync when played.
+type subtitleWriter struct {
+	file *os.File
+	buf  *bufio.Writer
+	cues int
+	next int64 // start of the next cue
+}
+
+func newSubtitleWriter(path string) (*subtitleWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &subtitleWriter{file: f, buf: bufio.NewWriter(f)}, nil
+}
+
+// Due reports whether a cue starts at or before pts
+func (s *subtitleWriter) Due(pts int64) bool {
+	return pts >= s.next
+}
+
+// Write adds a cue lasting one interval from the second pts falls in
+func (s *subtitleWriter) Write(pts int64, text string) error {
+	start := pts - pts%subtitleInterval
+	s.next = start + subtitleInterval
+	s.cues++
+	_, err := fmt.Fprintf(s.buf, "%d\n%s --> %s\n%s\n\n", s.cues, srtTimestamp(start), srtTimestamp(s.next), text)
+	return err
+}
+
+func (s *subtitleWriter) Close() error {
+	s.buf.Flush()
+	return s.file.Close()
+}
+
+// srtTimestamp formats a 90kHz time as HH:MM:SS,mmm
+func srtTimestamp(pts int64) string {
+	ms := pts * 1000 / rtpVideoClockRate
+	return fmt.Sprintf("%02d:%02d:%02d,%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// subtitleText describes the link, and the aircraft when telemetry is
+// available, in a few short lines
+func subtitleText(stats *WFBStats, telemetry *MAVLinkTelemetry) string {
+	var lines []string
+
+	rssi, snr := "--", "--"
+	if best := maxInt8(stats.Rssi); !math.IsNaN(best) {
+		rssi = fmt.Sprintf("%.0f", best)
+	}
+	if best := maxInt8(stats.Snr); !math.IsNaN(best) {
+		snr = fmt.Sprintf("%.0f", best)
+	}
+	lines = append(lines, fmt.Sprintf("RSSI %s dBm  SNR %s dB  MCS %d  %.1f Mbit/s",
+		rssi, snr, stats.McsIndex, float64(stats.LinkFlowBytesPerSec)*8/1e6))
+
+	loss, fec := 0.0, 0.0
+	if total := stats.VideoPacketsPerSec + stats.LostPacketsPerSec; total > 0 {
+		loss = float64(stats.LostPacketsPerSec) / float64(total) * 100
+	}
+	if stats.VideoPacketsPerSec > 0 {
+		fec = float64(stats.FecPacketsPerSec) / float64(stats.VideoPacketsPerSec) * 100
+	}
+	lines = append(lines, fmt.Sprintf("Loss %.1f%%  FEC %.1f%%", loss, fec))
+
+	if telemetry != nil {
+		var parts []string
+		if telemetry.HasPosition {
+			parts = append(parts, fmt.Sprintf("Alt %.1f m  Speed %.1f m/s", telemetry.AltitudeM, telemetry.GroundSpeedMS))
+		}
+		if telemetry.HasBattery {
+			battery := fmt.Sprintf("Bat %.2f V", telemetry.BatteryVoltage)
+			if telemetry.BatteryCurrentA >= 0 {
+				battery += fmt.Sprintf(" %.1f A", telemetry.BatteryCurrentA)
+			}
+			if telemetry.BatteryPercent >= 0 {
+				battery += fmt.Sprintf(" %d%%", telemetry.BatteryPercent)
+			}
+			parts = append(parts, battery)
+		}
+		if len(parts) > 0 {
+			lines = append(lines, strings.Join(parts, "  "))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
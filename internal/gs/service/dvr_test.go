@@ -0,0 +1,210 @@
+package service
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func dvrTestFrame(ts uint32, keyframe bool) *VideoFrame {
+	nalu := []byte{1 << 1, 1}
+	if keyframe {
+		nalu = []byte{19 << 1, 1}
+	}
+	nalu = append(nalu, bytes.Repeat([]byte{0x55}, 1000)...)
+	return &VideoFrame{
+		Codec:      CodecH265,
+		AccessUnit: &AccessUnit{Timestamp: ts, NALUs: [][]byte{nalu}, Keyframe: keyframe, Complete: true},
+	}
+}
+
+func TestDVRRecorder(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewDVRRecorder(NewStreamServer(0), dir, 2*time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.WithAuto(true)
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)
+	at := func(frame int) time.Time {
+		return start.Add(time.Duration(frame) * 100 * time.Millisecond)
+	}
+
+	// Recording waits for a keyframe
+	r.record(dvrTestFrame(0, false), at(0))
+	if r.Status().Recording {
+		t.Fatal("Expected no recording before a keyframe")
+	}
+
+	// 3s of video at 10fps with a keyframe every second, the RTP timestamp
+	// wrapping on the way
+	ts := uint32(0xffffffff - 9000*5)
+	for i := 1; i <= 30; i++ {
+		r.record(dvrTestFrame(ts, i%10 == 1), at(i))
+		ts += 9000
+	}
+
+	recordings, err := r.Recordings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first segment rolled over on the keyframe after 2s
+	if len(recordings) != 2 || !recordings[0].Active || recordings[1].Active {
+		t.Fatalf("Expected a finished and an active segment, got %+v", recordings)
+	}
+	first := recordings[1]
+	if first.Frames != 20 || first.DurationSec != 1.9 || first.Codec != CodecH265 {
+		t.Errorf("Unexpected first segment %+v", first)
+	}
+
+	data, err := os.ReadFile(r.dataPath(first.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pes, tables := tsTestPES(t, data)
+	if len(pes) != 20 || tables != 4 {
+		t.Errorf("Expected 20 frames and tables before 2 keyframes, got %d and %d", len(pes), tables)
+	}
+	if pts := decodePTS(pes[19][9:14]); pts != 19*9000+tsPTSOffset {
+		t.Errorf("Expected the last frame at PTS %d, got %d", 19*9000+tsPTSOffset, pts)
+	}
+
+	// Stopping through the API holds off auto recording until the link drops
+	r.StopRecording()
+	r.record(dvrTestFrame(ts, true), at(31))
+	if r.Status().Recording {
+		t.Fatal("Expected recording to stay stopped")
+	}
+	r.expire(at(31).Add(dvrLinkTimeout))
+	if r.Status().LinkUp {
+		t.Error("Expected the link to be down")
+	}
+	r.record(dvrTestFrame(ts, true), at(100))
+	if !r.Status().Recording {
+		t.Fatal("Expected recording to resume when the link came back")
+	}
+	r.expire(at(100).Add(dvrLinkTimeout))
+	if r.Status().Recording {
+		t.Fatal("Expected recording to stop when the link dropped")
+	}
+
+	// Quota deletes the oldest segments
+	recordings, _ = r.Recordings()
+	if len(recordings) != 3 {
+		t.Fatalf("Expected 3 segments, got %d", len(recordings))
+	}
+	r.quota = recordings[0].SizeBytes + recordings[1].SizeBytes
+	r.enforceQuota()
+	after, _ := r.Recordings()
+	if len(after) != 2 || after[1].ID != recordings[1].ID {
+		t.Errorf("Expected the oldest segment deleted, got %+v", after)
+	}
+
+	// Download and delete
+	rec := httptest.NewRecorder()
+	r.HandleRecording(rec, httptest.NewRequest(http.MethodGet, "/", nil), after[0].ID)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "video/mp2t" {
+		t.Fatalf("Download returned %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	rec = httptest.NewRecorder()
+	r.HandleRecording(rec, httptest.NewRequest(http.MethodDelete, "/", nil), after[0].ID)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Delete returned %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	r.HandleRecording(rec, httptest.NewRequest(http.MethodGet, "/", nil), "../etc")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid id, got %d", rec.Code)
+	}
+}
+
+func TestDVRRecorderManual(t *testing.T) {
+	r, err := NewDVRRecorder(NewStreamServer(0), t.TempDir(), time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	// Without auto nothing is recorded until started
+	r.record(dvrTestFrame(0, true), now)
+	if r.Status().Recording {
+		t.Fatal("Expected no recording")
+	}
+	r.StartRecording()
+	r.record(dvrTestFrame(3000, true), now)
+	if !r.Status().Recording {
+		t.Fatal("Expected recording after start")
+	}
+
+	// A codec change starts a new segment
+	frame := dvrTestFrame(6000, true)
+	frame.Codec = CodecH264
+	frame.NALUs = [][]byte{{0x65, 0x88}}
+	r.record(frame, now.Add(time.Second))
+	status := r.Status()
+	if status.Current == nil || status.Current.Codec != CodecH264 {
+		t.Errorf("Expected an H.264 segment, got %+v", status.Current)
+	}
+
+	r.StopRecording()
+	if recordings, _ := r.Recordings(); len(recordings) != 2 {
+		t.Errorf("Expected 2 segments, got %d", len(recordings))
+	}
+}
+
+func TestDVRSubtitles(t *testing.T) {
+	stats := NewWFBStatsService()
+	stats.currentStats = videoStats(WFBStreamStats{
+		Rssi: []int8{-70, -62}, Snr: []int8{20, 28}, McsIndex: 2,
+		VideoPacketsPerSec: 950, LostPacketsPerSec: 50, FecPacketsPerSec: 95, LinkFlowBytesPerSec: 1050000,
+	})
+	mavlink := NewMAVLinkService(0)
+	mavlink.telemetry = MAVLinkTelemetry{
+		HasPosition: true, AltitudeM: 120.5, GroundSpeedMS: 14.2,
+		HasBattery: true, BatteryVoltage: 15.8, BatteryCurrentA: -1, BatteryPercent: 76,
+	}
+
+	r, err := NewDVRRecorder(NewStreamServer(0), t.TempDir(), time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.WithTelemetry(stats, mavlink).StartRecording()
+
+	now := time.Now()
+	mavlink.telemetry.Updated = now
+	for i := 0; i < 25; i++ {
+		r.record(dvrTestFrame(uint32(i*9000), i == 0), now)
+	}
+	id := r.Status().Current.ID
+	r.StopRecording()
+
+	recordings, _ := r.Recordings()
+	if len(recordings) != 1 || !recordings[0].Subtitles {
+		t.Fatalf("Expected a recording with subtitles, got %+v", recordings)
+	}
+	data, err := os.ReadFile(r.subtitlePath(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "1\n00:00:00,000 --> 00:00:01,000\n" +
+		"RSSI -62 dBm  SNR 28 dB  MCS 2  8.4 Mbit/s\n" +
+		"Loss 5.0%  FEC 10.0%\n" +
+		"Alt 120.5 m  Speed 14.2 m/s  Bat 15.80 V 76%\n\n"
+	if !strings.HasPrefix(string(data), want) {
+		t.Errorf("Unexpected first cue:\n%s", data)
+	}
+	if !strings.Contains(string(data), "\n3\n00:00:02,000 --> 00:00:03,000\n") || strings.Contains(string(data), "\n4\n") {
+		t.Errorf("Expected 3 cues over 2.4s of video:\n%s", data)
+	}
+
+	rec := httptest.NewRecorder()
+	r.HandleRecording(rec, httptest.NewRequest(http.MethodGet, "/", nil), id+"/subtitles")
+	if rec.Code != http.StatusOK || rec.Body.String() != string(data) {
+		t.Errorf("Subtitle download returned %d", rec.Code)
+	}
+}
@@ -0,0 +1,282 @@
+package service
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// fmp4TrackID is the only track of the fragmented MP4 stream
+const fmp4TrackID = 1
+
+// Sample flags (ISO/IEC 14496-12 8.8.3.1): keyframes depend on no other
+// sample, other frames do and aren't sync samples
+const (
+	fmp4KeyframeFlags = 0x02000000
+	fmp4FrameFlags    = 0x01010000
+)
+
+// mp4Box returns an ISO BMFF box of the given type around its payloads
+func mp4Box(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+	box := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(box, uint32(size))
+	copy(box[4:], typ)
+	for _, p := range payloads {
+		box = append(box, p...)
+	}
+	return box
+}
+
+// mp4FullBox returns a box with a version and flags header
+func mp4FullBox(typ string, version byte, flags uint32, payloads ...[]byte) []byte {
+	header := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags)
+	return mp4Box(typ, append([][]byte{header}, payloads...)...)
+}
+
+// be builds big-endian fields of a box payload
+type be []byte
+
+func (b be) u8(v byte) be      { return append(b, v) }
+func (b be) u16(v uint16) be   { return binary.BigEndian.AppendUint16(b, v) }
+func (b be) u32(v uint32) be   { return binary.BigEndian.AppendUint32(b, v) }
+func (b be) u64(v uint64) be   { return binary.BigEndian.AppendUint64(b, v) }
+func (b be) zeros(n int) be    { return append(b, make([]byte, n)...) }
+func (b be) bytes(v []byte) be { return append(b, v...) }
+
+// fmp4Muxer writes video frames as fragmented MP4 for Media Source
+// Extensions: an init segment describing the track, then one fragment per
+// frame so frames reach the player as soon as they arrive
+type fmp4Muxer struct {
+	codec    string
+	seq      uint32
+	started  bool
+	lastTS   uint32
+	dts      uint64
+	duration uint32
+}
+
+func newFMP4Muxer(codec string) *fmp4Muxer {
+	return &fmp4Muxer{codec: codec}
+}
+
+// InitSegment returns the ftyp and moov boxes for a stream with the given
+// parameter sets, and the track description for the player
+func (m *fmp4Muxer) InitSegment(sets [][]byte) ([]byte, FMP4Init, error) {
+	spsType := byte(33)
+	if m.codec == CodecH264 {
+		spsType = 7
+	}
+	var sps []byte
+	for _, set := range sets {
+		if naluType(m.codec, set) == spsType {
+			sps = set
+		}
+	}
+	if sps == nil {
+		return nil, FMP4Init{}, fmt.Errorf("no SPS")
+	}
+	info, err := parseSPS(m.codec, sps)
+	if err != nil {
+		return nil, FMP4Init{}, err
+	}
+
+	var sampleEntry []byte
+	var codecString string
+	if m.codec == CodecH264 {
+		sampleEntry = mp4Box("avc1", visualSampleEntry(info), mp4Box("avcC", avcDecoderConfig(info, sets)))
+		codecString = fmt.Sprintf("avc1.%02x%02x%02x", info.ProfileIDC, info.Compatibility, info.LevelIDC)
+	} else {
+		sampleEntry = mp4Box("hvc1", visualSampleEntry(info), mp4Box("hvcC", hevcDecoderConfig(info, sets)))
+		codecString = hevcCodecString(info)
+	}
+
+	ftyp := mp4Box("ftyp", be{}.bytes([]byte("iso5")).u32(512).bytes([]byte("iso5iso6mp41")))
+	mvhd := mp4FullBox("mvhd", 0, 0, be{}.
+		u32(0).u32(0). // creation and modification time
+		u32(rtpVideoClockRate).u32(0).
+		u32(0x00010000).u16(0x0100).zeros(10). // rate, volume, reserved
+		bytes(mp4Matrix).zeros(24).
+		u32(fmp4TrackID+1))
+	// Flags: track enabled and in movie
+	tkhd := mp4FullBox("tkhd", 0, 3, be{}.
+		u32(0).u32(0).u32(fmp4TrackID).zeros(4).u32(0).
+		zeros(8).u16(0).u16(0).u16(0).u16(0). // layer, group, volume
+		bytes(mp4Matrix).
+		u32(uint32(info.Width)<<16).u32(uint32(info.Height)<<16))
+	mdhd := mp4FullBox("mdhd", 0, 0, be{}.u32(0).u32(0).u32(rtpVideoClockRate).u32(0).u16(0x55c4).u16(0)) // "und"
+	hdlr := mp4FullBox("hdlr", 0, 0, be{}.u32(0).bytes([]byte("vide")).zeros(12).bytes([]byte("VideoHandler\x00")))
+	vmhd := mp4FullBox("vmhd", 0, 1, be{}.zeros(8))
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, be{}.u32(1), mp4FullBox("url ", 0, 1)))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, be{}.u32(1), sampleEntry),
+		mp4FullBox("stts", 0, 0, be{}.u32(0)),
+		mp4FullBox("stsc", 0, 0, be{}.u32(0)),
+		mp4FullBox("stsz", 0, 0, be{}.u32(0).u32(0)),
+		mp4FullBox("stco", 0, 0, be{}.u32(0)))
+	trak := mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", vmhd, dinf, stbl)))
+	mvex := mp4Box("mvex", mp4FullBox("trex", 0, 0, be{}.u32(fmp4TrackID).u32(1).u32(0).u32(0).u32(0)))
+
+	init := append(ftyp, mp4Box("moov", mvhd, trak, mvex)...)
+	return init, FMP4Init{
+		MimeType: fmt.Sprintf("video/mp4; codecs=\"%s\"", codecString),
+		Width:    info.Width,
+		Height:   info.Height,
+	}, nil
+}
+
+// mp4Matrix is the identity transformation matrix
+var mp4Matrix = be{}.u32(0x00010000).zeros(12).u32(0x00010000).zeros(12).u32(0x40000000)
+
+func visualSampleEntry(info spsInfo) []byte {
+	return be{}.
+		zeros(6).u16(1). // reserved, data_reference_index
+		zeros(16).
+		u16(uint16(info.Width)).u16(uint16(info.Height)).
+		u32(0x00480000).u32(0x00480000). // 72 dpi
+		u32(0).u16(1).                   // frame_count
+		zeros(32).                       // compressorname
+		u16(0x0018).u16(0xffff)
+}
+
+// avcDecoderConfig returns an AVCDecoderConfigurationRecord (ISO/IEC
+// 14496-15 5.3.3.1)
+func avcDecoderConfig(info spsInfo, sets [][]byte) []byte {
+	var spss, ppss [][]byte
+	for _, set := range sets {
+		switch h264NALUType(set) {
+		case 7:
+			spss = append(spss, set)
+		case 8:
+			ppss = append(ppss, set)
+		}
+	}
+	b := be{}.u8(1).u8(info.ProfileIDC).u8(info.Compatibility).u8(info.LevelIDC).
+		u8(0xfc | 3). // 4 byte NAL unit lengths
+		u8(0xe0 | byte(len(spss)))
+	for _, sps := range spss {
+		b = b.u16(uint16(len(sps))).bytes(sps)
+	}
+	b = b.u8(byte(len(ppss)))
+	for _, pps := range ppss {
+		b = b.u16(uint16(len(pps))).bytes(pps)
+	}
+	return b
+}
+
+// hevcDecoderConfig returns an HEVCDecoderConfigurationRecord (ISO/IEC
+// 14496-15 8.3.3.1)
+func hevcDecoderConfig(info spsInfo, sets [][]byte) []byte {
+	temporalNesting := byte(0)
+	if info.TemporalIDNesting {
+		temporalNesting = 1
+	}
+	b := be{}.u8(1).
+		u8(info.ProfileSpace<<6 | info.Tier<<5 | info.ProfileIDC).
+		u32(info.CompatibilityFlags).
+		u16(uint16(info.ConstraintFlags >> 32)).u32(uint32(info.ConstraintFlags)).
+		u8(info.LevelIDC).
+		u16(0xf000). // min_spatial_segmentation_idc
+		u8(0xfc).    // parallelismType
+		u8(0xfc | byte(info.ChromaFormat)).
+		u8(0xf8 | byte(info.BitDepthLuma-8)).
+		u8(0xf8 | byte(info.BitDepthChroma-8)).
+		u16(0).                                                  // avgFrameRate
+		u8(byte(info.MaxSubLayers)<<3 | temporalNesting<<2 | 3). // 4 byte NAL unit lengths
+		u8(byte(len(sets)))
+	// One array per parameter set type, in VPS, SPS, PPS order
+	for _, set := range sets {
+		b = b.u8(0x80 | h265NALUType(set)).u16(1).u16(uint16(len(set))).bytes(set)
+	}
+	return b
+}
+
+// hevcCodecString returns the RFC 6381 codec string of an H265 stream,
+// e.g. hvc1.1.6.L120.90 (ISO/IEC 14496-15 E.3)
+func hevcCodecString(info spsInfo) string {
+	var b strings.Builder
+	b.WriteString("hvc1.")
+	if info.ProfileSpace > 0 {
+		b.WriteByte('A' + info.ProfileSpace - 1)
+	}
+	fmt.Fprintf(&b, "%d.%x.", info.ProfileIDC, bits.Reverse32(info.CompatibilityFlags))
+	if info.Tier == 1 {
+		b.WriteByte('H')
+	} else {
+		b.WriteByte('L')
+	}
+	fmt.Fprintf(&b, "%d", info.LevelIDC)
+	// Constraint bytes, trailing zero bytes omitted
+	constraints := binary.BigEndian.AppendUint64(nil, info.ConstraintFlags<<16)[:6]
+	for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+		constraints = constraints[:len(constraints)-1]
+	}
+	for _, c := range constraints {
+		fmt.Fprintf(&b, ".%x", c)
+	}
+	return b.String()
+}
+
+// Fragment returns a moof and mdat pair holding one frame. Parameter sets
+// and access unit delimiters are left out: the init segment carries the
+// former and MP4 has no use for the latter. Decode times follow the RTP
+// timestamps; the frame's duration is taken from the previous interval.
+func (m *fmp4Muxer) Fragment(au *AccessUnit) []byte {
+	if !m.started {
+		m.started = true
+		m.duration = uint32(defaultFrameDuration.Seconds() * rtpVideoClockRate)
+	} else {
+		// RTP timestamps wrap and restart with the air unit, so advance
+		// by the frame interval and fall back to the last one when it's off
+		delta := int64(int32(au.Timestamp - m.lastTS))
+		if delta > 0 && delta <= int64(maxFrameDuration.Seconds()*rtpVideoClockRate) {
+			m.duration = uint32(delta)
+		}
+		m.dts += uint64(m.duration)
+	}
+	m.lastTS = au.Timestamp
+	m.seq++
+
+	var mdat be
+	for _, nalu := range au.NALUs {
+		if len(nalu) == 0 || m.skipNALU(nalu) {
+			continue
+		}
+		mdat = mdat.u32(uint32(len(nalu))).bytes(nalu)
+	}
+
+	flags := uint32(fmp4FrameFlags)
+	if au.Keyframe {
+		flags = fmp4KeyframeFlags
+	}
+	// default-base-is-moof, so the data offset counts from the moof
+	tfhd := mp4FullBox("tfhd", 0, 0x020000, be{}.u32(fmp4TrackID))
+	tfdt := mp4FullBox("tfdt", 1, 0, be{}.u64(m.dts))
+	// data offset, sample duration, size and flags present
+	trunPayload := be{}.u32(1).u32(0).u32(m.duration).u32(uint32(len(mdat))).u32(flags)
+	moofSize := 8 + 16 + 8 + len(tfhd) + len(tfdt) + 12 + len(trunPayload)
+	binary.BigEndian.PutUint32(trunPayload[4:], uint32(moofSize+8))
+	trun := mp4FullBox("trun", 0, 0x000701, trunPayload)
+
+	moof := mp4Box("moof",
+		mp4FullBox("mfhd", 0, 0, be{}.u32(m.seq)),
+		mp4Box("traf", tfhd, tfdt, trun))
+	return append(moof, mp4Box("mdat", mdat)...)
+}
+
+func (m *fmp4Muxer) skipNALU(nalu []byte) bool {
+	t := naluType(m.codec, nalu)
+	for _, pt := range paramSetTypes(m.codec) {
+		if t == pt {
+			return true
+		}
+	}
+	if m.codec == CodecH264 {
+		return t == 9 // access unit delimiter
+	}
+	return t == 35
+}
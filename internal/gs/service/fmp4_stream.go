@@ -0,0 +1,127 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// fmp4WriteTimeout drops viewers that stop reading
+const fmp4WriteTimeout = 5 * time.Second
+
+// FMP4Init is sent as a text message before every init segment, so the
+// player can check the codec and (re)create its SourceBuffer
+type FMP4Init struct {
+	MimeType string `json:"mime_type"` // e.g. video/mp4; codecs="hvc1.1.6.L120.90"
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+}
+
+// HandleFMP4 streams the video as fragmented MP4 over a WebSocket, for
+// browsers that can decode the codec with Media Source Extensions but not
+// over WebRTC. A text message with FMP4Init precedes each binary init
+// segment; every following binary message is a fragment holding one frame.
+// The connection is closed when the codec changes.
+func (s *StreamServer) HandleFMP4(w http.ResponseWriter, r *http.Request) {
+	websocket.Handler(s.serveFMP4).ServeHTTP(w, r)
+}
+
+func (s *StreamServer) serveFMP4(ws *websocket.Conn) {
+	defer ws.Close()
+	sub := s.SubscribeFrames()
+	defer sub.Close()
+
+	s.fmp4Viewers.Add(1)
+	defer s.fmp4Viewers.Add(-1)
+	s.RequestKeyframe("new MSE viewer")
+
+	// Nothing is expected from the player; reading only notices it leaving
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, ws)
+		close(gone)
+	}()
+
+	codec := s.Codec()
+	params := newParameterSets(codec)
+	mux := newFMP4Muxer(codec)
+	var initSets [][]byte
+	waiting := true // for a keyframe
+
+	for {
+		select {
+		case <-gone:
+			return
+		case <-s.stopCh:
+			return
+		case frame, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if frame.Codec != codec {
+				return
+			}
+			if sub.Lagged() {
+				waiting = true
+			}
+			params.Observe(frame.NALUs)
+			if !frame.Complete {
+				continue
+			}
+
+			if frame.Keyframe {
+				sets := params.Missing(func(byte) bool { return false })
+				if len(sets) == len(paramSetTypes(codec)) && !sameParamSets(sets, initSets) {
+					if err := sendFMP4Init(ws, mux, sets); err != nil {
+						log.Printf("fMP4 viewer %s: %v", ws.Request().RemoteAddr, err)
+						return
+					}
+					initSets = sets
+				}
+				if initSets != nil {
+					waiting = false
+				}
+			}
+			if waiting {
+				continue
+			}
+
+			ws.SetWriteDeadline(time.Now().Add(fmp4WriteTimeout))
+			if err := websocket.Message.Send(ws, mux.Fragment(frame.AccessUnit)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// sendFMP4Init sends the init segment for new parameter sets. The muxer
+// is kept so decode times continue across resolution changes.
+func sendFMP4Init(ws *websocket.Conn, mux *fmp4Muxer, sets [][]byte) error {
+	init, msg, err := mux.InitSegment(sets)
+	if err != nil {
+		return fmt.Errorf("failed to build init segment: %w", err)
+	}
+
+	ws.SetWriteDeadline(time.Now().Add(fmp4WriteTimeout))
+	if err := websocket.JSON.Send(ws, msg); err != nil {
+		return err
+	}
+	return websocket.Message.Send(ws, init)
+}
+
+func sameParamSets(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// mp4Children splits data into boxes, checking their sizes add up, and
+// returns their payloads by type
+func mp4Children(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+	boxes := make(map[string][]byte)
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("Truncated box header %x", data)
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatalf("Box %q has size %d, %d bytes left", data[4:8], size, len(data))
+		}
+		boxes[string(data[4:8])] = data[8:size]
+		data = data[size:]
+	}
+	return boxes
+}
+
+// mp4Find returns the payload of a nested box
+func mp4Find(t *testing.T, data []byte, path ...string) []byte {
+	t.Helper()
+	for _, typ := range path {
+		payload, ok := mp4Children(t, data)[typ]
+		if !ok {
+			t.Fatalf("No %s box in %v", typ, path)
+		}
+		data = payload
+	}
+	return data
+}
+
+func TestFMP4InitSegmentH265(t *testing.T) {
+	vps := []byte{32 << 1, 1, 0x0c}
+	sps := testHex(t, testH265SPS1080p)
+	pps := []byte{34 << 1, 1, 0xc1}
+
+	init, track, err := newFMP4Muxer(CodecH265).InitSegment([][]byte{vps, sps, pps})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if track.MimeType != `video/mp4; codecs="hvc1.1.6.L120.90"` || track.Width != 1920 || track.Height != 1080 {
+		t.Errorf("Unexpected track %+v", track)
+	}
+
+	top := mp4Children(t, init)
+	if !bytes.HasPrefix(top["ftyp"], []byte("iso5")) {
+		t.Errorf("Unexpected ftyp %q", top["ftyp"])
+	}
+	mp4Find(t, top["moov"], "mvex", "trex")
+	stsd := mp4Find(t, top["moov"], "trak", "mdia", "minf", "stbl", "stsd")
+	// Version and entry count, then the sample entry's 78 byte header
+	entry := mp4Find(t, stsd[8:], "hvc1")
+	if w, h := binary.BigEndian.Uint16(entry[24:]), binary.BigEndian.Uint16(entry[26:]); w != 1920 || h != 1080 {
+		t.Errorf("Sample entry is %dx%d", w, h)
+	}
+	hvcC := mp4Find(t, entry[78:], "hvcC")
+	if hvcC[1] != 1 || hvcC[12] != 120 || hvcC[21]&3 != 3 || hvcC[22] != 3 {
+		t.Errorf("Unexpected hvcC header %x", hvcC[:23])
+	}
+	// VPS array
+	if hvcC[23] != 0x80|32 || !bytes.Equal(hvcC[28:28+len(vps)], vps) {
+		t.Errorf("Unexpected first array %x", hvcC[23:])
+	}
+}
+
+func TestFMP4Fragment(t *testing.T) {
+	sps := testHex(t, testH264SPS720p)
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	m := newFMP4Muxer(CodecH264)
+	_, track, err := m.InitSegment([][]byte{sps, pps})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if track.MimeType != `video/mp4; codecs="avc1.42c01f"` || track.Width != 1280 || track.Height != 720 {
+		t.Errorf("Unexpected track %+v", track)
+	}
+
+	idr := []byte{0x65, 0x88, 0x84}
+	for i, c := range []struct {
+		au    *AccessUnit
+		dts   uint64
+		flags uint32
+		mdat  []byte
+	}{
+		// Delimiter and parameter sets are left out
+		{&AccessUnit{Timestamp: 4294966000, NALUs: [][]byte{{0x09, 0xf0}, sps, pps, idr}, Keyframe: true}, 0, fmp4KeyframeFlags, append([]byte{0, 0, 0, 3}, idr...)},
+		// The timestamp wraps
+		{&AccessUnit{Timestamp: 204, NALUs: [][]byte{{0x41, 1}}}, 1500, fmp4FrameFlags, []byte{0, 0, 0, 2, 0x41, 1}},
+		{&AccessUnit{Timestamp: 3204, NALUs: [][]byte{{0x41, 2}}}, 4500, fmp4FrameFlags, []byte{0, 0, 0, 2, 0x41, 2}},
+	} {
+		frag := m.Fragment(c.au)
+		top := mp4Children(t, frag)
+		if seq := binary.BigEndian.Uint32(mp4Find(t, top["moof"], "mfhd")[4:]); seq != uint32(i+1) {
+			t.Errorf("Fragment %d has sequence number %d", i, seq)
+		}
+		if dts := binary.BigEndian.Uint64(mp4Find(t, top["moof"], "traf", "tfdt")[4:]); dts != c.dts {
+			t.Errorf("Fragment %d: expected decode time %d, got %d", i, c.dts, dts)
+		}
+		trun := mp4Find(t, top["moof"], "traf", "trun")
+		offset := binary.BigEndian.Uint32(trun[8:])
+		size := binary.BigEndian.Uint32(trun[16:])
+		flags := binary.BigEndian.Uint32(trun[20:])
+		if flags != c.flags || int(size) != len(c.mdat) {
+			t.Errorf("Fragment %d: unexpected sample flags %#x size %d", i, flags, size)
+		}
+		if !bytes.Equal(frag[offset:], c.mdat) || !bytes.Equal(top["mdat"], c.mdat) {
+			t.Errorf("Fragment %d: data offset %d doesn't point at the sample %x", i, offset, frag[offset:])
+		}
+	}
+}
+
+func TestHandleFMP4(t *testing.T) {
+	stream := NewStreamServer(0)
+	stream.codec = CodecH264
+	server := httptest.NewServer(http.HandlerFunc(stream.HandleFMP4))
+	defer server.Close()
+
+	ws, err := websocket.Dial(strings.Replace(server.URL, "http", "ws", 1), "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for stream.videoFrames.count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	sps := testHex(t, testH264SPS720p)
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	for _, au := range []*AccessUnit{
+		// Nothing is sent before a keyframe
+		{Timestamp: 0, NALUs: [][]byte{{0x41, 0}}, Complete: true},
+		{Timestamp: 3000, NALUs: [][]byte{sps, pps, {0x65, 1}}, Keyframe: true, Complete: true},
+		{Timestamp: 6000, NALUs: [][]byte{{0x41, 1}}},
+		{Timestamp: 9000, NALUs: [][]byte{{0x41, 2}}, Complete: true},
+	} {
+		stream.videoFrames.publish(&VideoFrame{Codec: CodecH264, AccessUnit: au})
+	}
+
+	var track FMP4Init
+	if err := websocket.JSON.Receive(ws, &track); err != nil {
+		t.Fatal(err)
+	}
+	if track.Width != 1280 || !strings.Contains(track.MimeType, "avc1.42c01f") {
+		t.Errorf("Unexpected track %+v", track)
+	}
+	var init []byte
+	if err := websocket.Message.Receive(ws, &init); err != nil {
+		t.Fatal(err)
+	}
+	mp4Find(t, init, "moov", "trak", "mdia", "minf", "stbl", "stsd")
+
+	// The keyframe, then the complete frame; the incomplete one is skipped
+	for _, want := range [][]byte{{0x65, 1}, {0x41, 2}} {
+		var frag []byte
+		if err := websocket.Message.Receive(ws, &frag); err != nil {
+			t.Fatal(err)
+		}
+		if mdat := mp4Children(t, frag)["mdat"]; !bytes.Equal(mdat[4:], want) {
+			t.Errorf("Expected %x, got %x", want, mdat)
+		}
+	}
+}
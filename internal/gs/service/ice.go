@@ -0,0 +1,219 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/stun/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// ICEConfig sets how peers reach the ground station. The zero value only
+// offers host candidates, which is all an offline ground station can use.
+type ICEConfig struct {
+	// STUN/TURN servers, also handed to browsers
+	Servers []webrtc.ICEServer
+	// Interfaces host candidates are gathered on, all when empty
+	Interfaces []string
+	// Public addresses advertised instead of the host's, each either
+	// "external" or "external/local"
+	NAT1To1IPs []string
+	// UDP ports peers connect to, any when zero
+	PortMin, PortMax uint16
+	// Serve every peer on this one UDP port instead of a port each
+	UDPMuxPort int
+	// Also accept ICE over TCP on this port, for networks dropping UDP
+	TCPMuxPort int
+}
+
+// ParseICEServers parses stun: and turn: URLs. The username and
+// credential are used for TURN servers.
+func ParseICEServers(urls []string, username, credential string) ([]webrtc.ICEServer, error) {
+	var servers []webrtc.ICEServer
+	for _, url := range urls {
+		server := webrtc.ICEServer{URLs: []string{url}}
+		if strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:") {
+			server.Username = username
+			server.Credential = credential
+		}
+		if _, err := stun.ParseURI(url); err != nil {
+			return nil, fmt.Errorf("invalid ICE server %q: %w", url, err)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// ParsePortRange parses a "min-max" port range, empty for any port
+func ParsePortRange(s string) (uint16, uint16, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	low, high, ok := strings.Cut(s, "-")
+	min, err1 := strconv.ParseUint(low, 10, 16)
+	max, err2 := strconv.ParseUint(high, 10, 16)
+	if !ok || err1 != nil || err2 != nil || min == 0 || min > max {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return uint16(min), uint16(max), nil
+}
+
+// WithICE sets how peers connect. Ports are opened on Start.
+func (s *StreamServer) WithICE(config ICEConfig) (*StreamServer, error) {
+	if config.UDPMuxPort != 0 && config.PortMax != 0 {
+		return nil, fmt.Errorf("a UDP port range can't be used with a single UDP port")
+	}
+	s.ice = config
+	return s, nil
+}
+
+// WithTURN adds the embedded TURN server to the ICE servers of peers and
+// browsers
+func (s *StreamServer) WithTURN(turn *TURNServer) *StreamServer {
+	s.turn = turn
+	return s
+}
+
+// iceServers returns the configured ICE servers and the embedded TURN
+// server as reached at host, with fresh credentials
+func (s *StreamServer) iceServers(host string) []webrtc.ICEServer {
+	servers := append([]webrtc.ICEServer{}, s.ice.Servers...)
+	if s.turn != nil {
+		server, err := s.turn.ICEServer(host)
+		if err != nil {
+			log.Printf("Failed to create TURN credentials: %v", err)
+		} else {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// requestHost returns the host a client reached the server at
+func requestHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return strings.Trim(host, "[]")
+}
+
+// startICE builds the WebRTC API peers are created with, opening the
+// shared ICE ports if configured
+func (s *StreamServer) startICE() error {
+	var settings webrtc.SettingEngine
+	config := s.ice
+
+	var keepInterface func(string) bool
+	if len(config.Interfaces) > 0 {
+		keepInterface = func(name string) bool {
+			return slices.Contains(config.Interfaces, name)
+		}
+		settings.SetInterfaceFilter(keepInterface)
+	}
+	if len(config.NAT1To1IPs) > 0 {
+		var rules []webrtc.ICEAddressRewriteRule
+		for _, mapping := range config.NAT1To1IPs {
+			external, local, _ := strings.Cut(mapping, "/")
+			if net.ParseIP(external) == nil || (local != "" && net.ParseIP(local) == nil) {
+				return fmt.Errorf("invalid NAT 1:1 mapping %q", mapping)
+			}
+			rules = append(rules, webrtc.ICEAddressRewriteRule{
+				External:        []string{external},
+				Local:           local,
+				AsCandidateType: webrtc.ICECandidateTypeHost,
+				Mode:            webrtc.ICEAddressRewriteReplace,
+			})
+		}
+		if err := settings.SetICEAddressRewriteRules(rules...); err != nil {
+			return fmt.Errorf("invalid NAT 1:1 mapping: %w", err)
+		}
+	}
+	if config.PortMax != 0 {
+		if err := settings.SetEphemeralUDPPortRange(config.PortMin, config.PortMax); err != nil {
+			return fmt.Errorf("invalid UDP port range: %w", err)
+		}
+	}
+
+	if config.UDPMuxPort != 0 {
+		var opts []ice.UDPMuxFromPortOption
+		if keepInterface != nil {
+			opts = append(opts, ice.UDPMuxFromPortWithInterfaceFilter(keepInterface))
+		}
+		udpMux, err := ice.NewMultiUDPMuxFromPort(config.UDPMuxPort, opts...)
+		if err != nil {
+			return fmt.Errorf("failed to listen for ICE on UDP port %d: %w", config.UDPMuxPort, err)
+		}
+		settings.SetICEUDPMux(udpMux)
+		s.iceMuxes = append(s.iceMuxes, udpMux)
+	}
+	if config.TCPMuxPort != 0 {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: config.TCPMuxPort})
+		if err != nil {
+			s.closeICE()
+			return fmt.Errorf("failed to listen for ICE on TCP port %d: %w", config.TCPMuxPort, err)
+		}
+		tcpMux := webrtc.NewICETCPMux(nil, listener, 8)
+		settings.SetICETCPMux(tcpMux)
+		settings.SetNetworkTypes([]webrtc.NetworkType{
+			webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6,
+			webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6,
+		})
+		s.iceMuxes = append(s.iceMuxes, tcpMux)
+	}
+
+	// Default codecs and interceptors, as webrtc.NewPeerConnection
+	s.api = webrtc.NewAPI(webrtc.WithSettingEngine(settings))
+	return nil
+}
+
+func (s *StreamServer) closeICE() {
+	for _, mux := range s.iceMuxes {
+		mux.Close()
+	}
+	s.iceMuxes = nil
+}
+
+// newPeerConnection creates a peer connection with the ICE configuration
+func (s *StreamServer) newPeerConnection() (*webrtc.PeerConnection, error) {
+	// The TURN server is on this host
+	config := webrtc.Configuration{ICEServers: s.iceServers("")}
+	if s.api == nil {
+		// Not started
+		return webrtc.NewPeerConnection(config)
+	}
+	return s.api.NewPeerConnection(config)
+}
+
+// HandleICEServers returns the ICE servers browsers should use, so they
+// don't wait on public STUN servers an offline ground station can't reach
+func (s *StreamServer) HandleICEServers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"ice_servers": s.iceServers(requestHost(r))})
+}
+
+// iceServerLinks returns ICE servers as WHEP Link header values
+func iceServerLinks(servers []webrtc.ICEServer) []string {
+	var links []string
+	for _, server := range servers {
+		for _, url := range server.URLs {
+			link := fmt.Sprintf(`<%s>; rel="ice-server"`, url)
+			if server.Username != "" {
+				link += fmt.Sprintf(`; username=%q; credential="%v"; credential-type="password"`, server.Username, server.Credential)
+			}
+			links = append(links, link)
+		}
+	}
+	return links
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestParseICEServers(t *testing.T) {
+	servers, err := ParseICEServers([]string{"stun:192.168.1.20:3478", "turn:192.168.1.20:3478?transport=udp"}, "gs", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 2 || servers[0].Username != "" || servers[1].Username != "gs" || servers[1].Credential != "secret" {
+		t.Errorf("Unexpected servers %+v", servers)
+	}
+	if _, err := ParseICEServers([]string{"http://example.com"}, "", ""); err == nil {
+		t.Error("Expected an error for a non-ICE URL")
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	if min, max, err := ParsePortRange("50000-50100"); err != nil || min != 50000 || max != 50100 {
+		t.Errorf("Expected 50000-50100, got %d-%d (%v)", min, max, err)
+	}
+	for _, s := range []string{"50000", "50100-50000", "0-10", "1-70000"} {
+		if _, _, err := ParsePortRange(s); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+	if _, err := NewStreamServer(0).WithICE(ICEConfig{PortMin: 1, PortMax: 2, UDPMuxPort: 3}); err == nil {
+		t.Error("Expected an error for a port range with a single UDP port")
+	}
+}
+
+// freePort returns a port nothing is listening on, over TCP and UDP
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestICEConfig(t *testing.T) {
+	port := freePort(t)
+	s := NewStreamServer(0)
+	if _, err := s.WithICE(ICEConfig{NAT1To1IPs: []string{"203.0.113.7"}, UDPMuxPort: port, TCPMuxPort: port}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.startICE(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.closeICE()
+
+	pc, err := s.newPeerConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	var candidates []string
+	for _, line := range strings.Split(pc.LocalDescription().SDP, "\r\n") {
+		if strings.HasPrefix(line, "a=candidate:") {
+			candidates = append(candidates, line)
+		}
+	}
+	if len(candidates) == 0 {
+		t.Skip("No network interfaces to gather candidates on")
+	}
+	var tcp bool
+	for _, c := range candidates {
+		fields := strings.Fields(c)
+		if fields[5] != strconv.Itoa(port) {
+			t.Errorf("Candidate %q isn't on the shared port", c)
+		}
+		// The mapping only covers IPv4 addresses
+		if ip := net.ParseIP(fields[4]); ip.To4() != nil && !ip.Equal(net.IPv4(203, 0, 113, 7)) {
+			t.Errorf("Candidate %q isn't on the mapped address", c)
+		}
+		tcp = tcp || strings.EqualFold(fields[2], "tcp")
+	}
+	if !tcp {
+		t.Errorf("No ICE-TCP candidate in %q", candidates)
+	}
+}
+
+func TestHandleICEServers(t *testing.T) {
+	s := NewStreamServer(0)
+	rec := httptest.NewRecorder()
+	s.HandleICEServers(rec, httptest.NewRequest(http.MethodGet, "/api/v1/stream/ice", nil))
+	// Host candidates only by default
+	if body := strings.TrimSpace(rec.Body.String()); body != `{"ice_servers":[]}` {
+		t.Errorf("Unexpected default %s", body)
+	}
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Keyframe request methods
+const (
+	KeyframeRequestAlink    = "alink"
+	KeyframeRequestMajestic = "majestic"
+	KeyframeRequestNone     = "none"
+)
+
+// keyframeRequestInterval is the minimum time between keyframe requests.
+// Each keyframe costs a burst of bitrate, so PLIs from several viewers
+// are answered with one.
+const keyframeRequestInterval = time.Second
+
+// AlinkKeyframeRequester returns a function asking alink on the air unit
+// for a keyframe. alink takes length prefixed text messages over UDP; the
+// random code lets it ignore retransmissions of the same request.
+func AlinkKeyframeRequester(addr string) func() error {
+	return func() error {
+		conn, err := net.DialTimeout("udp", addr, 2*time.Second)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		var code [2]byte
+		rand.Read(code[:])
+		msg := "special:request_keyframe:" + hex.EncodeToString(code[:])
+		packet := binary.BigEndian.AppendUint32(nil, uint32(len(msg)))
+		_, err = conn.Write(append(packet, msg...))
+		return err
+	}
+}
+
+// MajesticKeyframeRequester returns a function asking majestic for an IDR
+// frame through its HTTP API on the air unit's host
+func MajesticKeyframeRequester(airUnitURL string) (func() error, error) {
+	endpoint, err := majesticIDREndpoint(airUnitURL)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	return func() error {
+		resp, err := client.Get(endpoint)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("majestic returned %d", resp.StatusCode)
+		}
+		return nil
+	}, nil
+}
+
+// majesticIDREndpoint returns majestic's IDR request URL on the air unit's
+// host. Majestic listens on the default HTTP port.
+func majesticIDREndpoint(airUnitURL string) (string, error) {
+	u, err := url.Parse(airUnitURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("no host in %q", airUnitURL)
+	}
+	return (&url.URL{Scheme: "http", Host: u.Hostname(), Path: "/request/idr"}).String(), nil
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlinkKeyframeRequester(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := AlinkKeyframeRequester(conn.LocalAddr().String())(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := binary.BigEndian.Uint32(buf)
+	msg := string(buf[4:n])
+	if int(size) != len(msg) || !strings.HasPrefix(msg, "special:request_keyframe:") {
+		t.Errorf("Unexpected message %q with length %d", msg, size)
+	}
+}
+
+func TestMajesticIDREndpoint(t *testing.T) {
+	endpoint, err := majesticIDREndpoint("http://192.168.1.10:8080")
+	if err != nil || endpoint != "http://192.168.1.10/request/idr" {
+		t.Errorf("Unexpected endpoint %q (%v)", endpoint, err)
+	}
+	if _, err := majesticIDREndpoint("192.168.1.10:8080"); err == nil {
+		t.Error("Expected an error for a URL without scheme")
+	}
+}
+
+func TestRequestKeyframeRateLimit(t *testing.T) {
+	requests := make(chan struct{}, 10)
+	s := NewStreamServer(0).WithKeyframeRequester(func() error {
+		requests <- struct{}{}
+		return nil
+	})
+
+	if !s.RequestKeyframe("new peer") {
+		t.Fatal("Expected the first request to be sent")
+	}
+	if s.RequestKeyframe("picture loss") {
+		t.Error("Expected a second request right away to be dropped")
+	}
+	<-requests
+
+	s.lastKeyframeRequest = time.Now().Add(-keyframeRequestInterval)
+	if !s.RequestKeyframe("picture loss") {
+		t.Error("Expected a request after the interval")
+	}
+	<-requests
+	if got := s.keyframeRequests.Load(); got != 2 {
+		t.Errorf("Expected 2 requests counted, got %d", got)
+	}
+
+	if NewStreamServer(0).RequestKeyframe("new peer") {
+		t.Error("Expected no request without a requester")
+	}
+}
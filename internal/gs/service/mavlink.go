@@ -0,0 +1,297 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MAVLink framing
+const (
+	mavlinkV1Magic = 0xfe
+	mavlinkV2Magic = 0xfd
+
+	mavlinkV1HeaderSize = 6
+	mavlinkV2HeaderSize = 10
+	mavlinkChecksumSize = 2
+	mavlinkSignatureLen = 13
+	mavlinkFlagSigned   = 0x01
+)
+
+// MAVLink message IDs used for telemetry
+const (
+	MAVLinkMsgSysStatus         = 1
+	MAVLinkMsgGlobalPositionInt = 33
+	MAVLinkMsgVFRHUD            = 74
+)
+
+// mavlinkMessages holds the CRC extra byte and full payload length of the
+// messages that are decoded. Without the CRC extra other messages can't be
+// told apart from noise, so they are skipped.
+var mavlinkMessages = map[uint32]struct {
+	crcExtra byte
+	length   int
+}{
+	MAVLinkMsgSysStatus:         {124, 31},
+	MAVLinkMsgGlobalPositionInt: {104, 28},
+	MAVLinkMsgVFRHUD:            {20, 20},
+}
+
+// mavlinkStaleAfter is how long telemetry is shown after the last message
+const mavlinkStaleAfter = 5 * time.Second
+
+// MAVLinkMessage is a decoded MAVLink v1 or v2 frame
+type MAVLinkMessage struct {
+	Version int
+	SysID   byte
+	CompID  byte
+	MsgID   uint32
+	Payload []byte
+}
+
+// MAVLinkParser decodes a byte stream into the MAVLink frames listed in
+// mavlinkMessages. Data may arrive in arbitrary chunks; incomplete frames
+// are buffered until the rest arrives, and corrupt or unknown frames are
+// skipped.
+type MAVLinkParser struct {
+	buf []byte
+
+	// Counters for diagnostics
+	Frames int
+	Errors int // resyncs past corrupt or unknown frames
+}
+
+// Feed appends data to the parser and returns every complete frame found
+func (p *MAVLinkParser) Feed(data []byte) []MAVLinkMessage {
+	p.buf = append(p.buf, data...)
+
+	var msgs []MAVLinkMessage
+	for {
+		start := bytes.IndexAny(p.buf, "\xfe\xfd")
+		if start < 0 {
+			p.buf = p.buf[:0]
+			break
+		}
+		p.buf = p.buf[start:]
+
+		msg, n, ok := parseMAVLinkFrame(p.buf)
+		if n == 0 {
+			// Need more data
+			break
+		}
+		if !ok {
+			// Bad checksum or unknown message, resync on the next magic byte
+			p.Errors++
+			p.buf = p.buf[1:]
+			continue
+		}
+
+		p.Frames++
+		msgs = append(msgs, msg)
+		p.buf = p.buf[n:]
+	}
+
+	// Compact so the buffer doesn't grow without bound
+	if cap(p.buf) > 4096 && len(p.buf) < 512 {
+		p.buf = append([]byte(nil), p.buf...)
+	}
+	return msgs
+}
+
+// parseMAVLinkFrame parses one frame at the start of buf.
+// It returns n == 0 if more data is needed and ok == false if the frame is invalid.
+func parseMAVLinkFrame(buf []byte) (msg MAVLinkMessage, n int, ok bool) {
+	if len(buf) < 2 {
+		return msg, 0, false
+	}
+	length := int(buf[1])
+
+	var header int
+	switch buf[0] {
+	case mavlinkV1Magic:
+		header = mavlinkV1HeaderSize
+		n = header + length + mavlinkChecksumSize
+		if len(buf) < n {
+			return msg, 0, false
+		}
+		msg = MAVLinkMessage{Version: 1, SysID: buf[3], CompID: buf[4], MsgID: uint32(buf[5])}
+	case mavlinkV2Magic:
+		header = mavlinkV2HeaderSize
+		if len(buf) < 3 {
+			return msg, 0, false
+		}
+		n = header + length + mavlinkChecksumSize
+		if buf[2]&mavlinkFlagSigned != 0 {
+			n += mavlinkSignatureLen
+		}
+		if len(buf) < n {
+			return msg, 0, false
+		}
+		msg = MAVLinkMessage{
+			Version: 2,
+			SysID:   buf[5],
+			CompID:  buf[6],
+			MsgID:   uint32(buf[7]) | uint32(buf[8])<<8 | uint32(buf[9])<<16,
+		}
+	default:
+		return msg, 1, false
+	}
+
+	info, known := mavlinkMessages[msg.MsgID]
+	if !known {
+		return msg, n, false
+	}
+	if mavlinkCRC(buf[1:header+length], info.crcExtra) != binary.LittleEndian.Uint16(buf[header+length:]) {
+		return msg, n, false
+	}
+	// MAVLink 2 drops trailing zero bytes
+	msg.Payload = make([]byte, max(length, info.length))
+	copy(msg.Payload, buf[header:header+length])
+	return msg, n, true
+}
+
+// mavlinkCRC is the X.25 checksum over the frame after the magic byte,
+// followed by the message's CRC extra byte
+func mavlinkCRC(data []byte, extra byte) uint16 {
+	crc := uint16(0xffff)
+	accumulate := func(b byte) {
+		tmp := b ^ byte(crc)
+		tmp ^= tmp << 4
+		crc = crc>>8 ^ uint16(tmp)<<8 ^ uint16(tmp)<<3 ^ uint16(tmp)>>4
+	}
+	for _, b := range data {
+		accumulate(b)
+	}
+	accumulate(extra)
+	return crc
+}
+
+// MAVLinkTelemetry is the latest flight data received over MAVLink
+type MAVLinkTelemetry struct {
+	Updated time.Time `json:"updated"`
+
+	HasPosition   bool    `json:"has_position"`
+	AltitudeM     float64 `json:"altitude_m"` // relative to home
+	GroundSpeedMS float64 `json:"ground_speed_ms"`
+
+	HasBattery      bool    `json:"has_battery"`
+	BatteryVoltage  float64 `json:"battery_voltage"`
+	BatteryCurrentA float64 `json:"battery_current_a"` // -1 when not measured
+	BatteryPercent  int     `json:"battery_percent"`   // -1 when not estimated
+}
+
+// Apply updates the telemetry from a message and reports whether it was used
+func (t *MAVLinkTelemetry) Apply(msg MAVLinkMessage, now time.Time) bool {
+	p := msg.Payload
+	switch msg.MsgID {
+	case MAVLinkMsgGlobalPositionInt:
+		// time_boot_ms, lat, lon, alt, relative_alt (mm), vx, vy, vz (cm/s), hdg
+		relAlt := int32(binary.LittleEndian.Uint32(p[16:]))
+		vx := float64(int16(binary.LittleEndian.Uint16(p[20:])))
+		vy := float64(int16(binary.LittleEndian.Uint16(p[22:])))
+		t.AltitudeM = float64(relAlt) / 1000
+		t.GroundSpeedMS = math.Hypot(vx, vy) / 100
+		t.HasPosition = true
+	case MAVLinkMsgVFRHUD:
+		// airspeed, groundspeed, alt, climb (float), heading, throttle
+		t.GroundSpeedMS = float64(math.Float32frombits(binary.LittleEndian.Uint32(p[4:])))
+		if !t.HasPosition {
+			t.AltitudeM = float64(math.Float32frombits(binary.LittleEndian.Uint32(p[8:])))
+			t.HasPosition = true
+		}
+	case MAVLinkMsgSysStatus:
+		// voltage_battery (mV), current_battery (cA), ..., battery_remaining (%)
+		voltage := binary.LittleEndian.Uint16(p[14:])
+		if voltage == math.MaxUint16 {
+			return false
+		}
+		t.BatteryVoltage = float64(voltage) / 1000
+		t.BatteryCurrentA = -1
+		if current := int16(binary.LittleEndian.Uint16(p[16:])); current >= 0 {
+			t.BatteryCurrentA = float64(current) / 100
+		}
+		t.BatteryPercent = int(int8(p[30]))
+		t.HasBattery = true
+	default:
+		return false
+	}
+	t.Updated = now
+	return true
+}
+
+// MAVLinkService receives MAVLink telemetry over UDP (e.g. a copy of what
+// wfb-ng forwards to the ground control station) and keeps the latest values
+type MAVLinkService struct {
+	port      int
+	conn      *net.UDPConn
+	parser    MAVLinkParser
+	mu        sync.Mutex
+	telemetry MAVLinkTelemetry
+	running   atomic.Bool
+}
+
+// NewMAVLinkService creates a MAVLink service listening on the given UDP port
+func NewMAVLinkService(port int) *MAVLinkService {
+	return &MAVLinkService{port: port}
+}
+
+func (s *MAVLinkService) Start() error {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: s.port})
+	if err != nil {
+		return fmt.Errorf("failed to listen for MAVLink on port %d: %w", s.port, err)
+	}
+	s.conn = conn
+	s.running.Store(true)
+
+	log.Printf("MAVLink service listening on UDP port %d", s.port)
+	go s.readLoop()
+	return nil
+}
+
+func (s *MAVLinkService) Stop() {
+	if !s.running.CompareAndSwap(true, false) {
+		return
+	}
+	s.conn.Close()
+}
+
+func (s *MAVLinkService) readLoop() {
+	buf := make([]byte, 65535)
+	for s.running.Load() {
+		n, _, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if s.running.Load() {
+				log.Printf("MAVLink read error: %v", err)
+			}
+			return
+		}
+		s.Feed(buf[:n], time.Now())
+	}
+}
+
+// Feed decodes raw MAVLink bytes and updates the telemetry
+func (s *MAVLinkService) Feed(data []byte, now time.Time) {
+	msgs := s.parser.Feed(data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range msgs {
+		s.telemetry.Apply(msg, now)
+	}
+}
+
+// Telemetry returns the latest telemetry, or false if none arrived recently
+func (s *MAVLinkService) Telemetry(now time.Time) (MAVLinkTelemetry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.telemetry.Updated.IsZero() || now.Sub(s.telemetry.Updated) > mavlinkStaleAfter {
+		return MAVLinkTelemetry{}, false
+	}
+	return s.telemetry, true
+}
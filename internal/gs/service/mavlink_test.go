@@ -0,0 +1,92 @@
+package service
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// mavlinkV2Frame builds a MAVLink 2 frame, trimming trailing zero bytes of
+// the payload like real senders do
+func mavlinkV2Frame(msgID uint32, payload []byte) []byte {
+	for len(payload) > 1 && payload[len(payload)-1] == 0 {
+		payload = payload[:len(payload)-1]
+	}
+	frame := []byte{mavlinkV2Magic, byte(len(payload)), 0, 0, 7, 1, 1, byte(msgID), byte(msgID >> 8), byte(msgID >> 16)}
+	frame = append(frame, payload...)
+	return binary.LittleEndian.AppendUint16(frame, mavlinkCRC(frame[1:], mavlinkMessages[msgID].crcExtra))
+}
+
+func mavlinkV1Frame(msgID uint32, payload []byte) []byte {
+	frame := []byte{mavlinkV1Magic, byte(len(payload)), 7, 1, 1, byte(msgID)}
+	frame = append(frame, payload...)
+	return binary.LittleEndian.AppendUint16(frame, mavlinkCRC(frame[1:], mavlinkMessages[msgID].crcExtra))
+}
+
+func TestMAVLinkCRC(t *testing.T) {
+	// CRC-16/MCRF4XX check value
+	if crc := mavlinkCRC([]byte("12345678"), '9'); crc != 0x6f91 {
+		t.Errorf("Expected 0x6f91, got %#x", crc)
+	}
+}
+
+func TestMAVLinkTelemetry(t *testing.T) {
+	position := make([]byte, 28)
+	vx := int16(-300)
+	binary.LittleEndian.PutUint32(position[16:], 120500)     // 120.5m
+	binary.LittleEndian.PutUint16(position[20:], uint16(vx)) // 3m/s
+	binary.LittleEndian.PutUint16(position[22:], 400)        // 4m/s
+
+	status := make([]byte, 31)
+	binary.LittleEndian.PutUint16(status[14:], 15800) // 15.8V
+	binary.LittleEndian.PutUint16(status[16:], 1230)  // 12.3A
+	status[30] = 76
+
+	hud := make([]byte, 20)
+	binary.LittleEndian.PutUint32(hud[4:], math.Float32bits(9))
+
+	var stream []byte
+	stream = append(stream, 0x00, 0xfe, 0x42) // noise
+	stream = append(stream, mavlinkV2Frame(MAVLinkMsgGlobalPositionInt, position)...)
+	corrupt := mavlinkV2Frame(MAVLinkMsgSysStatus, status)
+	corrupt[12] ^= 0xff
+	stream = append(stream, corrupt...)
+	stream = append(stream, mavlinkV1Frame(MAVLinkMsgSysStatus, status)...)
+
+	s := NewMAVLinkService(0)
+	now := time.Now()
+	if _, ok := s.Telemetry(now); ok {
+		t.Fatal("Expected no telemetry before any message")
+	}
+
+	// Arrives in arbitrary chunks
+	for i := 0; i < len(stream); i += 7 {
+		s.Feed(stream[i:min(i+7, len(stream))], now)
+	}
+
+	tel, ok := s.Telemetry(now)
+	if !ok {
+		t.Fatal("Expected telemetry")
+	}
+	if !tel.HasPosition || tel.AltitudeM != 120.5 || tel.GroundSpeedMS != 5 {
+		t.Errorf("Unexpected position %+v", tel)
+	}
+	if !tel.HasBattery || tel.BatteryVoltage != 15.8 || tel.BatteryCurrentA != 12.3 || tel.BatteryPercent != 76 {
+		t.Errorf("Unexpected battery %+v", tel)
+	}
+	if s.parser.Frames != 2 || s.parser.Errors == 0 {
+		t.Errorf("Expected 2 frames and the corrupt one skipped, got %d frames %d errors", s.parser.Frames, s.parser.Errors)
+	}
+
+	// VFR_HUD updates the speed but not a GPS altitude
+	s.Feed(mavlinkV2Frame(MAVLinkMsgVFRHUD, hud), now)
+	tel, _ = s.Telemetry(now)
+	if tel.GroundSpeedMS != 9 || tel.AltitudeM != 120.5 {
+		t.Errorf("Unexpected telemetry after VFR_HUD %+v", tel)
+	}
+
+	if _, ok := s.Telemetry(now.Add(mavlinkStaleAfter + time.Second)); ok {
+		t.Error("Expected stale telemetry to be dropped")
+	}
+}
@@ -0,0 +1,243 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// MPEG-TS layout used for recordings (ISO/IEC 13818-1)
+const (
+	tsPacketSize = 188
+	tsPIDPAT     = 0x0000
+	tsPIDPMT     = 0x1000
+	tsPIDVideo   = 0x0100
+
+	tsStreamTypeH264 = 0x1b
+	tsStreamTypeH265 = 0x24
+
+	// tsPTSOffset keeps the first PTS above the PCR so players have time to buffer
+	tsPTSOffset = rtpVideoClockRate / 2
+	// tsPCRDelay is how far the clock reference runs behind the frames
+	tsPCRDelay = rtpVideoClockRate / 10
+)
+
+// Access unit delimiters the TS spec requires at the start of every frame
+var (
+	h264AUD = []byte{0x09, 0xf0}
+	h265AUD = []byte{0x46, 0x01, 0x50}
+)
+
+// tsMuxer writes video frames of one codec as an MPEG transport stream
+type tsMuxer struct {
+	w          io.Writer
+	codec      string
+	continuity map[uint16]byte
+	pkt        [tsPacketSize]byte
+}
+
+func newTSMuxer(w io.Writer, codec string) *tsMuxer {
+	return &tsMuxer{
+		w:          w,
+		codec:      codec,
+		continuity: make(map[uint16]byte),
+	}
+}
+
+// WriteFrame writes a frame with a presentation time in 90kHz units.
+// Tables are repeated before every keyframe so any keyframe is a place to
+// start playing from.
+func (m *tsMuxer) WriteFrame(au *AccessUnit, pts int64) error {
+	if au.Keyframe {
+		if err := m.writeTables(); err != nil {
+			return err
+		}
+	}
+
+	pes := m.pes(au, pts+tsPTSOffset)
+	pcr := pts + tsPTSOffset - tsPCRDelay
+	if pcr < 0 {
+		pcr = 0
+	}
+	first := true
+	for len(pes) > 0 {
+		n, err := m.writePacket(tsPIDVideo, first, pes, pcr, first && au.Keyframe)
+		if err != nil {
+			return err
+		}
+		pes = pes[n:]
+		first = false
+	}
+	return nil
+}
+
+// pes wraps a frame in a PES packet, adding an access unit delimiter if the
+// frame doesn't start with one
+func (m *tsMuxer) pes(au *AccessUnit, pts int64) []byte {
+	aud := h265AUD
+	hasAUD := len(au.NALUs) > 0 && len(au.NALUs[0]) > 0 && h265NALUType(au.NALUs[0]) == 35
+	if m.codec == CodecH264 {
+		aud = h264AUD
+		hasAUD = len(au.NALUs) > 0 && len(au.NALUs[0]) > 0 && h264NALUType(au.NALUs[0]) == 9
+	}
+
+	var b bytes.Buffer
+	// Start code, video stream id and an unbounded length, which is allowed for video
+	b.Write([]byte{0x00, 0x00, 0x01, 0xe0, 0x00, 0x00})
+	// Data alignment, PTS only, 5 bytes of header data
+	b.Write([]byte{0x84, 0x80, 0x05})
+	b.Write(encodePTS(pts))
+	if !hasAUD {
+		b.Write(annexBStartCode)
+		b.Write(aud)
+	}
+	b.Write(au.AnnexB())
+	return b.Bytes()
+}
+
+// encodePTS encodes a 33-bit timestamp with the PTS-only prefix
+func encodePTS(pts int64) []byte {
+	pts &= 1<<33 - 1
+	return []byte{
+		0x21 | byte(pts>>29)&0x0e,
+		byte(pts >> 22),
+		0x01 | byte(pts>>14)&0xfe,
+		byte(pts >> 7),
+		0x01 | byte(pts<<1)&0xfe,
+	}
+}
+
+// writePacket writes one TS packet carrying as much of data as fits and
+// returns how many bytes it took. The first packet of a PES carries the PCR.
+func (m *tsMuxer) writePacket(pid uint16, start bool, data []byte, pcr int64, randomAccess bool) (int, error) {
+	p := m.pkt[:]
+	p[0] = 0x47
+	p[1] = byte(pid >> 8 & 0x1f)
+	if start {
+		p[1] |= 0x40
+	}
+	p[2] = byte(pid)
+
+	// Adaptation field: PCR on the first packet, stuffing on the last
+	var adaptation []byte
+	if start && pid == tsPIDVideo {
+		flags := byte(0x10)
+		if randomAccess {
+			flags |= 0x40
+		}
+		base := pcr & (1<<33 - 1)
+		adaptation = []byte{
+			flags,
+			byte(base >> 25), byte(base >> 17), byte(base >> 9), byte(base >> 1),
+			byte(base<<7) | 0x7e, 0x00,
+		}
+	}
+	room := tsPacketSize - 4
+	if adaptation != nil {
+		room -= 1 + len(adaptation)
+	}
+	if len(data) < room {
+		// Stuff with 0xff so the payload ends the packet
+		stuffing := room - len(data)
+		if adaptation == nil {
+			stuffing--
+			if stuffing > 0 {
+				adaptation = []byte{0x00}
+				stuffing--
+			} else {
+				adaptation = []byte{}
+			}
+		}
+		for i := 0; i < stuffing; i++ {
+			adaptation = append(adaptation, 0xff)
+		}
+		room = len(data)
+	}
+
+	cc := m.continuity[pid]
+	m.continuity[pid] = (cc + 1) & 0x0f
+	if adaptation != nil {
+		p[3] = 0x30 | cc
+		p[4] = byte(len(adaptation))
+		copy(p[5:], adaptation)
+		copy(p[5+len(adaptation):], data[:room])
+	} else {
+		p[3] = 0x10 | cc
+		copy(p[4:], data[:room])
+	}
+	if _, err := m.w.Write(p); err != nil {
+		return 0, err
+	}
+	return room, nil
+}
+
+// writeTables writes the PAT and PMT
+func (m *tsMuxer) writeTables() error {
+	// Program 1 on the PMT PID
+	pat := psiSection(0x00, 0x0001, []byte{0x00, 0x01, 0xe0 | byte(tsPIDPMT>>8), byte(tsPIDPMT & 0xff)})
+
+	streamType := byte(tsStreamTypeH265)
+	if m.codec == CodecH264 {
+		streamType = tsStreamTypeH264
+	}
+	// PCR on the video PID, no program info, one elementary stream
+	pmt := psiSection(0x02, 0x0001, []byte{
+		0xe0 | byte(tsPIDVideo>>8), byte(tsPIDVideo & 0xff),
+		0xf0, 0x00,
+		streamType, 0xe0 | byte(tsPIDVideo>>8), byte(tsPIDVideo & 0xff), 0xf0, 0x00,
+	})
+
+	if err := m.writeSection(tsPIDPAT, pat); err != nil {
+		return err
+	}
+	return m.writeSection(tsPIDPMT, pmt)
+}
+
+func (m *tsMuxer) writeSection(pid uint16, section []byte) error {
+	// Pointer field, then the section padded with 0xff
+	p := m.pkt[:]
+	p[0] = 0x47
+	p[1] = 0x40 | byte(pid>>8&0x1f)
+	p[2] = byte(pid)
+	cc := m.continuity[pid]
+	m.continuity[pid] = (cc + 1) & 0x0f
+	p[3] = 0x10 | cc
+	p[4] = 0x00
+	n := copy(p[5:], section)
+	for i := 5 + n; i < tsPacketSize; i++ {
+		p[i] = 0xff
+	}
+	_, err := m.w.Write(p)
+	return err
+}
+
+// psiSection builds a PAT or PMT section with its CRC
+func psiSection(tableID byte, tableIDExt uint16, body []byte) []byte {
+	// Everything after the length field, including the CRC
+	length := 5 + len(body) + 4
+	s := []byte{
+		tableID, 0xb0 | byte(length>>8), byte(length),
+		byte(tableIDExt >> 8), byte(tableIDExt),
+		0xc1, // version 0, current
+		0x00, 0x00,
+	}
+	s = append(s, body...)
+	return binary.BigEndian.AppendUint32(s, crc32MPEG2(s))
+}
+
+// crc32MPEG2 is the CRC used by PSI tables: polynomial 0x04c11db7, not
+// reflected, no final xor
+func crc32MPEG2(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"bytes"
+	"testing"
+)
+
+// tsTestPES splits a transport stream into the PES packets of the video PID
+// and checks packet framing and continuity on the way
+func tsTestPES(t *testing.T, ts []byte) (pes [][]byte, tables int) {
+	t.Helper()
+	if len(ts)%tsPacketSize != 0 {
+		t.Fatalf("Stream of %d bytes isn't made of whole packets", len(ts))
+	}
+	continuity := map[uint16]byte{}
+	for off := 0; off < len(ts); off += tsPacketSize {
+		p := ts[off : off+tsPacketSize]
+		if p[0] != 0x47 {
+			t.Fatalf("Missing sync byte at %d", off)
+		}
+		pid := uint16(p[1]&0x1f)<<8 | uint16(p[2])
+		start := p[1]&0x40 != 0
+		cc := p[3] & 0x0f
+		if last, ok := continuity[pid]; ok && cc != (last+1)&0x0f {
+			t.Errorf("PID %#x continuity jumps from %d to %d", pid, last, cc)
+		}
+		continuity[pid] = cc
+
+		payload := p[4:]
+		if p[3]&0x20 != 0 {
+			payload = p[5+int(p[4]):]
+		}
+		switch pid {
+		case tsPIDPAT, tsPIDPMT:
+			section := payload[1:]
+			length := int(section[1]&0x0f)<<8 | int(section[2])
+			if crc32MPEG2(section[:3+length]) != 0 {
+				t.Errorf("PID %#x section has a bad CRC", pid)
+			}
+			tables++
+		case tsPIDVideo:
+			if start {
+				pes = append(pes, nil)
+			}
+			if len(pes) == 0 {
+				t.Fatal("Video payload before the first PES start")
+			}
+			pes[len(pes)-1] = append(pes[len(pes)-1], payload...)
+		default:
+			t.Errorf("Unexpected PID %#x", pid)
+		}
+	}
+	return pes, tables
+}
+
+func decodePTS(b []byte) int64 {
+	return int64(b[0]&0x0e)<<29 | int64(b[1])<<22 | int64(b[2]&0xfe)<<14 | int64(b[3])<<7 | int64(b[4])>>1
+}
+
+func TestTSMuxer(t *testing.T) {
+	var out bytes.Buffer
+	m := newTSMuxer(&out, CodecH265)
+
+	idr := &AccessUnit{
+		NALUs:    [][]byte{{32 << 1, 1, 0xaa}, {19 << 1, 1}},
+		Keyframe: true,
+		Complete: true,
+	}
+	idr.NALUs[1] = append(idr.NALUs[1], bytes.Repeat([]byte{0x55}, 500)...)
+	p := &AccessUnit{NALUs: [][]byte{{1 << 1, 1, 0x42}}, Complete: true}
+
+	if err := m.WriteFrame(idr, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteFrame(p, 3000); err != nil {
+		t.Fatal(err)
+	}
+	// PTS wraps at 33 bits
+	if err := m.WriteFrame(p, 1<<33); err != nil {
+		t.Fatal(err)
+	}
+
+	pes, tables := tsTestPES(t, out.Bytes())
+	if tables != 2 {
+		t.Errorf("Expected PAT and PMT once, got %d tables", tables)
+	}
+	if len(pes) != 3 {
+		t.Fatalf("Expected 3 PES packets, got %d", len(pes))
+	}
+
+	for i, want := range []int64{tsPTSOffset, 3000 + tsPTSOffset, tsPTSOffset} {
+		if !bytes.HasPrefix(pes[i], []byte{0x00, 0x00, 0x01, 0xe0}) {
+			t.Fatalf("PES %d has no video start code", i)
+		}
+		if pts := decodePTS(pes[i][9:14]); pts != want {
+			t.Errorf("PES %d has PTS %d, expected %d", i, pts, want)
+		}
+	}
+
+	// Access unit delimiter, then the frame
+	want := append(append(append([]byte{}, annexBStartCode...), h265AUD...), idr.AnnexB()...)
+	if !bytes.Equal(pes[0][14:], want) {
+		t.Errorf("Unexpected keyframe payload %x", pes[0][14:])
+	}
+}
+
+func TestCRC32MPEG2(t *testing.T) {
+	// Standard PAT for program 1 on PID 0x1000 as written by ffmpeg
+	pat := []byte{0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xf0, 0x00}
+	if crc := crc32MPEG2(pat); crc != 0x2ab104b2 {
+		t.Errorf("Expected CRC 0x2ab104b2, got %#x", crc)
+	}
+}
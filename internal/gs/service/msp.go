@@ -0,0 +1,208 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// MSP command IDs used by the ground station
+const (
+	MSPCmdDisplayPort = 182
+	mspCmdV2Envelope  = 255 // MSPv2 frame tunnelled inside an MSPv1 frame
+	mspMaxPayload     = 4096
+)
+
+// MSPMessage is a decoded MSP v1 or v2 frame
+type MSPMessage struct {
+	Version   int
+	Direction byte // '<' request, '>' response, '!' error
+	Flags     byte // MSPv2 only
+	Cmd       uint16
+	Payload   []byte
+}
+
+// MSPParser decodes a byte stream into MSP frames.
+// Data may arrive in arbitrary chunks; incomplete frames are buffered
+// until the rest arrives, and corrupt frames are skipped.
+type MSPParser struct {
+	buf []byte
+
+	// Counters for diagnostics
+	Frames int
+	Errors int
+}
+
+// Feed appends data to the parser and returns every complete frame found
+func (p *MSPParser) Feed(data []byte) []MSPMessage {
+	p.buf = append(p.buf, data...)
+
+	var msgs []MSPMessage
+	for {
+		start := bytes.IndexByte(p.buf, '$')
+		if start < 0 {
+			p.buf = p.buf[:0]
+			break
+		}
+		p.buf = p.buf[start:]
+
+		msg, n, ok := parseMSPFrame(p.buf)
+		if n == 0 {
+			// Need more data
+			break
+		}
+		if !ok {
+			// Bad header or checksum, resync on the next '$'
+			p.Errors++
+			p.buf = p.buf[1:]
+			continue
+		}
+
+		p.Frames++
+		msgs = append(msgs, msg)
+		p.buf = p.buf[n:]
+	}
+
+	// Compact so the buffer doesn't grow without bound
+	if cap(p.buf) > 4*mspMaxPayload && len(p.buf) < mspMaxPayload {
+		p.buf = append([]byte(nil), p.buf...)
+	}
+	return msgs
+}
+
+// parseMSPFrame parses one frame at the start of buf.
+// It returns n == 0 if more data is needed and ok == false if the frame is invalid.
+func parseMSPFrame(buf []byte) (msg MSPMessage, n int, ok bool) {
+	if len(buf) < 3 {
+		return msg, 0, false
+	}
+
+	dir := buf[2]
+	if dir != '<' && dir != '>' && dir != '!' {
+		return msg, 1, false
+	}
+
+	switch buf[1] {
+	case 'M':
+		return parseMSPv1(buf)
+	case 'X':
+		return parseMSPv2(buf)
+	default:
+		return msg, 1, false
+	}
+}
+
+// MSPv1: $ M <dir> <size> <cmd> [size_lo size_hi if jumbo] <payload> <xor checksum>
+func parseMSPv1(buf []byte) (msg MSPMessage, n int, ok bool) {
+	if len(buf) < 6 {
+		return msg, 0, false
+	}
+
+	size := int(buf[3])
+	cmd := buf[4]
+	hdr := 5
+	if size == 255 {
+		// Jumbo frame, real size follows the command
+		if len(buf) < 7 {
+			return msg, 0, false
+		}
+		size = int(binary.LittleEndian.Uint16(buf[5:7]))
+		hdr = 7
+	}
+	if size > mspMaxPayload {
+		return msg, 1, false
+	}
+
+	total := hdr + size + 1
+	if len(buf) < total {
+		return msg, 0, false
+	}
+
+	var crc byte
+	for _, b := range buf[3 : hdr+size] {
+		crc ^= b
+	}
+	if crc != buf[hdr+size] {
+		return msg, 1, false
+	}
+
+	payload := append([]byte(nil), buf[hdr:hdr+size]...)
+
+	if cmd == mspCmdV2Envelope {
+		// flag, cmd (u16), size (u16), payload, crc8
+		inner, ok := decodeMSPv2Body(payload)
+		if !ok {
+			return msg, 1, false
+		}
+		inner.Direction = buf[2]
+		return inner, total, true
+	}
+
+	return MSPMessage{
+		Version:   1,
+		Direction: buf[2],
+		Cmd:       uint16(cmd),
+		Payload:   payload,
+	}, total, true
+}
+
+// MSPv2: $ X <dir> <flag> <cmd u16> <size u16> <payload> <crc8 dvb-s2>
+func parseMSPv2(buf []byte) (msg MSPMessage, n int, ok bool) {
+	if len(buf) < 8 {
+		return msg, 0, false
+	}
+
+	size := int(binary.LittleEndian.Uint16(buf[6:8]))
+	if size > mspMaxPayload {
+		return msg, 1, false
+	}
+
+	total := 8 + size + 1
+	if len(buf) < total {
+		return msg, 0, false
+	}
+
+	msg, ok = decodeMSPv2Body(buf[3:total])
+	if !ok {
+		return msg, 1, false
+	}
+	msg.Direction = buf[2]
+	return msg, total, true
+}
+
+// decodeMSPv2Body decodes flag, cmd, size, payload and the trailing CRC
+func decodeMSPv2Body(body []byte) (MSPMessage, bool) {
+	if len(body) < 6 {
+		return MSPMessage{}, false
+	}
+	size := int(binary.LittleEndian.Uint16(body[3:5]))
+	if len(body) != 5+size+1 {
+		return MSPMessage{}, false
+	}
+
+	var crc byte
+	for _, b := range body[:5+size] {
+		crc = crc8DVBS2(crc, b)
+	}
+	if crc != body[5+size] {
+		return MSPMessage{}, false
+	}
+
+	return MSPMessage{
+		Version: 2,
+		Flags:   body[0],
+		Cmd:     binary.LittleEndian.Uint16(body[1:3]),
+		Payload: append([]byte(nil), body[5:5+size]...),
+	}, true
+}
+
+func crc8DVBS2(crc, b byte) byte {
+	crc ^= b
+	for i := 0; i < 8; i++ {
+		if crc&0x80 != 0 {
+			crc = (crc << 1) ^ 0xD5
+		} else {
+			crc <<= 1
+		}
+	}
+	return crc
+}
@@ -0,0 +1,301 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MSP DisplayPort sub-commands
+const (
+	mspDPHeartbeat   = 0
+	mspDPRelease     = 1
+	mspDPClearScreen = 2
+	mspDPWriteString = 3
+	mspDPDrawScreen  = 4
+	mspDPOptions     = 5
+)
+
+// DisplayPort attribute bits on write_string
+const (
+	mspDPAttrFontPage = 0x03
+	mspDPAttrBlink    = 0x40
+)
+
+// osdResolutions maps the DisplayPort options resolution index to columns x rows
+var osdResolutions = map[byte][2]int{
+	0: {30, 16}, // SD
+	1: {50, 18}, // HD 50x18
+	2: {30, 16}, // HD 30x16
+	3: {60, 22}, // HD 60x22
+}
+
+// OSDCell is a single character position on the OSD canvas
+type OSDCell struct {
+	Row   int    `json:"r"`
+	Col   int    `json:"c"`
+	Char  uint16 `json:"ch"`
+	Blink bool   `json:"b,omitempty"`
+}
+
+// OSDFrame is pushed to the browser. A full frame carries every non-empty
+// cell; a diff only carries the cells that changed (Char 0 clears a cell).
+type OSDFrame struct {
+	Cols  int       `json:"cols"`
+	Rows  int       `json:"rows"`
+	Full  bool      `json:"full"`
+	Cells []OSDCell `json:"cells"`
+}
+
+type osdChar struct {
+	char  uint16
+	blink bool
+}
+
+// OSDCanvas models the DisplayPort character grid.
+// Writes go to a back buffer which becomes visible on draw_screen.
+type OSDCanvas struct {
+	mu    sync.Mutex
+	cols  int
+	rows  int
+	back  []osdChar
+	front []osdChar
+}
+
+// NewOSDCanvas creates a canvas with the default HD 60x22 grid
+func NewOSDCanvas() *OSDCanvas {
+	c := &OSDCanvas{}
+	c.resize(60, 22)
+	return c
+}
+
+func (c *OSDCanvas) resize(cols, rows int) {
+	c.cols = cols
+	c.rows = rows
+	c.back = make([]osdChar, cols*rows)
+	c.front = make([]osdChar, cols*rows)
+}
+
+// Apply handles one MSP_DISPLAYPORT payload. If the payload committed
+// the back buffer it returns the resulting frame, otherwise nil.
+func (c *OSDCanvas) Apply(payload []byte) *OSDFrame {
+	if len(payload) == 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch payload[0] {
+	case mspDPHeartbeat:
+		// Nothing to do, the FC just keeps the port claimed
+	case mspDPRelease, mspDPClearScreen:
+		for i := range c.back {
+			c.back[i] = osdChar{}
+		}
+	case mspDPWriteString:
+		if len(payload) < 4 {
+			return nil
+		}
+		row, col, attr := int(payload[1]), int(payload[2]), payload[3]
+		if row >= c.rows {
+			return nil
+		}
+		page := uint16(attr&mspDPAttrFontPage) << 8
+		blink := attr&mspDPAttrBlink != 0
+		for _, ch := range payload[4:] {
+			if col >= c.cols {
+				break
+			}
+			c.back[row*c.cols+col] = osdChar{char: page | uint16(ch), blink: blink}
+			col++
+		}
+	case mspDPDrawScreen:
+		return c.commit()
+	case mspDPOptions:
+		if len(payload) < 3 {
+			return nil
+		}
+		if res, ok := osdResolutions[payload[2]]; ok && (res[0] != c.cols || res[1] != c.rows) {
+			c.resize(res[0], res[1])
+			return c.fullFrame()
+		}
+	}
+	return nil
+}
+
+// commit copies the back buffer to the front and returns the changed cells
+func (c *OSDCanvas) commit() *OSDFrame {
+	frame := &OSDFrame{Cols: c.cols, Rows: c.rows, Cells: []OSDCell{}}
+	for i, ch := range c.back {
+		if c.front[i] == ch {
+			continue
+		}
+		c.front[i] = ch
+		frame.Cells = append(frame.Cells, OSDCell{
+			Row:   i / c.cols,
+			Col:   i % c.cols,
+			Char:  ch.char,
+			Blink: ch.blink,
+		})
+	}
+	if len(frame.Cells) == 0 {
+		return nil
+	}
+	return frame
+}
+
+// Snapshot returns the currently displayed grid as a full frame
+func (c *OSDCanvas) Snapshot() *OSDFrame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fullFrame()
+}
+
+func (c *OSDCanvas) fullFrame() *OSDFrame {
+	frame := &OSDFrame{Cols: c.cols, Rows: c.rows, Full: true, Cells: []OSDCell{}}
+	for i, ch := range c.front {
+		if ch.char == 0 {
+			continue
+		}
+		frame.Cells = append(frame.Cells, OSDCell{
+			Row:   i / c.cols,
+			Col:   i % c.cols,
+			Char:  ch.char,
+			Blink: ch.blink,
+		})
+	}
+	return frame
+}
+
+// OSDService receives MSP DisplayPort frames over UDP (e.g. forwarded by
+// msposd) and pushes the decoded character grid to browsers
+type OSDService struct {
+	port    int
+	conn    *net.UDPConn
+	canvas  *OSDCanvas
+	parser  MSPParser
+	frames  *broadcaster[*OSDFrame]
+	running atomic.Bool
+}
+
+// NewOSDService creates an OSD service listening on the given UDP port
+func NewOSDService(port int) *OSDService {
+	return &OSDService{
+		port:   port,
+		canvas: NewOSDCanvas(),
+		frames: newBroadcaster[*OSDFrame](32),
+	}
+}
+
+func (s *OSDService) Start() error {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: s.port})
+	if err != nil {
+		return fmt.Errorf("failed to listen for MSP on port %d: %w", s.port, err)
+	}
+	s.conn = conn
+	s.running.Store(true)
+
+	log.Printf("OSD service listening for MSP DisplayPort on UDP port %d", s.port)
+	go s.readLoop()
+	return nil
+}
+
+func (s *OSDService) Stop() {
+	if !s.running.CompareAndSwap(true, false) {
+		return
+	}
+	s.conn.Close()
+}
+
+func (s *OSDService) readLoop() {
+	buf := make([]byte, 65535)
+	for s.running.Load() {
+		n, _, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if s.running.Load() {
+				log.Printf("OSD read error: %v", err)
+			}
+			return
+		}
+		s.Feed(buf[:n])
+	}
+}
+
+// Feed decodes raw MSP bytes and publishes any resulting grid updates
+func (s *OSDService) Feed(data []byte) {
+	for _, msg := range s.parser.Feed(data) {
+		if msg.Cmd != MSPCmdDisplayPort {
+			continue
+		}
+		if frame := s.canvas.Apply(msg.Payload); frame != nil {
+			s.frames.publish(frame)
+		}
+	}
+}
+
+// Snapshot returns the current OSD grid
+func (s *OSDService) Snapshot() *OSDFrame {
+	return s.canvas.Snapshot()
+}
+
+// HandleSnapshot serves the current OSD grid as JSON
+func (s *OSDService) HandleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Snapshot())
+}
+
+// HandleStream pushes OSD grid diffs to the browser as server-sent events.
+// The first event is always a full frame; a client that falls behind gets
+// another full frame instead of the diffs it missed.
+func (s *OSDService) HandleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := startSSE(w)
+	if !ok {
+		return
+	}
+
+	sub := s.frames.subscribe()
+	defer sub.Close()
+
+	if err := writeSSE(w, flusher, "osd", s.Snapshot()); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(sseKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case frame, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if sub.Lagged() {
+				frame = s.Snapshot()
+			}
+			if err := writeSSE(w, flusher, "osd", frame); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if err := writeSSEKeepalive(w, flusher); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func buildMSPv1(cmd byte, payload []byte) []byte {
+	frame := []byte{'$', 'M', '>', byte(len(payload)), cmd}
+	frame = append(frame, payload...)
+	var crc byte
+	for _, b := range frame[3:] {
+		crc ^= b
+	}
+	return append(frame, crc)
+}
+
+func buildMSPv2(cmd uint16, payload []byte) []byte {
+	frame := []byte{'$', 'X', '>', 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(frame[4:6], cmd)
+	binary.LittleEndian.PutUint16(frame[6:8], uint16(len(payload)))
+	frame = append(frame, payload...)
+	var crc byte
+	for _, b := range frame[3:] {
+		crc = crc8DVBS2(crc, b)
+	}
+	return append(frame, crc)
+}
+
+func TestMSPParser(t *testing.T) {
+	var p MSPParser
+
+	v1 := buildMSPv1(MSPCmdDisplayPort, []byte{mspDPHeartbeat})
+	v2 := buildMSPv2(MSPCmdDisplayPort, []byte{mspDPDrawScreen})
+
+	// Garbage, a corrupt frame, then a valid v1 frame split across two reads
+	corrupt := buildMSPv1(MSPCmdDisplayPort, []byte{1, 2, 3})
+	corrupt[len(corrupt)-1] ^= 0xFF
+
+	stream := append([]byte{0x00, 0x11}, corrupt...)
+	stream = append(stream, v1...)
+	stream = append(stream, v2...)
+
+	msgs := p.Feed(stream[:len(stream)-4])
+	msgs = append(msgs, p.Feed(stream[len(stream)-4:])...)
+
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(msgs))
+	}
+	if msgs[0].Version != 1 || msgs[0].Cmd != MSPCmdDisplayPort || msgs[0].Payload[0] != mspDPHeartbeat {
+		t.Errorf("Unexpected v1 message: %+v", msgs[0])
+	}
+	if msgs[1].Version != 2 || msgs[1].Cmd != MSPCmdDisplayPort || msgs[1].Payload[0] != mspDPDrawScreen {
+		t.Errorf("Unexpected v2 message: %+v", msgs[1])
+	}
+	if p.Errors == 0 {
+		t.Error("Expected the corrupt frame to be counted")
+	}
+}
+
+func TestOSDCanvasDiffs(t *testing.T) {
+	s := NewOSDService(0)
+	sub := s.frames.subscribe()
+	defer sub.Close()
+
+	write := func(row, col, attr byte, text string) []byte {
+		payload := append([]byte{mspDPWriteString, row, col, attr}, text...)
+		return buildMSPv1(MSPCmdDisplayPort, payload)
+	}
+	draw := buildMSPv1(MSPCmdDisplayPort, []byte{mspDPDrawScreen})
+
+	// Writes are not visible until draw_screen
+	s.Feed(write(1, 2, 0, "AB"))
+	if len(s.Snapshot().Cells) != 0 {
+		t.Fatal("Expected empty grid before draw")
+	}
+
+	s.Feed(draw)
+	frame := <-sub.C
+	if frame.Full || len(frame.Cells) != 2 {
+		t.Fatalf("Expected diff with 2 cells, got %+v", frame)
+	}
+	if frame.Cells[0] != (OSDCell{Row: 1, Col: 2, Char: 'A'}) {
+		t.Errorf("Unexpected cell %+v", frame.Cells[0])
+	}
+
+	// Clear, rewrite one cell on font page 1 and draw: only changes are sent
+	s.Feed(buildMSPv1(MSPCmdDisplayPort, []byte{mspDPClearScreen}))
+	s.Feed(write(1, 2, 1|mspDPAttrBlink, "A"))
+	s.Feed(draw)
+	frame = <-sub.C
+	if len(frame.Cells) != 2 {
+		t.Fatalf("Expected 2 changed cells, got %+v", frame.Cells)
+	}
+	if frame.Cells[0] != (OSDCell{Row: 1, Col: 2, Char: 0x100 | 'A', Blink: true}) {
+		t.Errorf("Unexpected cell %+v", frame.Cells[0])
+	}
+	if frame.Cells[1] != (OSDCell{Row: 1, Col: 3, Char: 0}) {
+		t.Errorf("Expected cleared cell, got %+v", frame.Cells[1])
+	}
+
+	// Resolution change pushes a full frame
+	s.Feed(buildMSPv1(MSPCmdDisplayPort, []byte{mspDPOptions, 0, 1}))
+	frame = <-sub.C
+	if !frame.Full || frame.Cols != 50 || frame.Rows != 18 {
+		t.Errorf("Expected full 50x18 frame, got %+v", frame)
+	}
+}
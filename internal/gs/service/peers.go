@@ -0,0 +1,190 @@
+package service
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// ntpEpochOffset is the number of seconds from 1900 (NTP) to 1970 (Unix)
+const ntpEpochOffset = 2208988800
+
+// PeerStatus describes a connected WebRTC viewer
+type PeerStatus struct {
+	ID         string    `json:"id"`
+	Sources    []string  `json:"sources"`     // Inputs the viewer receives
+	RemoteAddr string    `json:"remote_addr"` // Empty until ICE selects a pair
+	Connected  time.Time `json:"connected"`
+	ICEState   string    `json:"ice_state"`
+	// Sent on the selected candidate pair, RTCP and DTLS included
+	BytesSent   uint64  `json:"bytes_sent"`
+	PacketsSent uint32  `json:"packets_sent"`
+	NACKs       uint64  `json:"nacks"`
+	PLIs        uint64  `json:"plis"`
+	RTTMs       float64 `json:"rtt_ms"` // From the last receiver report, 0 until one arrives
+}
+
+// WithMaxPeers limits the number of WebRTC viewers, 0 for no limit. The
+// limit is shared with the inputs created from this server.
+func (s *StreamServer) WithMaxPeers(max int) *StreamServer {
+	s.viewers.max = max
+	return s
+}
+
+// viewerLimit counts the viewers of every input together. A viewer
+// receiving several inputs on one connection counts once.
+type viewerLimit struct {
+	mu      sync.Mutex
+	max     int
+	viewers map[string]int // Peer ID to the inputs it receives
+}
+
+// acquire counts a peer in, reporting false when the limit is reached
+func (l *viewerLimit) acquire(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.viewers[id] == 0 && l.max > 0 && len(l.viewers) >= l.max {
+		return false
+	}
+	l.viewers[id]++
+	return true
+}
+
+func (l *viewerLimit) release(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.viewers[id] <= 1 {
+		delete(l.viewers, id)
+	} else {
+		l.viewers[id]--
+	}
+}
+
+// Peers returns the connected WebRTC viewers, oldest first
+func (s *StreamServer) Peers() []PeerStatus {
+	s.peersMu.RLock()
+	peers := make([]PeerStatus, 0, len(s.peers))
+	for id, peer := range s.peers {
+		peers = append(peers, peer.status(id))
+	}
+	s.peersMu.RUnlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Connected.Before(peers[j].Connected)
+	})
+	return peers
+}
+
+func (p *streamPeer) status(id string) PeerStatus {
+	status := PeerStatus{
+		ID:        id,
+		Sources:   []string{p.source},
+		Connected: p.connected,
+		ICEState:  p.pc.ICEConnectionState().String(),
+		NACKs:     p.nacks.Load(),
+		PLIs:      p.plis.Load(),
+		RTTMs:     float64(p.rtt.Load()) / float64(time.Millisecond),
+	}
+	if transport := p.sender.Transport(); transport != nil {
+		ice := transport.ICETransport()
+		if pair, err := ice.GetSelectedCandidatePair(); err == nil && pair != nil {
+			status.RemoteAddr = net.JoinHostPort(pair.Remote.Address, strconv.Itoa(int(pair.Remote.Port)))
+		}
+		if stats, ok := ice.GetSelectedCandidatePairStats(); ok {
+			status.BytesSent = stats.BytesSent
+			status.PacketsSent = stats.PacketsSent
+		}
+	}
+	return status
+}
+
+// observeRTCP counts the feedback a peer sends and asks the air unit for a
+// keyframe when the peer lost the picture
+func (p *streamPeer) observeRTCP(s *StreamServer, packets []rtcp.Packet) {
+	for _, pkt := range packets {
+		switch pkt := pkt.(type) {
+		case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+			p.plis.Add(1)
+			s.RequestKeyframe("picture loss reported by peer")
+		case *rtcp.TransportLayerNack:
+			p.nacks.Add(1)
+		case *rtcp.ReceiverReport:
+			for _, report := range pkt.Reports {
+				if rtt, ok := reportRTT(report, time.Now()); ok {
+					p.rtt.Store(int64(rtt))
+				}
+			}
+		}
+	}
+}
+
+// reportRTT computes the round trip time from a reception report: the time
+// since the sender report it echoes, minus how long the peer held it
+// (RFC 3550 section 6.4.1)
+func reportRTT(report rtcp.ReceptionReport, now time.Time) (time.Duration, bool) {
+	if report.LastSenderReport == 0 {
+		return 0, false
+	}
+	rtt := ntpShort(now) - report.LastSenderReport - report.Delay
+	// A negative round trip wraps around, and can't be right
+	if rtt > 1<<31 {
+		return 0, false
+	}
+	return time.Duration(rtt) * time.Second / 65536, true
+}
+
+// ntpShort returns the middle 32 bits of the NTP timestamp of t, in
+// 1/65536 seconds
+func ntpShort(t time.Time) uint32 {
+	seconds := uint64(t.Unix()) + ntpEpochOffset
+	fraction := uint64(t.Nanosecond()) << 16 / uint64(time.Second)
+	return uint32(seconds<<16 | fraction)
+}
+
+// HandlePeers serves GET /api/v1/stream/peers
+func (s *StreamServer) HandlePeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Peers())
+}
+
+// HandlePeer serves GET and DELETE /api/v1/stream/peers/{id}. DELETE
+// disconnects the viewer.
+func (s *StreamServer) HandlePeer(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		s.peersMu.RLock()
+		peer, ok := s.peers[id]
+		var status PeerStatus
+		if ok {
+			status = peer.status(id)
+		}
+		s.peersMu.RUnlock()
+		if !ok {
+			http.Error(w, "Peer not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	case http.MethodDelete:
+		if !s.closePeer(id) {
+			http.Error(w, "Peer not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// errTooManyPeers rejects viewers beyond the configured maximum
+var errTooManyPeers = &signalingError{http.StatusServiceUnavailable, "Too many viewers, try again later"}
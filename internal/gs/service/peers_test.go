@@ -0,0 +1,86 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestReportRTT(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	sent := now.Add(-150 * time.Millisecond)
+	report := rtcp.ReceptionReport{
+		LastSenderReport: ntpShort(sent),
+		Delay:            uint32(100 * time.Millisecond * 65536 / time.Second),
+	}
+	rtt, ok := reportRTT(report, now)
+	if !ok || rtt < 49*time.Millisecond || rtt > 51*time.Millisecond {
+		t.Errorf("Expected a 50ms round trip, got %v", rtt)
+	}
+	if _, ok := reportRTT(rtcp.ReceptionReport{}, now); ok {
+		t.Error("Expected no round trip without a sender report")
+	}
+	// Held longer than the time since the sender report
+	report.Delay *= 2
+	if _, ok := reportRTT(report, now); ok {
+		t.Error("Expected a negative round trip to be ignored")
+	}
+}
+
+// testOffer returns a recvonly video offer from a new client peer connection
+func testOffer(t *testing.T) webrtc.SessionDescription {
+	t.Helper()
+	return testMultiOffer(t, 1)
+}
+
+func TestPeers(t *testing.T) {
+	s := NewStreamServer(0).WithMaxPeers(1)
+	if err := s.setCodec(CodecH264, "test"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	id, _, err := s.answerOffer(testOffer(t), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var se *signalingError
+	if _, _, err := s.answerOffer(testOffer(t), time.Second); !errors.As(err, &se) || se.status != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 beyond the maximum, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.HandlePeers(rec, httptest.NewRequest(http.MethodGet, "/api/v1/stream/peers", nil))
+	var peers []PeerStatus
+	if err := json.NewDecoder(rec.Body).Decode(&peers); err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].ID != id || peers[0].ICEState == "" || peers[0].Connected.IsZero() {
+		t.Errorf("Unexpected peers %+v", peers)
+	}
+
+	peer := func(method string) int {
+		rec := httptest.NewRecorder()
+		s.HandlePeer(rec, httptest.NewRequest(method, "/api/v1/stream/peers/"+id, nil), id)
+		return rec.Code
+	}
+	if code := peer(http.MethodGet); code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", code)
+	}
+	if code := peer(http.MethodDelete); code != http.StatusNoContent || s.PeerCount() != 0 {
+		t.Errorf("Expected the peer to be kicked, got %d with %d peers", code, s.PeerCount())
+	}
+	if code := peer(http.MethodDelete); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a kicked peer, got %d", code)
+	}
+	// The slot is free again
+	if _, _, err := s.answerOffer(testOffer(t), time.Second); err != nil {
+		t.Errorf("Expected a viewer after the kick, got %v", err)
+	}
+}
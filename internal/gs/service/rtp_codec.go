@@ -0,0 +1,192 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gilankpam/openipc-gs-web/internal/models"
+	"github.com/pion/webrtc/v4"
+)
+
+// Video codecs, named as in the air unit's video settings
+const (
+	CodecH264 = "h264"
+	CodecH265 = "h265"
+)
+
+const (
+	// codecDetectWindow is how many packets that only fit one codec are
+	// counted before deciding
+	codecDetectWindow = 64
+	// codecDetectShare is the share of a window a codec needs to win
+	codecDetectShare = 0.9
+)
+
+// codecMimeType returns the WebRTC MIME type of a codec
+func codecMimeType(codec string) string {
+	if codec == CodecH264 {
+		return webrtc.MimeTypeH264
+	}
+	return webrtc.MimeTypeH265
+}
+
+// newDepacketizer returns a depacketizer for a codec
+func newDepacketizer(codec string) rtpDepacketizer {
+	if codec == CodecH264 {
+		return NewH264Depacketizer()
+	}
+	return NewH265Depacketizer()
+}
+
+// normalizeCodec maps codec names used by majestic and SDP to CodecH264/CodecH265
+func normalizeCodec(name string) string {
+	switch strings.ToLower(name) {
+	case "h264", "avc":
+		return CodecH264
+	case "h265", "hevc":
+		return CodecH265
+	}
+	return ""
+}
+
+// codecDetector guesses the codec of an RTP stream from its payload headers.
+// Both codecs use a dynamic payload type, so the NAL unit header of each
+// packet is checked against what each codec allows. Many headers are valid
+// for both; only packets that fit a single codec are counted.
+type codecDetector struct {
+	h264, h265 int
+}
+
+// Observe counts a packet and returns the detected codec when a window of
+// packets is decisive, "" otherwise
+func (d *codecDetector) Observe(payload []byte) string {
+	is264, is265 := plausibleH264(payload), plausibleH265(payload)
+	switch {
+	case is264 && !is265:
+		d.h264++
+	case is265 && !is264:
+		d.h265++
+	default:
+		return ""
+	}
+
+	if d.h264+d.h265 < codecDetectWindow {
+		return ""
+	}
+	codec := ""
+	if float64(d.h264) >= codecDetectShare*codecDetectWindow {
+		codec = CodecH264
+	} else if float64(d.h265) >= codecDetectShare*codecDetectWindow {
+		codec = CodecH265
+	}
+	d.h264, d.h265 = 0, 0
+	return codec
+}
+
+// plausibleH264 reports whether payload starts with an H.264 NAL unit or
+// packetization header that a camera would send
+func plausibleH264(payload []byte) bool {
+	if len(payload) < 2 || payload[0]&0x80 != 0 {
+		return false
+	}
+	switch h264NALUType(payload) {
+	case 1, h264NALUIDR, 6, 7, 8, 9, h264NALUSTAPA:
+		return true
+	case h264NALUFUA:
+		// The fragment must carry a regular NAL unit type
+		t := payload[1] & 0x1f
+		return t >= 1 && t <= 23 && payload[1]&0xc0 != 0xc0
+	}
+	return false
+}
+
+// plausibleH265 reports whether payload starts with an H.265 NAL unit or
+// packetization header that a camera would send
+func plausibleH265(payload []byte) bool {
+	if len(payload) < 3 || payload[0]&0x80 != 0 {
+		return false
+	}
+	// Base layer only, temporal id plus one is never zero
+	layerID := (payload[0]&0x01)<<5 | payload[1]>>3
+	if layerID != 0 || payload[1]&0x07 == 0 {
+		return false
+	}
+	switch t := h265NALUType(payload); {
+	case t <= 9, t >= h265NALUIRAPFirst && t <= h265NALUIRAPLast, t >= 32 && t <= 40, t == h265NALUAP:
+		return true
+	case t == h265NALUFU:
+		ft := payload[2] & 0x3f
+		return ft <= 40 && payload[2]&0xc0 != 0xc0
+	}
+	return false
+}
+
+// offerSupportsCodec reports whether a browser's SDP offer can receive a codec
+func offerSupportsCodec(offer webrtc.SessionDescription, codec string) (bool, error) {
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return false, err
+	}
+	encoding := strings.ToUpper(codec) + "/"
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != "video" {
+			continue
+		}
+		for _, attr := range media.Attributes {
+			if attr.Key != "rtpmap" {
+				continue
+			}
+			// rtpmap:<payload type> <encoding>/<clock rate>
+			if fields := strings.Fields(attr.Value); len(fields) == 2 && strings.HasPrefix(strings.ToUpper(fields[1]), encoding) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// AirUnitVideoSettingsSource returns a function reading the air unit's
+// video settings through transport (nil for http.DefaultTransport), e.g. the
+// air unit proxy's instrumented transport
+func AirUnitVideoSettingsSource(airUnitURL string, transport http.RoundTripper) func() (*models.VideoSettings, error) {
+	client := &http.Client{Timeout: 3 * time.Second, Transport: transport}
+	return func() (*models.VideoSettings, error) {
+		resp, err := client.Get(strings.TrimSuffix(airUnitURL, "/") + "/api/v1/video")
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("air unit returned %d", resp.StatusCode)
+		}
+
+		var settings models.VideoSettings
+		if err := json.NewDecoder(resp.Body).Decode(&settings); err != nil {
+			return nil, err
+		}
+		return &settings, nil
+	}
+}
+
+// AirUnitCodecSource returns a function reading the configured video codec
+// from the air unit's video settings
+func AirUnitCodecSource(airUnitURL string, transport http.RoundTripper) func() (string, error) {
+	videoSettings := AirUnitVideoSettingsSource(airUnitURL, transport)
+	return func() (string, error) {
+		settings, err := videoSettings()
+		if err != nil {
+			return "", err
+		}
+		if settings.Codec == nil {
+			return "", fmt.Errorf("air unit reported no codec")
+		}
+		codec := normalizeCodec(*settings.Codec)
+		if codec == "" {
+			return "", fmt.Errorf("unsupported codec %q", *settings.Codec)
+		}
+		return codec, nil
+	}
+}
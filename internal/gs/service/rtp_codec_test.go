@@ -0,0 +1,92 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestCodecDetector(t *testing.T) {
+	h264Packets := [][]byte{
+		{0x7c, 0x85, 0x88}, // FU-A start of IDR
+		{0x7c, 0x05, 0x12}, // FU-A middle
+		{0x5c, 0x41, 0x9a}, // FU-A end of P slice
+		{0x41, 0x9a, 0x02}, // P slice
+		{0x78, 0x00, 0x04}, // STAP-A
+	}
+	h265Packets := [][]byte{
+		{0x62, 0x01, 0x93}, // FU start of IDR_W_RADL
+		{0x62, 0x01, 0x13}, // FU middle
+		{0x62, 0x01, 0x41}, // FU end of TRAIL_R
+		{0x02, 0x01, 0xd0}, // TRAIL_R
+		{0x60, 0x01, 0x00}, // AP
+	}
+
+	detect := func(packets [][]byte) string {
+		var d codecDetector
+		for i := 0; i < 200; i++ {
+			if codec := d.Observe(packets[i%len(packets)]); codec != "" {
+				return codec
+			}
+		}
+		return ""
+	}
+	if codec := detect(h264Packets); codec != CodecH264 {
+		t.Errorf("Expected h264, got %q", codec)
+	}
+	if codec := detect(h265Packets); codec != CodecH265 {
+		t.Errorf("Expected h265, got %q", codec)
+	}
+
+	// Mixed garbage never decides
+	if codec := detect([][]byte{h264Packets[0], h265Packets[0]}); codec != "" {
+		t.Errorf("Expected no decision, got %q", codec)
+	}
+}
+
+func TestOfferSupportsCodec(t *testing.T) {
+	sdp := "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96 102\r\nc=IN IP4 0.0.0.0\r\n" +
+		"a=rtpmap:96 VP8/90000\r\na=rtpmap:102 H264/90000\r\n"
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}
+
+	if ok, err := offerSupportsCodec(offer, CodecH264); err != nil || !ok {
+		t.Errorf("Expected H264 support, got %v %v", ok, err)
+	}
+	if ok, _ := offerSupportsCodec(offer, CodecH265); ok {
+		t.Error("Expected no H265 support")
+	}
+}
+
+func TestStreamServerRejectsUnsupportedCodec(t *testing.T) {
+	s := NewStreamServer(0)
+	if err := s.setCodec(CodecH265, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"offer":{"type":"offer","sdp":"v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\nm=video 9 UDP/TLS/RTP/SAVPF 102\r\nc=IN IP4 0.0.0.0\r\na=rtpmap:102 H264/90000\r\n"}}`
+	rec := httptest.NewRecorder()
+	s.HandleSignaling(rec, httptest.NewRequest(http.MethodPost, "/api/v1/stream/offer", strings.NewReader(body)))
+	if rec.Code != http.StatusNotAcceptable {
+		t.Errorf("Expected 406, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestAirUnitCodecSource(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/video" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"codec":"h264","fps":60}`))
+	}))
+	defer srv.Close()
+
+	codec, err := AirUnitCodecSource(srv.URL+"/", nil)()
+	if err != nil || codec != CodecH264 {
+		t.Errorf("Expected h264, got %q %v", codec, err)
+	}
+}
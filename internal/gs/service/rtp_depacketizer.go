@@ -0,0 +1,84 @@
+package service
+
+// AccessUnit is a coded video frame reassembled from RTP packets
+type AccessUnit struct {
+	Timestamp uint32
+	NALUs     [][]byte
+	Keyframe  bool
+	// Complete is false when packets of the frame were lost
+	Complete bool
+}
+
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// AnnexB returns the frame as an Annex-B byte stream
+func (au *AccessUnit) AnnexB() []byte {
+	size := 0
+	for _, nalu := range au.NALUs {
+		size += len(annexBStartCode) + len(nalu)
+	}
+	out := make([]byte, 0, size)
+	for _, nalu := range au.NALUs {
+		out = append(out, annexBStartCode...)
+		out = append(out, nalu...)
+	}
+	return out
+}
+
+// rtpDepacketizer turns RTP packets of one codec, in sequence order, into
+// access units
+type rtpDepacketizer interface {
+	Push(pkt orderedPacket) []*AccessUnit
+}
+
+// auAssembler groups NAL units into access units. A frame ends on the RTP
+// marker bit, or when the timestamp changes if the sender didn't set it.
+type auAssembler struct {
+	cur        *AccessUnit
+	isKeyframe func(nalu []byte) bool
+}
+
+// begin starts or continues the access unit of a packet. gap reports lost
+// packets before it; they could belong to either frame, so both are marked
+// incomplete.
+func (a *auAssembler) begin(ts uint32, gap bool) *AccessUnit {
+	var done *AccessUnit
+	if a.cur != nil && a.cur.Timestamp != ts {
+		if gap {
+			a.cur.Complete = false
+		}
+		done = a.finish()
+	}
+	if a.cur == nil {
+		a.cur = &AccessUnit{Timestamp: ts, Complete: !gap}
+	} else if gap {
+		a.cur.Complete = false
+	}
+	return done
+}
+
+func (a *auAssembler) add(nalu []byte) {
+	if len(nalu) == 0 {
+		return
+	}
+	a.cur.NALUs = append(a.cur.NALUs, nalu)
+	if a.isKeyframe(nalu) {
+		a.cur.Keyframe = true
+	}
+}
+
+func (a *auAssembler) markIncomplete() {
+	if a.cur != nil {
+		a.cur.Complete = false
+	}
+}
+
+// finish returns the current access unit, or nil if it has no NAL units
+func (a *auAssembler) finish() *AccessUnit {
+	au := a.cur
+	a.cur = nil
+	if au == nil || len(au.NALUs) == 0 {
+		return nil
+	}
+	return au
+}
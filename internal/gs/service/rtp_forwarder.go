@@ -0,0 +1,202 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// rtpForwardMTU is the largest RTP packet sent to peers, leaving room for
+// SRTP, UDP and IP headers (the same size pion packetizes samples to)
+const rtpForwardMTU = 1200
+
+// rtpForwarder sends received RTP packets to a single peer. The peer's
+// track rewrites SSRC and payload type to what the peer negotiated;
+// sequence numbers start at a random offset and stay contiguous when
+// packets are split to fit the MTU. Timestamps are passed through.
+type rtpForwarder struct {
+	track     *webrtc.TrackLocalStaticRTP
+	codec     string
+	seqOffset uint16
+}
+
+func newRTPForwarder(codec, streamID string) (*rtpForwarder, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: codecMimeType(codec)},
+		"video",
+		streamID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var b [2]byte
+	rand.Read(b[:])
+	return &rtpForwarder{
+		track:     track,
+		codec:     codec,
+		seqOffset: binary.BigEndian.Uint16(b[:]),
+	}, nil
+}
+
+// Forward writes a packet to the peer, split if it exceeds the MTU. pkt is
+// shared with the other peers and left unchanged.
+func (f *rtpForwarder) Forward(pkt *rtp.Packet) error {
+	packets := splitRTPPacket(pkt, f.codec, rtpForwardMTU-pkt.Header.MarshalSize())
+	for i, p := range packets {
+		header := p.Header
+		header.SequenceNumber = pkt.SequenceNumber + f.seqOffset + uint16(i)
+		if err := f.track.WriteRTP(&rtp.Packet{Header: header, Payload: p.Payload}); err != nil {
+			return err
+		}
+	}
+	// Later packets move up by the extra packets sent
+	f.seqOffset += uint16(len(packets) - 1)
+	return nil
+}
+
+// Inject sends NAL units ahead of pkt, one per packet with its timestamp.
+// Later packets move up by the packets inserted.
+func (f *rtpForwarder) Inject(pkt *rtp.Packet, nalus [][]byte) error {
+	for i, nalu := range nalus {
+		header := pkt.Header
+		header.Marker = false
+		header.SequenceNumber = pkt.SequenceNumber + f.seqOffset + uint16(i)
+		if err := f.track.WriteRTP(&rtp.Packet{Header: header, Payload: nalu}); err != nil {
+			return err
+		}
+	}
+	f.seqOffset += uint16(len(nalus))
+	return nil
+}
+
+// splitRTPPacket fragments a packet whose payload is larger than
+// maxPayload. Aggregation packets are split into their NAL units and large
+// NAL units into fragmentation units. Only the last packet keeps the marker.
+func splitRTPPacket(pkt *rtp.Packet, codec string, maxPayload int) []*rtp.Packet {
+	if len(pkt.Payload) <= maxPayload || len(pkt.Payload) == 0 {
+		return []*rtp.Packet{pkt}
+	}
+
+	var payloads [][]byte
+	if codec == CodecH264 {
+		payloads = splitH264Payload(pkt.Payload, maxPayload)
+	} else {
+		payloads = splitH265Payload(pkt.Payload, maxPayload)
+	}
+	if len(payloads) == 0 {
+		return []*rtp.Packet{pkt}
+	}
+
+	packets := make([]*rtp.Packet, len(payloads))
+	for i, payload := range payloads {
+		header := pkt.Header
+		header.Marker = pkt.Marker && i == len(payloads)-1
+		packets[i] = &rtp.Packet{Header: header, Payload: payload}
+	}
+	return packets
+}
+
+// splitAggregation returns the NAL units of an aggregation packet, skipping
+// the header of hdrSize bytes
+func splitAggregation(payload []byte, hdrSize int) [][]byte {
+	var nalus [][]byte
+	payload = payload[hdrSize:]
+	for len(payload) >= 2 {
+		size := int(binary.BigEndian.Uint16(payload))
+		payload = payload[2:]
+		if size > len(payload) {
+			break
+		}
+		nalus = append(nalus, payload[:size])
+		payload = payload[size:]
+	}
+	return nalus
+}
+
+// fragment splits data into FU payloads of at most maxPayload bytes, each
+// starting with header followed by the FU header. first and last control
+// whether the start and end bits may be set.
+func fragment(header []byte, fuType byte, data []byte, maxPayload int, first, last bool) [][]byte {
+	chunk := maxPayload - len(header) - 1
+	if chunk <= 0 {
+		return nil
+	}
+	var payloads [][]byte
+	for offset := 0; offset < len(data); offset += chunk {
+		end := min(offset+chunk, len(data))
+		fuHeader := fuType
+		if first && offset == 0 {
+			fuHeader |= 0x80
+		}
+		if last && end == len(data) {
+			fuHeader |= 0x40
+		}
+		payload := make([]byte, 0, len(header)+1+end-offset)
+		payload = append(payload, header...)
+		payload = append(payload, fuHeader)
+		payload = append(payload, data[offset:end]...)
+		payloads = append(payloads, payload)
+	}
+	return payloads
+}
+
+func splitH265Payload(payload []byte, maxPayload int) [][]byte {
+	if len(payload) < h265NALUHeaderSize+h265FUHeaderSize {
+		return nil
+	}
+	switch h265NALUType(payload) {
+	case h265NALUFU:
+		fuHeader := payload[h265NALUHeaderSize]
+		return fragment(payload[:h265NALUHeaderSize], fuHeader&0x3f,
+			payload[h265NALUHeaderSize+h265FUHeaderSize:], maxPayload, fuHeader&0x80 != 0, fuHeader&0x40 != 0)
+	case h265NALUAP:
+		var payloads [][]byte
+		for _, nalu := range splitAggregation(payload, h265NALUHeaderSize) {
+			payloads = append(payloads, splitH265NALU(nalu, maxPayload)...)
+		}
+		return payloads
+	}
+	return splitH265NALU(payload, maxPayload)
+}
+
+// splitH265NALU sends a NAL unit as is or as fragmentation units
+func splitH265NALU(nalu []byte, maxPayload int) [][]byte {
+	if len(nalu) <= maxPayload {
+		return [][]byte{nalu}
+	}
+	if len(nalu) < h265NALUHeaderSize {
+		return nil
+	}
+	header := []byte{(nalu[0] & 0x81) | (h265NALUFU << 1), nalu[1]}
+	return fragment(header, h265NALUType(nalu), nalu[h265NALUHeaderSize:], maxPayload, true, true)
+}
+
+func splitH264Payload(payload []byte, maxPayload int) [][]byte {
+	if len(payload) < h264NALUHeaderSize+h264FUHeaderSize {
+		return nil
+	}
+	switch h264NALUType(payload) {
+	case h264NALUFUA:
+		fuHeader := payload[h264NALUHeaderSize]
+		return fragment(payload[:h264NALUHeaderSize], fuHeader&0x1f,
+			payload[h264NALUHeaderSize+h264FUHeaderSize:], maxPayload, fuHeader&0x80 != 0, fuHeader&0x40 != 0)
+	case h264NALUSTAPA:
+		var payloads [][]byte
+		for _, nalu := range splitAggregation(payload, h264NALUHeaderSize) {
+			payloads = append(payloads, splitH264NALU(nalu, maxPayload)...)
+		}
+		return payloads
+	}
+	return splitH264NALU(payload, maxPayload)
+}
+
+// splitH264NALU sends a NAL unit as is or as FU-As
+func splitH264NALU(nalu []byte, maxPayload int) [][]byte {
+	if len(nalu) <= maxPayload {
+		return [][]byte{nalu}
+	}
+	header := []byte{(nalu[0] & 0xe0) | h264NALUFUA}
+	return fragment(header, h264NALUType(nalu), nalu[h264NALUHeaderSize:], maxPayload, true, true)
+}
@@ -0,0 +1,194 @@
+package service
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// depacketizeSplit runs split packets through a depacketizer and returns
+// the single frame they make up
+func depacketizeSplit(t *testing.T, d rtpDepacketizer, packets []*rtp.Packet, maxPayload int) *AccessUnit {
+	t.Helper()
+	var frames []*AccessUnit
+	for i, p := range packets {
+		if len(p.Payload) > maxPayload {
+			t.Errorf("Packet %d has %d byte payload, limit %d", i, len(p.Payload), maxPayload)
+		}
+		if p.Marker != (i == len(packets)-1) {
+			t.Errorf("Packet %d of %d has marker %v", i, len(packets), p.Marker)
+		}
+		frames = append(frames, d.Push(orderedPacket{Packet: p})...)
+	}
+	if len(frames) != 1 || !frames[0].Complete {
+		t.Fatalf("Expected one complete frame, got %+v", frames)
+	}
+	return frames[0]
+}
+
+func TestSplitRTPPacketH265(t *testing.T) {
+	idr := []byte{19 << 1, 1}
+	for i := 0; i < 50; i++ {
+		idr = append(idr, byte(i))
+	}
+	header := rtp.Header{SequenceNumber: 10, Timestamp: 3000, Marker: true}
+
+	// Single NAL unit into FUs
+	packets := splitRTPPacket(&rtp.Packet{Header: header, Payload: idr}, CodecH265, 20)
+	if len(packets) < 3 {
+		t.Fatalf("Expected the NAL unit to be fragmented, got %d packets", len(packets))
+	}
+	au := depacketizeSplit(t, NewH265Depacketizer(), packets, 20)
+	if len(au.NALUs) != 1 || !bytes.Equal(au.NALUs[0], idr) || !au.Keyframe {
+		t.Errorf("Unexpected frame %+v", au)
+	}
+
+	// AP with a small and a large NAL unit
+	vps := []byte{32 << 1, 1, 0xaa}
+	ap := []byte{48 << 1, 1, 0, byte(len(vps))}
+	ap = append(ap, vps...)
+	ap = append(ap, 0, byte(len(idr)))
+	ap = append(ap, idr...)
+	packets = splitRTPPacket(&rtp.Packet{Header: header, Payload: ap}, CodecH265, 20)
+	au = depacketizeSplit(t, NewH265Depacketizer(), packets, 20)
+	if len(au.NALUs) != 2 || !bytes.Equal(au.NALUs[0], vps) || !bytes.Equal(au.NALUs[1], idr) {
+		t.Errorf("Unexpected NAL units %x", au.NALUs)
+	}
+
+	// A middle FU keeps neither start nor end bit
+	fu := append([]byte{49 << 1, 1, 19}, idr[2:]...)
+	packets = splitRTPPacket(&rtp.Packet{Header: header, Payload: fu}, CodecH265, 20)
+	for i, p := range packets {
+		if p.Payload[2]&0xc0 != 0 || p.Payload[2]&0x3f != 19 {
+			t.Errorf("Packet %d has FU header %#x", i, p.Payload[2])
+		}
+	}
+}
+
+func TestSplitRTPPacketH264(t *testing.T) {
+	idr := []byte{0x65}
+	for i := 0; i < 50; i++ {
+		idr = append(idr, byte(i))
+	}
+	sps := []byte{0x67, 0x42, 0x00, 0x1f}
+	header := rtp.Header{SequenceNumber: 10, Timestamp: 3000, Marker: true}
+
+	stapA := []byte{0x78, 0, byte(len(sps))}
+	stapA = append(stapA, sps...)
+	stapA = append(stapA, 0, byte(len(idr)))
+	stapA = append(stapA, idr...)
+	packets := splitRTPPacket(&rtp.Packet{Header: header, Payload: stapA}, CodecH264, 20)
+	au := depacketizeSplit(t, NewH264Depacketizer(), packets, 20)
+	if len(au.NALUs) != 2 || !bytes.Equal(au.NALUs[0], sps) || !bytes.Equal(au.NALUs[1], idr) || !au.Keyframe {
+		t.Errorf("Unexpected frame %+v", au)
+	}
+
+	// Small packets are passed through as is
+	small := &rtp.Packet{Header: header, Payload: sps}
+	if packets := splitRTPPacket(small, CodecH264, 20); len(packets) != 1 || packets[0] != small {
+		t.Errorf("Expected the packet unchanged, got %+v", packets)
+	}
+}
+
+func TestRTPForwarderSequence(t *testing.T) {
+	f, err := newRTPForwarder(CodecH265, defaultStreamID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.seqOffset = 100
+
+	large := append([]byte{19 << 1, 1}, make([]byte, 2*rtpForwardMTU)...)
+	if err := f.Forward(&rtp.Packet{Header: rtp.Header{SequenceNumber: 1}, Payload: large}); err != nil {
+		t.Fatal(err)
+	}
+	// Split into three packets, so later sequence numbers move up by two
+	if f.seqOffset != 102 {
+		t.Errorf("Expected offset 102, got %d", f.seqOffset)
+	}
+
+	if err := f.Forward(&rtp.Packet{Header: rtp.Header{SequenceNumber: 2}, Payload: []byte{1 << 1, 1, 0}}); err != nil {
+		t.Fatal(err)
+	}
+	if f.seqOffset != 102 {
+		t.Errorf("Expected offset to stay 102, got %d", f.seqOffset)
+	}
+}
+
+func TestRTPForwarderInject(t *testing.T) {
+	f, err := newRTPForwarder(CodecH264, defaultStreamID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.seqOffset = 10
+
+	pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: 5}, Payload: []byte{0x65, 0x88}}
+	if err := f.Inject(pkt, [][]byte{{0x67, 0x42}, {0x68, 0xce}}); err != nil {
+		t.Fatal(err)
+	}
+	// The keyframe follows the two injected packets
+	if f.seqOffset != 12 {
+		t.Errorf("Expected offset 12, got %d", f.seqOffset)
+	}
+}
+
+// recordingTrackContext binds a forwarder's track without a peer connection
+// and records the sequence numbers written to it
+type recordingTrackContext struct {
+	webrtc.TrackLocalContext
+	seqs []uint16
+}
+
+func (c *recordingTrackContext) CodecParameters() []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000},
+		PayloadType:        96,
+	}}
+}
+func (c *recordingTrackContext) SSRC() webrtc.SSRC                       { return 1 }
+func (c *recordingTrackContext) SSRCRetransmission() webrtc.SSRC         { return 0 }
+func (c *recordingTrackContext) SSRCForwardErrorCorrection() webrtc.SSRC { return 0 }
+func (c *recordingTrackContext) ID() string                              { return "test" }
+func (c *recordingTrackContext) WriteStream() webrtc.TrackLocalWriter    { return c }
+func (c *recordingTrackContext) Write(b []byte) (int, error)             { return len(b), nil }
+func (c *recordingTrackContext) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	c.seqs = append(c.seqs, header.SequenceNumber)
+	return len(payload), nil
+}
+
+func TestRTPForwarderPeers(t *testing.T) {
+	var peers []*rtpForwarder
+	var written []*recordingTrackContext
+	for _, offset := range []uint16{10, 1000} {
+		f, err := newRTPForwarder(CodecH264, defaultStreamID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.seqOffset = offset
+		ctx := &recordingTrackContext{}
+		if _, err := f.track.Bind(ctx); err != nil {
+			t.Fatal(err)
+		}
+		peers = append(peers, f)
+		written = append(written, ctx)
+	}
+
+	// The same packet goes to every peer
+	for seq := uint16(100); seq < 102; seq++ {
+		pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: seq}, Payload: []byte{0x65, 0x88}}
+		for _, f := range peers {
+			if err := f.Forward(pkt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if pkt.SequenceNumber != seq {
+			t.Errorf("Expected the packet left at %d, got %d", seq, pkt.SequenceNumber)
+		}
+	}
+	for i, expected := range [][]uint16{{110, 111}, {1100, 1101}} {
+		if got := written[i].seqs; len(got) != 2 || got[0] != expected[0] || got[1] != expected[1] {
+			t.Errorf("Peer %d: expected sequence numbers %v, got %v", i, expected, got)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package service
+
+import "encoding/binary"
+
+// H.264 NAL unit types (ITU-T H.264 table 7-1, RFC 6184)
+const (
+	h264NALUIDR   = 5
+	h264NALUSTAPA = 24
+	h264NALUFUA   = 28
+
+	h264NALUHeaderSize = 1
+	h264FUHeaderSize   = 1
+)
+
+func h264NALUType(nalu []byte) byte {
+	return nalu[0] & 0x1f
+}
+
+func h264IsKeyframe(nalu []byte) bool {
+	return h264NALUType(nalu) == h264NALUIDR
+}
+
+// H264Depacketizer reassembles H.264 access units from RTP packets as
+// described in RFC 6184: single NAL unit packets, STAP-A and FU-A.
+// Interleaved mode (STAP-B, MTAP, FU-B) isn't supported.
+type H264Depacketizer struct {
+	au auAssembler
+	fu []byte // fragmented NAL unit being reassembled
+}
+
+func NewH264Depacketizer() *H264Depacketizer {
+	return &H264Depacketizer{au: auAssembler{isKeyframe: h264IsKeyframe}}
+}
+
+// Push adds the next packet in sequence order and returns finished frames
+func (d *H264Depacketizer) Push(pkt orderedPacket) []*AccessUnit {
+	var out []*AccessUnit
+	if pkt.Gap && d.fu != nil {
+		d.fu = nil
+	}
+	if done := d.au.begin(pkt.Timestamp, pkt.Gap); done != nil {
+		out = append(out, done)
+	}
+
+	payload := pkt.Payload
+	if len(payload) < h264NALUHeaderSize {
+		d.au.markIncomplete()
+	} else {
+		switch t := h264NALUType(payload); {
+		case t == h264NALUSTAPA:
+			d.aggregation(payload)
+		case t == h264NALUFUA:
+			d.fragment(payload)
+		case t >= 1 && t <= 23:
+			d.au.add(payload)
+		default:
+			d.au.markIncomplete()
+		}
+	}
+
+	if pkt.Marker {
+		if d.fu != nil {
+			// The frame ended in the middle of a fragmented NAL unit
+			d.fu = nil
+			d.au.markIncomplete()
+		}
+		if done := d.au.finish(); done != nil {
+			out = append(out, done)
+		}
+	}
+	return out
+}
+
+// aggregation splits a STAP-A into its NAL units, each prefixed by a 16-bit size
+func (d *H264Depacketizer) aggregation(payload []byte) {
+	payload = payload[h264NALUHeaderSize:]
+	for len(payload) > 0 {
+		if len(payload) < 2 {
+			d.au.markIncomplete()
+			return
+		}
+		size := int(binary.BigEndian.Uint16(payload))
+		payload = payload[2:]
+		if size > len(payload) {
+			d.au.markIncomplete()
+			return
+		}
+		d.au.add(payload[:size])
+		payload = payload[size:]
+	}
+}
+
+// fragment reassembles a NAL unit split across FU-As
+func (d *H264Depacketizer) fragment(payload []byte) {
+	if len(payload) < h264NALUHeaderSize+h264FUHeaderSize {
+		d.au.markIncomplete()
+		return
+	}
+	fuHeader := payload[h264NALUHeaderSize]
+	start := fuHeader&0x80 != 0
+	end := fuHeader&0x40 != 0
+	data := payload[h264NALUHeaderSize+h264FUHeaderSize:]
+
+	if start {
+		if d.fu != nil {
+			// Previous fragmented NAL unit never ended
+			d.au.markIncomplete()
+		}
+		// Rebuild the NAL unit header from the FU indicator's NRI and the original type
+		d.fu = []byte{(payload[0] & 0xe0) | (fuHeader & 0x1f)}
+	} else if d.fu == nil {
+		// Lost the start of this NAL unit
+		d.au.markIncomplete()
+		return
+	}
+
+	d.fu = append(d.fu, data...)
+	if end {
+		d.au.add(d.fu)
+		d.fu = nil
+	}
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestH264Depacketizer(t *testing.T) {
+	d := NewH264Depacketizer()
+
+	sps := []byte{0x67, 0x42, 0x00, 0x1f}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	idr := []byte{0x65, 0x88, 0x84, 0x00, 0x33}
+
+	stapA := []byte{0x78, 0, byte(len(sps))}
+	stapA = append(stapA, sps...)
+	stapA = append(stapA, 0, byte(len(pps)))
+	stapA = append(stapA, pps...)
+
+	// FU indicator keeps the NRI of the IDR, FU header carries its type
+	fuA := func(start, end bool, data ...byte) []byte {
+		h := byte(5)
+		if start {
+			h |= 0x80
+		}
+		if end {
+			h |= 0x40
+		}
+		return append([]byte{0x7c, h}, data...)
+	}
+
+	var frames []*AccessUnit
+	frames = append(frames, d.Push(rtpTestPacket(1, 3000, false, false, stapA))...)
+	frames = append(frames, d.Push(rtpTestPacket(2, 3000, false, false, fuA(true, false, 0x88, 0x84)))...)
+	frames = append(frames, d.Push(rtpTestPacket(3, 3000, true, false, fuA(false, true, 0x00, 0x33)))...)
+
+	if len(frames) != 1 {
+		t.Fatalf("Expected one frame, got %d", len(frames))
+	}
+	au := frames[0]
+	if !au.Complete || !au.Keyframe || len(au.NALUs) != 3 {
+		t.Fatalf("Unexpected frame %+v", au)
+	}
+	if !bytes.Equal(au.NALUs[0], sps) || !bytes.Equal(au.NALUs[1], pps) || !bytes.Equal(au.NALUs[2], idr) {
+		t.Errorf("Unexpected NAL units %x", au.NALUs)
+	}
+
+	// Lost the start of a fragmented P frame
+	out := d.Push(rtpTestPacket(5, 6000, true, true, append([]byte{0x5c, 0x41}, 0x9a)))
+	if len(out) != 0 {
+		t.Errorf("Expected broken frame to produce nothing, got %+v", out)
+	}
+
+	// Single NAL unit P frame
+	out = d.Push(rtpTestPacket(6, 9000, true, false, []byte{0x41, 0x9a, 0x02}))
+	if len(out) != 1 || !out[0].Complete || out[0].Keyframe {
+		t.Errorf("Expected a complete P frame, got %+v", out)
+	}
+}
@@ -0,0 +1,128 @@
+package service
+
+import "encoding/binary"
+
+// H.265 NAL unit types (ITU-T H.265 table 7-1, RFC 7798)
+const (
+	h265NALUIRAPFirst = 16 // BLA_W_LP
+	h265NALUIRAPLast  = 21 // CRA_NUT
+	h265NALUAP        = 48
+	h265NALUFU        = 49
+	h265NALUPACI      = 50
+
+	h265NALUHeaderSize = 2
+	h265FUHeaderSize   = 1
+)
+
+func h265NALUType(nalu []byte) byte {
+	return (nalu[0] >> 1) & 0x3f
+}
+
+func h265IsKeyframe(nalu []byte) bool {
+	t := h265NALUType(nalu)
+	return t >= h265NALUIRAPFirst && t <= h265NALUIRAPLast
+}
+
+// H265Depacketizer reassembles H.265 access units from RTP packets as
+// described in RFC 7798: single NAL unit packets, aggregation packets and
+// fragmentation units. DONL fields (sprop-max-don-diff > 0) aren't supported.
+type H265Depacketizer struct {
+	au auAssembler
+	fu []byte // fragmented NAL unit being reassembled
+}
+
+func NewH265Depacketizer() *H265Depacketizer {
+	return &H265Depacketizer{au: auAssembler{isKeyframe: h265IsKeyframe}}
+}
+
+// Push adds the next packet in sequence order and returns finished frames
+func (d *H265Depacketizer) Push(pkt orderedPacket) []*AccessUnit {
+	var out []*AccessUnit
+	if pkt.Gap && d.fu != nil {
+		d.fu = nil
+	}
+	if done := d.au.begin(pkt.Timestamp, pkt.Gap); done != nil {
+		out = append(out, done)
+	}
+
+	payload := pkt.Payload
+	if len(payload) < h265NALUHeaderSize {
+		d.au.markIncomplete()
+	} else {
+		switch h265NALUType(payload) {
+		case h265NALUAP:
+			d.aggregation(payload)
+		case h265NALUFU:
+			d.fragment(payload)
+		case h265NALUPACI:
+			d.au.markIncomplete()
+		default:
+			d.au.add(payload)
+		}
+	}
+
+	if pkt.Marker {
+		if d.fu != nil {
+			// The frame ended in the middle of a fragmented NAL unit
+			d.fu = nil
+			d.au.markIncomplete()
+		}
+		if done := d.au.finish(); done != nil {
+			out = append(out, done)
+		}
+	}
+	return out
+}
+
+// aggregation splits an AP into its NAL units, each prefixed by a 16-bit size
+func (d *H265Depacketizer) aggregation(payload []byte) {
+	payload = payload[h265NALUHeaderSize:]
+	for len(payload) > 0 {
+		if len(payload) < 2 {
+			d.au.markIncomplete()
+			return
+		}
+		size := int(binary.BigEndian.Uint16(payload))
+		payload = payload[2:]
+		if size > len(payload) {
+			d.au.markIncomplete()
+			return
+		}
+		d.au.add(payload[:size])
+		payload = payload[size:]
+	}
+}
+
+// fragment reassembles a NAL unit split across FUs
+func (d *H265Depacketizer) fragment(payload []byte) {
+	if len(payload) < h265NALUHeaderSize+h265FUHeaderSize {
+		d.au.markIncomplete()
+		return
+	}
+	fuHeader := payload[h265NALUHeaderSize]
+	start := fuHeader&0x80 != 0
+	end := fuHeader&0x40 != 0
+	data := payload[h265NALUHeaderSize+h265FUHeaderSize:]
+
+	if start {
+		if d.fu != nil {
+			// Previous fragmented NAL unit never ended
+			d.au.markIncomplete()
+		}
+		// Rebuild the NAL unit header with the original type
+		d.fu = []byte{
+			(payload[0] & 0x81) | ((fuHeader & 0x3f) << 1),
+			payload[1],
+		}
+	} else if d.fu == nil {
+		// Lost the start of this NAL unit
+		d.au.markIncomplete()
+		return
+	}
+
+	d.fu = append(d.fu, data...)
+	if end {
+		d.au.add(d.fu)
+		d.fu = nil
+	}
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func rtpTestPacket(seq uint16, ts uint32, marker, gap bool, payload []byte) orderedPacket {
+	return orderedPacket{
+		Packet: &rtp.Packet{
+			Header:  rtp.Header{SequenceNumber: seq, Timestamp: ts, Marker: marker},
+			Payload: payload,
+		},
+		Gap: gap,
+	}
+}
+
+func TestH265Depacketizer(t *testing.T) {
+	d := NewH265Depacketizer()
+
+	vps := []byte{32 << 1, 1, 0xaa}
+	sps := []byte{33 << 1, 1, 0xbb}
+	idr := []byte{19 << 1, 1, 0x10, 0x11, 0x12, 0x13, 0x14}
+
+	// AP with VPS and SPS
+	ap := []byte{48 << 1, 1, 0, byte(len(vps))}
+	ap = append(ap, vps...)
+	ap = append(ap, 0, byte(len(sps)))
+	ap = append(ap, sps...)
+
+	// IDR split into three FUs
+	fu := func(start, end bool, data ...byte) []byte {
+		h := byte(19)
+		if start {
+			h |= 0x80
+		}
+		if end {
+			h |= 0x40
+		}
+		return append([]byte{49 << 1, 1, h}, data...)
+	}
+
+	var frames []*AccessUnit
+	frames = append(frames, d.Push(rtpTestPacket(1, 3000, false, false, ap))...)
+	frames = append(frames, d.Push(rtpTestPacket(2, 3000, false, false, fu(true, false, 0x10, 0x11)))...)
+	frames = append(frames, d.Push(rtpTestPacket(3, 3000, false, false, fu(false, false, 0x12)))...)
+	frames = append(frames, d.Push(rtpTestPacket(4, 3000, true, false, fu(false, true, 0x13, 0x14)))...)
+
+	if len(frames) != 1 {
+		t.Fatalf("Expected one frame, got %d", len(frames))
+	}
+	au := frames[0]
+	if !au.Complete || !au.Keyframe || au.Timestamp != 3000 || len(au.NALUs) != 3 {
+		t.Fatalf("Unexpected frame %+v", au)
+	}
+	if !bytes.Equal(au.NALUs[2], idr) {
+		t.Errorf("FU reassembly: got %x, want %x", au.NALUs[2], idr)
+	}
+	want := append(append(append([]byte{0, 0, 0, 1}, vps...), append([]byte{0, 0, 0, 1}, sps...)...), append([]byte{0, 0, 0, 1}, idr...)...)
+	if !bytes.Equal(au.AnnexB(), want) {
+		t.Errorf("Annex-B: got %x, want %x", au.AnnexB(), want)
+	}
+
+	// Single NAL unit frame, marker lost: finished when the timestamp changes
+	trail := []byte{1 << 1, 1, 0x20}
+	if out := d.Push(rtpTestPacket(5, 6000, false, false, trail)); len(out) != 0 {
+		t.Fatalf("Expected frame to stay open, got %d", len(out))
+	}
+	out := d.Push(rtpTestPacket(6, 9000, true, false, trail))
+	if len(out) != 2 || !out[0].Complete || out[0].Keyframe || out[0].Timestamp != 6000 || out[1].Timestamp != 9000 {
+		t.Fatalf("Expected frames 6000 and 9000, got %+v", out)
+	}
+
+	// Middle fragment lost
+	d.Push(rtpTestPacket(7, 12000, false, false, fu(true, false, 0x10)))
+	out = d.Push(rtpTestPacket(9, 12000, true, true, fu(false, true, 0x14)))
+	if len(out) != 0 {
+		t.Fatalf("Expected no NAL units from a broken FU, got %+v", out)
+	}
+
+	// Start of the frame lost
+	out = d.Push(rtpTestPacket(11, 15000, true, true, trail))
+	if len(out) != 1 || out[0].Complete {
+		t.Fatalf("Expected an incomplete frame, got %+v", out)
+	}
+}
@@ -0,0 +1,164 @@
+package service
+
+import "github.com/pion/rtp"
+
+// paramSetTypes returns the NAL unit types of a codec's parameter sets in
+// the order decoders expect them
+func paramSetTypes(codec string) []byte {
+	if codec == CodecH264 {
+		return []byte{7, 8} // SPS, PPS
+	}
+	return []byte{32, 33, 34} // VPS, SPS, PPS
+}
+
+func naluType(codec string, nalu []byte) byte {
+	if codec == CodecH264 {
+		return h264NALUType(nalu)
+	}
+	return h265NALUType(nalu)
+}
+
+func isKeyframeNALU(codec string, nalu []byte) bool {
+	if codec == CodecH264 {
+		return h264IsKeyframe(nalu)
+	}
+	return h265IsKeyframe(nalu)
+}
+
+// parameterSets caches the latest parameter sets of a stream. Encoders
+// may send them only now and then, so a keyframe on its own isn't always
+// decodable; the cached ones are put in front of keyframes that lack them.
+type parameterSets struct {
+	codec string
+	sets  map[byte][]byte
+}
+
+func newParameterSets(codec string) *parameterSets {
+	return &parameterSets{codec: codec, sets: make(map[byte][]byte)}
+}
+
+// Observe caches the parameter sets among nalus
+func (p *parameterSets) Observe(nalus [][]byte) {
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		t := naluType(p.codec, nalu)
+		for _, pt := range paramSetTypes(p.codec) {
+			if t == pt {
+				p.sets[t] = append([]byte(nil), nalu...)
+			}
+		}
+	}
+}
+
+// Missing returns the cached parameter sets whose type isn't present, in
+// decoding order
+func (p *parameterSets) Missing(present func(t byte) bool) [][]byte {
+	var missing [][]byte
+	for _, t := range paramSetTypes(p.codec) {
+		if set, ok := p.sets[t]; ok && !present(t) {
+			missing = append(missing, set)
+		}
+	}
+	return missing
+}
+
+// Fill caches the parameter sets of a frame and puts cached ones in front
+// of a keyframe that lacks them
+func (p *parameterSets) Fill(au *AccessUnit) {
+	p.Observe(au.NALUs)
+	if !au.Keyframe {
+		return
+	}
+	present := make(map[byte]bool)
+	for _, nalu := range au.NALUs {
+		if len(nalu) > 0 {
+			present[naluType(p.codec, nalu)] = true
+		}
+	}
+	if missing := p.Missing(func(t byte) bool { return present[t] }); len(missing) > 0 {
+		au.NALUs = append(missing, au.NALUs...)
+	}
+}
+
+// packetNALUs returns the whole NAL units in an RTP payload and whether it
+// starts a keyframe. Fragments carry no whole NAL unit.
+func packetNALUs(codec string, payload []byte) (nalus [][]byte, keyframe bool) {
+	if codec == CodecH264 {
+		if len(payload) < h264NALUHeaderSize+h264FUHeaderSize {
+			return nil, false
+		}
+		switch h264NALUType(payload) {
+		case h264NALUSTAPA:
+			nalus = splitAggregation(payload, h264NALUHeaderSize)
+		case h264NALUFUA:
+			fuHeader := payload[h264NALUHeaderSize]
+			return nil, fuHeader&0x80 != 0 && fuHeader&0x1f == h264NALUIDR
+		default:
+			nalus = [][]byte{payload}
+		}
+	} else {
+		if len(payload) < h265NALUHeaderSize+h265FUHeaderSize {
+			return nil, false
+		}
+		switch h265NALUType(payload) {
+		case h265NALUAP:
+			nalus = splitAggregation(payload, h265NALUHeaderSize)
+		case h265NALUFU:
+			fuHeader := payload[h265NALUHeaderSize]
+			t := fuHeader & 0x3f
+			return nil, fuHeader&0x80 != 0 && t >= h265NALUIRAPFirst && t <= h265NALUIRAPLast
+		case h265NALUPACI:
+			return nil, false
+		default:
+			nalus = [][]byte{payload}
+		}
+	}
+	for _, nalu := range nalus {
+		if len(nalu) > 0 && isKeyframeNALU(codec, nalu) {
+			keyframe = true
+		}
+	}
+	return nalus, keyframe
+}
+
+// rtpParamInjector finds keyframes in an RTP stream that come without
+// parameter sets, for forwarding modes that don't reassemble frames
+type rtpParamInjector struct {
+	params   *parameterSets
+	ts       uint32
+	started  bool
+	present  map[byte]bool // parameter sets seen in the current frame
+	injected bool
+}
+
+func newRTPParamInjector(codec string) *rtpParamInjector {
+	return &rtpParamInjector{params: newParameterSets(codec), present: make(map[byte]bool)}
+}
+
+// Before returns the parameter sets to send ahead of pkt, if it starts a
+// keyframe whose frame hasn't carried them so far. Packets are expected
+// in order; parameter sets sent later in the frame are sent twice, which
+// decoders accept.
+func (in *rtpParamInjector) Before(pkt *rtp.Packet) [][]byte {
+	if !in.started || pkt.Timestamp != in.ts {
+		in.ts = pkt.Timestamp
+		in.started = true
+		in.injected = false
+		clear(in.present)
+	}
+
+	nalus, keyframe := packetNALUs(in.params.codec, pkt.Payload)
+	in.params.Observe(nalus)
+	for _, nalu := range nalus {
+		if len(nalu) > 0 {
+			in.present[naluType(in.params.codec, nalu)] = true
+		}
+	}
+	if !keyframe || in.injected {
+		return nil
+	}
+	in.injected = true
+	return in.params.Missing(func(t byte) bool { return in.present[t] })
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func TestParameterSetsFill(t *testing.T) {
+	vps := []byte{32 << 1, 1, 0xaa}
+	sps := []byte{33 << 1, 1, 0xbb}
+	pps := []byte{34 << 1, 1, 0xcc}
+	idr := []byte{19 << 1, 1, 0x10}
+	p := newParameterSets(CodecH265)
+
+	// Nothing cached yet
+	au := &AccessUnit{NALUs: [][]byte{idr}, Keyframe: true}
+	p.Fill(au)
+	if len(au.NALUs) != 1 {
+		t.Fatalf("Expected the keyframe unchanged, got %x", au.NALUs)
+	}
+
+	p.Fill(&AccessUnit{NALUs: [][]byte{vps, sps, pps, idr}, Keyframe: true})
+
+	// A keyframe with only a new PPS gets the cached VPS and SPS
+	newPPS := []byte{34 << 1, 1, 0xdd}
+	au = &AccessUnit{NALUs: [][]byte{newPPS, idr}, Keyframe: true}
+	p.Fill(au)
+	if len(au.NALUs) != 4 || !bytes.Equal(au.NALUs[0], vps) || !bytes.Equal(au.NALUs[1], sps) || !bytes.Equal(au.NALUs[2], newPPS) {
+		t.Errorf("Unexpected NAL units %x", au.NALUs)
+	}
+
+	// Other frames are left alone
+	au = &AccessUnit{NALUs: [][]byte{{1 << 1, 1, 0x42}}}
+	p.Fill(au)
+	if len(au.NALUs) != 1 {
+		t.Errorf("Expected a P frame unchanged, got %x", au.NALUs)
+	}
+}
+
+func TestRTPParamInjector(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0x00, 0x1f}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	stapA := []byte{0x78, 0, byte(len(sps))}
+	stapA = append(stapA, sps...)
+	stapA = append(stapA, 0, byte(len(pps)))
+	stapA = append(stapA, pps...)
+	fuStart := []byte{0x7c, 0x85, 0x88}
+	fuEnd := []byte{0x7c, 0x45, 0x84}
+
+	in := newRTPParamInjector(CodecH264)
+	pkt := func(ts uint32, payload []byte) *rtp.Packet {
+		return &rtp.Packet{Header: rtp.Header{Timestamp: ts}, Payload: payload}
+	}
+
+	// Keyframe with its parameter sets
+	if got := in.Before(pkt(3000, stapA)); got != nil {
+		t.Errorf("Expected nothing for parameter sets, got %x", got)
+	}
+	if got := in.Before(pkt(3000, fuStart)); got != nil {
+		t.Errorf("Expected nothing for a keyframe with parameter sets, got %x", got)
+	}
+
+	// Keyframe without: the cached ones go first, once
+	got := in.Before(pkt(6000, fuStart))
+	if len(got) != 2 || !bytes.Equal(got[0], sps) || !bytes.Equal(got[1], pps) {
+		t.Errorf("Expected SPS and PPS injected, got %x", got)
+	}
+	if got := in.Before(pkt(6000, fuEnd)); got != nil {
+		t.Errorf("Expected nothing for the rest of the frame, got %x", got)
+	}
+	if got := in.Before(pkt(9000, []byte{0x41, 0x9a})); got != nil {
+		t.Errorf("Expected nothing for a P frame, got %x", got)
+	}
+}
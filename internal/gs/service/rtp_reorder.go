@@ -0,0 +1,138 @@
+package service
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// orderedPacket is an RTP packet released by the reorder buffer.
+// Gap is set when packets before it were lost.
+type orderedPacket struct {
+	*rtp.Packet
+	Gap bool
+}
+
+type bufferedPacket struct {
+	pkt *rtp.Packet
+	at  time.Time
+}
+
+// rtpReorderBuffer puts RTP packets back in sequence number order. A missing
+// packet is waited for until the buffer holds size packets or the oldest
+// buffered packet is older than maxDelay, then it is given up as lost.
+type rtpReorderBuffer struct {
+	size     int
+	maxDelay time.Duration
+	pending  map[uint16]bufferedPacket
+	next     uint16
+	started  bool
+
+	// Counters
+	Lost      uint64
+	Reordered uint64
+	Late      uint64
+}
+
+func newRTPReorderBuffer(size int, maxDelay time.Duration) *rtpReorderBuffer {
+	return &rtpReorderBuffer{
+		size:     size,
+		maxDelay: maxDelay,
+		pending:  make(map[uint16]bufferedPacket, size),
+	}
+}
+
+// Push adds a packet and returns the packets that can be released in order
+func (b *rtpReorderBuffer) Push(pkt *rtp.Packet, now time.Time) []orderedPacket {
+	seq := pkt.SequenceNumber
+	if !b.started {
+		b.started = true
+		b.next = seq
+	}
+
+	diff := int16(seq - b.next)
+	switch {
+	case diff < 0 && int(-diff) <= b.size*4:
+		// Duplicate or arrived after we gave up on it
+		b.Late++
+		return nil
+	case diff < 0 || int(diff) > b.size*4:
+		// Sequence jumped (sender restarted), start over from here
+		out := b.flush()
+		b.next = seq
+		b.pending[seq] = bufferedPacket{pkt: pkt, at: now}
+		return append(out, b.drain(true)...)
+	}
+
+	if _, ok := b.pending[seq]; ok {
+		b.Late++
+		return nil
+	}
+	if seq != b.next {
+		b.Reordered++
+	}
+	b.pending[seq] = bufferedPacket{pkt: pkt, at: now}
+
+	out := b.drain(false)
+	return append(out, b.Expire(now)...)
+}
+
+// Expire gives up on missing packets that were waited for too long
+func (b *rtpReorderBuffer) Expire(now time.Time) []orderedPacket {
+	var out []orderedPacket
+	for len(b.pending) > 0 && (len(b.pending) > b.size || now.Sub(b.oldest()) > b.maxDelay) {
+		b.skip()
+		out = append(out, b.drain(true)...)
+	}
+	return out
+}
+
+// drain releases consecutive packets starting at next
+func (b *rtpReorderBuffer) drain(gap bool) []orderedPacket {
+	var out []orderedPacket
+	for {
+		p, ok := b.pending[b.next]
+		if !ok {
+			return out
+		}
+		delete(b.pending, b.next)
+		out = append(out, orderedPacket{Packet: p.pkt, Gap: gap})
+		gap = false
+		b.next++
+	}
+}
+
+// skip moves next to the earliest buffered packet, counting the ones skipped as lost
+func (b *rtpReorderBuffer) skip() {
+	first := -1
+	for seq := range b.pending {
+		if d := int(uint16(seq - b.next)); first < 0 || d < first {
+			first = d
+		}
+	}
+	b.Lost += uint64(first)
+	b.next += uint16(first)
+}
+
+// flush releases everything buffered in order
+func (b *rtpReorderBuffer) flush() []orderedPacket {
+	var out []orderedPacket
+	for len(b.pending) > 0 {
+		_, ok := b.pending[b.next]
+		if !ok {
+			b.skip()
+		}
+		out = append(out, b.drain(!ok)...)
+	}
+	return out
+}
+
+func (b *rtpReorderBuffer) oldest() time.Time {
+	var oldest time.Time
+	for _, p := range b.pending {
+		if oldest.IsZero() || p.at.Before(oldest) {
+			oldest = p.at
+		}
+	}
+	return oldest
+}
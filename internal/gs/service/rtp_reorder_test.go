@@ -0,0 +1,78 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func seqs(packets []orderedPacket) (out []int, gaps []int) {
+	for _, p := range packets {
+		out = append(out, int(p.SequenceNumber))
+		if p.Gap {
+			gaps = append(gaps, int(p.SequenceNumber))
+		}
+	}
+	return out, gaps
+}
+
+func TestRTPReorderBuffer(t *testing.T) {
+	b := newRTPReorderBuffer(4, 30*time.Millisecond)
+	now := time.Now()
+	push := func(seq uint16) []orderedPacket {
+		return b.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}}, now)
+	}
+
+	// In order, across the wrap
+	var got []int
+	for _, seq := range []uint16{65534, 65535, 0} {
+		out, _ := seqs(push(seq))
+		got = append(got, out...)
+	}
+	if len(got) != 3 || got[2] != 0 {
+		t.Fatalf("Expected packets released in order, got %v", got)
+	}
+
+	// 2 arrives before 1
+	if out, _ := seqs(push(2)); len(out) != 0 {
+		t.Fatalf("Expected 2 to be held back, got %v", out)
+	}
+	if out, _ := seqs(push(1)); len(out) != 2 || out[0] != 1 || out[1] != 2 {
+		t.Fatalf("Expected 1, 2, got %v", out)
+	}
+	if b.Reordered != 1 {
+		t.Errorf("Expected 1 reordered packet, got %d", b.Reordered)
+	}
+
+	// Duplicate
+	if out := push(2); len(out) != 0 || b.Late != 1 {
+		t.Errorf("Expected duplicate to be dropped, got %d packets", len(out))
+	}
+
+	// 3 is lost: given up once 4 and 5 waited too long
+	push(4)
+	push(5)
+	now = now.Add(50 * time.Millisecond)
+	out, gaps := seqs(b.Expire(now))
+	if len(out) != 2 || out[0] != 4 || len(gaps) != 1 || gaps[0] != 4 {
+		t.Fatalf("Expected 4 (after a gap), 5, got %v gaps %v", out, gaps)
+	}
+	if b.Lost != 1 {
+		t.Errorf("Expected 1 lost packet, got %d", b.Lost)
+	}
+
+	// Too many waiting: 6 is given up without waiting for the delay
+	for seq := uint16(7); seq <= 11; seq++ {
+		push(seq)
+	}
+	if b.Lost != 2 || len(b.pending) != 0 {
+		t.Errorf("Expected 6 to be given up on a full buffer, lost %d pending %d", b.Lost, len(b.pending))
+	}
+
+	// Sender restart
+	out, gaps = seqs(push(30000))
+	if len(out) != 1 || len(gaps) != 1 {
+		t.Errorf("Expected restart to release the packet with a gap, got %v gaps %v", out, gaps)
+	}
+}
@@ -0,0 +1,585 @@
+package service
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gilankpam/openipc-gs-web/internal/metrics"
+	"github.com/pion/rtp"
+)
+
+const (
+	// rtspPath is the URL path the stream is served on
+	rtspPath = "/live"
+	// rtspPayloadType is the dynamic payload type announced in the SDP
+	rtspPayloadType = 96
+	// rtspSessionTimeout is announced to clients, which send keepalives
+	// (usually GET_PARAMETER) well within it
+	rtspSessionTimeout = 60
+	// rtspWriteTimeout drops clients that stop reading interleaved packets
+	rtspWriteTimeout = 5 * time.Second
+)
+
+// RTSPServer serves the received video stream over RTSP for players that
+// don't speak WebRTC (VLC, OBS, VR and FPV viewer apps). Video is sent as
+// RTP over the RTSP connection (interleaved) or over UDP.
+type RTSPServer struct {
+	stream   *StreamServer
+	port     int
+	listener net.Listener
+	running  atomic.Bool
+	stopCh   chan struct{}
+
+	mu     sync.Mutex
+	params *parameterSets // latest parameter sets for the SDP
+	conns  map[net.Conn]struct{}
+
+	playing atomic.Int64
+}
+
+// NewRTSPServer creates an RTSP server for a stream
+func NewRTSPServer(stream *StreamServer, port int) *RTSPServer {
+	return &RTSPServer{
+		stream: stream,
+		port:   port,
+		stopCh: make(chan struct{}),
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+// Start begins accepting RTSP clients
+func (s *RTSPServer) Start() error {
+	var err error
+	s.listener, err = net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return fmt.Errorf("failed to listen for RTSP on port %d: %w", s.port, err)
+	}
+	s.running.Store(true)
+	log.Printf("RTSP server listening on rtsp://0.0.0.0:%d%s", s.port, rtspPath)
+
+	go s.cacheParams(s.stream.SubscribeFrames())
+	go s.accept()
+	return nil
+}
+
+// Stop closes the listener and every client connection
+func (s *RTSPServer) Stop() {
+	if !s.running.CompareAndSwap(true, false) {
+		return
+	}
+	close(s.stopCh)
+	s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// RegisterMetrics exports the number of playing RTSP clients
+func (s *RTSPServer) RegisterMetrics(reg *metrics.Registry) {
+	reg.NewGaugeFunc("gs_rtsp_sessions", "RTSP clients receiving video.", func() float64 {
+		return float64(s.playing.Load())
+	})
+}
+
+// cacheParams keeps the latest parameter sets, so DESCRIBE can announce
+// them and new clients can decode their first keyframe
+func (s *RTSPServer) cacheParams(sub *Subscription[*VideoFrame]) {
+	defer sub.Close()
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case frame, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			s.mu.Lock()
+			if s.params == nil || s.params.codec != frame.Codec {
+				s.params = newParameterSets(frame.Codec)
+			}
+			s.params.Observe(frame.NALUs)
+			s.mu.Unlock()
+		}
+	}
+}
+
+// paramSets returns the cached parameter sets of codec in decoding order
+func (s *RTSPServer) paramSets(codec string) [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.params == nil || s.params.codec != codec {
+		return nil
+	}
+	return s.params.Missing(func(byte) bool { return false })
+}
+
+func (s *RTSPServer) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.running.Load() {
+				log.Printf("RTSP accept error: %v", err)
+			}
+			return
+		}
+		// Stop may have closed the other connections already
+		s.mu.Lock()
+		if !s.running.Load() {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+// rtspRequest is a parsed RTSP request
+type rtspRequest struct {
+	method string
+	url    *url.URL
+	header textproto.MIMEHeader
+}
+
+// rtspSession is the state of one client connection. A connection carries
+// a single session with a single track.
+type rtspSession struct {
+	server *RTSPServer
+	conn   net.Conn
+	id     string
+	codec  string
+
+	writeMu sync.Mutex
+
+	// Transport set up by SETUP: interleaved channel or UDP destination
+	setup       bool
+	interleaved bool
+	channel     byte
+	udpConn     *net.UDPConn
+	rtcpConn    *net.UDPConn
+	clientAddr  *net.UDPAddr
+
+	ssrc    uint32
+	seq     uint16
+	playing bool
+	stopCh  chan struct{}
+}
+
+func (s *RTSPServer) serve(conn net.Conn) {
+	sess := &rtspSession{server: s, conn: conn, stopCh: make(chan struct{})}
+	defer func() {
+		close(sess.stopCh)
+		if sess.udpConn != nil {
+			sess.udpConn.Close()
+			sess.rtcpConn.Close()
+		}
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		req, err := readRTSPRequest(r)
+		if err != nil {
+			if err != io.EOF && s.running.Load() {
+				log.Printf("RTSP client %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if !sess.handle(req) {
+			return
+		}
+	}
+}
+
+// readRTSPRequest reads the next request, skipping interleaved packets
+// (RTCP receiver reports) sent by the client
+func readRTSPRequest(r *bufio.Reader) (*rtspRequest, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '$' {
+			break
+		}
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		if _, err := r.Discard(int(binary.BigEndian.Uint16(hdr[2:]))); err != nil {
+			return nil, err
+		}
+	}
+
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+		return nil, fmt.Errorf("invalid request line %q", line)
+	}
+	u, err := url.Parse(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid request URL %q", parts[1])
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := strconv.Atoi(header.Get("Content-Length")); n > 0 {
+		if _, err := r.Discard(n); err != nil {
+			return nil, err
+		}
+	}
+	return &rtspRequest{method: parts[0], url: u, header: header}, nil
+}
+
+// handle answers a request and returns false when the connection should
+// be closed
+func (sess *rtspSession) handle(req *rtspRequest) bool {
+	headers := []string{"CSeq: " + req.header.Get("CSeq")}
+
+	path := strings.TrimSuffix(req.url.Path, "/")
+	if req.method != "OPTIONS" && path != rtspPath && !strings.HasPrefix(path, rtspPath+"/") {
+		return sess.reply(404, "Not Found", headers, "")
+	}
+	if sess.id != "" && req.method != "OPTIONS" && req.method != "DESCRIBE" {
+		if id, _, _ := strings.Cut(req.header.Get("Session"), ";"); id != "" && strings.TrimSpace(id) != sess.id {
+			return sess.reply(454, "Session Not Found", headers, "")
+		}
+	}
+
+	switch req.method {
+	case "OPTIONS":
+		headers = append(headers, "Public: OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER, SET_PARAMETER")
+		return sess.reply(200, "OK", headers, "")
+	case "DESCRIBE":
+		codec := sess.server.stream.Codec()
+		base := url.URL{Scheme: "rtsp", Host: req.url.Host, Path: rtspPath + "/"}
+		if base.Host == "" {
+			base.Host = sess.conn.LocalAddr().String()
+		}
+		headers = append(headers, "Content-Base: "+base.String(), "Content-Type: application/sdp")
+		return sess.reply(200, "OK", headers, sess.server.sdp(codec, sess.conn.LocalAddr()))
+	case "SETUP":
+		return sess.handleSetup(req, headers)
+	case "PLAY":
+		if !sess.setup {
+			return sess.reply(455, "Method Not Valid in This State", headers, "")
+		}
+		headers = append(headers, sess.sessionHeader(), "Range: npt=0.000-")
+		if sess.playing {
+			return sess.reply(200, "OK", headers, "")
+		}
+		sess.playing = true
+		// Subscribe before replying so no frame after PLAY is missed
+		sub := sess.server.stream.SubscribeFrames()
+		if !sess.reply(200, "OK", headers, "") {
+			sub.Close()
+			return false
+		}
+		go sess.play(sub)
+		return true
+	case "TEARDOWN":
+		sess.reply(200, "OK", headers, "")
+		return false
+	case "GET_PARAMETER", "SET_PARAMETER":
+		if sess.id != "" {
+			headers = append(headers, sess.sessionHeader())
+		}
+		return sess.reply(200, "OK", headers, "")
+	}
+	return sess.reply(501, "Not Implemented", headers, "")
+}
+
+func (sess *rtspSession) handleSetup(req *rtspRequest, headers []string) bool {
+	if sess.setup {
+		// A second track or a transport change isn't supported
+		return sess.reply(459, "Aggregate Operation Not Allowed", headers, "")
+	}
+	transport := req.header.Get("Transport")
+	// Clients may list several transports in order of preference
+	for _, option := range strings.Split(transport, ",") {
+		params := strings.Split(strings.TrimSpace(option), ";")
+		if strings.Contains(option, "multicast") {
+			continue
+		}
+		switch params[0] {
+		case "RTP/AVP/TCP":
+			sess.interleaved = true
+			sess.channel = 0
+			for _, p := range params[1:] {
+				if v, ok := strings.CutPrefix(p, "interleaved="); ok {
+					first, _, _ := strings.Cut(v, "-")
+					if n, err := strconv.Atoi(first); err == nil && n >= 0 && n < 255 {
+						sess.channel = byte(n)
+					}
+				}
+			}
+			sess.start()
+			headers = append(headers, sess.sessionHeader(), fmt.Sprintf(
+				"Transport: RTP/AVP/TCP;unicast;interleaved=%d-%d;ssrc=%08X", sess.channel, sess.channel+1, sess.ssrc))
+			return sess.reply(200, "OK", headers, "")
+		case "RTP/AVP", "RTP/AVP/UDP":
+			var clientPort string
+			for _, p := range params[1:] {
+				if v, ok := strings.CutPrefix(p, "client_port="); ok {
+					clientPort = v
+				}
+			}
+			rtpPort, _, _ := strings.Cut(clientPort, "-")
+			port, err := strconv.Atoi(rtpPort)
+			if err != nil || port <= 0 || port > 65535 {
+				continue
+			}
+			host, _, _ := net.SplitHostPort(sess.conn.RemoteAddr().String())
+			sess.clientAddr = &net.UDPAddr{IP: net.ParseIP(host), Port: port}
+			if err := sess.openUDP(); err != nil {
+				log.Printf("RTSP client %s: %v", sess.conn.RemoteAddr(), err)
+				return sess.reply(500, "Internal Server Error", headers, "")
+			}
+			sess.start()
+			headers = append(headers, sess.sessionHeader(), fmt.Sprintf(
+				"Transport: RTP/AVP;unicast;client_port=%s;server_port=%d-%d;ssrc=%08X", clientPort,
+				sess.udpConn.LocalAddr().(*net.UDPAddr).Port, sess.rtcpConn.LocalAddr().(*net.UDPAddr).Port, sess.ssrc))
+			return sess.reply(200, "OK", headers, "")
+		}
+	}
+	return sess.reply(461, "Unsupported Transport", headers, "")
+}
+
+// openUDP opens the server's RTP and RTCP sockets. Nothing is read from
+// the RTCP one; it exists so client reports aren't answered with ICMP
+// errors.
+func (sess *rtspSession) openUDP() error {
+	var err error
+	sess.udpConn, err = net.ListenUDP("udp", nil)
+	if err != nil {
+		return fmt.Errorf("failed to open RTP socket: %w", err)
+	}
+	sess.rtcpConn, err = net.ListenUDP("udp", nil)
+	if err != nil {
+		sess.udpConn.Close()
+		sess.udpConn = nil
+		return fmt.Errorf("failed to open RTCP socket: %w", err)
+	}
+	return nil
+}
+
+// start creates the session once its transport is set up
+func (sess *rtspSession) start() {
+	sess.setup = true
+	sess.id = newRandomID()
+	sess.codec = sess.server.stream.Codec()
+	var b [6]byte
+	rand.Read(b[:])
+	sess.ssrc = binary.BigEndian.Uint32(b[:4])
+	sess.seq = binary.BigEndian.Uint16(b[4:])
+}
+
+func (sess *rtspSession) sessionHeader() string {
+	return fmt.Sprintf("Session: %s;timeout=%d", sess.id, rtspSessionTimeout)
+}
+
+func (sess *rtspSession) reply(code int, status string, headers []string, body string) bool {
+	var b strings.Builder
+	fmt.Fprintf(&b, "RTSP/1.0 %d %s\r\n", code, status)
+	for _, h := range headers {
+		b.WriteString(h + "\r\n")
+	}
+	b.WriteString("Server: gs-server\r\n")
+	if body != "" {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+	}
+	b.WriteString("\r\n" + body)
+
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
+	sess.conn.SetWriteDeadline(time.Now().Add(rtspWriteTimeout))
+	_, err := io.WriteString(sess.conn, b.String())
+	return err == nil
+}
+
+// play sends frames to the client, starting at the next keyframe. Frames
+// with lost packets are skipped like for WebRTC peers. A codec change
+// ends the session; the client reconnects and gets a new SDP.
+func (sess *rtspSession) play(sub *Subscription[*VideoFrame]) {
+	defer sub.Close()
+	sess.server.playing.Add(1)
+	defer sess.server.playing.Add(-1)
+	sess.server.stream.RequestKeyframe("new RTSP client")
+
+	started := false
+	for {
+		select {
+		case <-sess.stopCh:
+			return
+		case frame, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if frame.Codec != sess.codec {
+				log.Printf("RTSP client %s: codec changed to %s, closing", sess.conn.RemoteAddr(), frame.Codec)
+				sess.conn.Close()
+				return
+			}
+			if !frame.Complete || (!started && !frame.Keyframe) {
+				continue
+			}
+			started = true
+			if err := sess.writeFrame(frame.AccessUnit); err != nil {
+				log.Printf("RTSP client %s: %v", sess.conn.RemoteAddr(), err)
+				sess.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// writeFrame packetizes a frame, putting the cached parameter sets in
+// front of keyframes that lack them
+func (sess *rtspSession) writeFrame(au *AccessUnit) error {
+	nalus := au.NALUs
+	if au.Keyframe {
+		present := make(map[byte]bool)
+		for _, nalu := range nalus {
+			if len(nalu) > 0 {
+				present[naluType(sess.codec, nalu)] = true
+			}
+		}
+		var missing [][]byte
+		for _, set := range sess.server.paramSets(sess.codec) {
+			if !present[naluType(sess.codec, set)] {
+				missing = append(missing, set)
+			}
+		}
+		nalus = append(missing, nalus...)
+	}
+
+	maxPayload := rtpForwardMTU - 12
+	var payloads [][]byte
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		if sess.codec == CodecH264 {
+			payloads = append(payloads, splitH264NALU(nalu, maxPayload)...)
+		} else {
+			payloads = append(payloads, splitH265NALU(nalu, maxPayload)...)
+		}
+	}
+
+	for i, payload := range payloads {
+		pkt := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    rtspPayloadType,
+				SequenceNumber: sess.seq,
+				Timestamp:      au.Timestamp,
+				SSRC:           sess.ssrc,
+				Marker:         i == len(payloads)-1,
+			},
+			Payload: payload,
+		}
+		sess.seq++
+		data, err := pkt.Marshal()
+		if err != nil {
+			return err
+		}
+		if err := sess.writePacket(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sess *rtspSession) writePacket(data []byte) error {
+	if !sess.interleaved {
+		_, err := sess.udpConn.WriteToUDP(data, sess.clientAddr)
+		return err
+	}
+	frame := []byte{'$', sess.channel, 0, 0}
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(data)))
+
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
+	sess.conn.SetWriteDeadline(time.Now().Add(rtspWriteTimeout))
+	_, err := sess.conn.Write(append(frame, data...))
+	return err
+}
+
+// sdp describes the stream with the cached parameter sets, so clients can
+// set up their decoder before the first keyframe
+func (s *RTSPServer) sdp(codec string, local net.Addr) string {
+	host, _, _ := net.SplitHostPort(local.String())
+	addrType := "IP4"
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		addrType = "IP6"
+	}
+	var id [4]byte
+	rand.Read(id[:])
+
+	var b strings.Builder
+	b.WriteString("v=0\r\n")
+	fmt.Fprintf(&b, "o=- %d 1 IN %s %s\r\n", binary.BigEndian.Uint32(id[:]), addrType, host)
+	b.WriteString("s=gs-server\r\n")
+	fmt.Fprintf(&b, "c=IN %s %s\r\n", addrType, host)
+	b.WriteString("t=0 0\r\n")
+	fmt.Fprintf(&b, "m=video 0 RTP/AVP %d\r\n", rtspPayloadType)
+	fmt.Fprintf(&b, "a=rtpmap:%d %s/%d\r\n", rtspPayloadType, strings.ToUpper(codec), rtpVideoClockRate)
+	if fmtp := sdpFmtp(codec, s.paramSets(codec)); fmtp != "" {
+		fmt.Fprintf(&b, "a=fmtp:%d %s\r\n", rtspPayloadType, fmtp)
+	}
+	b.WriteString("a=control:trackID=0\r\n")
+	return b.String()
+}
+
+// sdpFmtp returns the format parameters announcing the parameter sets
+// (RFC 6184 for H264, RFC 7798 for H265)
+func sdpFmtp(codec string, sets [][]byte) string {
+	b64 := base64.StdEncoding.EncodeToString
+	if codec == CodecH264 {
+		params := []string{"packetization-mode=1"}
+		var sprops []string
+		for _, set := range sets {
+			if h264NALUType(set) == 7 && len(set) >= 4 {
+				params = append(params, "profile-level-id="+strings.ToUpper(hex.EncodeToString(set[1:4])))
+			}
+			sprops = append(sprops, b64(set))
+		}
+		if len(sprops) > 0 {
+			params = append(params, "sprop-parameter-sets="+strings.Join(sprops, ","))
+		}
+		return strings.Join(params, ";")
+	}
+
+	names := map[byte]string{32: "sprop-vps", 33: "sprop-sps", 34: "sprop-pps"}
+	var params []string
+	for _, set := range sets {
+		params = append(params, names[h265NALUType(set)]+"="+b64(set))
+	}
+	return strings.Join(params, ";")
+}
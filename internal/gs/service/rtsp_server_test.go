@@ -0,0 +1,239 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// rtspTestClient is a minimal RTSP client speaking to the server in-process
+type rtspTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	url  string
+	cseq int
+}
+
+func dialRTSP(t *testing.T, s *RTSPServer) *rtspTestClient {
+	t.Helper()
+	port := s.listener.Addr().(*net.TCPAddr).Port
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &rtspTestClient{t: t, conn: conn, r: bufio.NewReader(conn), url: "rtsp://" + conn.RemoteAddr().String() + rtspPath}
+}
+
+func (c *rtspTestClient) do(method, url string, headers ...string) (int, textproto.MIMEHeader, string) {
+	c.t.Helper()
+	c.cseq++
+	req := fmt.Sprintf("%s %s RTSP/1.0\r\nCSeq: %d\r\n", method, url, c.cseq)
+	for _, h := range headers {
+		req += h + "\r\n"
+	}
+	if _, err := io.WriteString(c.conn, req+"\r\n"); err != nil {
+		c.t.Fatal(err)
+	}
+
+	tp := textproto.NewReader(c.r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	parts := strings.SplitN(line, " ", 3)
+	code, _ := strconv.Atoi(parts[1])
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if header.Get("CSeq") != strconv.Itoa(c.cseq) {
+		c.t.Errorf("Expected CSeq %d, got %q", c.cseq, header.Get("CSeq"))
+	}
+	body := make([]byte, 0)
+	if n, _ := strconv.Atoi(header.Get("Content-Length")); n > 0 {
+		body = make([]byte, n)
+		if _, err := io.ReadFull(c.r, body); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	return code, header, string(body)
+}
+
+// readInterleaved reads the next RTP packet sent over the RTSP connection
+func (c *rtspTestClient) readInterleaved() (byte, *rtp.Packet) {
+	c.t.Helper()
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	if hdr[0] != '$' {
+		c.t.Fatalf("Expected an interleaved packet, got %q", hdr)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		c.t.Fatal(err)
+	}
+	pkt := &rtp.Packet{}
+	if err := pkt.Unmarshal(data); err != nil {
+		c.t.Fatal(err)
+	}
+	return hdr[1], pkt
+}
+
+var (
+	rtspTestSPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda}
+	rtspTestPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+func startRTSPTest(t *testing.T) (*StreamServer, *RTSPServer) {
+	t.Helper()
+	stream := NewStreamServer(0)
+	stream.codec = CodecH264
+	s := NewRTSPServer(stream, 0)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+
+	// Cache the parameter sets before clients connect
+	stream.videoFrames.publish(&VideoFrame{Codec: CodecH264, AccessUnit: &AccessUnit{
+		Timestamp: 1000, NALUs: [][]byte{rtspTestSPS, rtspTestPPS, {0x65, 1}}, Keyframe: true, Complete: true,
+	}})
+	for deadline := time.Now().Add(time.Second); len(s.paramSets(CodecH264)) < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("Parameter sets not cached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return stream, s
+}
+
+// publishTestFrames sends a frame before any keyframe, a keyframe without
+// parameter sets that is larger than a packet, an incomplete frame and a
+// complete one
+func publishTestFrames(stream *StreamServer) []byte {
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0xab}, 3000)...)
+	for _, au := range []*AccessUnit{
+		{Timestamp: 2000, NALUs: [][]byte{{0x41, 1}}, Complete: true},
+		{Timestamp: 5000, NALUs: [][]byte{idr}, Keyframe: true, Complete: true},
+		{Timestamp: 8000, NALUs: [][]byte{{0x41, 2}}},
+		{Timestamp: 11000, NALUs: [][]byte{{0x41, 3}}, Complete: true},
+	} {
+		stream.videoFrames.publish(&VideoFrame{Codec: CodecH264, AccessUnit: au})
+	}
+	return idr
+}
+
+func checkTestFrames(t *testing.T, idr []byte, next func() *rtp.Packet) {
+	t.Helper()
+	d := NewH264Depacketizer()
+	var frames []*AccessUnit
+	for len(frames) < 2 {
+		pkt := next()
+		if pkt.PayloadType != rtspPayloadType || len(pkt.Payload) > rtpForwardMTU-12 {
+			t.Fatalf("Unexpected packet %v", pkt)
+		}
+		frames = append(frames, d.Push(orderedPacket{Packet: pkt})...)
+	}
+	key := frames[0]
+	if key.Timestamp != 5000 || !key.Keyframe || len(key.NALUs) != 3 ||
+		!bytes.Equal(key.NALUs[0], rtspTestSPS) || !bytes.Equal(key.NALUs[1], rtspTestPPS) || !bytes.Equal(key.NALUs[2], idr) {
+		t.Errorf("Expected the keyframe with parameter sets, got %+v", key)
+	}
+	if frames[1].Timestamp != 11000 || !frames[1].Complete {
+		t.Errorf("Expected the complete frame after it, got %+v", frames[1])
+	}
+}
+
+func TestRTSPServerInterleaved(t *testing.T) {
+	stream, s := startRTSPTest(t)
+	c := dialRTSP(t, s)
+
+	if code, h, _ := c.do("OPTIONS", c.url); code != 200 || !strings.Contains(h.Get("Public"), "DESCRIBE") {
+		t.Fatalf("OPTIONS: %d %v", code, h)
+	}
+	if code, _, _ := c.do("DESCRIBE", "rtsp://gs/other"); code != 404 {
+		t.Errorf("Expected 404 for an unknown path, got %d", code)
+	}
+	code, h, sdp := c.do("DESCRIBE", c.url, "Accept: application/sdp")
+	if code != 200 || h.Get("Content-Type") != "application/sdp" {
+		t.Fatalf("DESCRIBE: %d %v", code, h)
+	}
+	for _, want := range []string{"a=rtpmap:96 H264/90000", "profile-level-id=42C01F", "sprop-parameter-sets=Z0LAH9o=,aM48gA==", "a=control:trackID=0"} {
+		if !strings.Contains(sdp, want) {
+			t.Errorf("SDP lacks %q:\n%s", want, sdp)
+		}
+	}
+
+	if code, _, _ := c.do("PLAY", c.url); code != 455 {
+		t.Errorf("Expected 455 for PLAY before SETUP, got %d", code)
+	}
+	code, h, _ = c.do("SETUP", h.Get("Content-Base")+"trackID=0", "Transport: RTP/AVP/TCP;unicast;interleaved=2-3")
+	if code != 200 || !strings.Contains(h.Get("Transport"), "interleaved=2-3") {
+		t.Fatalf("SETUP: %d %v", code, h)
+	}
+	session, _, _ := strings.Cut(h.Get("Session"), ";")
+	if code, _, _ := c.do("PLAY", c.url, "Session: "+session); code != 200 {
+		t.Fatalf("PLAY: %d", code)
+	}
+
+	idr := publishTestFrames(stream)
+	checkTestFrames(t, idr, func() *rtp.Packet {
+		channel, pkt := c.readInterleaved()
+		if channel != 2 {
+			t.Errorf("Expected channel 2, got %d", channel)
+		}
+		return pkt
+	})
+
+	if code, _, _ := c.do("TEARDOWN", c.url, "Session: "+session); code != 200 {
+		t.Errorf("TEARDOWN: %d", code)
+	}
+}
+
+func TestRTSPServerUDP(t *testing.T) {
+	stream, s := startRTSPTest(t)
+	c := dialRTSP(t, s)
+	udp := listenUDP(t)
+
+	code, h, _ := c.do("SETUP", c.url+"/trackID=0",
+		fmt.Sprintf("Transport: RTP/AVP;multicast,RTP/AVP;unicast;client_port=%d-%d", udp.LocalAddr().(*net.UDPAddr).Port, udp.LocalAddr().(*net.UDPAddr).Port+1))
+	if code != 200 || !strings.Contains(h.Get("Transport"), "server_port=") {
+		t.Fatalf("SETUP: %d %v", code, h)
+	}
+	if code, _, _ := c.do("PLAY", c.url, "Session: wrong"); code != 454 {
+		t.Errorf("Expected 454 for a wrong session, got %d", code)
+	}
+	if code, _, _ := c.do("PLAY", c.url, "Session: "+h.Get("Session")); code != 200 {
+		t.Fatalf("PLAY: %d", code)
+	}
+
+	idr := publishTestFrames(stream)
+	checkTestFrames(t, idr, func() *rtp.Packet {
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(readUDP(t, udp)); err != nil {
+			t.Fatal(err)
+		}
+		return pkt
+	})
+}
+
+func TestSDPFmtpH265(t *testing.T) {
+	fmtp := sdpFmtp(CodecH265, [][]byte{{32 << 1, 1}, {33 << 1, 1}, {34 << 1, 1}})
+	if fmtp != "sprop-vps=QAE=;sprop-sps=QgE=;sprop-pps=RAE=" {
+		t.Errorf("Unexpected fmtp %q", fmtp)
+	}
+}
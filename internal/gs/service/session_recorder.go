@@ -0,0 +1,524 @@
+package service
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Supported session file formats
+const (
+	SessionFormatNDJSON = "ndjson"
+	SessionFormatCSV    = "csv"
+)
+
+var sessionIDPattern = regexp.MustCompile(`^[0-9A-Za-z_-]+$`)
+
+var sessionCSVHeader = []string{
+	"time", "rssi", "snr", "packets", "lost", "fec_rec", "bad", "flow_bytes",
+	"frequency", "mcs_index", "bandwidth", "fec_k", "fec_n",
+}
+
+// SessionSummary describes a recorded flight session
+type SessionSummary struct {
+	ID                  string    `json:"id"`
+	Format              string    `json:"format"`
+	Active              bool      `json:"active"`
+	Start               time.Time `json:"start"`
+	End                 time.Time `json:"end"`
+	DurationSec         float64   `json:"duration_sec"`
+	Updates             int       `json:"updates"`
+	MinRssi             int       `json:"min_rssi"`
+	Packets             int64     `json:"packets"`
+	Lost                int64     `json:"lost"`
+	FecRecovered        int64     `json:"fec_recovered"`
+	LossPercent         float64   `json:"loss_percent"`
+	FecRecoveredPercent float64   `json:"fec_recovered_percent"`
+	Channels            []int     `json:"channels"`
+	McsIndexes          []int     `json:"mcs_indexes"`
+	SizeBytes           int64     `json:"size_bytes"`
+}
+
+type activeSession struct {
+	summary    SessionSummary
+	file       *os.File
+	buf        *bufio.Writer
+	csv        *csv.Writer
+	lastPacket time.Time
+	haveRssi   bool
+}
+
+// SessionRecorder writes every stats update to disk while packets are
+// flowing. A session starts with the first packets and ends once no
+// packets were received for the quiet period.
+type SessionRecorder struct {
+	dir     string
+	format  string
+	quiet   time.Duration
+	stats   *WFBStatsService
+	mu      sync.Mutex
+	active  *activeSession
+	running atomic.Bool
+	stopCh  chan struct{}
+
+	// wfb-ng totals of the last video stream update, sessions count
+	// packets from their differences
+	lastTotals WFBPacketTotals
+	haveTotals bool
+}
+
+// NewSessionRecorder creates a recorder storing sessions in dir
+func NewSessionRecorder(stats *WFBStatsService, dir, format string, quiet time.Duration) (*SessionRecorder, error) {
+	if format != SessionFormatNDJSON && format != SessionFormatCSV {
+		return nil, fmt.Errorf("unsupported session format %q", format)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create sessions dir: %w", err)
+	}
+	return &SessionRecorder{
+		dir:    dir,
+		format: format,
+		quiet:  quiet,
+		stats:  stats,
+		stopCh: make(chan struct{}),
+	}, nil
+}
+
+func (r *SessionRecorder) Start() {
+	r.running.Store(true)
+	sub := r.stats.Subscribe()
+	go r.run(sub)
+}
+
+func (r *SessionRecorder) Stop() {
+	if !r.running.CompareAndSwap(true, false) {
+		return
+	}
+	close(r.stopCh)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeSession(time.Now())
+}
+
+func (r *SessionRecorder) run(sub *Subscription[*WFBStats]) {
+	defer sub.Close()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case stats, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			r.record(stats, time.Now())
+		case now := <-ticker.C:
+			// wfb-ng may stop reporting entirely, so expire on a timer too
+			r.expire(now)
+		}
+	}
+}
+
+// record appends a stats update to the active session, starting one if packets are flowing
+func (r *SessionRecorder) record(stats *WFBStats, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Sessions follow the video stream only
+	if !r.running.Load() || !stats.PrimaryUpdated() {
+		return
+	}
+
+	if stats.VideoPacketsPerSec > 0 && r.active == nil {
+		if err := r.openSession(now); err != nil {
+			log.Printf("Failed to start session recording: %v", err)
+			return
+		}
+	}
+	// Nothing is known to have been received before the first update
+	var delta WFBPacketTotals
+	totals := stats.wfbTotals
+	if r.haveTotals {
+		delta = WFBPacketTotals{
+			All:          uint64(totalsDelta(totals.All, r.lastTotals.All)),
+			Lost:         uint64(totalsDelta(totals.Lost, r.lastTotals.Lost)),
+			FecRecovered: uint64(totalsDelta(totals.FecRecovered, r.lastTotals.FecRecovered)),
+		}
+	}
+	r.lastTotals, r.haveTotals = totals, true
+	if r.active == nil {
+		return
+	}
+
+	if err := r.writeRecord(stats, now); err != nil {
+		log.Printf("Failed to write session record: %v", err)
+	}
+	r.updateSummary(stats, delta, now)
+
+	if r.active.summary.End.Sub(r.active.lastPacket) >= r.quiet {
+		r.closeSession(now)
+	}
+}
+
+// expire ends the active session once the quiet period has passed
+func (r *SessionRecorder) expire(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.active != nil && now.Sub(r.active.lastPacket) >= r.quiet {
+		r.closeSession(now)
+	}
+}
+
+func (r *SessionRecorder) openSession(now time.Time) error {
+	// Sessions restarting within the same second get a suffix
+	id := now.Format("20060102-150405")
+	for i := 1; r.sessionExists(id); i++ {
+		id = fmt.Sprintf("%s-%d", now.Format("20060102-150405"), i)
+	}
+	f, err := os.Create(r.dataPath(id, r.format))
+	if err != nil {
+		return err
+	}
+
+	s := &activeSession{
+		summary: SessionSummary{
+			ID:         id,
+			Format:     r.format,
+			Active:     true,
+			Start:      now,
+			End:        now,
+			Channels:   []int{},
+			McsIndexes: []int{},
+		},
+		file:       f,
+		buf:        bufio.NewWriter(f),
+		lastPacket: now,
+	}
+	if r.format == SessionFormatCSV {
+		s.csv = csv.NewWriter(s.buf)
+		s.csv.Write(sessionCSVHeader)
+	}
+
+	r.active = s
+	log.Printf("Started session recording %s", id)
+	return nil
+}
+
+func (r *SessionRecorder) closeSession(now time.Time) {
+	s := r.active
+	if s == nil {
+		return
+	}
+	r.active = nil
+
+	if s.csv != nil {
+		s.csv.Flush()
+	}
+	s.buf.Flush()
+	s.file.Close()
+
+	s.summary.Active = false
+	if info, err := os.Stat(r.dataPath(s.summary.ID, s.summary.Format)); err == nil {
+		s.summary.SizeBytes = info.Size()
+	}
+
+	data, err := json.MarshalIndent(s.summary, "", "  ")
+	if err == nil {
+		err = os.WriteFile(r.summaryPath(s.summary.ID), data, 0644)
+	}
+	if err != nil {
+		log.Printf("Failed to write session summary: %v", err)
+	}
+	log.Printf("Finished session recording %s (%.0fs)", s.summary.ID, s.summary.DurationSec)
+}
+
+func (r *SessionRecorder) writeRecord(stats *WFBStats, now time.Time) error {
+	s := r.active
+	if s.csv != nil {
+		s.csv.Write([]string{
+			now.Format(time.RFC3339Nano),
+			joinInt8(stats.Rssi),
+			joinInt8(stats.Snr),
+			strconv.Itoa(stats.VideoPacketsPerSec),
+			strconv.Itoa(stats.LostPacketsPerSec),
+			strconv.Itoa(stats.FecPacketsPerSec),
+			strconv.Itoa(stats.BadBlocksPerSec),
+			strconv.Itoa(stats.LinkFlowBytesPerSec),
+			strconv.FormatUint(uint64(stats.Frequency), 10),
+			strconv.Itoa(stats.McsIndex),
+			strconv.Itoa(stats.Bandwidth),
+			strconv.Itoa(stats.FecK),
+			strconv.Itoa(stats.FecN),
+		})
+		s.csv.Flush()
+		if err := s.csv.Error(); err != nil {
+			return err
+		}
+		return s.buf.Flush()
+	}
+
+	line, err := json.Marshal(struct {
+		Time time.Time `json:"time"`
+		*WFBStreamStats
+	}{now, &stats.WFBStreamStats})
+	if err != nil {
+		return err
+	}
+	s.buf.Write(line)
+	s.buf.WriteByte('\n')
+	return s.buf.Flush()
+}
+
+// updateSummary accounts for a stats update and the packets wfb-ng counted
+// since the previous one
+func (r *SessionRecorder) updateSummary(stats *WFBStats, packets WFBPacketTotals, now time.Time) {
+	s := r.active
+	sum := &s.summary
+
+	sum.End = now
+	sum.DurationSec = now.Sub(sum.Start).Seconds()
+	sum.Updates++
+
+	if stats.VideoPacketsPerSec > 0 {
+		s.lastPacket = now
+	}
+
+	for _, rssi := range stats.Rssi {
+		if !s.haveRssi || int(rssi) < sum.MinRssi {
+			sum.MinRssi = int(rssi)
+			s.haveRssi = true
+		}
+	}
+
+	sum.Packets += int64(packets.All)
+	sum.Lost += int64(packets.Lost)
+	sum.FecRecovered += int64(packets.FecRecovered)
+	if total := sum.Packets + sum.Lost; total > 0 {
+		sum.LossPercent = float64(sum.Lost) / float64(total) * 100
+	}
+	if sum.Packets > 0 {
+		sum.FecRecoveredPercent = float64(sum.FecRecovered) / float64(sum.Packets) * 100
+	}
+
+	if ch := frequencyToChannel(stats.Frequency); ch > 0 {
+		sum.Channels = appendUniqueInt(sum.Channels, ch)
+	}
+	if stats.VideoPacketsPerSec > 0 {
+		sum.McsIndexes = appendUniqueInt(sum.McsIndexes, stats.McsIndex)
+	}
+}
+
+// Sessions returns all recorded sessions, newest first. Sessions cut off
+// before their summary was written are listed from their data file.
+func (r *SessionRecorder) Sessions() ([]SessionSummary, error) {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	var active *SessionSummary
+	if r.active != nil {
+		summary := r.active.summary
+		active = &summary
+	}
+	r.mu.Unlock()
+
+	sessions := []SessionSummary{}
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		id := strings.TrimSuffix(e.Name(), ext)
+		format := strings.TrimPrefix(ext, ".")
+		if e.IsDir() || (format != SessionFormatNDJSON && format != SessionFormatCSV) || !sessionIDPattern.MatchString(id) {
+			continue
+		}
+		if active != nil && active.ID == id {
+			continue
+		}
+
+		var summary SessionSummary
+		data, err := os.ReadFile(r.summaryPath(id))
+		if err != nil || json.Unmarshal(data, &summary) != nil {
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			start, _ := time.ParseInLocation("20060102-150405", id[:min(len(id), 15)], time.Local)
+			summary = SessionSummary{
+				ID:          id,
+				Format:      format,
+				Start:       start,
+				End:         info.ModTime(),
+				DurationSec: info.ModTime().Sub(start).Seconds(),
+				SizeBytes:   info.Size(),
+				Channels:    []int{},
+				McsIndexes:  []int{},
+			}
+		}
+		sessions = append(sessions, summary)
+	}
+	if active != nil {
+		sessions = append(sessions, *active)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Start.After(sessions[j].Start)
+	})
+	return sessions, nil
+}
+
+// sessionFormat returns the format a session was recorded in, from its
+// summary or else from its data file
+func (r *SessionRecorder) sessionFormat(id string) (string, error) {
+	var summary SessionSummary
+	if data, err := os.ReadFile(r.summaryPath(id)); err == nil && json.Unmarshal(data, &summary) == nil && summary.Format != "" {
+		return summary.Format, nil
+	}
+	for _, format := range []string{SessionFormatNDJSON, SessionFormatCSV} {
+		if _, err := os.Stat(r.dataPath(id, format)); err == nil {
+			return format, nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// sessionExists reports whether any file of a session is on disk
+func (r *SessionRecorder) sessionExists(id string) bool {
+	for _, path := range []string{r.summaryPath(id), r.dataPath(id, SessionFormatNDJSON), r.dataPath(id, SessionFormatCSV)} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteSession removes a finished session and its summary
+func (r *SessionRecorder) DeleteSession(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.active != nil && r.active.summary.ID == id {
+		return fmt.Errorf("session %s is still recording", id)
+	}
+	format, err := r.sessionFormat(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(r.dataPath(id, format)); err != nil {
+		return err
+	}
+	if err := os.Remove(r.summaryPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// HandleSessions serves GET /api/v1/stats/sessions
+func (r *SessionRecorder) HandleSessions(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessions, err := r.Sessions()
+	if err != nil {
+		log.Printf("Error listing sessions: %v", err)
+		http.Error(w, "Failed to list sessions", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// HandleSession serves GET (download) and DELETE /api/v1/stats/sessions/{id}
+func (r *SessionRecorder) HandleSession(w http.ResponseWriter, req *http.Request, id string) {
+	if !sessionIDPattern.MatchString(id) {
+		http.Error(w, "Invalid session id", http.StatusBadRequest)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		format, err := r.sessionFormat(id)
+		if err != nil {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		path := r.dataPath(id, format)
+		if format == SessionFormatCSV {
+			w.Header().Set("Content-Type", "text/csv")
+		} else {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+		http.ServeFile(w, req, path)
+	case http.MethodDelete:
+		if err := r.DeleteSession(id); err != nil {
+			if os.IsNotExist(err) {
+				http.Error(w, "Session not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *SessionRecorder) dataPath(id, format string) string {
+	return filepath.Join(r.dir, id+"."+format)
+}
+
+func (r *SessionRecorder) summaryPath(id string) string {
+	return filepath.Join(r.dir, id+".json")
+}
+
+// frequencyToChannel converts a WiFi center frequency in MHz to its channel number
+func frequencyToChannel(freq uint32) int {
+	switch {
+	case freq == 2484:
+		return 14
+	case freq >= 2412 && freq < 2484:
+		return int(freq-2407) / 5
+	case freq >= 5000 && freq < 5925:
+		return int(freq-5000) / 5
+	default:
+		return 0
+	}
+}
+
+func appendUniqueInt(list []int, v int) []int {
+	for _, x := range list {
+		if x == v {
+			return list
+		}
+	}
+	return append(list, v)
+}
+
+func joinInt8(values []int8) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, ";")
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// videoStats wraps stream stats in a snapshot produced by a video stream update
+func videoStats(st WFBStreamStats) *WFBStats {
+	return &WFBStats{WFBStreamStats: st, primaryUpdate: true}
+}
+
+func TestSessionRecorder(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewSessionRecorder(NewWFBStatsService(), dir, SessionFormatNDJSON, 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.running.Store(true)
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// No packets: nothing is recorded. wfb-ng counted packets before.
+	totals := WFBPacketTotals{All: 5000, Lost: 20, FecRecovered: 60}
+	r.record(videoStats(WFBStreamStats{wfbTotals: totals}), start.Add(-time.Second))
+	if sessions, _ := r.Sessions(); len(sessions) != 0 {
+		t.Fatalf("Expected no sessions, got %d", len(sessions))
+	}
+
+	updates := []WFBStreamStats{
+		{Rssi: []int8{-60, -65}, VideoPacketsPerSec: 900, LostPacketsPerSec: 0, FecPacketsPerSec: 10, Frequency: 5825, McsIndex: 2},
+		{Rssi: []int8{-72, -68}, VideoPacketsPerSec: 800, LostPacketsPerSec: 100, FecPacketsPerSec: 30, Frequency: 5825, McsIndex: 1},
+		{Rssi: []int8{-90}, Frequency: 5825, McsIndex: 1},
+	}
+	// wfb-ng's totals count what the rates only sample
+	for i, stats := range updates {
+		totals.All += uint64(stats.VideoPacketsPerSec) + 10
+		totals.Lost += uint64(stats.LostPacketsPerSec)
+		totals.FecRecovered += uint64(stats.FecPacketsPerSec)
+		stats.wfbTotals = totals
+		r.record(videoStats(stats), start.Add(time.Duration(i)*time.Second))
+	}
+
+	// Other streams don't count towards the session
+	r.record(&WFBStats{WFBStreamStats: WFBStreamStats{ID: "mavlink rx", Rssi: []int8{-99}}, Source: "mavlink rx"}, start.Add(2*time.Second))
+
+	sessions, _ := r.Sessions()
+	if len(sessions) != 1 || !sessions[0].Active {
+		t.Fatalf("Expected one active session, got %+v", sessions)
+	}
+
+	// Quiet period elapses
+	r.expire(start.Add(5 * time.Second))
+
+	sessions, _ = r.Sessions()
+	if len(sessions) != 1 || sessions[0].Active {
+		t.Fatalf("Expected one finished session, got %+v", sessions)
+	}
+	s := sessions[0]
+	if s.Updates != 3 || s.DurationSec != 2 {
+		t.Errorf("Expected 3 updates over 2s, got %d over %.1fs", s.Updates, s.DurationSec)
+	}
+	if s.MinRssi != -90 {
+		t.Errorf("Expected min RSSI -90, got %d", s.MinRssi)
+	}
+	if s.Packets != 1730 || s.Lost != 100 || s.LossPercent != 100.0/1830*100 {
+		t.Errorf("Unexpected loss totals: %+v", s)
+	}
+	if s.FecRecovered != 40 {
+		t.Errorf("Expected 40 FEC recovered, got %d", s.FecRecovered)
+	}
+	if len(s.Channels) != 1 || s.Channels[0] != 165 {
+		t.Errorf("Expected channel 165, got %v", s.Channels)
+	}
+	if len(s.McsIndexes) != 2 {
+		t.Errorf("Expected MCS 2 and 1, got %v", s.McsIndexes)
+	}
+
+	// Download
+	rec := httptest.NewRecorder()
+	r.HandleSession(rec, httptest.NewRequest(http.MethodGet, "/", nil), s.ID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Download returned %d", rec.Code)
+	}
+	scanner := bufio.NewScanner(strings.NewReader(rec.Body.String()))
+	lines := 0
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("Invalid NDJSON line: %v", err)
+		}
+		if _, ok := line["time"]; !ok {
+			t.Error("Record missing time")
+		}
+		lines++
+	}
+	if lines != 3 {
+		t.Errorf("Expected 3 records, got %d", lines)
+	}
+
+	// Delete
+	rec = httptest.NewRecorder()
+	r.HandleSession(rec, httptest.NewRequest(http.MethodDelete, "/", nil), s.ID)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Delete returned %d", rec.Code)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected empty sessions dir, got %d files", len(entries))
+	}
+
+	rec = httptest.NewRecorder()
+	r.HandleSession(rec, httptest.NewRequest(http.MethodGet, "/", nil), "../etc")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid id, got %d", rec.Code)
+	}
+}
+
+func TestSessionRecorderRecovery(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewSessionRecorder(NewWFBStatsService(), dir, SessionFormatNDJSON, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.running.Store(true)
+
+	// Two sessions starting within the same second
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)
+	for i := 0; i < 2; i++ {
+		r.record(videoStats(WFBStreamStats{VideoPacketsPerSec: 100}), start)
+		r.closeSession(start)
+	}
+
+	// Cut off by a power loss, recorded before the format changed
+	crashed := "20240501-130000"
+	if err := os.WriteFile(filepath.Join(dir, crashed+".csv"), []byte("time\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r.format = SessionFormatCSV
+
+	sessions, err := r.Sessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 3 || sessions[0].ID != crashed || sessions[0].Format != SessionFormatCSV || sessions[0].SizeBytes != 5 {
+		t.Fatalf("Expected the cut off session listed first, got %+v", sessions)
+	}
+	if sessions[1].ID == sessions[2].ID || sessions[1].Format != SessionFormatNDJSON {
+		t.Errorf("Expected two distinct ndjson sessions, got %+v", sessions[1:])
+	}
+
+	// Served and deleted in the format they were recorded in
+	rec := httptest.NewRecorder()
+	r.HandleSession(rec, httptest.NewRequest(http.MethodGet, "/", nil), sessions[1].ID)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("Expected the ndjson session downloaded, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	for _, s := range sessions {
+		rec := httptest.NewRecorder()
+		r.HandleSession(rec, httptest.NewRequest(http.MethodDelete, "/", nil), s.ID)
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("Expected %s deleted, got %d", s.ID, rec.Code)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected empty sessions dir, got %d files", len(entries))
+	}
+}
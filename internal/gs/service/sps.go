@@ -0,0 +1,264 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errSPSTruncated = errors.New("truncated SPS")
+
+// bitReader reads the bit fields and Exp-Golomb codes of parameter sets
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+	err  error
+}
+
+func (r *bitReader) bits(n int) uint64 {
+	var v uint64
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			r.err = errSPSTruncated
+			return 0
+		}
+		bit := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+		v = v<<1 | uint64(bit)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) flag() bool {
+	return r.bits(1) == 1
+}
+
+func (r *bitReader) skip(n int) {
+	r.bits(n)
+}
+
+// ue reads an unsigned Exp-Golomb code
+func (r *bitReader) ue() uint64 {
+	zeros := 0
+	for !r.flag() {
+		if r.err != nil || zeros > 31 {
+			r.err = errSPSTruncated
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+// se reads a signed Exp-Golomb code
+func (r *bitReader) se() int64 {
+	v := r.ue()
+	if v%2 == 1 {
+		return int64(v+1) / 2
+	}
+	return -int64(v / 2)
+}
+
+// nalRBSP removes the emulation prevention bytes of a NAL unit
+func nalRBSP(nalu []byte) []byte {
+	rbsp := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// spsInfo is what players need to know from a sequence parameter set
+type spsInfo struct {
+	Width  int
+	Height int
+
+	// H264: profile_idc, constraint flags and level_idc
+	ProfileIDC     byte
+	Compatibility  byte
+	LevelIDC       byte
+	ChromaFormat   int
+	BitDepthLuma   int
+	BitDepthChroma int
+
+	// H265 profile_tier_level and sub-layer fields for the hvcC record
+	ProfileSpace       byte
+	Tier               byte
+	CompatibilityFlags uint32
+	ConstraintFlags    uint64 // 48 bits
+	MaxSubLayers       int
+	TemporalIDNesting  bool
+}
+
+// parseSPS parses the SPS of either codec
+func parseSPS(codec string, nalu []byte) (spsInfo, error) {
+	if codec == CodecH264 {
+		return parseH264SPS(nalu)
+	}
+	return parseH265SPS(nalu)
+}
+
+// parseH264SPS parses an H264 SPS (ITU-T H.264 7.3.2.1.1)
+func parseH264SPS(nalu []byte) (spsInfo, error) {
+	if len(nalu) < 4 || h264NALUType(nalu) != 7 {
+		return spsInfo{}, fmt.Errorf("not an H264 SPS")
+	}
+	r := &bitReader{data: nalRBSP(nalu[h264NALUHeaderSize:])}
+	info := spsInfo{ChromaFormat: 1, BitDepthLuma: 8, BitDepthChroma: 8}
+	info.ProfileIDC = byte(r.bits(8))
+	info.Compatibility = byte(r.bits(8))
+	info.LevelIDC = byte(r.bits(8))
+	r.ue() // seq_parameter_set_id
+
+	switch info.ProfileIDC {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		info.ChromaFormat = int(r.ue())
+		if info.ChromaFormat == 3 {
+			r.skip(1) // separate_colour_plane_flag
+		}
+		info.BitDepthLuma = int(r.ue()) + 8
+		info.BitDepthChroma = int(r.ue()) + 8
+		r.skip(1) // qpprime_y_zero_transform_bypass_flag
+		if r.flag() {
+			lists := 8
+			if info.ChromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if !r.flag() {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int64(8), int64(8)
+				for j := 0; j < size && next != 0; j++ {
+					next = (last + r.se() + 256) % 256
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.skip(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		cycle := r.ue()
+		for i := uint64(0); i < cycle && r.err == nil; i++ {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.skip(1) // gaps_in_frame_num_value_allowed_flag
+	widthMBs := int(r.ue()) + 1
+	heightMapUnits := int(r.ue()) + 1
+	frameMBsOnly := r.flag()
+	if !frameMBsOnly {
+		r.skip(1) // mb_adaptive_frame_field_flag
+	}
+	r.skip(1) // direct_8x8_inference_flag
+
+	fieldFactor := 2
+	if frameMBsOnly {
+		fieldFactor = 1
+	}
+	info.Width = widthMBs * 16
+	info.Height = fieldFactor * heightMapUnits * 16
+	if r.flag() {
+		left, right, top, bottom := int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+		cropX, cropY := 1, fieldFactor
+		switch info.ChromaFormat {
+		case 1:
+			cropX, cropY = 2, 2*fieldFactor
+		case 2:
+			cropX = 2
+		}
+		info.Width -= cropX * (left + right)
+		info.Height -= cropY * (top + bottom)
+	}
+	if r.err != nil {
+		return spsInfo{}, r.err
+	}
+	return info, nil
+}
+
+// parseH265SPS parses an H265 SPS up to the bit depths (ITU-T H.265
+// 7.3.2.2.1)
+func parseH265SPS(nalu []byte) (spsInfo, error) {
+	if len(nalu) < 3 || h265NALUType(nalu) != 33 {
+		return spsInfo{}, fmt.Errorf("not an H265 SPS")
+	}
+	r := &bitReader{data: nalRBSP(nalu[h265NALUHeaderSize:])}
+	var info spsInfo
+	r.skip(4) // sps_video_parameter_set_id
+	info.MaxSubLayers = int(r.bits(3)) + 1
+	info.TemporalIDNesting = r.flag()
+
+	// profile_tier_level with the general profile
+	info.ProfileSpace = byte(r.bits(2))
+	info.Tier = byte(r.bits(1))
+	info.ProfileIDC = byte(r.bits(5))
+	info.CompatibilityFlags = uint32(r.bits(32))
+	info.ConstraintFlags = r.bits(48)
+	info.LevelIDC = byte(r.bits(8))
+	subProfile := make([]bool, info.MaxSubLayers-1)
+	subLevel := make([]bool, info.MaxSubLayers-1)
+	for i := range subProfile {
+		subProfile[i] = r.flag()
+		subLevel[i] = r.flag()
+	}
+	if info.MaxSubLayers > 1 {
+		r.skip(2 * (9 - info.MaxSubLayers)) // reserved_zero_2bits
+	}
+	for i := range subProfile {
+		if subProfile[i] {
+			r.skip(88)
+		}
+		if subLevel[i] {
+			r.skip(8)
+		}
+	}
+
+	r.ue() // sps_seq_parameter_set_id
+	info.ChromaFormat = int(r.ue())
+	if info.ChromaFormat == 3 {
+		r.skip(1) // separate_colour_plane_flag
+	}
+	info.Width = int(r.ue())
+	info.Height = int(r.ue())
+	if r.flag() {
+		left, right, top, bottom := int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+		cropX, cropY := 1, 1
+		switch info.ChromaFormat {
+		case 1:
+			cropX, cropY = 2, 2
+		case 2:
+			cropX = 2
+		}
+		info.Width -= cropX * (left + right)
+		info.Height -= cropY * (top + bottom)
+	}
+	info.BitDepthLuma = int(r.ue()) + 8
+	info.BitDepthChroma = int(r.ue()) + 8
+	if r.err != nil {
+		return spsInfo{}, r.err
+	}
+	return info, nil
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// Parameter sets of real encoders
+const (
+	testH264SPS720p  = "6742c01fda014016e840000003004000000c83c60ca8"
+	testH264SPS1080p = "67640028acd940780227e5c044000003000400000300f03c60c658"
+	testH265SPS1080p = "420101016000000300900000030000030078a003c08010e596666924cae010000003001000000301e080"
+)
+
+func testHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParseSPS(t *testing.T) {
+	for _, c := range []struct {
+		codec, sps    string
+		width, height int
+		profile       byte
+		level         byte
+	}{
+		// Baseline with emulation prevention bytes
+		{CodecH264, testH264SPS720p, 1280, 720, 66, 31},
+		// High profile with cropping 1088 down to 1080
+		{CodecH264, testH264SPS1080p, 1920, 1080, 100, 40},
+		{CodecH265, testH265SPS1080p, 1920, 1080, 1, 120},
+	} {
+		info, err := parseSPS(c.codec, testHex(t, c.sps))
+		if err != nil {
+			t.Fatalf("%s: %v", c.sps, err)
+		}
+		if info.Width != c.width || info.Height != c.height || info.ProfileIDC != c.profile || info.LevelIDC != c.level {
+			t.Errorf("%s: unexpected %+v", c.sps, info)
+		}
+	}
+
+	if _, err := parseSPS(CodecH264, []byte{0x67, 0x42, 0xc0, 0x1f}); err == nil {
+		t.Error("Expected an error for a truncated SPS")
+	}
+}
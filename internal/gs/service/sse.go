@@ -0,0 +1,50 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// startSSE prepares the response for a server-sent events stream
+func startSSE(w http.ResponseWriter) (http.Flusher, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return flusher, true
+}
+
+// writeSSE writes a single JSON encoded event and flushes it to the client
+func writeSSE(w http.ResponseWriter, flusher http.Flusher, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// sseKeepaliveInterval is how often idle streams send a comment line so
+// proxies and browsers don't time the connection out
+const sseKeepaliveInterval = 15 * time.Second
+
+// writeSSEKeepalive writes a comment line to keep an idle stream open
+func writeSSEKeepalive(w http.ResponseWriter, flusher http.Flusher) error {
+	if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
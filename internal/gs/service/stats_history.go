@@ -0,0 +1,251 @@
+package service
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// historyRawWindow is how long per-second samples are kept before they
+	// are folded into downsampled buckets
+	historyRawWindow = 5 * time.Minute
+	// historyBucketSize is the resolution of downsampled history
+	historyBucketSize = 10 * time.Second
+)
+
+// HistoryValue is the min/avg/max of a metric over a time bucket
+type HistoryValue struct {
+	Min float64 `json:"min"`
+	Avg float64 `json:"avg"`
+	Max float64 `json:"max"`
+
+	sum float64
+	n   int
+}
+
+func newHistoryValue(v float64) HistoryValue {
+	return HistoryValue{Min: v, Avg: v, Max: v, sum: v, n: 1}
+}
+
+func (h *HistoryValue) merge(o HistoryValue) {
+	if o.n == 0 {
+		return
+	}
+	if h.n == 0 {
+		*h = o
+		return
+	}
+	h.Min = math.Min(h.Min, o.Min)
+	h.Max = math.Max(h.Max, o.Max)
+	h.sum += o.sum
+	h.n += o.n
+	h.Avg = h.sum / float64(h.n)
+}
+
+// HistoryPoint holds aggregated link statistics for one time bucket
+type HistoryPoint struct {
+	Time      int64          `json:"time"`     // Bucket start, unix seconds
+	Duration  int64          `json:"duration"` // Bucket length in seconds
+	Rssi      []HistoryValue `json:"rssi"`
+	Snr       []HistoryValue `json:"snr"`
+	Packets   HistoryValue   `json:"packets"`
+	Lost      HistoryValue   `json:"lost"`
+	FecRec    HistoryValue   `json:"fec_rec"`
+	Bad       HistoryValue   `json:"bad"`
+	Flow      HistoryValue   `json:"flow"`
+	Mcs       HistoryValue   `json:"mcs"`
+	Frequency HistoryValue   `json:"frequency"`
+}
+
+func newHistoryPoint(stats *WFBStats, sec int64) HistoryPoint {
+	p := HistoryPoint{
+		Time:      sec,
+		Duration:  1,
+		Rssi:      make([]HistoryValue, len(stats.Rssi)),
+		Snr:       make([]HistoryValue, len(stats.Snr)),
+		Packets:   newHistoryValue(float64(stats.VideoPacketsPerSec)),
+		Lost:      newHistoryValue(float64(stats.LostPacketsPerSec)),
+		FecRec:    newHistoryValue(float64(stats.FecPacketsPerSec)),
+		Bad:       newHistoryValue(float64(stats.BadBlocksPerSec)),
+		Flow:      newHistoryValue(float64(stats.LinkFlowBytesPerSec)),
+		Mcs:       newHistoryValue(float64(stats.McsIndex)),
+		Frequency: newHistoryValue(float64(stats.Frequency)),
+	}
+	for i, v := range stats.Rssi {
+		p.Rssi[i] = newHistoryValue(float64(v))
+	}
+	for i, v := range stats.Snr {
+		p.Snr[i] = newHistoryValue(float64(v))
+	}
+	return p
+}
+
+func (p *HistoryPoint) merge(o HistoryPoint) {
+	p.Rssi = mergeHistoryValues(p.Rssi, o.Rssi)
+	p.Snr = mergeHistoryValues(p.Snr, o.Snr)
+	p.Packets.merge(o.Packets)
+	p.Lost.merge(o.Lost)
+	p.FecRec.merge(o.FecRec)
+	p.Bad.merge(o.Bad)
+	p.Flow.merge(o.Flow)
+	p.Mcs.merge(o.Mcs)
+	p.Frequency.merge(o.Frequency)
+}
+
+// mergeHistoryValues merges per-antenna values by antenna index
+func mergeHistoryValues(dst, src []HistoryValue) []HistoryValue {
+	for i, v := range src {
+		if i >= len(dst) {
+			dst = append(dst, v)
+			continue
+		}
+		dst[i].merge(v)
+	}
+	return dst
+}
+
+// historyRing is a fixed capacity FIFO of history points
+type historyRing struct {
+	points []HistoryPoint
+	head   int
+	size   int
+}
+
+func newHistoryRing(capacity int) *historyRing {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &historyRing{points: make([]HistoryPoint, capacity)}
+}
+
+// push appends a point, returning the evicted oldest point if the ring was full
+func (r *historyRing) push(p HistoryPoint) (HistoryPoint, bool) {
+	idx := (r.head + r.size) % len(r.points)
+	if r.size < len(r.points) {
+		r.points[idx] = p
+		r.size++
+		return HistoryPoint{}, false
+	}
+	evicted := r.points[r.head]
+	r.points[r.head] = p
+	r.head = (r.head + 1) % len(r.points)
+	return evicted, true
+}
+
+// last returns the newest point
+func (r *historyRing) last() *HistoryPoint {
+	if r.size == 0 {
+		return nil
+	}
+	return &r.points[(r.head+r.size-1)%len(r.points)]
+}
+
+// each calls fn for every point from oldest to newest
+func (r *historyRing) each(fn func(p HistoryPoint)) {
+	for i := 0; i < r.size; i++ {
+		fn(r.points[(r.head+i)%len(r.points)])
+	}
+}
+
+// StatsHistory keeps per-second samples of link statistics for a short
+// window and min/avg/max buckets of older data up to the retention period
+type StatsHistory struct {
+	mu        sync.Mutex
+	retention time.Duration
+	raw       *historyRing
+	buckets   *historyRing
+}
+
+// NewStatsHistory creates a history that keeps data for the given retention
+func NewStatsHistory(retention time.Duration) *StatsHistory {
+	rawWindow := historyRawWindow
+	if retention < rawWindow {
+		rawWindow = retention
+	}
+	return &StatsHistory{
+		retention: retention,
+		raw:       newHistoryRing(int(rawWindow / time.Second)),
+		buckets:   newHistoryRing(int(retention/historyBucketSize) + 1),
+	}
+}
+
+// Add records a stats update taken at the given time.
+// Updates within the same second are folded into one sample.
+func (h *StatsHistory) Add(stats *WFBStats, at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sec := at.Unix()
+	point := newHistoryPoint(stats, sec)
+
+	if last := h.raw.last(); last != nil && last.Time == sec {
+		last.merge(point)
+		return
+	}
+
+	if evicted, ok := h.raw.push(point); ok {
+		h.downsample(evicted)
+	}
+}
+
+// downsample folds a per-second sample into its bucket
+func (h *StatsHistory) downsample(p HistoryPoint) {
+	bucketSecs := int64(historyBucketSize / time.Second)
+	start := p.Time - p.Time%bucketSecs
+
+	if last := h.buckets.last(); last != nil && last.Time == start {
+		last.merge(p)
+		return
+	}
+
+	p.Time = start
+	p.Duration = bucketSecs
+	h.buckets.push(p)
+}
+
+// Query returns history between from and to, aggregated into step sized
+// buckets aligned to from. A zero step picks 1s for ranges covered by per-second samples
+// and the downsampled bucket size otherwise.
+func (h *StatsHistory) Query(from, to time.Time, step time.Duration) []HistoryPoint {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if step <= 0 {
+		step = time.Second
+		if to.Sub(from) > historyRawWindow {
+			step = historyBucketSize
+		}
+	}
+	stepSecs := int64(step / time.Second)
+	if stepSecs < 1 {
+		stepSecs = 1
+	}
+
+	cutoff := time.Now().Add(-h.retention).Unix()
+	fromSec, toSec := from.Unix(), to.Unix()
+
+	result := []HistoryPoint{}
+	add := func(p HistoryPoint) {
+		if p.Time < fromSec || p.Time > toSec || p.Time < cutoff {
+			return
+		}
+		start := fromSec + (p.Time-fromSec)/stepSecs*stepSecs
+		if n := len(result); n > 0 && result[n-1].Time == start {
+			result[n-1].merge(p)
+			return
+		}
+		// Deep copy the antenna slices so merging never touches stored points
+		p.Rssi = append([]HistoryValue(nil), p.Rssi...)
+		p.Snr = append([]HistoryValue(nil), p.Snr...)
+		p.Time = start
+		if p.Duration < stepSecs {
+			p.Duration = stepSecs
+		}
+		result = append(result, p)
+	}
+
+	h.buckets.each(add)
+	h.raw.each(add)
+	return result
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsHistoryDownsampling(t *testing.T) {
+	h := NewStatsHistory(time.Hour)
+
+	// 10 minutes of samples ending now, two updates per second
+	end := time.Now().Truncate(10 * time.Second)
+	start := end.Add(-10 * time.Minute)
+	for ts := start; ts.Before(end); ts = ts.Add(time.Second) {
+		h.Add(videoStats(WFBStreamStats{Rssi: []int8{-60, -70}, VideoPacketsPerSec: 100}), ts)
+		h.Add(videoStats(WFBStreamStats{Rssi: []int8{-50, -70}, VideoPacketsPerSec: 300}), ts.Add(500*time.Millisecond))
+	}
+
+	// Recent data is still per second
+	recent := h.Query(end.Add(-time.Minute), end.Add(-time.Second), time.Second)
+	if len(recent) != 60 {
+		t.Fatalf("Expected 60 per-second points, got %d", len(recent))
+	}
+	p := recent[0]
+	if p.Packets.Min != 100 || p.Packets.Max != 300 || p.Packets.Avg != 200 {
+		t.Errorf("Unexpected packets aggregate: %+v", p.Packets)
+	}
+	if len(p.Rssi) != 2 || p.Rssi[0].Min != -60 || p.Rssi[0].Max != -50 || p.Rssi[1].Avg != -70 {
+		t.Errorf("Unexpected RSSI aggregate: %+v", p.Rssi)
+	}
+
+	// Old data has been folded into 10s buckets
+	old := h.Query(start, start.Add(59*time.Second), time.Second)
+	if len(old) != 6 {
+		t.Fatalf("Expected 6 downsampled points, got %d", len(old))
+	}
+	if old[0].Duration != 10 || old[0].Packets.Avg != 200 {
+		t.Errorf("Unexpected downsampled point: %+v", old[0])
+	}
+
+	// Default step over the full range uses the bucket size
+	all := h.Query(start, end, 0)
+	if len(all) != 60 {
+		t.Errorf("Expected 60 points for the full range, got %d", len(all))
+	}
+
+	// Coarser steps re-aggregate
+	minutes := h.Query(start, end, time.Minute)
+	if len(minutes) != 10 {
+		t.Errorf("Expected 10 one-minute points, got %d", len(minutes))
+	}
+}
+
+func TestStatsHistoryRetention(t *testing.T) {
+	h := NewStatsHistory(30 * time.Second)
+
+	now := time.Now()
+	for i := 120; i > 0; i-- {
+		h.Add(videoStats(WFBStreamStats{VideoPacketsPerSec: i}), now.Add(-time.Duration(i)*time.Second))
+	}
+
+	points := h.Query(now.Add(-time.Hour), now, time.Second)
+	if len(points) == 0 || len(points) > 30 {
+		t.Fatalf("Expected at most 30 points within retention, got %d", len(points))
+	}
+	if oldest := now.Unix() - points[0].Time; oldest > 30 {
+		t.Errorf("Point %ds old returned despite 30s retention", oldest)
+	}
+}
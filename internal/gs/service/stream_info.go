@@ -0,0 +1,464 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gilankpam/openipc-gs-web/internal/models"
+)
+
+const (
+	// streamInfoWindow is how long frame and bit rates are averaged over
+	streamInfoWindow = time.Second
+	// streamInfoStale is how long after the last frame rates read as zero
+	streamInfoStale = 2 * time.Second
+	// streamInfoGOPs is how many keyframe intervals are kept
+	streamInfoGOPs = 8
+	// videoSettingsInterval is how often the air unit's settings are read
+	videoSettingsInterval = 10 * time.Second
+	// streamInfoIdle is how long frames are analyzed after the last request
+	streamInfoIdle = 30 * time.Second
+)
+
+// StreamInfo describes the received video stream
+type StreamInfo struct {
+	Codec         string   `json:"codec"`
+	Width         int      `json:"width"`
+	Height        int      `json:"height"`
+	Profile       string   `json:"profile"`
+	Level         string   `json:"level"`
+	ChromaFormat  string   `json:"chroma_format"`
+	BitDepth      int      `json:"bit_depth"`
+	ParameterSets []string `json:"parameter_sets"` // Kinds seen, e.g. VPS, SPS, PPS
+
+	FPS         float64 `json:"fps"`
+	BitrateKbps float64 `json:"bitrate_kbps"` // Video payload
+	IngestKbps  float64 `json:"ingest_kbps"`  // RTP packets as received
+	// Frames between the last two keyframes and the longest recent
+	// keyframe interval. Keyframes requested for viewers shorten the
+	// interval they fall in, so the longest is the encoder's GOP.
+	GOPFrames           int     `json:"gop_frames"`
+	KeyframeIntervalSec float64 `json:"keyframe_interval_sec"`
+
+	Frames           uint64            `json:"frames"`
+	IncompleteFrames uint64            `json:"incomplete_frames"`
+	NALUTypes        map[string]uint64 `json:"nalu_types"`
+
+	// The air unit's video settings, and where the stream disagrees
+	Configured *models.VideoSettings `json:"configured"`
+	Mismatches []StreamMismatch      `json:"mismatches"`
+}
+
+// StreamMismatch is a video setting the received stream doesn't match
+type StreamMismatch struct {
+	Setting    string `json:"setting"`
+	Configured string `json:"configured"`
+	Received   string `json:"received"`
+}
+
+// StreamAnalyzer measures the received stream: parameters from its SPS,
+// frame rate, bitrate, keyframe interval and NAL unit types. Frames are
+// only analyzed while the info is being requested, so in RTP mode the
+// stream doesn't reassemble them for nothing.
+type StreamAnalyzer struct {
+	stream   *StreamServer
+	settings func() (*models.VideoSettings, error)
+	running  atomic.Bool
+	stopCh   chan struct{}
+
+	mu          sync.Mutex
+	info        StreamInfo
+	sps         []byte
+	lastFrame   time.Time
+	configured  *models.VideoSettings
+	sub         *Subscription[*VideoFrame]
+	lastRequest time.Time
+
+	// Current rate window
+	windowStart  time.Time
+	windowFrames int
+	windowBytes  int
+	windowIngest uint64
+
+	// Keyframe interval tracking
+	haveKeyframe        bool
+	keyframeTS          uint32
+	framesSinceKeyframe int
+	intervals           []float64
+}
+
+// NewStreamAnalyzer creates an analyzer of a stream
+func NewStreamAnalyzer(stream *StreamServer) *StreamAnalyzer {
+	return &StreamAnalyzer{
+		stream: stream,
+		stopCh: make(chan struct{}),
+	}
+}
+
+// WithVideoSettingsSource sets where the air unit's video settings are read
+// from (e.g. AirUnitVideoSettingsSource) to compare the stream with
+func (a *StreamAnalyzer) WithVideoSettingsSource(source func() (*models.VideoSettings, error)) *StreamAnalyzer {
+	a.settings = source
+	return a
+}
+
+// Start begins reading the air unit's settings. Frames are analyzed once
+// the info is requested.
+func (a *StreamAnalyzer) Start() {
+	a.running.Store(true)
+	if a.settings != nil {
+		go a.pollSettings()
+	}
+}
+
+// Stop ends the analysis
+func (a *StreamAnalyzer) Stop() {
+	if a.running.CompareAndSwap(true, false) {
+		close(a.stopCh)
+	}
+}
+
+// watch analyzes frames from now until streamInfoIdle passes without a
+// request. In RTP mode the stream reassembles frames for it meanwhile.
+func (a *StreamAnalyzer) watch(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lastRequest = now
+	if a.sub != nil || !a.running.Load() {
+		return
+	}
+	// Rates and keyframe intervals don't span the time frames were skipped
+	a.windowStart = time.Time{}
+	a.windowFrames = 0
+	a.windowBytes = 0
+	a.haveKeyframe = false
+	a.framesSinceKeyframe = 0
+	a.sub = a.stream.SubscribeFrames()
+	go a.run(a.sub)
+}
+
+func (a *StreamAnalyzer) run(sub *Subscription[*VideoFrame]) {
+	defer func() {
+		a.mu.Lock()
+		if a.sub == sub {
+			a.sub = nil
+		}
+		a.mu.Unlock()
+		sub.Close()
+	}()
+	ticker := time.NewTicker(streamInfoIdle / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.stopCh:
+			return
+		case frame, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			a.observe(frame, time.Now())
+		case now := <-ticker.C:
+			if a.idle(now) {
+				return
+			}
+		}
+	}
+}
+
+// idle stops the analysis once nobody requested the info for a while
+func (a *StreamAnalyzer) idle(now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.lastRequest) < streamInfoIdle {
+		return false
+	}
+	a.sub = nil
+	return true
+}
+
+func (a *StreamAnalyzer) pollSettings() {
+	ticker := time.NewTicker(videoSettingsInterval)
+	defer ticker.Stop()
+
+	for {
+		// The last settings read are kept while the air unit is unreachable
+		if settings, err := a.settings(); err == nil {
+			a.mu.Lock()
+			a.configured = settings
+			a.mu.Unlock()
+		}
+
+		select {
+		case <-a.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// observe accounts for a received frame
+func (a *StreamAnalyzer) observe(frame *VideoFrame, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if frame.Codec != a.info.Codec {
+		a.reset(frame.Codec)
+	}
+	a.lastFrame = now
+	a.info.Frames++
+	if !frame.Complete {
+		a.info.IncompleteFrames++
+	}
+
+	size := 0
+	for _, nalu := range frame.NALUs {
+		if len(nalu) == 0 {
+			continue
+		}
+		size += len(nalu)
+		typ := naluType(frame.Codec, nalu)
+		a.info.NALUTypes[naluTypeName(frame.Codec, typ)]++
+		a.observeParamSet(frame.Codec, typ, nalu)
+	}
+
+	if frame.Keyframe {
+		if a.haveKeyframe {
+			a.info.GOPFrames = a.framesSinceKeyframe
+			interval := float64(frame.Timestamp-a.keyframeTS) / rtpVideoClockRate
+			a.intervals = append(a.intervals, interval)
+			if len(a.intervals) > streamInfoGOPs {
+				a.intervals = a.intervals[1:]
+			}
+		}
+		a.haveKeyframe = true
+		a.keyframeTS = frame.Timestamp
+		a.framesSinceKeyframe = 0
+	}
+	a.framesSinceKeyframe++
+
+	// The frame opening a window only marks its start
+	if a.windowStart.IsZero() {
+		a.windowStart = now
+		a.windowIngest = a.stream.ingestBytes.Load()
+		return
+	}
+	a.windowFrames++
+	a.windowBytes += size
+	if elapsed := now.Sub(a.windowStart).Seconds(); elapsed >= streamInfoWindow.Seconds() {
+		ingest := a.stream.ingestBytes.Load()
+		a.info.FPS = float64(a.windowFrames) / elapsed
+		a.info.BitrateKbps = float64(a.windowBytes) * 8 / elapsed / 1000
+		a.info.IngestKbps = float64(ingest-a.windowIngest) * 8 / elapsed / 1000
+		a.windowStart = now
+		a.windowFrames = 0
+		a.windowBytes = 0
+		a.windowIngest = ingest
+	}
+}
+
+// reset starts over for a new codec
+func (a *StreamAnalyzer) reset(codec string) {
+	a.info = StreamInfo{Codec: codec, NALUTypes: make(map[string]uint64)}
+	a.sps = nil
+	a.windowStart = time.Time{}
+	a.windowFrames = 0
+	a.windowBytes = 0
+	a.haveKeyframe = false
+	a.framesSinceKeyframe = 0
+	a.intervals = nil
+}
+
+// observeParamSet records parameter set kinds and parses new SPSs
+func (a *StreamAnalyzer) observeParamSet(codec string, typ byte, nalu []byte) {
+	var name string
+	for _, t := range paramSetTypes(codec) {
+		if t == typ {
+			name = naluTypeName(codec, typ)
+		}
+	}
+	if name == "" {
+		return
+	}
+	if !slices.Contains(a.info.ParameterSets, name) {
+		a.info.ParameterSets = append(a.info.ParameterSets, name)
+	}
+
+	if name != "SPS" || bytes.Equal(nalu, a.sps) {
+		return
+	}
+	sps, err := parseSPS(codec, nalu)
+	if err != nil {
+		return
+	}
+	a.sps = append(a.sps[:0], nalu...)
+	a.info.Width = sps.Width
+	a.info.Height = sps.Height
+	a.info.Profile = profileName(codec, sps)
+	a.info.Level = levelName(codec, sps.LevelIDC)
+	a.info.ChromaFormat = chromaFormatName(sps.ChromaFormat)
+	a.info.BitDepth = sps.BitDepthLuma
+}
+
+// Info returns what was measured, compared with the air unit's settings
+func (a *StreamAnalyzer) Info() StreamInfo {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	info := a.info
+	info.NALUTypes = make(map[string]uint64, len(a.info.NALUTypes))
+	for name, n := range a.info.NALUTypes {
+		info.NALUTypes[name] = n
+	}
+	info.ParameterSets = append([]string{}, a.info.ParameterSets...)
+	for _, interval := range a.intervals {
+		info.KeyframeIntervalSec = math.Max(info.KeyframeIntervalSec, interval)
+	}
+	if time.Since(a.lastFrame) > streamInfoStale {
+		info.FPS = 0
+		info.BitrateKbps = 0
+		info.IngestKbps = 0
+	}
+	info.Configured = a.configured
+	info.Mismatches = info.compare(a.configured)
+	return info
+}
+
+// compare lists where the stream disagrees with the air unit's settings.
+// Rates are only compared while video arrives.
+func (info *StreamInfo) compare(cfg *models.VideoSettings) []StreamMismatch {
+	mismatches := []StreamMismatch{}
+	if cfg == nil || info.Codec == "" {
+		return mismatches
+	}
+	add := func(setting, configured, received string) {
+		mismatches = append(mismatches, StreamMismatch{setting, configured, received})
+	}
+
+	if cfg.Codec != nil && normalizeCodec(*cfg.Codec) != info.Codec {
+		add("codec", *cfg.Codec, info.Codec)
+	}
+	if received := fmt.Sprintf("%dx%d", info.Width, info.Height); cfg.Resolution != nil && info.Width > 0 && *cfg.Resolution != received {
+		add("resolution", *cfg.Resolution, received)
+	}
+	if info.FPS == 0 {
+		return mismatches
+	}
+	// Within 10%, a frame or two is lost or late every second
+	if cfg.Fps != nil && *cfg.Fps > 0 && math.Abs(info.FPS-float64(*cfg.Fps)) > math.Max(1, 0.1*float64(*cfg.Fps)) {
+		add("fps", strconv.Itoa(*cfg.Fps), strconv.FormatFloat(info.FPS, 'f', 1, 64))
+	}
+	// The encoder's rate control swings around its target, and static
+	// scenes need much less
+	if cfg.Bitrate != nil && *cfg.Bitrate > 0 {
+		target := float64(*cfg.Bitrate)
+		if info.BitrateKbps > 1.25*target || info.BitrateKbps < 0.5*target {
+			add("bitrate", strconv.Itoa(*cfg.Bitrate), strconv.FormatFloat(info.BitrateKbps, 'f', 0, 64))
+		}
+	}
+	// Majestic's GOP size is in seconds
+	if cfg.GopSize != nil && *cfg.GopSize > 0 && info.KeyframeIntervalSec > 0 {
+		gop := float64(*cfg.GopSize)
+		if math.Abs(info.KeyframeIntervalSec-gop) > 0.2*gop+0.1 {
+			add("gop_size", strconv.Itoa(*cfg.GopSize), strconv.FormatFloat(info.KeyframeIntervalSec, 'f', 2, 64))
+		}
+	}
+	return mismatches
+}
+
+// HandleInfo serves GET /api/v1/stream/info
+func (a *StreamAnalyzer) HandleInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a.watch(time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.Info())
+}
+
+// naluTypeName names the common NAL unit types of a codec
+func naluTypeName(codec string, typ byte) string {
+	names := map[byte]string{1: "non-IDR", 5: "IDR", 6: "SEI", 7: "SPS", 8: "PPS", 9: "AUD", 12: "filler"}
+	if codec == CodecH265 {
+		names = map[byte]string{
+			0: "TRAIL_N", 1: "TRAIL_R", 2: "TSA_N", 3: "TSA_R", 4: "STSA_N", 5: "STSA_R",
+			6: "RADL_N", 7: "RADL_R", 8: "RASL_N", 9: "RASL_R",
+			16: "BLA_W_LP", 17: "BLA_W_RADL", 18: "BLA_N_LP", 19: "IDR_W_RADL", 20: "IDR_N_LP", 21: "CRA",
+			32: "VPS", 33: "SPS", 34: "PPS", 35: "AUD", 38: "filler", 39: "SEI", 40: "SEI",
+		}
+	}
+	if name, ok := names[typ]; ok {
+		return name
+	}
+	return strconv.Itoa(int(typ))
+}
+
+func profileName(codec string, sps spsInfo) string {
+	if codec == CodecH265 {
+		switch sps.ProfileIDC {
+		case 1:
+			return "Main"
+		case 2:
+			return "Main 10"
+		case 3:
+			return "Main Still Picture"
+		case 4:
+			return "Range Extensions"
+		}
+		return strconv.Itoa(int(sps.ProfileIDC))
+	}
+	switch sps.ProfileIDC {
+	case 66:
+		// constraint_set1_flag
+		if sps.Compatibility&0x40 != 0 {
+			return "Constrained Baseline"
+		}
+		return "Baseline"
+	case 77:
+		return "Main"
+	case 88:
+		return "Extended"
+	case 100:
+		return "High"
+	case 110:
+		return "High 10"
+	case 122:
+		return "High 4:2:2"
+	case 244:
+		return "High 4:4:4"
+	}
+	return strconv.Itoa(int(sps.ProfileIDC))
+}
+
+// levelName formats level_idc, ten times the level in H264 and thirty
+// times in H265
+func levelName(codec string, levelIDC byte) string {
+	divisor := 10.0
+	if codec == CodecH265 {
+		divisor = 30
+	}
+	return strconv.FormatFloat(math.Round(float64(levelIDC)/divisor*10)/10, 'f', -1, 64)
+}
+
+func chromaFormatName(format int) string {
+	switch format {
+	case 0:
+		return "4:0:0"
+	case 1:
+		return "4:2:0"
+	case 2:
+		return "4:2:2"
+	case 3:
+		return "4:4:4"
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gilankpam/openipc-gs-web/internal/models"
+)
+
+func TestStreamAnalyzer(t *testing.T) {
+	stream := NewStreamServer(0)
+	a := NewStreamAnalyzer(stream)
+	sps := testHex(t, testH264SPS720p)
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+
+	// 30fps with a keyframe every 15 frames, one frame incomplete
+	start := time.Now().Add(-5 * time.Second)
+	for i := 0; i < 61; i++ {
+		au := &AccessUnit{Timestamp: uint32(i * 3000), Complete: i != 20}
+		if i%15 == 0 {
+			au.NALUs = [][]byte{sps, pps, {0x65, 0x88}}
+			au.Keyframe = true
+		} else {
+			au.NALUs = [][]byte{append([]byte{0x41}, make([]byte, 499)...)}
+		}
+		stream.ingestBytes.Add(600)
+		a.observe(&VideoFrame{Codec: CodecH264, AccessUnit: au}, start.Add(time.Duration(i)*time.Second/30))
+	}
+
+	info := a.Info()
+	if info.Width != 1280 || info.Height != 720 || info.Profile != "Constrained Baseline" || info.Level != "3.1" || info.ChromaFormat != "4:2:0" {
+		t.Errorf("Unexpected parameters %+v", info)
+	}
+	// The last frame was over two seconds ago
+	if info.FPS != 0 {
+		t.Errorf("Expected stale rates to read zero, got %.1f fps", info.FPS)
+	}
+	a.lastFrame = time.Now()
+	info = a.Info()
+	// Each second has 28 frames of 500 bytes and 2 keyframes of 28
+	if math.Abs(info.FPS-30) > 0.5 || math.Abs(info.BitrateKbps-112.5) > 1 || math.Abs(info.IngestKbps-144) > 1 {
+		t.Errorf("Expected 30fps at 112.5kbps (144 ingested), got %.1f fps at %.1f (%.1f)", info.FPS, info.BitrateKbps, info.IngestKbps)
+	}
+	if info.GOPFrames != 15 || info.KeyframeIntervalSec != 0.5 {
+		t.Errorf("Expected a 15 frame GOP of 0.5s, got %d frames of %.2fs", info.GOPFrames, info.KeyframeIntervalSec)
+	}
+	if info.Frames != 61 || info.IncompleteFrames != 1 || info.NALUTypes["IDR"] != 5 || info.NALUTypes["non-IDR"] != 56 || info.NALUTypes["SPS"] != 5 {
+		t.Errorf("Unexpected counts %+v", info)
+	}
+	if len(info.ParameterSets) != 2 || len(info.Mismatches) != 0 {
+		t.Errorf("Unexpected parameter sets %v and mismatches %v", info.ParameterSets, info.Mismatches)
+	}
+
+	// Everything but the codec disagrees
+	codec, resolution, fps, bitrate, gop := "h264", "1920x1080", 60, 4096, 1
+	a.configured = &models.VideoSettings{Codec: &codec, Resolution: &resolution, Fps: &fps, Bitrate: &bitrate, GopSize: &gop}
+	rec := httptest.NewRecorder()
+	a.HandleInfo(rec, httptest.NewRequest(http.MethodGet, "/api/v1/stream/info", nil))
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, m := range info.Mismatches {
+		got[m.Setting] = m.Received
+	}
+	want := map[string]string{"resolution": "1280x720", "fps": "30.0", "bitrate": "112", "gop_size": "0.50"}
+	if len(got) != len(want) {
+		t.Errorf("Expected mismatches %v, got %v", want, info.Mismatches)
+	}
+	for setting, received := range want {
+		if got[setting] != received {
+			t.Errorf("Expected %s mismatch %q, got %q", setting, received, got[setting])
+		}
+	}
+
+	// A new codec starts over
+	a.observe(&VideoFrame{Codec: CodecH265, AccessUnit: &AccessUnit{NALUs: [][]byte{testHex(t, testH265SPS1080p)}}}, time.Now())
+	if info := a.Info(); info.Width != 1920 || info.Profile != "Main" || info.Level != "4" || info.Frames != 1 {
+		t.Errorf("Unexpected H265 info %+v", info)
+	}
+}
+
+func TestStreamAnalyzerOnDemand(t *testing.T) {
+	stream := NewStreamServer(0)
+	a := NewStreamAnalyzer(stream)
+	a.Start()
+	defer a.Stop()
+
+	// Nothing reassembled for the analyzer until the info is requested
+	if n := stream.videoFrames.count(); n != 0 {
+		t.Fatalf("Expected no frame subscribers, got %d", n)
+	}
+	get := func() {
+		rec := httptest.NewRecorder()
+		a.HandleInfo(rec, httptest.NewRequest(http.MethodGet, "/api/v1/stream/info", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", rec.Code)
+		}
+	}
+	get()
+	get()
+	if n := stream.videoFrames.count(); n != 1 {
+		t.Fatalf("Expected one frame subscriber, got %d", n)
+	}
+
+	now := time.Now()
+	if a.idle(now.Add(streamInfoIdle / 2)) {
+		t.Error("Expected the analysis to go on within the idle time")
+	}
+	if !a.idle(now.Add(streamInfoIdle)) || a.sub != nil {
+		t.Error("Expected the analysis to stop after the idle time")
+	}
+}
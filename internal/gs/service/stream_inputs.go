@@ -0,0 +1,571 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gilankpam/openipc-gs-web/internal/metrics"
+	"github.com/pion/webrtc/v4"
+)
+
+// MainStreamInput is the ID of the input received on the server's own
+// RTP port. It can't be removed.
+const MainStreamInput = "main"
+
+var streamInputIDPattern = regexp.MustCompile(`^[0-9A-Za-z_-]+$`)
+
+// StreamInput is a video source received as RTP on its own UDP port, e.g.
+// a second camera or a second drone
+type StreamInput struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+	Port  int    `json:"port"`
+	// Codec expected until one is detected from the stream, h265 when empty
+	Codec string `json:"codec,omitempty"`
+}
+
+// StreamInputStatus is an input with what it currently receives
+type StreamInputStatus struct {
+	StreamInput
+	CurrentCodec string     `json:"current_codec"`
+	Peers        int        `json:"peers"`
+	IngestBytes  uint64     `json:"ingest_bytes"`
+	LastPacket   *time.Time `json:"last_packet,omitempty"`
+}
+
+func (i *StreamInput) validate() error {
+	if i.ID != "" && !streamInputIDPattern.MatchString(i.ID) {
+		return fmt.Errorf("invalid input id %q", i.ID)
+	}
+	if i.Port <= 0 || i.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535")
+	}
+	if i.Codec != "" && i.Codec != CodecH264 && i.Codec != CodecH265 {
+		return fmt.Errorf("unsupported codec %q", i.Codec)
+	}
+	return nil
+}
+
+type streamInput struct {
+	cfg    StreamInput
+	server *StreamServer
+}
+
+func (i *streamInput) status() StreamInputStatus {
+	status := StreamInputStatus{
+		StreamInput:  i.cfg,
+		CurrentCodec: i.server.Codec(),
+		Peers:        i.server.PeerCount(),
+		IngestBytes:  i.server.ingestBytes.Load(),
+	}
+	if last := i.server.LastPacket(); !last.IsZero() {
+		status.LastPacket = &last
+	}
+	return status
+}
+
+// StreamInputs is the set of video inputs viewers can choose from: the
+// main stream server and further ones, each with its own port and track.
+// The others share the main server's mode, viewer limit and ICE ports.
+type StreamInputs struct {
+	main       *streamInput
+	configPath string
+	mu         sync.RWMutex
+	inputs     []*streamInput
+}
+
+// NewStreamInputs creates the input set around a started main server,
+// loading and starting further inputs from configPath when set
+func NewStreamInputs(main *StreamServer, label, configPath string) (*StreamInputs, error) {
+	s := &StreamInputs{
+		main:       &streamInput{cfg: StreamInput{ID: MainStreamInput, Label: label, Port: main.rtpPort}, server: main},
+		configPath: configPath,
+	}
+	if configPath == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stream inputs config: %w", err)
+	}
+	var inputs []StreamInput
+	if err := json.Unmarshal(data, &inputs); err != nil {
+		return nil, fmt.Errorf("failed to parse stream inputs config: %w", err)
+	}
+	for _, cfg := range inputs {
+		if err := s.check(cfg); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("invalid stream input %q: %w", cfg.ID, err)
+		}
+		input, err := s.open(cfg)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to start stream input %q: %w", cfg.ID, err)
+		}
+		s.inputs = append(s.inputs, input)
+	}
+	return s, nil
+}
+
+// Close stops every input but the main one
+func (s *StreamInputs) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, input := range s.inputs {
+		input.server.Stop()
+	}
+}
+
+// RegisterMetrics exports the number of inputs to a metrics registry
+func (s *StreamInputs) RegisterMetrics(reg *metrics.Registry) {
+	reg.NewGaugeFunc("gs_stream_inputs", "Video inputs, including the main one.", func() float64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return float64(len(s.inputs) + 1)
+	})
+}
+
+// open starts the server of an input
+func (s *StreamInputs) open(cfg StreamInput) (*streamInput, error) {
+	main := s.main.server
+	server := NewStreamServer(cfg.Port)
+	server.mode = main.mode
+	server.streamID = cfg.ID
+	server.source = cfg.ID
+	server.viewers = main.viewers
+	server.ice, server.api, server.turn = main.ice, main.api, main.turn
+	// The keyframe requester and codec hint talk to the main air unit's
+	// encoder and the outputs carry the main stream, so none apply here:
+	// viewers wait for the input's next keyframe and the codec is detected
+	// from the stream
+	if cfg.Codec != "" {
+		server.initialCodec = cfg.Codec
+	}
+	if err := server.Start(); err != nil {
+		return nil, err
+	}
+	return &streamInput{cfg: cfg, server: server}, nil
+}
+
+// check validates an input and that its ID and port are free
+func (s *StreamInputs) check(cfg StreamInput) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if cfg.ID == MainStreamInput || s.find(cfg.ID) >= 0 {
+		return fmt.Errorf("input %s already exists", cfg.ID)
+	}
+	for _, input := range append([]*streamInput{s.main}, s.inputs...) {
+		if input.cfg.Port == cfg.Port {
+			return fmt.Errorf("port %d is already used by input %s", cfg.Port, input.cfg.ID)
+		}
+	}
+	return nil
+}
+
+// Inputs returns every input, the main one first
+func (s *StreamInputs) Inputs() []StreamInputStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	statuses := make([]StreamInputStatus, 0, len(s.inputs))
+	for _, input := range s.inputs {
+		statuses = append(statuses, input.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return append([]StreamInputStatus{s.main.status()}, statuses...)
+}
+
+// Add creates and starts an input
+func (s *StreamInputs) Add(cfg StreamInput) (StreamInputStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cfg.ID == "" {
+		cfg.ID = newRandomID()
+	}
+	if err := s.check(cfg); err != nil {
+		return StreamInputStatus{}, err
+	}
+	input, err := s.open(cfg)
+	if err != nil {
+		return StreamInputStatus{}, err
+	}
+	s.inputs = append(s.inputs, input)
+	// Not added unless it is kept across restarts
+	if err := s.save(); err != nil {
+		s.inputs = s.inputs[:len(s.inputs)-1]
+		input.server.Stop()
+		return StreamInputStatus{}, err
+	}
+	log.Printf("Added video input %s (%s) on UDP port %d", cfg.ID, cfg.Label, cfg.Port)
+	return input.status(), nil
+}
+
+// Delete stops and removes an input, disconnecting its viewers
+func (s *StreamInputs) Delete(id string) error {
+	if id == MainStreamInput {
+		return fmt.Errorf("the main input can't be removed")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.find(id)
+	if i < 0 {
+		return os.ErrNotExist
+	}
+	s.inputs[i].server.Stop()
+	s.inputs = append(s.inputs[:i], s.inputs[i+1:]...)
+	return s.save()
+}
+
+func (s *StreamInputs) find(id string) int {
+	for i, input := range s.inputs {
+		if input.cfg.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *StreamInputs) save() error {
+	if s.configPath == "" {
+		return nil
+	}
+	configs := make([]StreamInput, 0, len(s.inputs))
+	for _, input := range s.inputs {
+		configs = append(configs, input.cfg)
+	}
+	data, err := json.MarshalIndent(configs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.configPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save stream inputs config: %w", err)
+	}
+	return os.Rename(tmp, s.configPath)
+}
+
+// servers returns the servers of the given inputs, the main one when none
+// are given
+func (s *StreamInputs) servers(ids []string) ([]*StreamServer, error) {
+	if len(ids) == 0 {
+		return []*StreamServer{s.main.server}, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	servers := make([]*StreamServer, 0, len(ids))
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			return nil, &signalingError{http.StatusBadRequest, fmt.Sprintf("Source %s is listed twice", id)}
+		}
+		seen[id] = true
+		if id == MainStreamInput {
+			servers = append(servers, s.main.server)
+			continue
+		}
+		i := s.find(id)
+		if i < 0 {
+			return nil, &signalingError{http.StatusNotFound, fmt.Sprintf("Unknown source %s", id)}
+		}
+		servers = append(servers, s.inputs[i].server)
+	}
+	return servers, nil
+}
+
+// answerOffer answers an offer for one or more inputs. Several inputs share
+// one peer connection, in the order of the offer's video sections, each as
+// a media stream named after its input.
+func (s *StreamInputs) answerOffer(offer webrtc.SessionDescription, sources []string) (*webrtc.SessionDescription, error) {
+	servers, err := s.servers(sources)
+	if err != nil {
+		return nil, err
+	}
+	if len(servers) == 1 {
+		_, answer, err := servers[0].answerOffer(offer, 0)
+		return answer, err
+	}
+
+	for _, server := range servers {
+		if err := server.checkOffer(offer); err != nil {
+			return nil, err
+		}
+	}
+	if videoSections(offer) < len(servers) {
+		return nil, &signalingError{http.StatusBadRequest, fmt.Sprintf("The offer needs a video section for each of the %d sources", len(servers))}
+	}
+
+	peerConnection, err := s.main.server.newPeerConnection()
+	if err != nil {
+		log.Printf("Failed to create peer connection: %v", err)
+		return nil, err
+	}
+	peerID := newRandomID()
+	closeAll := func() {
+		for _, server := range servers {
+			server.closePeer(peerID)
+		}
+		peerConnection.Close()
+	}
+	for _, server := range servers {
+		if err := server.attachPeer(peerID, peerConnection); err != nil {
+			closeAll()
+			return nil, err
+		}
+	}
+	peerConnection.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		log.Printf("Peer %s connection state: %s", peerID, state.String())
+		for _, server := range servers {
+			server.peerStateChanged(peerID, state)
+		}
+	})
+
+	answer, err := completeAnswer(peerConnection, offer, 0)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	return answer, nil
+}
+
+// videoSections counts the video media sections of an offer
+func videoSections(offer webrtc.SessionDescription) int {
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media == "video" {
+			count++
+		}
+	}
+	return count
+}
+
+// HandleSignaling answers offers for the inputs listed in sources, the main
+// one when there are none
+func (s *StreamInputs) HandleSignaling(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req SignalingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	answer, err := s.answerOffer(req.Offer, req.Sources)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SignalingResponse{Answer: *answer})
+}
+
+// HandleInputs serves GET and POST /api/v1/stream/inputs
+func (s *StreamInputs) HandleInputs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Inputs())
+	case http.MethodPost:
+		var cfg StreamInput
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		created, err := s.Add(cfg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleInput serves GET and DELETE /api/v1/stream/inputs/{id}
+func (s *StreamInputs) HandleInput(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		for _, input := range s.Inputs() {
+			if input.ID == id {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(input)
+				return
+			}
+		}
+		http.Error(w, "Input not found", http.StatusNotFound)
+	case http.MethodDelete:
+		err := s.Delete(id)
+		if os.IsNotExist(err) {
+			http.Error(w, "Input not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// allServers returns the servers of every input, the main one first
+func (s *StreamInputs) allServers() []*StreamServer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	servers := []*StreamServer{s.main.server}
+	for _, input := range s.inputs {
+		servers = append(servers, input.server)
+	}
+	return servers
+}
+
+// peerServers returns the servers of the inputs a peer receives
+func (s *StreamInputs) peerServers(id string) []*StreamServer {
+	var servers []*StreamServer
+	for _, server := range s.allServers() {
+		server.peersMu.RLock()
+		_, ok := server.peers[id]
+		server.peersMu.RUnlock()
+		if ok {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// Peers returns the viewers of every input, or of the source input when it
+// is set, oldest first
+func (s *StreamInputs) Peers(source string) ([]PeerStatus, error) {
+	servers := s.allServers()
+	if source != "" {
+		var err error
+		if servers, err = s.servers([]string{source}); err != nil {
+			return nil, err
+		}
+	}
+	var peers []PeerStatus
+	for _, server := range servers {
+		peers = append(peers, server.Peers()...)
+	}
+	peers = mergePeers(peers)
+	sort.SliceStable(peers, func(i, j int) bool {
+		return peers[i].Connected.Before(peers[j].Connected)
+	})
+	return peers, nil
+}
+
+// mergePeers combines the entries of a viewer receiving several inputs on
+// one connection. Transport stats are the connection's, feedback is summed.
+func mergePeers(peers []PeerStatus) []PeerStatus {
+	merged := []PeerStatus{}
+	index := map[string]int{}
+	for _, peer := range peers {
+		i, ok := index[peer.ID]
+		if !ok {
+			index[peer.ID] = len(merged)
+			merged = append(merged, peer)
+			continue
+		}
+		m := &merged[i]
+		m.Sources = append(m.Sources, peer.Sources...)
+		m.NACKs += peer.NACKs
+		m.PLIs += peer.PLIs
+	}
+	return merged
+}
+
+// HandleWHEP serves the WHEP endpoint for the input in the source query
+// parameter, the main one when it is missing
+func (s *StreamInputs) HandleWHEP(w http.ResponseWriter, r *http.Request) {
+	var sources []string
+	if source := r.URL.Query().Get("source"); source != "" {
+		sources = []string{source}
+	}
+	servers, err := s.servers(sources)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	servers[0].HandleWHEP(w, r)
+}
+
+// HandleWHEPSession serves a WHEP session of any input
+func (s *StreamInputs) HandleWHEPSession(w http.ResponseWriter, r *http.Request, id string) {
+	servers := s.peerServers(id)
+	if len(servers) == 0 {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	servers[0].HandleWHEPSession(w, r, id)
+}
+
+// HandlePeers serves GET /api/v1/stream/peers, filtered to one input with
+// the source query parameter
+func (s *StreamInputs) HandlePeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	peers, err := s.Peers(r.URL.Query().Get("source"))
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peers)
+}
+
+// HandlePeer serves GET and DELETE /api/v1/stream/peers/{id} for a viewer
+// of any input. DELETE disconnects it from every input it receives.
+func (s *StreamInputs) HandlePeer(w http.ResponseWriter, r *http.Request, id string) {
+	servers := s.peerServers(id)
+	if len(servers) == 0 {
+		http.Error(w, "Peer not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		var statuses []PeerStatus
+		for _, server := range servers {
+			for _, peer := range server.Peers() {
+				if peer.ID == id {
+					statuses = append(statuses, peer)
+				}
+			}
+		}
+		statuses = mergePeers(statuses)
+		if len(statuses) == 0 {
+			http.Error(w, "Peer not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statuses[0])
+	case http.MethodDelete:
+		for _, server := range servers {
+			server.closePeer(id)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestStreamInputs(t *testing.T) {
+	main := NewStreamServer(freePort(t))
+	main.initialCodec = CodecH264
+	if err := main.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer main.Stop()
+
+	path := filepath.Join(t.TempDir(), "inputs.json")
+	inputs, err := NewStreamInputs(main, "Main", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		inputs.HandleInputs(rec, httptest.NewRequest(http.MethodPost, "/api/v1/stream/inputs", strings.NewReader(body)))
+		return rec
+	}
+	port := freePort(t)
+	rec := post(`{"id":"cam2","label":"Second camera","port":` + strconv.Itoa(port) + `,"codec":"h264"}`)
+	var created StreamInputStatus
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("Expected the input created, got %d: %v", rec.Code, err)
+	}
+	if created.CurrentCodec != CodecH264 || created.Label != "Second camera" {
+		t.Errorf("Unexpected input %+v", created)
+	}
+	for _, body := range []string{
+		`{"id":"cam3","port":` + strconv.Itoa(port) + `}`,
+		`{"id":"cam3","port":` + strconv.Itoa(main.rtpPort) + `}`,
+		`{"id":"cam2","port":1}`,
+		`{"id":"cam3","port":` + strconv.Itoa(freePort(t)) + `,"codec":"vp8"}`,
+	} {
+		if rec := post(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, rec.Code)
+		}
+	}
+	if got := inputs.Inputs(); len(got) != 2 || got[0].ID != MainStreamInput || got[0].Label != "Main" || got[1].ID != "cam2" {
+		t.Errorf("Unexpected inputs %+v", got)
+	}
+
+	// Both inputs on one connection, each as its own stream
+	cam2 := inputs.inputs[0].server
+	answer, err := inputs.answerOffer(testMultiOffer(t, 2), []string{MainStreamInput, "cam2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if main.PeerCount() != 1 || cam2.PeerCount() != 1 {
+		t.Errorf("Expected the peer on both inputs, got %d and %d", main.PeerCount(), cam2.PeerCount())
+	}
+	if !strings.Contains(answer.SDP, "msid:"+defaultStreamID+" ") || !strings.Contains(answer.SDP, "msid:cam2 ") {
+		t.Errorf("Expected a media stream per input in the answer:\n%s", answer.SDP)
+	}
+
+	var se *signalingError
+	if _, err := inputs.answerOffer(testOffer(t), []string{MainStreamInput, "cam2"}); !errors.As(err, &se) || se.status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for too few video sections, got %v", err)
+	}
+	if _, err := inputs.answerOffer(testOffer(t), []string{"cam9"}); !errors.As(err, &se) || se.status != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown source, got %v", err)
+	}
+
+	// A single source through the signaling endpoint
+	body, _ := json.Marshal(SignalingRequest{Offer: testOffer(t), Sources: []string{"cam2"}})
+	rec = httptest.NewRecorder()
+	inputs.HandleSignaling(rec, httptest.NewRequest(http.MethodPost, "/api/v1/stream/offer", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK || cam2.PeerCount() != 2 || main.PeerCount() != 1 {
+		t.Errorf("Expected a peer on cam2 only, got %d with %d and %d peers", rec.Code, main.PeerCount(), cam2.PeerCount())
+	}
+
+	// One limit across inputs, a viewer of both counting once
+	main.viewers.max = 2
+	if _, err := inputs.answerOffer(testOffer(t), nil); !errors.As(err, &se) || se.status != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 beyond the shared maximum, got %v", err)
+	}
+	peers, err := inputs.Peers("")
+	if err != nil || len(peers) != 2 || len(peers[0].Sources) != 2 || peers[0].Sources[1] != "cam2" {
+		t.Fatalf("Expected two viewers, the first of both inputs, got %+v (%v)", peers, err)
+	}
+	if peers, _ := inputs.Peers("cam2"); len(peers) != 2 {
+		t.Errorf("Expected two viewers of cam2, got %+v", peers)
+	}
+	if _, err := inputs.Peers("cam9"); !errors.As(err, &se) || se.status != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown source, got %v", err)
+	}
+	rec = httptest.NewRecorder()
+	inputs.HandlePeer(rec, httptest.NewRequest(http.MethodDelete, "/api/v1/stream/peers/"+peers[0].ID, nil), peers[0].ID)
+	if rec.Code != http.StatusNoContent || main.PeerCount() != 0 || cam2.PeerCount() != 1 {
+		t.Errorf("Expected the viewer kicked from both inputs, got %d with %d and %d peers", rec.Code, main.PeerCount(), cam2.PeerCount())
+	}
+
+	// WHEP picks its input with the source parameter
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/stream/whep?source=cam2", strings.NewReader(testOffer(t).SDP))
+	req.Header.Set("Content-Type", "application/sdp")
+	inputs.HandleWHEP(rec, req)
+	if rec.Code != http.StatusCreated || cam2.PeerCount() != 2 {
+		t.Fatalf("Expected a WHEP session on cam2, got %d", rec.Code)
+	}
+	location := rec.Header().Get("Location")
+	rec = httptest.NewRecorder()
+	inputs.HandleWHEPSession(rec, httptest.NewRequest(http.MethodDelete, location, nil), location[strings.LastIndex(location, "/")+1:])
+	if rec.Code != http.StatusOK || cam2.PeerCount() != 1 {
+		t.Errorf("Expected the WHEP session ended, got %d", rec.Code)
+	}
+
+	// Saved and started again
+	inputs.Close()
+	if inputs, err = NewStreamInputs(main, "Main", path); err != nil {
+		t.Fatal(err)
+	}
+	defer inputs.Close()
+	if got := inputs.Inputs(); len(got) != 2 || got[1].Port != port || got[1].Codec != CodecH264 {
+		t.Errorf("Expected cam2 loaded, got %+v", got)
+	}
+
+	remove := func(id string) int {
+		rec := httptest.NewRecorder()
+		inputs.HandleInput(rec, httptest.NewRequest(http.MethodDelete, "/api/v1/stream/inputs/"+id, nil), id)
+		return rec.Code
+	}
+	if code := remove(MainStreamInput); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 removing the main input, got %d", code)
+	}
+	if code := remove("cam2"); code != http.StatusNoContent || len(inputs.Inputs()) != 1 {
+		t.Errorf("Expected cam2 removed, got %d", code)
+	}
+	if code := remove("cam2"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a removed input, got %d", code)
+	}
+}
+
+// testMultiOffer returns an offer with n recvonly video sections from a new
+// client peer connection
+func testMultiOffer(t *testing.T, n int) webrtc.SessionDescription {
+	t.Helper()
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	for i := 0; i < n; i++ {
+		if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo,
+			webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	return offer
+}
+
+func TestStreamInputsAddRollback(t *testing.T) {
+	main := NewStreamServer(freePort(t))
+	if err := main.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer main.Stop()
+
+	// The config can't be written
+	inputs, err := NewStreamInputs(main, "Main", filepath.Join(t.TempDir(), "missing", "inputs.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inputs.Close()
+
+	port := freePort(t)
+	if _, err := inputs.Add(StreamInput{ID: "cam2", Port: port}); err == nil {
+		t.Fatal("Expected the add to fail")
+	}
+	if got := inputs.Inputs(); len(got) != 1 {
+		t.Errorf("Expected only the main input, got %+v", got)
+	}
+	// The port was released
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		t.Fatalf("Expected port %d free again: %v", port, err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,366 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var streamOutputIDPattern = regexp.MustCompile(`^[0-9A-Za-z_-]+$`)
+
+// StreamOutput is a UDP destination the received RTP stream is copied to
+type StreamOutput struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Address string `json:"address"` // host:port, unicast or multicast
+	Enabled bool   `json:"enabled"`
+	// PayloadType rewrites the RTP payload type for receivers expecting a
+	// fixed one, 0 keeps it
+	PayloadType int `json:"payload_type,omitempty"`
+	// TTL (hop limit for IPv6) of multicast packets, 1 (local network) when 0
+	TTL int `json:"ttl,omitempty"`
+}
+
+// StreamOutputStatus is an output with its counters
+type StreamOutputStatus struct {
+	StreamOutput
+	Packets   uint64 `json:"packets"`
+	Bytes     uint64 `json:"bytes"`
+	Errors    uint64 `json:"errors"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+func (o *StreamOutput) validate() error {
+	if o.ID != "" && !streamOutputIDPattern.MatchString(o.ID) {
+		return fmt.Errorf("invalid output id %q", o.ID)
+	}
+	if _, _, err := net.SplitHostPort(o.Address); err != nil {
+		return fmt.Errorf("invalid address %q: %w", o.Address, err)
+	}
+	if o.PayloadType < 0 || o.PayloadType > 127 {
+		return fmt.Errorf("payload type must be between 0 and 127")
+	}
+	if o.TTL < 0 || o.TTL > 255 {
+		return fmt.Errorf("ttl must be between 0 and 255")
+	}
+	return nil
+}
+
+type streamOutput struct {
+	cfg       StreamOutput
+	conn      *net.UDPConn
+	scratchMu sync.Mutex
+	scratch   []byte // payload type rewrites, only used by Send
+
+	packets   atomic.Uint64
+	bytes     atomic.Uint64
+	errors    atomic.Uint64
+	lastError atomic.Pointer[string]
+}
+
+func openStreamOutput(cfg StreamOutput) (*streamOutput, error) {
+	addr, err := net.ResolveUDPAddr("udp", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	if addr.IP.IsMulticast() {
+		ttl := cfg.TTL
+		if ttl == 0 {
+			ttl = 1
+		}
+		if addr.IP.To4() != nil {
+			err = ipv4.NewPacketConn(conn).SetMulticastTTL(ttl)
+		} else {
+			err = ipv6.NewPacketConn(conn).SetMulticastHopLimit(ttl)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to set multicast TTL: %w", err)
+		}
+	}
+	return &streamOutput{cfg: cfg, conn: conn}, nil
+}
+
+func (o *streamOutput) status() StreamOutputStatus {
+	status := StreamOutputStatus{
+		StreamOutput: o.cfg,
+		Packets:      o.packets.Load(),
+		Bytes:        o.bytes.Load(),
+		Errors:       o.errors.Load(),
+	}
+	if err := o.lastError.Load(); err != nil {
+		status.LastError = *err
+	}
+	return status
+}
+
+// StreamOutputs copies every received RTP packet to a list of UDP
+// destinations, so tools like QGroundControl or a VRX can watch the same
+// stream wfb-ng delivers to a single port
+type StreamOutputs struct {
+	configPath string
+	mu         sync.RWMutex
+	outputs    []*streamOutput
+}
+
+// NewStreamOutputs creates the output list, loading it from configPath
+// when set
+func NewStreamOutputs(configPath string) (*StreamOutputs, error) {
+	s := &StreamOutputs{configPath: configPath}
+	if configPath == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stream outputs config: %w", err)
+	}
+	var outputs []StreamOutput
+	if err := json.Unmarshal(data, &outputs); err != nil {
+		return nil, fmt.Errorf("failed to parse stream outputs config: %w", err)
+	}
+	for _, cfg := range outputs {
+		if err := cfg.validate(); err != nil {
+			return nil, fmt.Errorf("invalid stream output %q: %w", cfg.ID, err)
+		}
+		out, err := openStreamOutput(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open stream output %q: %w", cfg.ID, err)
+		}
+		s.outputs = append(s.outputs, out)
+	}
+	return s, nil
+}
+
+// Close closes every output
+func (s *StreamOutputs) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, out := range s.outputs {
+		out.conn.Close()
+	}
+}
+
+// Send copies a received RTP packet to every enabled output. Errors are
+// counted per output and never stop the others. Send must only be called
+// from the ingest goroutine; the payload type rewrite has its own lock as
+// outputs are only read locked here.
+func (s *StreamOutputs) Send(packet []byte) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, out := range s.outputs {
+		if !out.cfg.Enabled {
+			continue
+		}
+		out.send(packet)
+	}
+}
+
+// send writes a packet to the output, with its payload type rewritten if set
+func (o *streamOutput) send(packet []byte) {
+	data := packet
+	// Only touch packets that look like RTP version 2
+	if o.cfg.PayloadType > 0 && len(packet) >= 12 && packet[0]>>6 == 2 {
+		o.scratchMu.Lock()
+		defer o.scratchMu.Unlock()
+		o.scratch = append(o.scratch[:0], packet...)
+		o.scratch[1] = o.scratch[1]&0x80 | byte(o.cfg.PayloadType)
+		data = o.scratch
+	}
+	if _, err := o.conn.Write(data); err != nil {
+		o.errors.Add(1)
+		msg := err.Error()
+		o.lastError.Store(&msg)
+		return
+	}
+	o.packets.Add(1)
+	o.bytes.Add(uint64(len(data)))
+}
+
+// Outputs returns every output with its counters
+func (s *StreamOutputs) Outputs() []StreamOutputStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	statuses := make([]StreamOutputStatus, 0, len(s.outputs))
+	for _, out := range s.outputs {
+		statuses = append(statuses, out.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// Add creates an output
+func (s *StreamOutputs) Add(cfg StreamOutput) (StreamOutputStatus, error) {
+	if err := cfg.validate(); err != nil {
+		return StreamOutputStatus{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cfg.ID == "" {
+		cfg.ID = newRandomID()
+	}
+	if s.find(cfg.ID) >= 0 {
+		return StreamOutputStatus{}, fmt.Errorf("output %s already exists", cfg.ID)
+	}
+	out, err := openStreamOutput(cfg)
+	if err != nil {
+		return StreamOutputStatus{}, err
+	}
+	s.outputs = append(s.outputs, out)
+	return out.status(), s.save()
+}
+
+// Update replaces an output's settings. Counters are kept.
+func (s *StreamOutputs) Update(id string, cfg StreamOutput) (StreamOutputStatus, error) {
+	cfg.ID = id
+	if err := cfg.validate(); err != nil {
+		return StreamOutputStatus{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.find(id)
+	if i < 0 {
+		return StreamOutputStatus{}, os.ErrNotExist
+	}
+	old := s.outputs[i]
+	out, err := openStreamOutput(cfg)
+	if err != nil {
+		return StreamOutputStatus{}, err
+	}
+	out.packets.Store(old.packets.Load())
+	out.bytes.Store(old.bytes.Load())
+	out.errors.Store(old.errors.Load())
+	old.conn.Close()
+	s.outputs[i] = out
+	return out.status(), s.save()
+}
+
+// Delete removes an output
+func (s *StreamOutputs) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.find(id)
+	if i < 0 {
+		return os.ErrNotExist
+	}
+	s.outputs[i].conn.Close()
+	s.outputs = append(s.outputs[:i], s.outputs[i+1:]...)
+	return s.save()
+}
+
+func (s *StreamOutputs) find(id string) int {
+	for i, out := range s.outputs {
+		if out.cfg.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *StreamOutputs) save() error {
+	if s.configPath == "" {
+		return nil
+	}
+	configs := make([]StreamOutput, 0, len(s.outputs))
+	for _, out := range s.outputs {
+		configs = append(configs, out.cfg)
+	}
+	data, err := json.MarshalIndent(configs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.configPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save stream outputs config: %w", err)
+	}
+	return os.Rename(tmp, s.configPath)
+}
+
+// HandleOutputs serves GET and POST /api/v1/stream/outputs
+func (s *StreamOutputs) HandleOutputs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Outputs())
+	case http.MethodPost:
+		// New outputs are enabled unless the request says otherwise
+		cfg := StreamOutput{Enabled: true}
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		created, err := s.Add(cfg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleOutput serves GET, PUT and DELETE /api/v1/stream/outputs/{id}
+func (s *StreamOutputs) HandleOutput(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		for _, out := range s.Outputs() {
+			if out.ID == id {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(out)
+				return
+			}
+		}
+		http.Error(w, "Output not found", http.StatusNotFound)
+	case http.MethodPut:
+		var cfg StreamOutput
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		updated, err := s.Update(id, cfg)
+		if os.IsNotExist(err) {
+			http.Error(w, "Output not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(updated)
+	case http.MethodDelete:
+		err := s.Delete(id)
+		if os.IsNotExist(err) {
+			http.Error(w, "Output not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readUDP(t *testing.T, conn *net.UDPConn) []byte {
+	t.Helper()
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestStreamOutputsSend(t *testing.T) {
+	plain := listenUDP(t)
+	rewrite := listenUDP(t)
+
+	s, err := NewStreamOutputs("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Add(StreamOutput{ID: "plain", Address: plain.LocalAddr().String(), Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(StreamOutput{ID: "rewrite", Address: rewrite.LocalAddr().String(), Enabled: true, PayloadType: 96}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Marker set, payload type 97
+	packet := []byte{0x80, 0x80 | 97, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0xaa}
+	s.Send(packet)
+
+	if got := readUDP(t, plain); string(got) != string(packet) {
+		t.Errorf("Expected the packet unchanged, got %x", got)
+	}
+	got := readUDP(t, rewrite)
+	if got[1] != 0x80|96 || string(got[2:]) != string(packet[2:]) {
+		t.Errorf("Expected payload type 96 with the marker kept, got %x", got)
+	}
+	if packet[1] != 0x80|97 {
+		t.Error("Rewrite modified the received packet")
+	}
+
+	// Disabled outputs are skipped
+	if _, err := s.Update("plain", StreamOutput{Address: plain.LocalAddr().String()}); err != nil {
+		t.Fatal(err)
+	}
+	s.Send(packet)
+	readUDP(t, rewrite)
+
+	for _, out := range s.Outputs() {
+		want := uint64(2)
+		if out.ID == "plain" {
+			want = 1
+		}
+		if out.Packets != want || out.Bytes != want*uint64(len(packet)) {
+			t.Errorf("Output %s: expected %d packets, got %+v", out.ID, want, out)
+		}
+	}
+}
+
+func TestStreamOutputsAPI(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outputs.json")
+	s, err := NewStreamOutputs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, body := range []string{`{"address":"nope"}`, `{"address":"127.0.0.1:5600","payload_type":200}`, `{`} {
+		w := httptest.NewRecorder()
+		s.HandleOutputs(w, httptest.NewRequest(http.MethodPost, "/api/v1/stream/outputs", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.HandleOutputs(w, httptest.NewRequest(http.MethodPost, "/api/v1/stream/outputs",
+		strings.NewReader(`{"name":"QGC","address":"127.0.0.1:5600"}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var created StreamOutputStatus
+	json.NewDecoder(w.Body).Decode(&created)
+	if created.ID == "" || created.Name != "QGC" || !created.Enabled {
+		t.Fatalf("Unexpected output %+v", created)
+	}
+
+	w = httptest.NewRecorder()
+	s.HandleOutput(w, httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{"name":"VRX","address":"239.0.0.1:5600","ttl":2}`)), created.ID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	// Outputs survive a restart
+	reloaded, err := NewStreamOutputs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	outputs := reloaded.Outputs()
+	if len(outputs) != 1 || outputs[0].Name != "VRX" || outputs[0].Enabled || outputs[0].TTL != 2 {
+		t.Errorf("Unexpected outputs after reload %+v", outputs)
+	}
+
+	w = httptest.NewRecorder()
+	s.HandleOutput(w, httptest.NewRequest(http.MethodDelete, "/", nil), created.ID)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.HandleOutput(w, httptest.NewRequest(http.MethodGet, "/", nil), created.ID)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", w.Code)
+	}
+}
+
+func TestStreamOutputMulticastTTL(t *testing.T) {
+	v4, err := openStreamOutput(StreamOutput{Address: "239.0.0.1:5600", TTL: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v4.conn.Close()
+	if ttl, err := ipv4.NewPacketConn(v4.conn).MulticastTTL(); err != nil || ttl != 3 {
+		t.Errorf("Expected TTL 3, got %d %v", ttl, err)
+	}
+
+	v6, err := openStreamOutput(StreamOutput{Address: "[ff15::1]:5600", TTL: 4})
+	if err != nil {
+		t.Skipf("No IPv6 multicast route: %v", err)
+	}
+	defer v6.conn.Close()
+	if hops, err := ipv6.NewPacketConn(v6.conn).MulticastHopLimit(); err != nil || hops != 4 {
+		t.Errorf("Expected hop limit 4, got %d %v", hops, err)
+	}
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gilankpam/openipc-gs-web/internal/metrics"
+)
+
+// Events published by the stream watchdog
+const (
+	EventNoSignal       = "no_signal"
+	EventSignalRestored = "signal_restored"
+)
+
+// SignalEvent reports the stream stopping or coming back
+type SignalEvent struct {
+	Time time.Time `json:"time"`
+	// Why the signal was lost: "no packets" or "no complete frames"
+	Reason string `json:"reason,omitempty"`
+	// How long the stream was out, once it is restored
+	OutageSec float64 `json:"outage_sec,omitempty"`
+}
+
+// StreamWatchdog notices when no complete frame arrived for a while. It
+// reports the outage, reopens the RTP socket and asks the air unit for a
+// keyframe until the stream comes back.
+type StreamWatchdog struct {
+	stream  *StreamServer
+	timeout time.Duration
+	publish func(event string, v interface{})
+	running bool
+	stopCh  chan struct{}
+
+	mu          sync.Mutex
+	lastFrame   time.Time
+	lost        bool
+	lastRestart time.Time
+	outages     uint64
+}
+
+// NewStreamWatchdog creates a watchdog declaring no signal after timeout
+// without a complete frame
+func NewStreamWatchdog(stream *StreamServer, timeout time.Duration) *StreamWatchdog {
+	return &StreamWatchdog{
+		stream:  stream,
+		timeout: timeout,
+		stopCh:  make(chan struct{}),
+	}
+}
+
+// WithEvents sets where no signal and signal restored events are published
+// (e.g. WFBStatsService.PushEvent)
+func (w *StreamWatchdog) WithEvents(publish func(event string, v interface{})) *StreamWatchdog {
+	w.publish = publish
+	return w
+}
+
+// Start begins watching the stream. In RTP mode the stream reassembles
+// frames for it.
+func (w *StreamWatchdog) Start() {
+	w.running = true
+	go w.run(w.stream.SubscribeFrames())
+}
+
+// Stop ends the watch
+func (w *StreamWatchdog) Stop() {
+	if !w.running {
+		return
+	}
+	w.running = false
+	close(w.stopCh)
+}
+
+// RegisterMetrics exports the signal state to a metrics registry
+func (w *StreamWatchdog) RegisterMetrics(reg *metrics.Registry) {
+	reg.NewGaugeFunc("gs_stream_signal", "Whether complete video frames are being received.", func() float64 {
+		if w.Signal() {
+			return 1
+		}
+		return 0
+	})
+	reg.NewCounterFunc("gs_stream_outages_total", "Times the video stream was lost.", func() float64 {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return float64(w.outages)
+	})
+}
+
+// Signal reports whether complete frames are arriving
+func (w *StreamWatchdog) Signal() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return !w.lastFrame.IsZero() && !w.lost
+}
+
+func (w *StreamWatchdog) run(sub *Subscription[*VideoFrame]) {
+	defer sub.Close()
+	ticker := time.NewTicker(w.timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		case frame, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			w.observe(frame, time.Now())
+		case now := <-ticker.C:
+			w.check(now)
+		}
+	}
+}
+
+// observe accounts for a received frame, ending an outage if there was one
+func (w *StreamWatchdog) observe(frame *VideoFrame, now time.Time) {
+	if !frame.Complete {
+		return
+	}
+	w.mu.Lock()
+	lost := w.lost
+	outage := now.Sub(w.lastFrame)
+	w.lastFrame = now
+	w.lost = false
+	w.mu.Unlock()
+	if !lost {
+		return
+	}
+
+	log.Printf("Video signal restored after %.1fs", outage.Seconds())
+	w.emit(EventSignalRestored, SignalEvent{Time: now, OutageSec: outage.Seconds()})
+	// The decoders need a keyframe to pick up again
+	if !frame.Keyframe {
+		w.stream.RequestKeyframe("signal restored")
+	}
+}
+
+// check declares no signal once the timeout passed without a complete frame
+// and restarts ingest every timeout for as long as the outage lasts. Nothing
+// is reported before the first frame.
+func (w *StreamWatchdog) check(now time.Time) {
+	w.mu.Lock()
+	if w.lastFrame.IsZero() || now.Sub(w.lastFrame) < w.timeout ||
+		(w.lost && now.Sub(w.lastRestart) < w.timeout) {
+		w.mu.Unlock()
+		return
+	}
+	started := !w.lost
+	if started {
+		w.lost = true
+		w.outages++
+	}
+	w.lastRestart = now
+	w.mu.Unlock()
+
+	if started {
+		reason := "no complete frames"
+		if now.Sub(w.stream.LastPacket()) >= w.timeout {
+			reason = "no packets"
+		}
+		log.Printf("No video signal: %s for %v", reason, w.timeout)
+		w.emit(EventNoSignal, SignalEvent{Time: now, Reason: reason})
+	}
+
+	if err := w.stream.RestartIngest(); err != nil {
+		log.Printf("Failed to restart video ingest: %v", err)
+	}
+	w.stream.RequestKeyframe("no signal")
+}
+
+func (w *StreamWatchdog) emit(event string, v SignalEvent) {
+	if w.publish != nil {
+		w.publish(event, v)
+	}
+}
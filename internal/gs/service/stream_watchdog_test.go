@@ -0,0 +1,91 @@
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStreamWatchdog(t *testing.T) {
+	port := freePort(t)
+	requests := 0
+	s := NewStreamServer(port).WithKeyframeRequester(func() error { return nil })
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	type event struct {
+		name string
+		SignalEvent
+	}
+	var events []event
+	w := NewStreamWatchdog(s, 3*time.Second).WithEvents(func(name string, v interface{}) {
+		events = append(events, event{name, v.(SignalEvent)})
+	})
+
+	// Nothing to report before the stream started
+	start := time.Now()
+	w.check(start.Add(10 * time.Second))
+	if len(events) != 0 || s.ingestRestarts.Load() != 0 {
+		t.Fatalf("Expected no outage before the first frame, got %v", events)
+	}
+
+	frame := &VideoFrame{Codec: CodecH264, AccessUnit: &AccessUnit{Complete: true}}
+	w.observe(frame, start)
+	if !w.Signal() {
+		t.Error("Expected a signal after a complete frame")
+	}
+	w.check(start.Add(2 * time.Second))
+	if len(events) != 0 {
+		t.Fatalf("Expected no outage within the timeout, got %v", events)
+	}
+
+	w.check(start.Add(3 * time.Second))
+	if len(events) != 1 || events[0].name != EventNoSignal || events[0].Reason != "no packets" || !events[0].Time.Equal(start.Add(3*time.Second)) {
+		t.Fatalf("Expected a no signal event, got %v", events)
+	}
+	if w.Signal() || s.ingestRestarts.Load() != 1 || s.keyframeRequests.Load() != 1 {
+		t.Errorf("Expected ingest restarted and a keyframe requested, got %d restarts and %d requests",
+			s.ingestRestarts.Load(), s.keyframeRequests.Load())
+	}
+	requests = int(s.keyframeRequests.Load())
+
+	// Restarted every timeout while the outage lasts, reported once
+	w.check(start.Add(4 * time.Second))
+	w.check(start.Add(6 * time.Second))
+	if len(events) != 1 || s.ingestRestarts.Load() != 2 {
+		t.Errorf("Expected a second restart and no new event, got %d restarts and %v", s.ingestRestarts.Load(), events)
+	}
+
+	// The reopened socket still receives
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv6loopback, Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for deadline := time.Now().Add(2 * time.Second); s.LastPacket().IsZero() && time.Now().Before(deadline); {
+		conn.Write([]byte{0x80, 0x60, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1})
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.LastPacket().IsZero() {
+		t.Error("Expected packets after the restart")
+	}
+
+	// A complete frame ends the outage and asks for a keyframe to decode from
+	s.lastKeyframeRequest = time.Time{}
+	w.observe(frame, start.Add(7*time.Second))
+	if len(events) != 2 || events[1].name != EventSignalRestored || events[1].OutageSec != 7 {
+		t.Fatalf("Expected a 7s outage restored, got %v", events)
+	}
+	if !w.Signal() || int(s.keyframeRequests.Load()) != requests+1 {
+		t.Errorf("Expected a keyframe request on restore, got %d", s.keyframeRequests.Load())
+	}
+
+	// Packets without complete frames
+	s.lastPacket.Store(start.Add(9 * time.Second).UnixNano())
+	w.check(start.Add(10 * time.Second))
+	if len(events) != 3 || events[2].Reason != "no complete frames" || w.outages != 2 {
+		t.Errorf("Expected an outage with packets still arriving, got %v", events)
+	}
+}
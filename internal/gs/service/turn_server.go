@@ -0,0 +1,155 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/gilankpam/openipc-gs-web/internal/metrics"
+	"github.com/pion/turn/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// turnRealm is the realm announced by the embedded TURN server
+const turnRealm = "openipc-gs"
+
+// TURNServer is an embedded TURN relay for viewers on networks that block
+// UDP between clients, like phone hotspots and venue Wi-Fi. It listens on
+// UDP and TCP, and hands out short-lived credentials derived from a secret
+// generated on start (the TURN REST API scheme).
+type TURNServer struct {
+	port    int
+	relayIP net.IP
+	ttl     time.Duration
+	secret  string
+	server  *turn.Server
+}
+
+// NewTURNServer creates a TURN server on port. Relayed traffic is
+// advertised on relayIP, the first IPv4 address of the host when empty.
+// Credentials expire after ttl.
+func NewTURNServer(port int, relayIP string, ttl time.Duration) (*TURNServer, error) {
+	var ip net.IP
+	if relayIP == "" {
+		ip = firstIPv4()
+		if ip == nil {
+			return nil, fmt.Errorf("no IPv4 address to relay on")
+		}
+	} else if ip = net.ParseIP(relayIP); ip == nil {
+		return nil, fmt.Errorf("invalid relay IP %q", relayIP)
+	}
+
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &TURNServer{
+		port:    port,
+		relayIP: ip,
+		ttl:     ttl,
+		secret:  hex.EncodeToString(secret),
+	}, nil
+}
+
+// firstIPv4 returns the first non-loopback IPv4 address of the host
+func firstIPv4() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP.To4()
+		}
+	}
+	return nil
+}
+
+// Start begins serving TURN on UDP and TCP
+func (s *TURNServer) Start() error {
+	udpConn, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return fmt.Errorf("failed to listen for TURN on UDP port %d: %w", s.port, err)
+	}
+	tcpListener, err := net.Listen("tcp4", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		udpConn.Close()
+		return fmt.Errorf("failed to listen for TURN on TCP port %d: %w", s.port, err)
+	}
+
+	relay := &turn.RelayAddressGeneratorStatic{RelayAddress: s.relayIP, Address: "0.0.0.0"}
+	s.server, err = turn.NewServer(turn.ServerConfig{
+		Realm:             turnRealm,
+		AuthHandler:       turn.LongTermTURNRESTAuthHandler(s.secret, nil),
+		PacketConnConfigs: []turn.PacketConnConfig{{PacketConn: udpConn, RelayAddressGenerator: relay, PermissionHandler: s.allowPeer}},
+		ListenerConfigs:   []turn.ListenerConfig{{Listener: tcpListener, RelayAddressGenerator: relay, PermissionHandler: s.allowPeer}},
+	})
+	if err != nil {
+		udpConn.Close()
+		tcpListener.Close()
+		return fmt.Errorf("failed to start TURN server: %w", err)
+	}
+	log.Printf("TURN server listening on port %d, relaying on %s", s.port, s.relayIP)
+	return nil
+}
+
+// allowPeer only lets viewers relay to the ground station itself, so the
+// freely handed out credentials don't open a relay into the air unit's
+// network or beyond
+func (s *TURNServer) allowPeer(_ net.Addr, peerIP net.IP) bool {
+	if peerIP.Equal(s.relayIP) {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(peerIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stop closes the server and every allocation
+func (s *TURNServer) Stop() {
+	if s.server == nil {
+		return
+	}
+	s.server.Close()
+	s.server = nil
+}
+
+// RegisterMetrics exports the number of relay allocations
+func (s *TURNServer) RegisterMetrics(reg *metrics.Registry) {
+	reg.NewGaugeFunc("gs_turn_allocations", "Relay allocations on the embedded TURN server.", func() float64 {
+		if s.server == nil {
+			return 0
+		}
+		return float64(s.server.AllocationCount())
+	})
+}
+
+// ICEServer returns the server's UDP and TCP URLs with fresh credentials.
+// host is how the client reaches the ground station, the relay IP when
+// empty.
+func (s *TURNServer) ICEServer(host string) (webrtc.ICEServer, error) {
+	if host == "" {
+		host = s.relayIP.String()
+	}
+	username, password, err := turn.GenerateLongTermTURNRESTCredentials(s.secret, "viewer", s.ttl)
+	if err != nil {
+		return webrtc.ICEServer{}, err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(s.port))
+	return webrtc.ICEServer{
+		URLs:       []string{"turn:" + addr + "?transport=udp", "turn:" + addr + "?transport=tcp"},
+		Username:   username,
+		Credential: password,
+	}, nil
+}
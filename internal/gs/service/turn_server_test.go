@@ -0,0 +1,104 @@
+package service
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// allocate requests a relay from a TURN server over UDP and permission to
+// relay to peers
+func allocate(t *testing.T, addr, username, password string, peers ...net.IP) error {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := turn.NewClient(&turn.ClientConfig{
+		TURNServerAddr: addr,
+		Username:       username,
+		Password:       password,
+		Conn:           conn,
+		RTO:            50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	relay, err := client.Allocate()
+	if err != nil {
+		return err
+	}
+	defer relay.Close()
+	for _, peer := range peers {
+		if err := client.CreatePermission(&net.UDPAddr{IP: peer, Port: 5000}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestTURNServer(t *testing.T) {
+	port := freePort(t)
+	server, err := NewTURNServer(port, "127.0.0.1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	s := NewStreamServer(0).WithTURN(server)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/stream/ice", nil)
+	req.Host = "gs.local:8081"
+	s.HandleICEServers(rec, req)
+	var resp struct {
+		ICEServers []webrtc.ICEServer `json:"ice_servers"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	// Advertised at the address the browser used
+	addr := "gs.local:" + strconv.Itoa(port)
+	if len(resp.ICEServers) != 1 || resp.ICEServers[0].URLs[0] != "turn:"+addr+"?transport=udp" ||
+		!strings.HasSuffix(resp.ICEServers[0].Username, ":viewer") {
+		t.Fatalf("Unexpected ICE servers %+v", resp.ICEServers)
+	}
+
+	ice, err := server.ICEServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = "127.0.0.1:" + strconv.Itoa(port)
+	if err := allocate(t, addr, ice.Username, ice.Credential.(string)); err != nil {
+		t.Errorf("Allocation with issued credentials failed: %v", err)
+	}
+	if err := allocate(t, addr, ice.Username, "wrong"); err == nil {
+		t.Error("Expected a wrong credential to be rejected")
+	}
+	// Only the ground station itself can be relayed to
+	if err := allocate(t, addr, ice.Username, ice.Credential.(string), net.IPv4(127, 0, 0, 1)); err != nil {
+		t.Errorf("Expected relaying to the ground station allowed: %v", err)
+	}
+	if err := allocate(t, addr, ice.Username, ice.Credential.(string), net.IPv4(10, 5, 0, 10)); err == nil {
+		t.Error("Expected relaying to the air unit refused")
+	}
+	expired := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10) + ":viewer"
+	if err := allocate(t, addr, expired, ice.Credential.(string)); err == nil {
+		t.Error("Expected expired credentials to be rejected")
+	}
+}
@@ -2,157 +2,614 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
-	"os/exec"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/gilankpam/openipc-gs-web/internal/metrics"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 	"github.com/pion/webrtc/v4/pkg/media"
 )
 
-// StreamServer handles WebRTC streaming of RTP H265 video
+const (
+	rtpVideoClockRate    = 90000
+	rtpReorderSize       = 64
+	rtpReorderDelay      = 30 * time.Millisecond
+	rtpReadBufferSize    = 4 * 1024 * 1024
+	defaultFrameDuration = 33 * time.Millisecond // ~30fps
+	maxFrameDuration     = time.Second
+
+	// codecHintInterval is how often the air unit's codec setting is checked
+	codecHintInterval = 10 * time.Second
+	// codecHintHoldoff is how long a codec detected from the stream takes
+	// precedence over the air unit's setting
+	codecHintHoldoff = 5 * time.Second
+
+	// defaultStreamID is the media stream peers receive the main input in
+	defaultStreamID = "wfb-stream"
+)
+
+// Stream modes
+const (
+	// StreamModeSample reassembles frames and packetizes them again for
+	// each peer. Incomplete frames are dropped.
+	StreamModeSample = "sample"
+	// StreamModeRTP forwards received RTP packets to peers as they arrive,
+	// for the lowest latency and CPU use
+	StreamModeRTP = "rtp"
+)
+
+// VideoFrame is a received frame with the codec it was coded in
+type VideoFrame struct {
+	Codec string
+	*AccessUnit
+}
+
+// streamPeer is a connected browser
+type streamPeer struct {
+	pc        *webrtc.PeerConnection
+	sender    *webrtc.RTPSender
+	source    string
+	connected time.Time
+	// Per peer track in RTP mode
+	forwarder *rtpForwarder
+
+	// Feedback from the peer, and the round trip time in nanoseconds
+	nacks atomic.Uint64
+	plis  atomic.Uint64
+	rtt   atomic.Int64
+}
+
+// StreamServer handles WebRTC streaming of RTP H264/H265 video
 type StreamServer struct {
-	rtpPort    int
-	cmd        *exec.Cmd
-	peers      map[string]*webrtc.PeerConnection
-	peersMu    sync.RWMutex
-	videoTrack *webrtc.TrackLocalStaticSample
-	running    bool
-	stopCh     chan struct{}
+	rtpPort  int
+	mode     string
+	streamID string
+	conn     *net.UDPConn
+	peers    map[string]*streamPeer
+	peersMu  sync.RWMutex
+	viewers  *viewerLimit
+	source   string
+	running  atomic.Bool
+	stopCh   chan struct{}
+
+	// The track matches the codec of the incoming stream
+	trackMu      sync.RWMutex
+	codec        string
+	initialCodec string
+	videoTrack   *webrtc.TrackLocalStaticSample
+	lastDetected time.Time
+	codecHint    func() (string, error)
+
+	// RTP timestamp of the last frame written to the track
+	lastFrameTS   uint32
+	haveLastFrame bool
+
+	// The RTP socket and its reader, replaced when ingest restarts
+	ingestMu   sync.Mutex
+	ingestDone chan struct{}
+	lastPacket atomic.Int64 // unix nanoseconds
+
+	// Counters for metrics
+	ingestBytes      atomic.Uint64
+	ingestRestarts   atomic.Uint64
+	invalidPackets   atomic.Uint64
+	lostPackets      atomic.Uint64
+	frames           atomic.Uint64
+	framesDropped    atomic.Uint64
+	forwardedPackets atomic.Uint64
+	keyframeRequests atomic.Uint64
+	fmp4Viewers      atomic.Int64
+
+	// Asks the air unit for a keyframe, nil when not possible
+	keyframeRequester   func() error
+	keyframeMu          sync.Mutex
+	lastKeyframeRequest time.Time
+
+	// Received frames for recorders, complete or not
+	videoFrames *broadcaster[*VideoFrame]
+
+	// UDP destinations every received packet is copied to
+	outputs *StreamOutputs
+
+	// How peers connect, and the shared ICE ports opened for it
+	ice      ICEConfig
+	api      *webrtc.API
+	iceMuxes []io.Closer
+	turn     *TURNServer
 }
 
 // NewStreamServer creates a new streaming server
 func NewStreamServer(rtpPort int) *StreamServer {
 	return &StreamServer{
-		rtpPort: rtpPort,
-		peers:   make(map[string]*webrtc.PeerConnection),
-		stopCh:  make(chan struct{}),
+		rtpPort:      rtpPort,
+		mode:         StreamModeSample,
+		streamID:     defaultStreamID,
+		source:       MainStreamInput,
+		viewers:      &viewerLimit{viewers: make(map[string]int)},
+		initialCodec: CodecH265,
+		peers:        make(map[string]*streamPeer),
+		stopCh:       make(chan struct{}),
+
+		videoFrames: newBroadcaster[*VideoFrame](256),
 	}
 }
 
-// Start begins listening for RTP packets via GStreamer and serving WebRTC
+// WithKeyframeRequester sets how a keyframe is requested from the air unit
+// when a viewer joins or reports picture loss
+func (s *StreamServer) WithKeyframeRequester(request func() error) *StreamServer {
+	s.keyframeRequester = request
+	return s
+}
+
+// WithOutputs sets the UDP destinations received packets are copied to
+func (s *StreamServer) WithOutputs(outputs *StreamOutputs) *StreamServer {
+	s.outputs = outputs
+	return s
+}
+
+// WithMode sets how video is sent to peers: StreamModeSample or StreamModeRTP
+func (s *StreamServer) WithMode(mode string) (*StreamServer, error) {
+	if mode != StreamModeSample && mode != StreamModeRTP {
+		return nil, fmt.Errorf("unsupported stream mode %q", mode)
+	}
+	s.mode = mode
+	return s, nil
+}
+
+// WithCodecSource sets where the configured codec is read from (e.g.
+// AirUnitCodecSource) until it is detected from the stream
+func (s *StreamServer) WithCodecSource(source func() (string, error)) *StreamServer {
+	s.codecHint = source
+	return s
+}
+
+// Start begins listening for RTP packets and serving WebRTC
 func (s *StreamServer) Start() error {
-	// Create a video track for H265 samples
-	var err error
-	s.videoTrack, err = webrtc.NewTrackLocalStaticSample(
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265},
-		"video",
-		"wfb-stream",
-	)
-	if err != nil {
+	// H265 or the input's codec until the stream or the air unit says
+	// otherwise
+	if err := s.setCodec(s.initialCodec, "default"); err != nil {
 		return err
 	}
 
-	s.running = true
-	log.Printf("Streaming server starting GStreamer pipeline on UDP port %d", s.rtpPort)
+	// Inputs share the ICE ports of the server they were created from
+	if s.api == nil {
+		if err := s.startICE(); err != nil {
+			return err
+		}
+	}
 
-	// Start GStreamer reader goroutine
-	go s.readFromGStreamer()
+	s.running.Store(true)
+	if err := s.startIngest(); err != nil {
+		s.running.Store(false)
+		s.closeICE()
+		return err
+	}
+	log.Printf("Streaming server receiving RTP on UDP port %d (%s mode)", s.rtpPort, s.mode)
+
+	if s.codecHint != nil {
+		go s.pollCodecHint()
+	}
 
 	return nil
 }
 
 // Stop shuts down the streaming server
 func (s *StreamServer) Stop() {
-	if !s.running {
+	if !s.running.CompareAndSwap(true, false) {
 		return
 	}
-	s.running = false
 	close(s.stopCh)
 
-	if s.cmd != nil && s.cmd.Process != nil {
-		s.cmd.Process.Kill()
-	}
+	s.ingestMu.Lock()
+	s.conn.Close()
+	s.ingestMu.Unlock()
 
 	// Close all peer connections
 	s.peersMu.Lock()
-	for id, pc := range s.peers {
-		pc.Close()
+	for id, peer := range s.peers {
+		peer.pc.Close()
 		delete(s.peers, id)
+		s.viewers.release(id)
 	}
 	s.peersMu.Unlock()
+	s.closeICE()
 }
 
-// readFromGStreamer spawns GStreamer to depayload RTP and reads H265 byte-stream
-func (s *StreamServer) readFromGStreamer() {
-	for s.running {
-		// GStreamer pipeline: receive RTP H265, depayload, output byte-stream to stdout
-		s.cmd = exec.Command("gst-launch-1.0", "-q",
-			"udpsrc", "port=5601",
-			"caps=application/x-rtp, media=(string)video, encoding-name=(string)H265, clock-rate=(int)90000",
-			"!", "rtph265depay",
-			"!", "h265parse", "config-interval=-1",
-			"!", "video/x-h265, stream-format=byte-stream",
-			"!", "fdsink", "fd=1",
-		)
+// startIngest opens the RTP socket and starts reading from it
+func (s *StreamServer) startIngest() error {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: s.rtpPort})
+	if err != nil {
+		return fmt.Errorf("failed to listen for RTP on port %d: %w", s.rtpPort, err)
+	}
+	if err := conn.SetReadBuffer(rtpReadBufferSize); err != nil {
+		log.Printf("Failed to set RTP socket buffer: %v", err)
+	}
+
+	done := make(chan struct{})
+	s.conn = conn
+	s.ingestDone = done
+	go func() {
+		defer close(done)
+		if s.mode == StreamModeRTP {
+			s.forwardRTP(conn)
+		} else {
+			s.readRTP(conn)
+		}
+	}()
+	return nil
+}
+
+// RestartIngest closes the RTP socket and starts over with a new one and
+// fresh reassembly state, for when the stream stopped arriving
+func (s *StreamServer) RestartIngest() error {
+	s.ingestMu.Lock()
+	defer s.ingestMu.Unlock()
+	if !s.running.Load() {
+		return fmt.Errorf("streaming server not running")
+	}
+
+	s.conn.Close()
+	<-s.ingestDone
+	s.ingestRestarts.Add(1)
+	return s.startIngest()
+}
 
-		stdout, err := s.cmd.StdoutPipe()
+// LastPacket returns when the last RTP packet was received, zero if none was
+func (s *StreamServer) LastPacket() time.Time {
+	ns := s.lastPacket.Load()
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// PeerCount returns the number of connected WebRTC peers
+func (s *StreamServer) PeerCount() int {
+	s.peersMu.RLock()
+	defer s.peersMu.RUnlock()
+	return len(s.peers)
+}
+
+// RegisterMetrics exports ingest and peer metrics to a metrics registry
+func (s *StreamServer) RegisterMetrics(reg *metrics.Registry) {
+	reg.NewCounterFunc("gs_stream_ingest_bytes_total", "Bytes of RTP video received.", func() float64 {
+		return float64(s.ingestBytes.Load())
+	})
+	reg.NewCounterFunc("gs_stream_ingest_restarts_total", "Times the RTP socket was reopened after the stream stopped.", func() float64 {
+		return float64(s.ingestRestarts.Load())
+	})
+	reg.NewCounterFunc("gs_stream_rtp_invalid_packets_total", "Received packets that aren't valid RTP.", func() float64 {
+		return float64(s.invalidPackets.Load())
+	})
+	reg.NewCounterFunc("gs_stream_rtp_lost_packets_total", "RTP packets missing from the received sequence.", func() float64 {
+		return float64(s.lostPackets.Load())
+	})
+	reg.NewCounterFunc("gs_stream_frames_total", "Video frames forwarded to peers.", func() float64 {
+		return float64(s.frames.Load())
+	})
+	reg.NewCounterFunc("gs_stream_frames_dropped_total", "Incomplete video frames dropped.", func() float64 {
+		return float64(s.framesDropped.Load())
+	})
+	reg.NewCounterFunc("gs_stream_keyframe_requests_total", "Keyframes requested from the air unit.", func() float64 {
+		return float64(s.keyframeRequests.Load())
+	})
+	reg.NewCounterFunc("gs_stream_rtp_forwarded_packets_total", "RTP packets forwarded to peers in rtp mode.", func() float64 {
+		return float64(s.forwardedPackets.Load())
+	})
+	reg.NewGaugeFunc("gs_webrtc_peers", "Connected WebRTC peers.", func() float64 {
+		return float64(s.PeerCount())
+	})
+	reg.NewGaugeFunc("gs_stream_fmp4_viewers", "Viewers receiving fragmented MP4 over WebSocket.", func() float64 {
+		return float64(s.fmp4Viewers.Load())
+	})
+}
+
+// RequestKeyframe asks the air unit for a keyframe unless one was requested
+// less than keyframeRequestInterval ago. It reports whether a request was sent.
+func (s *StreamServer) RequestKeyframe(reason string) bool {
+	if s.keyframeRequester == nil {
+		return false
+	}
+	s.keyframeMu.Lock()
+	if time.Since(s.lastKeyframeRequest) < keyframeRequestInterval {
+		s.keyframeMu.Unlock()
+		return false
+	}
+	s.lastKeyframeRequest = time.Now()
+	s.keyframeMu.Unlock()
+
+	s.keyframeRequests.Add(1)
+	go func() {
+		if err := s.keyframeRequester(); err != nil {
+			log.Printf("Keyframe request (%s) failed: %v", reason, err)
+		}
+	}()
+	return true
+}
+
+// SubscribeFrames returns a feed of every received frame. In RTP mode
+// frames are only reassembled while someone is subscribed.
+func (s *StreamServer) SubscribeFrames() *Subscription[*VideoFrame] {
+	return s.videoFrames.subscribe()
+}
+
+// Codec returns the codec currently streamed to peers
+func (s *StreamServer) Codec() string {
+	s.trackMu.RLock()
+	defer s.trackMu.RUnlock()
+	return s.codec
+}
+
+// setCodec switches the video track to a codec. Peers negotiated the old
+// codec, so they are closed and the browsers reconnect with a new offer.
+func (s *StreamServer) setCodec(codec, reason string) error {
+	s.trackMu.Lock()
+	if codec == s.codec {
+		s.trackMu.Unlock()
+		return nil
+	}
+	// In RTP mode every peer gets its own track when it connects
+	var track *webrtc.TrackLocalStaticSample
+	if s.mode == StreamModeSample {
+		var err error
+		track, err = webrtc.NewTrackLocalStaticSample(
+			webrtc.RTPCodecCapability{MimeType: codecMimeType(codec)},
+			"video",
+			s.streamID,
+		)
 		if err != nil {
-			log.Printf("Failed to get GStreamer stdout: %v", err)
-			time.Sleep(time.Second)
-			continue
+			s.trackMu.Unlock()
+			return err
+		}
+	}
+	previous := s.codec
+	s.codec = codec
+	s.videoTrack = track
+	s.haveLastFrame = false
+	s.trackMu.Unlock()
+
+	if previous == "" {
+		return nil
+	}
+
+	s.peersMu.Lock()
+	log.Printf("Video codec changed from %s to %s (%s), closing %d peers", previous, codec, reason, len(s.peers))
+	for id, peer := range s.peers {
+		peer.pc.Close()
+		delete(s.peers, id)
+		s.viewers.release(id)
+	}
+	s.peersMu.Unlock()
+	return nil
+}
+
+// pollCodecHint follows the air unit's codec setting while no codec is
+// detected from the stream
+func (s *StreamServer) pollCodecHint() {
+	ticker := time.NewTicker(codecHintInterval)
+	defer ticker.Stop()
+
+	for {
+		codec, err := s.codecHint()
+		s.trackMu.RLock()
+		detected := time.Since(s.lastDetected) < codecHintHoldoff
+		s.trackMu.RUnlock()
+		if err == nil && !detected {
+			if err := s.setCodec(codec, "air unit setting"); err != nil {
+				log.Printf("Failed to switch codec: %v", err)
+			}
 		}
 
-		// Capture stderr for debugging
-		stderr, _ := s.cmd.StderrPipe()
-		go func() {
-			buf := make([]byte, 4096)
-			for {
-				n, err := stderr.Read(buf)
-				if n > 0 {
-					log.Printf("GStreamer stderr: %s", string(buf[:n]))
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// readRTP receives RTP packets, puts them back in order and writes every
+// complete frame to the video track
+func (s *StreamServer) readRTP(conn *net.UDPConn) {
+	reorder := newRTPReorderBuffer(rtpReorderSize, rtpReorderDelay)
+	var detector codecDetector
+	codec := s.Codec()
+	depacketizer := newDepacketizer(codec)
+	params := newParameterSets(codec)
+	buf := make([]byte, 65535)
+
+	for s.running.Load() {
+		// Wake up regularly so missing packets are given up on even when
+		// nothing else arrives
+		conn.SetReadDeadline(time.Now().Add(rtpReorderDelay))
+		n, _, err := conn.ReadFromUDP(buf)
+		now := time.Now()
+
+		var packets []orderedPacket
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				// Closed by Stop or RestartIngest
+				if s.running.Load() && !errors.Is(err, net.ErrClosed) {
+					log.Printf("RTP read error: %v", err)
 				}
-				if err != nil {
-					return
+				return
+			}
+			packets = reorder.Expire(now)
+		} else {
+			s.ingestBytes.Add(uint64(n))
+			s.lastPacket.Store(now.UnixNano())
+			if s.outputs != nil {
+				s.outputs.Send(buf[:n])
+			}
+
+			// Buffered packets outlive the read buffer
+			pkt := &rtp.Packet{}
+			if err := pkt.Unmarshal(append([]byte(nil), buf[:n]...)); err != nil {
+				s.invalidPackets.Add(1)
+				continue
+			}
+			packets = reorder.Push(pkt, now)
+		}
+
+		for _, p := range packets {
+			s.detectCodec(&detector, p.Payload, now)
+			if current := s.Codec(); current != codec {
+				codec = current
+				depacketizer = newDepacketizer(codec)
+				params = newParameterSets(codec)
+			}
+			for _, au := range depacketizer.Push(p) {
+				if au.Complete {
+					params.Fill(au)
 				}
+				s.videoFrames.publish(&VideoFrame{Codec: codec, AccessUnit: au})
+				s.writeFrame(au)
 			}
-		}()
+		}
+		s.lostPackets.Store(reorder.Lost)
+	}
+}
+
+// detectCodec feeds a payload to the codec detector and switches codec when
+// the stream changed
+func (s *StreamServer) detectCodec(detector *codecDetector, payload []byte, now time.Time) {
+	detected := detector.Observe(payload)
+	if detected == "" {
+		return
+	}
+	s.trackMu.Lock()
+	s.lastDetected = now
+	s.trackMu.Unlock()
+	if err := s.setCodec(detected, "detected from stream"); err != nil {
+		log.Printf("Failed to switch codec: %v", err)
+	}
+}
 
-		if err := s.cmd.Start(); err != nil {
-			log.Printf("Failed to start GStreamer: %v", err)
-			time.Sleep(time.Second)
+// forwardRTP receives RTP packets and forwards them to every peer as they
+// arrive. Reordering and loss are left to the browser's jitter buffer.
+func (s *StreamServer) forwardRTP(conn *net.UDPConn) {
+	var detector codecDetector
+	// Frames for recorders are still put back in order and reassembled
+	reorder := newRTPReorderBuffer(rtpReorderSize, rtpReorderDelay)
+	codec := s.Codec()
+	depacketizer := newDepacketizer(codec)
+	injector := newRTPParamInjector(codec)
+	var lastSeq uint16
+	started := false
+	buf := make([]byte, 65535)
+
+	for s.running.Load() {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if s.running.Load() && !errors.Is(err, net.ErrClosed) {
+				log.Printf("RTP read error: %v", err)
+			}
+			return
+		}
+		s.ingestBytes.Add(uint64(n))
+		s.lastPacket.Store(time.Now().UnixNano())
+		if s.outputs != nil {
+			s.outputs.Send(buf[:n])
+		}
+
+		// Buffered packets outlive the read buffer
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(append([]byte(nil), buf[:n]...)); err != nil {
+			s.invalidPackets.Add(1)
 			continue
 		}
+		if started {
+			if gap := int16(pkt.SequenceNumber - lastSeq); gap > 1 {
+				s.lostPackets.Add(uint64(gap - 1))
+			}
+		}
+		if !started || int16(pkt.SequenceNumber-lastSeq) > 0 {
+			lastSeq = pkt.SequenceNumber
+			started = true
+		}
 
-		log.Printf("GStreamer pipeline started (PID: %d)", s.cmd.Process.Pid)
+		now := time.Now()
+		s.detectCodec(&detector, pkt.Payload, now)
+		if current := s.Codec(); current != codec {
+			codec = current
+			depacketizer = newDepacketizer(codec)
+			injector = newRTPParamInjector(codec)
+		}
+		params := injector.Before(pkt)
 
-		// Read H265 NAL units from stdout
-		buf := make([]byte, 65535)
-		for s.running {
-			n, err := stdout.Read(buf)
-			if err != nil {
-				if err != io.EOF && s.running {
-					log.Printf("GStreamer read error: %v", err)
+		s.peersMu.RLock()
+		for _, peer := range s.peers {
+			if peer.forwarder == nil {
+				continue
+			}
+			// Both fail only for peers that are closing
+			if len(params) > 0 {
+				if err := peer.forwarder.Inject(pkt, params); err != nil {
+					continue
 				}
-				break
 			}
+			if err := peer.forwarder.Forward(pkt); err == nil {
+				s.forwardedPackets.Add(1)
+			}
+		}
+		s.peersMu.RUnlock()
 
-			if n > 0 {
-				// Write H265 data as a sample
-				sample := media.Sample{
-					Data:     buf[:n],
-					Duration: time.Millisecond * 33, // ~30fps
-				}
-				if err := s.videoTrack.WriteSample(sample); err != nil {
-					log.Printf("Sample write error: %v", err)
+		if s.videoFrames.count() == 0 {
+			continue
+		}
+		for _, p := range reorder.Push(pkt, now) {
+			for _, au := range depacketizer.Push(p) {
+				if au.Complete {
+					injector.params.Fill(au)
 				}
+				s.videoFrames.publish(&VideoFrame{Codec: codec, AccessUnit: au})
 			}
 		}
+	}
+}
+
+// writeFrame writes a frame to the video track. Incomplete frames are
+// dropped, the next frame's duration covers them.
+func (s *StreamServer) writeFrame(au *AccessUnit) {
+	if !au.Complete {
+		s.framesDropped.Add(1)
+		return
+	}
 
-		s.cmd.Wait()
-		if s.running {
-			log.Printf("GStreamer pipeline ended, restarting...")
-			time.Sleep(time.Second)
+	s.trackMu.Lock()
+	track := s.videoTrack
+	duration := defaultFrameDuration
+	if s.haveLastFrame {
+		d := time.Duration(au.Timestamp-s.lastFrameTS) * time.Second / rtpVideoClockRate
+		if d > 0 && d <= maxFrameDuration {
+			duration = d
 		}
 	}
+	s.lastFrameTS = au.Timestamp
+	s.haveLastFrame = true
+	s.trackMu.Unlock()
+
+	s.frames.Add(1)
+	if err := track.WriteSample(media.Sample{Data: au.AnnexB(), Duration: duration}); err != nil {
+		log.Printf("Sample write error: %v", err)
+	}
 }
 
 // SignalingRequest represents a WebRTC offer from the browser
 type SignalingRequest struct {
 	Offer webrtc.SessionDescription `json:"offer"`
+	// Inputs to receive, in the order of the offer's video sections. The
+	// main input when empty.
+	Sources []string `json:"sources,omitempty"`
 }
 
 // SignalingResponse represents the WebRTC answer to send to the browser
@@ -174,29 +631,93 @@ func (s *StreamServer) HandleSignaling(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The answer carries every candidate, as the UI doesn't trickle
+	_, answer, err := s.answerOffer(req.Offer, 0)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+
+	// Send the answer back
+	resp := SignalingResponse{
+		Answer: *answer,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// signalingError is an offer that can't be answered, with the HTTP status
+// to report it with
+type signalingError struct {
+	status int
+	msg    string
+}
+
+func (e *signalingError) Error() string {
+	return e.msg
+}
+
+func writeSignalingError(w http.ResponseWriter, err error) {
+	var se *signalingError
+	if errors.As(err, &se) {
+		http.Error(w, se.msg, se.status)
+		return
+	}
+	http.Error(w, "Failed to create connection", http.StatusInternalServerError)
+}
+
+// answerOffer creates a peer for an offer and returns its ID and answer.
+// The answer holds the candidates gathered within gatherTimeout, or all of
+// them when it is 0.
+func (s *StreamServer) answerOffer(offer webrtc.SessionDescription, gatherTimeout time.Duration) (string, *webrtc.SessionDescription, error) {
+	// Only answer browsers that can decode the stream
+	if err := s.checkOffer(offer); err != nil {
+		return "", nil, err
+	}
+
 	// Create a new peer connection
-	peerConnection, err := s.createPeerConnection()
+	peerID, peerConnection, err := s.createPeerConnection()
 	if err != nil {
 		log.Printf("Failed to create peer connection: %v", err)
-		http.Error(w, "Failed to create connection", http.StatusInternalServerError)
-		return
+		return "", nil, err
+	}
+
+	answer, err := completeAnswer(peerConnection, offer, gatherTimeout)
+	if err != nil {
+		s.closePeer(peerID)
+		return "", nil, err
+	}
+	return peerID, answer, nil
+}
+
+// checkOffer rejects offers that can't receive the stream's codec
+func (s *StreamServer) checkOffer(offer webrtc.SessionDescription) error {
+	codec := s.Codec()
+	supported, err := offerSupportsCodec(offer, codec)
+	if err != nil {
+		return &signalingError{http.StatusBadRequest, "Invalid offer"}
 	}
+	if !supported {
+		return &signalingError{http.StatusNotAcceptable, fmt.Sprintf("This browser can't decode %s video", strings.ToUpper(codec))}
+	}
+	return nil
+}
 
+// completeAnswer applies an offer to a peer connection and returns the
+// answer once candidates are gathered
+func completeAnswer(peerConnection *webrtc.PeerConnection, offer webrtc.SessionDescription, gatherTimeout time.Duration) (*webrtc.SessionDescription, error) {
 	// Set the remote description (the browser's offer)
-	if err = peerConnection.SetRemoteDescription(req.Offer); err != nil {
+	if err := peerConnection.SetRemoteDescription(offer); err != nil {
 		log.Printf("Failed to set remote description: %v", err)
-		peerConnection.Close()
-		http.Error(w, "Failed to process offer", http.StatusInternalServerError)
-		return
+		return nil, &signalingError{http.StatusBadRequest, "Failed to process offer"}
 	}
 
 	// Create an answer
 	answer, err := peerConnection.CreateAnswer(nil)
 	if err != nil {
 		log.Printf("Failed to create answer: %v", err)
-		peerConnection.Close()
-		http.Error(w, "Failed to create answer", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	// Create channel to wait for ICE gathering completion
@@ -205,75 +726,112 @@ func (s *StreamServer) HandleSignaling(w http.ResponseWriter, r *http.Request) {
 	// Set the local description
 	if err = peerConnection.SetLocalDescription(answer); err != nil {
 		log.Printf("Failed to set local description: %v", err)
-		peerConnection.Close()
-		http.Error(w, "Failed to set local description", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	// Wait for ICE gathering to complete
-	<-gatherComplete
-
-	// Send the answer back
-	resp := SignalingResponse{
-		Answer: *peerConnection.LocalDescription(),
+	if gatherTimeout > 0 {
+		select {
+		case <-gatherComplete:
+		case <-time.After(gatherTimeout):
+		}
+	} else {
+		<-gatherComplete
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	return peerConnection.LocalDescription(), nil
 }
 
 // createPeerConnection creates and configures a new WebRTC peer connection
-func (s *StreamServer) createPeerConnection() (*webrtc.PeerConnection, error) {
-	// Configure WebRTC
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
+func (s *StreamServer) createPeerConnection() (string, *webrtc.PeerConnection, error) {
+	peerConnection, err := s.newPeerConnection()
+	if err != nil {
+		return "", nil, err
 	}
 
-	peerConnection, err := webrtc.NewPeerConnection(config)
-	if err != nil {
-		return nil, err
+	peerID := newRandomID()
+	if err := s.attachPeer(peerID, peerConnection); err != nil {
+		peerConnection.Close()
+		return "", nil, err
 	}
 
-	// Add the video track
-	rtpSender, err := peerConnection.AddTrack(s.videoTrack)
+	// Handle connection state changes
+	peerConnection.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		log.Printf("Peer %s connection state: %s", peerID, state.String())
+		s.peerStateChanged(peerID, state)
+	})
+
+	return peerID, peerConnection, nil
+}
+
+// attachPeer adds the video track to a peer connection and stores it as a
+// peer. The connection may carry other inputs' tracks too.
+func (s *StreamServer) attachPeer(peerID string, peerConnection *webrtc.PeerConnection) error {
+	// Add the video track, shared in sample mode and per peer in RTP mode
+	peer := &streamPeer{pc: peerConnection, source: s.source, connected: time.Now()}
+	var track webrtc.TrackLocal
+	var err error
+	if s.mode == StreamModeRTP {
+		peer.forwarder, err = newRTPForwarder(s.Codec(), s.streamID)
+		if err != nil {
+			return err
+		}
+		track = peer.forwarder.track
+	} else {
+		s.trackMu.RLock()
+		track = s.videoTrack
+		s.trackMu.RUnlock()
+	}
+	peer.sender, err = peerConnection.AddTrack(track)
 	if err != nil {
-		peerConnection.Close()
-		return nil, err
+		return err
 	}
 
-	// Read incoming RTCP packets (required for NACK processing)
+	// Read incoming RTCP packets (required for NACK processing) for the
+	// peer's stats and keyframe requests
 	go func() {
-		rtcpBuf := make([]byte, 1500)
 		for {
-			if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
+			packets, _, rtcpErr := peer.sender.ReadRTCP()
+			if rtcpErr != nil {
 				return
 			}
+			peer.observeRTCP(s, packets)
 		}
 	}()
 
-	// Handle connection state changes
-	peerID := peerConnection.GetConfiguration().PeerIdentity
-	peerConnection.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
-		log.Printf("Peer %s connection state: %s", peerID, state.String())
+	// Store peer connection
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
+	if !s.viewers.acquire(peerID) {
+		return errTooManyPeers
+	}
+	s.peers[peerID] = peer
+	return nil
+}
 
-		if state == webrtc.ICEConnectionStateFailed ||
-			state == webrtc.ICEConnectionStateClosed ||
-			state == webrtc.ICEConnectionStateDisconnected {
-			peerConnection.Close()
-			s.peersMu.Lock()
-			delete(s.peers, peerID)
-			s.peersMu.Unlock()
-		}
-	})
+// peerStateChanged starts a connected peer and forgets a lost one
+func (s *StreamServer) peerStateChanged(peerID string, state webrtc.ICEConnectionState) {
+	// Start the new viewer without waiting for the next GOP
+	if state == webrtc.ICEConnectionStateConnected {
+		s.RequestKeyframe("new peer")
+	}
 
-	// Store peer connection
+	if state == webrtc.ICEConnectionStateFailed ||
+		state == webrtc.ICEConnectionStateClosed ||
+		state == webrtc.ICEConnectionStateDisconnected {
+		s.closePeer(peerID)
+	}
+}
+
+// closePeer closes and forgets a peer, returning false if it's unknown
+func (s *StreamServer) closePeer(id string) bool {
 	s.peersMu.Lock()
-	s.peers[peerID] = peerConnection
+	peer, ok := s.peers[id]
+	delete(s.peers, id)
 	s.peersMu.Unlock()
-
-	return peerConnection, nil
+	if ok {
+		s.viewers.release(id)
+		peer.pc.Close()
+	}
+	return ok
 }
@@ -3,22 +3,37 @@ package service
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/gilankpam/openipc-gs-web/internal/metrics"
 	"github.com/vmihailenco/msgpack/v5"
 )
 
-// WFBStats holds the aggregated statistics for the UI
-type WFBStats struct {
-	// Antenna stats
+// WFBStreamStats holds the statistics of one wfb-ng receive stream
+type WFBStreamStats struct {
+	// Stream ID reported by wfb-ng, e.g. "video rx"
+	ID string `json:"id"`
+
+	// Antenna stats (average per antenna, ordered by ant_id)
 	Rssi []int8 `json:"rssi"`
 	Snr  []int8 `json:"snr"`
 
+	// Detailed per antenna and per adapter stats
+	Antennas    []WFBAntennaStats `json:"antennas"`
+	Adapters    []WFBAdapterStats `json:"adapters"`
+	BestAntenna int64             `json:"best_antenna"` // ant_id, -1 when no antenna received packets
+
 	// Link stats (rates)
 	VideoPacketsPerSec int `json:"video_packets_per_sec"`
 	FecPacketsPerSec   int `json:"fec_packets_per_sec"`
@@ -33,17 +48,143 @@ type WFBStats struct {
 	FecN                int    `json:"fec_n"`
 	LinkFlowBytesPerSec int    `json:"link_flow_bytes_per_sec"`
 
-	// Raw stats for debug or accumulation
-	TotalPackets uint32 `json:"total_packets"`
-	TotalLost    uint32 `json:"total_lost"`
+	// Cumulative counters since wfb-ng started or the last reset
+	TotalPackets uint64          `json:"total_packets"`
+	TotalLost    uint64          `json:"total_lost"`
+	Totals       WFBPacketTotals `json:"totals"`
+	LossPercent  float64         `json:"loss_percent"`
+
+	// Totals as counted by wfb-ng, unaffected by resets
+	wfbTotals WFBPacketTotals
+}
+
+// WFBPacketTotals holds the cumulative packet counters of a receive stream
+type WFBPacketTotals struct {
+	All          uint64 `json:"all"`
+	Lost         uint64 `json:"lost"`
+	FecRecovered uint64 `json:"fec_rec"`
+	Bad          uint64 `json:"bad"`
+	Bytes        uint64 `json:"all_bytes"`
+	DecErr       uint64 `json:"dec_err"`
+	Out          uint64 `json:"out"`
+}
+
+// WFBAntennaStats holds the receive statistics of one antenna chain
+type WFBAntennaStats struct {
+	// ant_id as reported by wfb-ng: (wlan index << 8) | antenna
+	AntennaID int64 `json:"ant_id"`
+	WlanIndex int   `json:"wlan_idx"`
+	Antenna   int   `json:"antenna"`
+
+	Frequency uint32 `json:"frequency"`
+	McsIndex  int    `json:"mcs_index"`
+	Bandwidth int    `json:"bandwidth"`
+
+	PacketsPerSec int `json:"packets_per_sec"`
+	// Percentage of the stream's unique packets seen by this antenna
+	PacketShare float64 `json:"packet_share"`
+
+	RssiMin int `json:"rssi_min"`
+	RssiAvg int `json:"rssi_avg"`
+	RssiMax int `json:"rssi_max"`
+	SnrMin  int `json:"snr_min"`
+	SnrAvg  int `json:"snr_avg"`
+	SnrMax  int `json:"snr_max"`
+
+	Best bool `json:"best"`
+}
+
+// WFBAdapterStats groups the antennas of one wlan adapter
+type WFBAdapterStats struct {
+	WlanIndex int     `json:"wlan_idx"`
+	Antennas  []int64 `json:"antennas"` // ant_ids
+
+	// An adapter receives a packet once, whatever chains it was seen on
+	PacketsPerSec int     `json:"packets_per_sec"`
+	PacketShare   float64 `json:"packet_share"`
+	BestRssi      int     `json:"best_rssi"`
+	BestSnr       int     `json:"best_snr"`
+	Best          bool    `json:"best"`
+}
+
+// WFBTxStats holds the statistics of one wfb-ng transmit stream (the uplink)
+type WFBTxStats struct {
+	ID string `json:"id"`
+
+	IncomingPacketsPerSec int `json:"incoming_packets_per_sec"`
+	InjectedPacketsPerSec int `json:"injected_packets_per_sec"`
+	InjectedBytesPerSec   int `json:"injected_bytes_per_sec"`
+	DroppedPacketsPerSec  int `json:"dropped_packets_per_sec"`
+	TruncatedPerSec       int `json:"truncated_per_sec"`
+	FecTimeoutsPerSec     int `json:"fec_timeouts_per_sec"`
+
+	// Per TX antenna injection latency
+	Antennas []WFBTxAntennaStats `json:"antennas"`
+
+	// Totals as counted by wfb-ng
+	wfbTotals wfbTxTotals
+}
+
+// wfbTxTotals holds the cumulative packet counters of a transmit stream
+type wfbTxTotals struct {
+	Injected  uint64
+	Dropped   uint64
+	Truncated uint64
+}
+
+// WFBTxAntennaStats holds injection stats of one transmit antenna
+type WFBTxAntennaStats struct {
+	AntennaID    int64 `json:"ant_id"`
+	Injected     int   `json:"injected"`
+	Dropped      int   `json:"dropped"`
+	LatencyMinUs int   `json:"latency_min_us"`
+	LatencyAvgUs int   `json:"latency_avg_us"`
+	LatencyMaxUs int   `json:"latency_max_us"`
+}
+
+// WFBStats holds the aggregated statistics for the UI.
+// The embedded stream is the primary (video) receive stream, so the flat
+// fields keep describing the video link; every stream is listed in Rx and Tx.
+type WFBStats struct {
+	WFBStreamStats
+
+	Rx map[string]*WFBStreamStats `json:"rx"`
+	Tx map[string]*WFBTxStats     `json:"tx"`
+
+	// Stream ID of the update that produced this snapshot
+	Source string `json:"source"`
+
+	primaryUpdate bool
+	// Published by ResetTotals rather than by a stream update
+	totalsReset bool
+}
+
+// PrimaryUpdated reports whether this snapshot was produced by an update
+// of the primary video stream rather than another rx or tx stream
+func (s *WFBStats) PrimaryUpdated() bool {
+	return s.primaryUpdate
+}
+
+// isPrimaryStream reports whether an rx stream carries the video link.
+// Messages without an ID come from single stream setups.
+func isPrimaryStream(id string) bool {
+	return id == "" || strings.HasPrefix(id, "video")
 }
 
 // Internal MsgPack structures
 type WFBMessage struct {
 	Type       string                 `msgpack:"type"`
+	ID         string                 `msgpack:"id"`           // e.g. "video rx", "mavlink rx", "video tx"
 	Packets    map[string][]int64     `msgpack:"packets"`      // keys: "all", "lost", "fec_rec", "bad", "all_bytes"
 	RxAntStats msgpack.RawMessage     `msgpack:"rx_ant_stats"` // Complex key map, decode manually
 	Session    map[string]interface{} `msgpack:"session"`
+	Latency    msgpack.RawMessage     `msgpack:"latency"` // tx only: ant_id -> [injected, dropped, lat_min, lat_avg, lat_max]
+}
+
+// streamEvent is an event sent on the stats stream besides stats updates
+type streamEvent struct {
+	name string
+	data interface{}
 }
 
 // WFBStatsService handles reading stats via TCP
@@ -51,7 +192,15 @@ type WFBStatsService struct {
 	mu           sync.Mutex
 	currentStats *WFBStats
 	address      string
-	running      bool
+	running      atomic.Bool
+	feed         *broadcaster[*WFBStats]
+	events       *broadcaster[streamEvent]
+	history      *StatsHistory
+
+	// wfb-ng totals per stream and category, as last received and as of
+	// the last reset
+	lastTotals map[string]map[string]int64
+	baselines  map[string]map[string]int64
 }
 
 func NewWFBStatsService() *WFBStatsService {
@@ -59,9 +208,19 @@ func NewWFBStatsService() *WFBStatsService {
 	return &WFBStatsService{
 		address: "127.0.0.1:8003",
 		currentStats: &WFBStats{
-			Rssi: []int8{},
-			Snr:  []int8{},
+			WFBStreamStats: WFBStreamStats{
+				Rssi:        []int8{},
+				Snr:         []int8{},
+				BestAntenna: -1,
+			},
+			Rx: map[string]*WFBStreamStats{},
+			Tx: map[string]*WFBTxStats{},
 		},
+		feed:       newBroadcaster[*WFBStats](16),
+		events:     newBroadcaster[streamEvent](16),
+		history:    NewStatsHistory(time.Hour),
+		lastTotals: map[string]map[string]int64{},
+		baselines:  map[string]map[string]int64{},
 	}
 }
 
@@ -71,13 +230,19 @@ func (s *WFBStatsService) WithAddress(addr string) *WFBStatsService {
 	return s
 }
 
+// WithHistoryRetention sets how long stats history is kept
+func (s *WFBStatsService) WithHistoryRetention(retention time.Duration) *WFBStatsService {
+	s.history = NewStatsHistory(retention)
+	return s
+}
+
 func (s *WFBStatsService) Start() {
-	s.running = true
+	s.running.Store(true)
 	go s.runLoop()
 }
 
 func (s *WFBStatsService) Stop() {
-	s.running = false
+	s.running.Store(false)
 }
 
 func (s *WFBStatsService) GetStats() (*WFBStats, error) {
@@ -88,8 +253,200 @@ func (s *WFBStatsService) GetStats() (*WFBStats, error) {
 	return &stats, nil
 }
 
+// Subscribe returns a feed of every stats update as it arrives from wfb-ng.
+// Received stats are shared between subscribers and must not be modified.
+// A subscriber that falls behind loses the oldest queued updates.
+func (s *WFBStatsService) Subscribe() *Subscription[*WFBStats] {
+	return s.feed.subscribe()
+}
+
+// RegisterMetrics exports link statistics to a metrics registry.
+// Per-antenna signal of the video stream is exported as gauges and the
+// packet totals of every stream are accumulated into counters.
+func (s *WFBStatsService) RegisterMetrics(reg *metrics.Registry) {
+	rssi := reg.NewGauge("wfb_rssi_dbm", "Average RSSI per receive antenna.", "antenna")
+	snr := reg.NewGauge("wfb_snr_db", "Average SNR per receive antenna.", "antenna")
+	antPackets := reg.NewGauge("wfb_antenna_packets_per_second", "Packets per second received per adapter and antenna.", "wlan", "antenna")
+	packets := reg.NewCounter("wfb_packets_total", "Packets received by wfb-ng by stream and category.", "stream", "type")
+	bytes := reg.NewCounter("wfb_received_bytes_total", "Bytes received by wfb-ng by stream.", "stream")
+	txPackets := reg.NewCounter("wfb_tx_packets_total", "Packets handled by wfb-ng transmitters by stream and category.", "stream", "type")
+	mcs := reg.NewGauge("wfb_mcs_index", "MCS index of the received video stream.")
+	freq := reg.NewGauge("wfb_frequency_mhz", "Frequency of the received video stream.")
+	bandwidth := reg.NewGauge("wfb_bandwidth_mhz", "Channel bandwidth of the received video stream.")
+
+	// wfb-ng totals already added, per stream
+	counted := map[string]WFBPacketTotals{}
+	txCounted := map[string]wfbTxTotals{}
+
+	sub := s.Subscribe()
+	go func() {
+		for stats := range sub.C {
+			// A reset repeats the streams' last rates
+			if stats.totalsReset {
+				continue
+			}
+			if rx, ok := stats.Rx[stats.Source]; ok {
+				cur, prev := rx.wfbTotals, counted[rx.ID]
+				packets.Add(totalsDelta(cur.All, prev.All), rx.ID, "all")
+				packets.Add(totalsDelta(cur.Lost, prev.Lost), rx.ID, "lost")
+				packets.Add(totalsDelta(cur.FecRecovered, prev.FecRecovered), rx.ID, "fec_rec")
+				packets.Add(totalsDelta(cur.Bad, prev.Bad), rx.ID, "bad")
+				bytes.Add(totalsDelta(cur.Bytes, prev.Bytes), rx.ID)
+				counted[rx.ID] = cur
+			}
+			if tx, ok := stats.Tx[stats.Source]; ok {
+				cur, prev := tx.wfbTotals, txCounted[tx.ID]
+				txPackets.Add(totalsDelta(cur.Injected, prev.Injected), tx.ID, "injected")
+				txPackets.Add(totalsDelta(cur.Dropped, prev.Dropped), tx.ID, "dropped")
+				txPackets.Add(totalsDelta(cur.Truncated, prev.Truncated), tx.ID, "truncated")
+				txCounted[tx.ID] = cur
+			}
+
+			if !stats.PrimaryUpdated() {
+				continue
+			}
+			rssi.Reset()
+			snr.Reset()
+			antPackets.Reset()
+			for i, v := range stats.Rssi {
+				rssi.Set(float64(v), strconv.Itoa(i))
+			}
+			for i, v := range stats.Snr {
+				snr.Set(float64(v), strconv.Itoa(i))
+			}
+			for _, ant := range stats.Antennas {
+				antPackets.Set(float64(ant.PacketsPerSec), strconv.Itoa(ant.WlanIndex), strconv.Itoa(ant.Antenna))
+			}
+			mcs.Set(float64(stats.McsIndex))
+			freq.Set(float64(stats.Frequency))
+			bandwidth.Set(float64(stats.Bandwidth))
+		}
+	}()
+}
+
+// totalsDelta returns how much a wfb-ng total grew since it was last
+// counted. After a wfb-ng restart it counts from zero again.
+func totalsDelta(cur, prev uint64) float64 {
+	if cur < prev {
+		return float64(cur)
+	}
+	return float64(cur - prev)
+}
+
+// PushEvent sends an event to every client of the stats stream, so things
+// derived from the stats (such as alerts) reach the UI on the same channel
+func (s *WFBStatsService) PushEvent(event string, v interface{}) {
+	s.events.publish(streamEvent{name: event, data: v})
+}
+
+// HandleStream pushes every stats update to the client as server-sent events
+func (s *WFBStatsService) HandleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := startSSE(w)
+	if !ok {
+		return
+	}
+
+	sub := s.Subscribe()
+	defer sub.Close()
+	events := s.events.subscribe()
+	defer events.Close()
+
+	// Send the current snapshot so the client doesn't start empty
+	stats, _ := s.GetStats()
+	if err := writeSSE(w, flusher, "stats", stats); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(sseKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case stats, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if err := writeSSE(w, flusher, "stats", stats); err != nil {
+				return
+			}
+		case ev, ok := <-events.C:
+			if !ok {
+				return
+			}
+			if err := writeSSE(w, flusher, ev.name, ev.data); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if err := writeSSEKeepalive(w, flusher); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// History returns the in-memory stats history
+func (s *WFBStatsService) History() *StatsHistory {
+	return s.history
+}
+
+// HandleHistory serves GET /api/v1/stats/history?from=&to=&step=.
+// from and to are unix seconds (default: the last 5 minutes), step is in
+// seconds or a duration such as "10s".
+func (s *WFBStatsService) HandleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	to := time.Now()
+	if v := query.Get("to"); v != "" {
+		sec, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid 'to' parameter", http.StatusBadRequest)
+			return
+		}
+		to = time.Unix(sec, 0)
+	}
+	from := to.Add(-historyRawWindow)
+	if v := query.Get("from"); v != "" {
+		sec, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid 'from' parameter", http.StatusBadRequest)
+			return
+		}
+		from = time.Unix(sec, 0)
+	}
+	if from.After(to) {
+		http.Error(w, "'from' must be before 'to'", http.StatusBadRequest)
+		return
+	}
+
+	var step time.Duration
+	if v := query.Get("step"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil {
+			step = time.Duration(sec) * time.Second
+		} else if d, err := time.ParseDuration(v); err == nil {
+			step = d
+		} else {
+			http.Error(w, "Invalid 'step' parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.history.Query(from, to, step))
+}
+
 func (s *WFBStatsService) runLoop() {
-	for s.running {
+	for s.running.Load() {
 		conn, err := net.DialTimeout("tcp", s.address, 2*time.Second)
 		if err != nil {
 			time.Sleep(2 * time.Second)
@@ -108,7 +465,7 @@ func (s *WFBStatsService) handleConnection(conn net.Conn) {
 	// wfb-ng sends: [4 bytes length][msgpack payload]
 	header := make([]byte, 4)
 
-	for s.running {
+	for s.running.Load() {
 		// Read length
 		if _, err := io.ReadFull(conn, header); err != nil {
 			return
@@ -133,8 +490,11 @@ func (s *WFBStatsService) handleConnection(conn net.Conn) {
 			continue
 		}
 
-		if msg.Type == "rx" {
+		switch msg.Type {
+		case "rx":
 			s.updateStats(msg)
+		case "tx":
+			s.updateTxStats(msg)
 		}
 	}
 }
@@ -143,7 +503,8 @@ func (s *WFBStatsService) updateStats(msg WFBMessage) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	newStats := &WFBStats{
+	newStats := &WFBStreamStats{
+		ID:   msg.ID,
 		Rssi: make([]int8, 0, 4),
 		Snr:  make([]int8, 0, 4),
 	}
@@ -161,6 +522,7 @@ func (s *WFBStatsService) updateStats(msg WFBMessage) {
 	newStats.FecPacketsPerSec = getInt("fec_rec")
 	newStats.BadBlocksPerSec = getInt("bad")
 	newStats.LinkFlowBytesPerSec = getInt("all_bytes")
+	s.updateTotals(newStats, msg.Packets)
 
 	// 2. Parse Session Info (FEC)
 	if msg.Session != nil {
@@ -174,85 +536,333 @@ func (s *WFBStatsService) updateStats(msg WFBMessage) {
 
 	// 3. Parse Antenna Stats (Complex keys) & Transmission Info
 	if len(msg.RxAntStats) > 0 {
-		dec := msgpack.NewDecoder(bytes.NewReader(msg.RxAntStats))
-		n, err := dec.DecodeMapLen()
-		if err == nil {
-			// Temporary map to sort by antenna ID
-			type antData struct {
-				rssi int8
-				snr  int8
-			}
-			dataMap := make(map[int64]antData)
-			foundRadioInfo := false
-
-			for i := 0; i < n; i++ {
-				// Decode Key: ((freq, mcs, bw), ant_id)
-				var key []interface{}
-				if err := dec.Decode(&key); err != nil {
-					log.Printf("Error decoding ant key: %v", err)
-					break
-				}
-
-				// Extract Radio Info from the first valid key
-				// Key[0] is [freq, mcs, bw]
-				if !foundRadioInfo && len(key) >= 1 {
-					if radioInfo, ok := key[0].([]interface{}); ok && len(radioInfo) >= 3 {
-						newStats.Frequency = uint32(convertToInt64(radioInfo[0]))
-						newStats.McsIndex = int(convertToInt64(radioInfo[1]))
-						newStats.Bandwidth = int(convertToInt64(radioInfo[2]))
-						foundRadioInfo = true
-					}
-					// Check if msgpack decoded it as slice of correct types directly
-					// Sometimes it might come as []int64 if generic decoding didn't happen?
-					// But we are decoding into []interface{} which should work.
-				}
-
-				// Extract ant_id. Key should be [ [f,m,b], ant_id ]
-				var antID int64
-				if len(key) >= 2 {
-					antID = convertToInt64(key[1])
-				}
-
-				// Decode Value: [pkt_s, rssi_min, rssi_avg, rssi_max, snr_min, snr_avg, snr_max]
-				var val []int64
-				if err := dec.Decode(&val); err != nil {
-					log.Printf("Error decoding ant val: %v", err)
-					break
-				}
-
-				if len(val) >= 6 {
-					dataMap[antID] = antData{
-						rssi: int8(val[2]),
-						snr:  int8(val[5]),
-					}
-				}
-			}
+		antennas, err := decodeRxAntStats(msg.RxAntStats)
+		if err != nil {
+			log.Printf("Error decoding antenna stats: %v", err)
+		}
+		if len(antennas) > 0 {
+			// Radio info is the same for every antenna of a stream
+			newStats.Frequency = antennas[0].Frequency
+			newStats.McsIndex = antennas[0].McsIndex
+			newStats.Bandwidth = antennas[0].Bandwidth
+		}
 
-			// Sort by antenna ID
-			var keys []int64
-			for k := range dataMap {
-				keys = append(keys, k)
-			}
-			// Bubble sort
-			for i := 0; i < len(keys); i++ {
-				for j := i + 1; j < len(keys); j++ {
-					if keys[i] > keys[j] {
-						keys[i], keys[j] = keys[j], keys[i]
-					}
-				}
-			}
+		// Share is relative to unique packets, "all" counts duplicates
+		// received on several antennas
+		uniq := getInt("uniq")
+		if uniq == 0 {
+			uniq = newStats.VideoPacketsPerSec
+		}
+		summarizeAntennas(newStats, antennas, uniq)
+	}
+	if newStats.Antennas == nil {
+		newStats.BestAntenna = -1
+	}
+
+	snapshot := s.nextSnapshot(msg.ID)
+	snapshot.Rx[msg.ID] = newStats
+	if isPrimaryStream(msg.ID) {
+		snapshot.WFBStreamStats = *newStats
+		snapshot.primaryUpdate = true
+		s.history.Add(snapshot, time.Now())
+	}
+	s.publish(snapshot)
+}
+
+func (s *WFBStatsService) updateTxStats(msg WFBMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	getInt := func(key string) int {
+		if val, ok := msg.Packets[key]; ok && len(val) > 0 {
+			return int(val[0])
+		}
+		return 0
+	}
+	getTotal := func(key string) uint64 {
+		if val, ok := msg.Packets[key]; ok && len(val) > 1 {
+			return uint64(val[1])
+		}
+		return 0
+	}
 
-			for _, k := range keys {
-				d := dataMap[k]
-				newStats.Rssi = append(newStats.Rssi, d.rssi)
-				newStats.Snr = append(newStats.Snr, d.snr)
+	tx := &WFBTxStats{
+		ID:                    msg.ID,
+		IncomingPacketsPerSec: getInt("incoming"),
+		InjectedPacketsPerSec: getInt("injected"),
+		InjectedBytesPerSec:   getInt("injected_bytes"),
+		DroppedPacketsPerSec:  getInt("dropped"),
+		TruncatedPerSec:       getInt("truncated"),
+		FecTimeoutsPerSec:     getInt("fec_timeouts"),
+		Antennas:              []WFBTxAntennaStats{},
+		wfbTotals: wfbTxTotals{
+			Injected:  getTotal("injected"),
+			Dropped:   getTotal("dropped"),
+			Truncated: getTotal("truncated"),
+		},
+	}
+
+	if len(msg.Latency) > 0 {
+		var latency map[int64][]int64
+		if err := msgpack.Unmarshal(msg.Latency, &latency); err != nil {
+			log.Printf("Error decoding tx latency: %v", err)
+		}
+		for antID, val := range latency {
+			if len(val) < 5 {
+				continue
 			}
-		} else {
-			log.Printf("Error decoding map len: %v", err)
+			tx.Antennas = append(tx.Antennas, WFBTxAntennaStats{
+				AntennaID:    antID,
+				Injected:     int(val[0]),
+				Dropped:      int(val[1]),
+				LatencyMinUs: int(val[2]),
+				LatencyAvgUs: int(val[3]),
+				LatencyMaxUs: int(val[4]),
+			})
+		}
+		sort.Slice(tx.Antennas, func(i, j int) bool {
+			return tx.Antennas[i].AntennaID < tx.Antennas[j].AntennaID
+		})
+	}
+
+	snapshot := s.nextSnapshot(msg.ID)
+	snapshot.Tx[msg.ID] = tx
+	s.publish(snapshot)
+}
+
+// updateTotals sets the cumulative counters of stats from the totals in
+// packets, relative to the baseline of the last reset
+func (s *WFBStatsService) updateTotals(stats *WFBStreamStats, packets map[string][]int64) {
+	last := make(map[string]int64, len(packets))
+	base := s.baselines[stats.ID]
+	total := func(key string) uint64 {
+		val, ok := packets[key]
+		if !ok || len(val) < 2 {
+			return 0
+		}
+		last[key] = val[1]
+		// wfb-ng restarted and counts from zero again
+		if val[1] < base[key] {
+			delete(base, key)
+		}
+		return uint64(val[1] - base[key])
+	}
+
+	stats.Totals = WFBPacketTotals{
+		All:          total("all"),
+		Lost:         total("lost"),
+		FecRecovered: total("fec_rec"),
+		Bad:          total("bad"),
+		Bytes:        total("all_bytes"),
+		DecErr:       total("dec_err"),
+		Out:          total("out"),
+	}
+	s.lastTotals[stats.ID] = last
+	stats.wfbTotals = WFBPacketTotals{
+		All:          uint64(last["all"]),
+		Lost:         uint64(last["lost"]),
+		FecRecovered: uint64(last["fec_rec"]),
+		Bad:          uint64(last["bad"]),
+		Bytes:        uint64(last["all_bytes"]),
+		DecErr:       uint64(last["dec_err"]),
+		Out:          uint64(last["out"]),
+	}
+
+	stats.TotalPackets = stats.Totals.All
+	stats.TotalLost = stats.Totals.Lost
+	if sum := stats.Totals.All + stats.Totals.Lost; sum > 0 {
+		stats.LossPercent = float64(stats.Totals.Lost) / float64(sum) * 100
+	}
+}
+
+// ResetTotals zeroes the cumulative counters of every stream. wfb-ng keeps
+// counting, the current totals become the new baseline.
+func (s *WFBStatsService) ResetTotals() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.baselines = make(map[string]map[string]int64, len(s.lastTotals))
+	for id, last := range s.lastTotals {
+		base := make(map[string]int64, len(last))
+		for key, v := range last {
+			base[key] = v
 		}
+		s.baselines[id] = base
 	}
 
-	s.currentStats = newStats
+	// Publish zeroed counters right away instead of on the next update
+	snapshot := s.nextSnapshot("")
+	snapshot.totalsReset = true
+	for id, st := range snapshot.Rx {
+		zeroed := *st
+		zeroed.Totals = WFBPacketTotals{}
+		zeroed.TotalPackets, zeroed.TotalLost, zeroed.LossPercent = 0, 0, 0
+		snapshot.Rx[id] = &zeroed
+		if isPrimaryStream(id) {
+			snapshot.WFBStreamStats = zeroed
+		}
+	}
+	s.publish(snapshot)
+}
+
+// HandleReset serves POST /api/v1/stats/reset
+func (s *WFBStatsService) HandleReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.ResetTotals()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// nextSnapshot copies the current stats so a single stream can be replaced.
+// Stream entries are never modified once stored, so they are shared.
+func (s *WFBStatsService) nextSnapshot(source string) *WFBStats {
+	next := &WFBStats{
+		WFBStreamStats: s.currentStats.WFBStreamStats,
+		Rx:             make(map[string]*WFBStreamStats, len(s.currentStats.Rx)+1),
+		Tx:             make(map[string]*WFBTxStats, len(s.currentStats.Tx)+1),
+		Source:         source,
+	}
+	for id, st := range s.currentStats.Rx {
+		next.Rx[id] = st
+	}
+	for id, st := range s.currentStats.Tx {
+		next.Tx[id] = st
+	}
+	return next
+}
+
+func (s *WFBStatsService) publish(snapshot *WFBStats) {
+	s.currentStats = snapshot
+	s.feed.publish(snapshot)
+}
+
+// decodeRxAntStats decodes the rx_ant_stats map of an rx message.
+// Keys are ((freq, mcs, bw), ant_id), values are
+// [pkt_s, rssi_min, rssi_avg, rssi_max, snr_min, snr_avg, snr_max].
+// The result is ordered by ant_id.
+func decodeRxAntStats(raw msgpack.RawMessage) ([]WFBAntennaStats, error) {
+	dec := msgpack.NewDecoder(bytes.NewReader(raw))
+	n, err := dec.DecodeMapLen()
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int64]WFBAntennaStats, n)
+	for i := 0; i < n; i++ {
+		var key []interface{}
+		if err := dec.Decode(&key); err != nil {
+			return sortAntennas(byID), err
+		}
+		var val []int64
+		if err := dec.Decode(&val); err != nil {
+			return sortAntennas(byID), err
+		}
+		if len(key) < 2 || len(val) < 7 {
+			continue
+		}
+
+		antID := convertToInt64(key[1])
+		ant := WFBAntennaStats{
+			AntennaID:     antID,
+			WlanIndex:     int(antID >> 8),
+			Antenna:       int(antID & 0xff),
+			PacketsPerSec: int(val[0]),
+			RssiMin:       int(val[1]),
+			RssiAvg:       int(val[2]),
+			RssiMax:       int(val[3]),
+			SnrMin:        int(val[4]),
+			SnrAvg:        int(val[5]),
+			SnrMax:        int(val[6]),
+		}
+		if radioInfo, ok := key[0].([]interface{}); ok && len(radioInfo) >= 3 {
+			ant.Frequency = uint32(convertToInt64(radioInfo[0]))
+			ant.McsIndex = int(convertToInt64(radioInfo[1]))
+			ant.Bandwidth = int(convertToInt64(radioInfo[2]))
+		}
+
+		// The same antenna can briefly show up under two radio keys after a
+		// channel or MCS change, keep the one that received more
+		if prev, ok := byID[antID]; ok && prev.PacketsPerSec >= ant.PacketsPerSec {
+			continue
+		}
+		byID[antID] = ant
+	}
+	return sortAntennas(byID), nil
+}
+
+func sortAntennas(byID map[int64]WFBAntennaStats) []WFBAntennaStats {
+	antennas := make([]WFBAntennaStats, 0, len(byID))
+	for _, ant := range byID {
+		antennas = append(antennas, ant)
+	}
+	sort.Slice(antennas, func(i, j int) bool { return antennas[i].AntennaID < antennas[j].AntennaID })
+	return antennas
+}
+
+// betterAntenna reports whether a has a stronger signal than b.
+// Antennas that received nothing never win.
+func betterAntenna(a, b WFBAntennaStats) bool {
+	if (a.PacketsPerSec > 0) != (b.PacketsPerSec > 0) {
+		return a.PacketsPerSec > 0
+	}
+	if a.RssiAvg != b.RssiAvg {
+		return a.RssiAvg > b.RssiAvg
+	}
+	return a.SnrAvg > b.SnrAvg
+}
+
+// summarizeAntennas fills the antenna, adapter and best antenna fields of
+// stats. uniq is the number of unique packets per second of the stream.
+func summarizeAntennas(stats *WFBStreamStats, antennas []WFBAntennaStats, uniq int) {
+	share := func(pkts int) float64 {
+		if uniq <= 0 {
+			return 0
+		}
+		return min(float64(pkts)/float64(uniq)*100, 100)
+	}
+
+	stats.Antennas = antennas
+	stats.Adapters = nil
+	stats.BestAntenna = -1
+
+	best := -1
+	for i := range antennas {
+		ant := &antennas[i]
+		ant.PacketShare = share(ant.PacketsPerSec)
+		stats.Rssi = append(stats.Rssi, int8(ant.RssiAvg))
+		stats.Snr = append(stats.Snr, int8(ant.SnrAvg))
+		if ant.PacketsPerSec > 0 && (best < 0 || betterAntenna(*ant, antennas[best])) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		antennas[best].Best = true
+		stats.BestAntenna = antennas[best].AntennaID
+	}
+
+	// Antennas are ordered by ant_id, so each adapter's chains are adjacent
+	for _, ant := range antennas {
+		n := len(stats.Adapters)
+		if n == 0 || stats.Adapters[n-1].WlanIndex != ant.WlanIndex {
+			stats.Adapters = append(stats.Adapters, WFBAdapterStats{
+				WlanIndex: ant.WlanIndex,
+				BestRssi:  ant.RssiAvg,
+				BestSnr:   ant.SnrAvg,
+			})
+			n++
+		}
+		adapter := &stats.Adapters[n-1]
+		adapter.Antennas = append(adapter.Antennas, ant.AntennaID)
+		adapter.PacketsPerSec = max(adapter.PacketsPerSec, ant.PacketsPerSec)
+		adapter.BestRssi = max(adapter.BestRssi, ant.RssiAvg)
+		adapter.BestSnr = max(adapter.BestSnr, ant.SnrAvg)
+		adapter.Best = adapter.Best || ant.Best
+	}
+	for i := range stats.Adapters {
+		stats.Adapters[i].PacketShare = share(stats.Adapters[i].PacketsPerSec)
+	}
 }
 
 func convertToInt64(v interface{}) int64 {
@@ -2,10 +2,15 @@ package service
 
 import (
 	"encoding/binary"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gilankpam/openipc-gs-web/internal/metrics"
 	"github.com/vmihailenco/msgpack/v5"
 )
 
@@ -142,3 +147,324 @@ func sendMsg(t *testing.T, conn net.Conn, msg interface{}) {
 		return
 	}
 }
+
+func TestStatsSubscribe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for _, all := range []int{100, 120} {
+			sendMsg(t, conn, map[string]interface{}{
+				"type":    "rx",
+				"packets": map[string][]int{"all": {all, 0}},
+			})
+		}
+		// Non rx messages must not reach subscribers
+		sendMsg(t, conn, map[string]interface{}{"type": "cli_title"})
+
+		time.Sleep(1 * time.Second)
+	}()
+
+	s := NewWFBStatsService().WithAddress(ln.Addr().String())
+	sub := s.Subscribe()
+	defer sub.Close()
+	s.Start()
+	defer s.Stop()
+
+	for _, want := range []int{100, 120} {
+		select {
+		case stats := <-sub.C:
+			if stats.VideoPacketsPerSec != want {
+				t.Errorf("Expected %d packets/sec, got %d", want, stats.VideoPacketsPerSec)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for update with %d packets/sec", want)
+		}
+	}
+
+	select {
+	case stats := <-sub.C:
+		t.Errorf("Unexpected extra update: %+v", stats)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBroadcasterDropsOldestForSlowSubscriber(t *testing.T) {
+	b := newBroadcaster[int](2)
+	sub := b.subscribe()
+
+	for i := 1; i <= 5; i++ {
+		b.publish(i)
+	}
+
+	if !sub.Lagged() {
+		t.Error("Expected subscriber to be marked lagged")
+	}
+	if got := []int{<-sub.C, <-sub.C}; got[0] != 4 || got[1] != 5 {
+		t.Errorf("Expected the newest values [4 5], got %v", got)
+	}
+
+	sub.Close()
+	if _, ok := <-sub.C; ok {
+		t.Error("Expected channel to be closed")
+	}
+	if b.count() != 0 {
+		t.Errorf("Expected no subscribers, got %d", b.count())
+	}
+}
+
+func TestStatsMetrics(t *testing.T) {
+	s := NewWFBStatsService()
+	reg := metrics.NewRegistry()
+	s.RegisterMetrics(reg)
+
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	// wfb-ng's totals, whatever the rates say
+	for i := int64(1); i <= 2; i++ {
+		s.updateStats(WFBMessage{
+			Type: "rx",
+			ID:   "video rx",
+			Packets: map[string][]int64{
+				"all":       {90, 100 * i},
+				"lost":      {1, 3 * i},
+				"all_bytes": {9000, 1000 * i},
+			},
+		})
+	}
+	for i := int64(1); i <= 2; i++ {
+		s.updateTxStats(WFBMessage{
+			Type: "tx",
+			ID:   "video tx",
+			Packets: map[string][]int64{
+				"injected": {40, 50 * i},
+				"dropped":  {1, 2 * i},
+			},
+		})
+	}
+	// A single unnamed stream, its totals reset and wfb-ng restarted
+	unnamed := func(total int64) {
+		s.updateStats(WFBMessage{Type: "rx", Packets: map[string][]int64{"all": {50, total}}})
+	}
+	unnamed(50)
+	s.ResetTotals()
+	unnamed(100)
+	unnamed(30)
+
+	expected := []string{
+		`wfb_packets_total{stream="",type="all"} 130`,
+		`wfb_packets_total{stream="video rx",type="all"} 200`,
+		`wfb_packets_total{stream="video rx",type="lost"} 6`,
+		`wfb_received_bytes_total{stream="video rx"} 2000`,
+		`wfb_tx_packets_total{stream="video tx",type="injected"} 100`,
+		`wfb_tx_packets_total{stream="video tx",type="dropped"} 4`,
+	}
+
+	// Metrics are updated asynchronously from the stats feed
+	var body string
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		body = string(data)
+
+		if strings.Contains(body, expected[0]) && strings.Contains(body, expected[1]) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Missing line %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestStatsPerStream(t *testing.T) {
+	s := NewWFBStatsService()
+
+	s.updateStats(WFBMessage{
+		Type:    "rx",
+		ID:      "video rx",
+		Packets: map[string][]int64{"all": {900, 0}},
+	})
+	s.updateStats(WFBMessage{
+		Type:    "rx",
+		ID:      "mavlink rx",
+		Packets: map[string][]int64{"all": {12, 0}},
+	})
+
+	latency, _ := msgpack.Marshal(map[int64][]int64{
+		1: {50, 2, 100, 250, 900},
+	})
+	s.updateTxStats(WFBMessage{
+		Type: "tx",
+		ID:   "mavlink tx",
+		Packets: map[string][]int64{
+			"injected": {50, 1000},
+			"dropped":  {2, 10},
+		},
+		Latency: latency,
+	})
+
+	stats, _ := s.GetStats()
+
+	// Flat fields describe the video stream regardless of arrival order
+	if stats.ID != "video rx" || stats.VideoPacketsPerSec != 900 {
+		t.Errorf("Expected video stream in flat fields, got %s with %d packets", stats.ID, stats.VideoPacketsPerSec)
+	}
+	if stats.Source != "mavlink tx" || stats.PrimaryUpdated() {
+		t.Errorf("Expected snapshot from mavlink tx, got %q", stats.Source)
+	}
+	if len(stats.Rx) != 2 || stats.Rx["mavlink rx"].VideoPacketsPerSec != 12 {
+		t.Errorf("Unexpected rx streams: %+v", stats.Rx)
+	}
+
+	tx := stats.Tx["mavlink tx"]
+	if tx == nil {
+		t.Fatal("Missing tx stream")
+	}
+	if tx.InjectedPacketsPerSec != 50 || tx.DroppedPacketsPerSec != 2 {
+		t.Errorf("Unexpected tx packets: %+v", tx)
+	}
+	if len(tx.Antennas) != 1 || tx.Antennas[0].AntennaID != 1 || tx.Antennas[0].LatencyAvgUs != 250 {
+		t.Errorf("Unexpected tx latency: %+v", tx.Antennas)
+	}
+}
+
+func TestStatsPerAntenna(t *testing.T) {
+	// Two adapters: wlan0 with two chains, wlan1 with one
+	type antKey struct {
+		_msgpack struct{} `msgpack:",as_array"`
+		Radio    []int
+		AntID    int
+	}
+	ants := []struct {
+		id  int
+		val []int
+	}{
+		{0x000, []int{900, -70, -66, -60, 10, 14, 18}},
+		{0x001, []int{900, -80, -75, -71, 5, 8, 12}},
+		{0x100, []int{450, -62, -58, -55, 18, 22, 26}},
+	}
+	payload := []byte{0x80 | byte(len(ants))}
+	for _, a := range ants {
+		k, _ := msgpack.Marshal(antKey{Radio: []int{5825, 3, 20}, AntID: a.id})
+		v, _ := msgpack.Marshal(a.val)
+		payload = append(payload, k...)
+		payload = append(payload, v...)
+	}
+
+	s := NewWFBStatsService()
+	s.updateStats(WFBMessage{
+		Type:       "rx",
+		ID:         "video rx",
+		Packets:    map[string][]int64{"all": {2250, 0}, "uniq": {1000, 0}},
+		RxAntStats: payload,
+	})
+	stats, _ := s.GetStats()
+
+	if len(stats.Antennas) != 3 {
+		t.Fatalf("Expected 3 antennas, got %+v", stats.Antennas)
+	}
+	a := stats.Antennas[1]
+	if a.WlanIndex != 0 || a.Antenna != 1 || a.RssiMin != -80 || a.RssiMax != -71 || a.SnrMax != 12 {
+		t.Errorf("Unexpected antenna decode: %+v", a)
+	}
+	if a.PacketShare != 90 || stats.Antennas[2].PacketShare != 45 {
+		t.Errorf("Unexpected packet shares %v and %v", a.PacketShare, stats.Antennas[2].PacketShare)
+	}
+	if stats.McsIndex != 3 || len(stats.Rssi) != 3 || stats.Rssi[2] != -58 {
+		t.Errorf("Expected legacy fields to be kept, got MCS %d RSSI %v", stats.McsIndex, stats.Rssi)
+	}
+
+	// Strongest signal wins even though it sees fewer packets
+	if stats.BestAntenna != 0x100 || !stats.Antennas[2].Best || stats.Antennas[0].Best {
+		t.Errorf("Expected wlan1 antenna 0 to be best, got %d", stats.BestAntenna)
+	}
+
+	if len(stats.Adapters) != 2 {
+		t.Fatalf("Expected 2 adapters, got %+v", stats.Adapters)
+	}
+	wlan0 := stats.Adapters[0]
+	if len(wlan0.Antennas) != 2 || wlan0.PacketsPerSec != 900 || wlan0.BestRssi != -66 || wlan0.Best {
+		t.Errorf("Unexpected wlan0 adapter: %+v", wlan0)
+	}
+	if !stats.Adapters[1].Best || stats.Adapters[1].PacketShare != 45 {
+		t.Errorf("Unexpected wlan1 adapter: %+v", stats.Adapters[1])
+	}
+
+	// No antenna data
+	s.updateStats(WFBMessage{Type: "rx", ID: "video rx"})
+	if stats, _ := s.GetStats(); stats.BestAntenna != -1 {
+		t.Errorf("Expected no best antenna, got %d", stats.BestAntenna)
+	}
+}
+
+func TestStatsTotalsReset(t *testing.T) {
+	s := NewWFBStatsService()
+	update := func(all, lost, bytes int64) *WFBStats {
+		s.updateStats(WFBMessage{
+			Type: "rx",
+			ID:   "video rx",
+			Packets: map[string][]int64{
+				"all":       {100, all},
+				"lost":      {1, lost},
+				"all_bytes": {1000, bytes},
+				"dec_err":   {0, 3},
+			},
+		})
+		stats, _ := s.GetStats()
+		return stats
+	}
+
+	stats := update(9900, 100, 500000)
+	if stats.TotalPackets != 9900 || stats.TotalLost != 100 || stats.LossPercent != 1 {
+		t.Errorf("Unexpected totals: %d/%d %.2f%%", stats.TotalPackets, stats.TotalLost, stats.LossPercent)
+	}
+	if stats.Totals.Bytes != 500000 || stats.Totals.DecErr != 3 {
+		t.Errorf("Unexpected category totals: %+v", stats.Totals)
+	}
+
+	rec := httptest.NewRecorder()
+	s.HandleReset(rec, httptest.NewRequest(http.MethodPost, "/api/v1/stats/reset", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Reset returned %d", rec.Code)
+	}
+	stats, _ = s.GetStats()
+	if stats.TotalPackets != 0 || stats.Rx["video rx"].Totals.Bytes != 0 {
+		t.Errorf("Expected zeroed totals after reset, got %+v", stats.Totals)
+	}
+
+	stats = update(10000, 102, 501000)
+	if stats.TotalPackets != 100 || stats.TotalLost != 2 || stats.Totals.DecErr != 0 {
+		t.Errorf("Expected totals relative to reset, got %+v", stats.Totals)
+	}
+
+	// wfb-ng restarted: its counters start over
+	stats = update(50, 0, 2000)
+	if stats.TotalPackets != 50 || stats.Totals.Bytes != 2000 {
+		t.Errorf("Expected totals after wfb-ng restart, got %+v", stats.Totals)
+	}
+
+	rec = httptest.NewRecorder()
+	s.HandleReset(rec, httptest.NewRequest(http.MethodGet, "/api/v1/stats/reset", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// whepGatherTimeout bounds how long the answer waits for candidates.
+	// WHEP clients trickle theirs, and host candidates are there at once.
+	whepGatherTimeout = time.Second
+	// whepMaxBody limits offers and candidate fragments
+	whepMaxBody = 64 * 1024
+)
+
+// HandleWHEP serves the WHEP endpoint, the playback counterpart of WHIP
+// (RFC 9725): a POST with an SDP offer creates a session and returns 201
+// with the answer and the session's URL in Location
+func (s *StreamServer) HandleWHEP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Accept-Post", "application/sdp")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !hasContentType(r, "application/sdp") {
+		http.Error(w, "Expected application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+	sdp, err := io.ReadAll(io.LimitReader(r.Body, whepMaxBody))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(sdp)}
+	id, answer, err := s.answerOffer(offer, whepGatherTimeout)
+	if err != nil {
+		writeSignalingError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	for _, link := range iceServerLinks(s.iceServers(requestHost(r))) {
+		w.Header().Add("Link", link)
+	}
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+id)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer.SDP)
+}
+
+// HandleWHEPSession serves a WHEP session: PATCH adds trickled ICE
+// candidates, DELETE ends it
+func (s *StreamServer) HandleWHEPSession(w http.ResponseWriter, r *http.Request, id string) {
+	s.peersMu.RLock()
+	peer, ok := s.peers[id]
+	s.peersMu.RUnlock()
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPatch:
+		if !hasContentType(r, "application/trickle-ice-sdpfrag") {
+			http.Error(w, "Expected application/trickle-ice-sdpfrag", http.StatusUnsupportedMediaType)
+			return
+		}
+		candidates, ufrag, err := parseSDPFragment(io.LimitReader(r.Body, whepMaxBody))
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		// New credentials mean an ICE restart, which isn't supported
+		if remote := peer.pc.RemoteDescription(); ufrag != "" && remote != nil && !sdpHasLine(remote.SDP, "a=ice-ufrag:"+ufrag) {
+			http.Error(w, "ICE restart not supported", http.StatusUnprocessableEntity)
+			return
+		}
+		for _, candidate := range candidates {
+			if err := peer.pc.AddICECandidate(candidate); err != nil {
+				log.Printf("Peer %s: invalid candidate %q: %v", id, candidate.Candidate, err)
+				http.Error(w, "Invalid candidate", http.StatusBadRequest)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		s.closePeer(id)
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func sdpHasLine(sdp, want string) bool {
+	for _, line := range strings.Split(sdp, "\n") {
+		if strings.TrimSpace(line) == want {
+			return true
+		}
+	}
+	return false
+}
+
+func hasContentType(r *http.Request, want string) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == want
+}
+
+// parseSDPFragment returns the candidates of a trickle ICE SDP fragment
+// (RFC 8840) and the ICE username fragment it is for
+func parseSDPFragment(body io.Reader) ([]webrtc.ICECandidateInit, string, error) {
+	var candidates []webrtc.ICECandidateInit
+	var ufrag string
+	var mid *string
+	var mLineIndex uint16
+	mLines := 0
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "m="):
+			mLineIndex = uint16(mLines)
+			mLines++
+			mid = nil
+		case strings.HasPrefix(line, "a=mid:"):
+			m := strings.TrimPrefix(line, "a=mid:")
+			mid = &m
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			index := mLineIndex
+			candidates = append(candidates, webrtc.ICECandidateInit{
+				Candidate:     strings.TrimPrefix(line, "a="),
+				SDPMid:        mid,
+				SDPMLineIndex: &index,
+			})
+		}
+	}
+	return candidates, ufrag, scanner.Err()
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestParseSDPFragment(t *testing.T) {
+	frag := "a=ice-ufrag:EsAw\r\na=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\r\n" +
+		"m=audio 9 RTP/AVP 0\r\na=mid:0\r\na=candidate:1387637174 1 udp 2122260223 192.0.2.1 61764 typ host generation 0\r\n" +
+		"m=video 9 RTP/AVP 0\r\na=mid:1\r\na=candidate:3471623853 1 udp 2122194687 198.51.100.1 61765 typ host\r\na=end-of-candidates\r\n"
+	candidates, ufrag, err := parseSDPFragment(strings.NewReader(frag))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ufrag != "EsAw" || len(candidates) != 2 {
+		t.Fatalf("Unexpected ufrag %q and candidates %+v", ufrag, candidates)
+	}
+	if c := candidates[1]; !strings.HasPrefix(c.Candidate, "candidate:3471623853") || *c.SDPMid != "1" || *c.SDPMLineIndex != 1 {
+		t.Errorf("Unexpected candidate %+v", c)
+	}
+}
+
+func TestWHEP(t *testing.T) {
+	s := NewStreamServer(0)
+	if err := s.setCodec(CodecH264, "test"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo,
+		webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	candidates := make(chan *webrtc.ICECandidate, 16)
+	client.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c != nil {
+			candidates <- c
+		}
+	})
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/stream/whep", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		s.HandleWHEP(rec, req)
+		return rec
+	}
+	if rec := post("application/json", offer.SDP); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415, got %d", rec.Code)
+	}
+
+	// The offer is sent without waiting for candidates, which are trickled
+	rec := post("application/sdp", offer.SDP)
+	if rec.Code != http.StatusCreated || rec.Header().Get("Content-Type") != "application/sdp" {
+		t.Fatalf("Expected 201 with an SDP answer, got %d: %s", rec.Code, rec.Body)
+	}
+	location := rec.Header().Get("Location")
+	id := strings.TrimPrefix(location, "/api/v1/stream/whep/")
+	if id == "" || id == location || s.PeerCount() != 1 {
+		t.Fatalf("Unexpected location %q with %d peers", location, s.PeerCount())
+	}
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: rec.Body.String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	session := func(method, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, location, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		s.HandleWHEPSession(rec, req, id)
+		return rec
+	}
+	candidate := (<-candidates).ToJSON().Candidate
+	ufrag := ""
+	for _, line := range strings.Split(offer.SDP, "\r\n") {
+		if v, ok := strings.CutPrefix(line, "a=ice-ufrag:"); ok {
+			ufrag = v
+		}
+	}
+	frag := "a=ice-ufrag:" + ufrag + "\r\nm=video 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:0\r\na=" + candidate + "\r\n"
+	if rec := session(http.MethodPatch, "application/trickle-ice-sdpfrag", frag); rec.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 for a candidate, got %d: %s", rec.Code, rec.Body)
+	}
+	restart := strings.Replace(frag, ufrag, "other", 1)
+	if rec := session(http.MethodPatch, "application/trickle-ice-sdpfrag", restart); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for an ICE restart, got %d", rec.Code)
+	}
+
+	if rec := session(http.MethodDelete, "", ""); rec.Code != http.StatusOK || s.PeerCount() != 0 {
+		t.Errorf("Expected the session to end, got %d with %d peers", rec.Code, s.PeerCount())
+	}
+	rec = session(http.MethodPatch, "application/trickle-ice-sdpfrag", frag)
+	if body, _ := io.ReadAll(rec.Body); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 after DELETE, got %d: %s", rec.Code, body)
+	}
+}
@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, url string) string {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Scrape failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestRegistryExposition(t *testing.T) {
+	reg := NewRegistry()
+
+	packets := reg.NewCounter("test_packets_total", "Packets received.", "type")
+	packets.Add(100, "all")
+	packets.Inc("lost")
+	packets.Add(-5, "lost") // ignored, counters never go down
+
+	rssi := reg.NewGauge("test_rssi_dbm", "Antenna RSSI.", "antenna")
+	rssi.Set(-60, "0")
+	rssi.Set(-72, "1")
+
+	reg.NewGaugeFunc("test_peers", "Connected peers.", func() float64 { return 3 })
+	reg.NewGaugeFunc("test_missing", "Unavailable value.", func() float64 { return math.NaN() })
+
+	latency := reg.NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1}, "path")
+	latency.Observe(0.05, `/api/"x"`)
+	latency.Observe(0.5, `/api/"x"`)
+
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	body := scrape(t, srv.URL)
+
+	expected := []string{
+		"# HELP test_packets_total Packets received.",
+		"# TYPE test_packets_total counter",
+		`test_packets_total{type="all"} 100`,
+		`test_packets_total{type="lost"} 1`,
+		"# TYPE test_rssi_dbm gauge",
+		`test_rssi_dbm{antenna="0"} -60`,
+		`test_rssi_dbm{antenna="1"} -72`,
+		"test_peers 3",
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{path="/api/\"x\"",le="0.1"} 1`,
+		`test_latency_seconds_bucket{path="/api/\"x\"",le="1"} 2`,
+		`test_latency_seconds_bucket{path="/api/\"x\"",le="+Inf"} 2`,
+		`test_latency_seconds_sum{path="/api/\"x\""} 0.55`,
+		`test_latency_seconds_count{path="/api/\"x\""} 2`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Missing line %q in:\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, "test_missing") {
+		t.Error("NaN gauge func should be omitted")
+	}
+
+	// Gauges can drop label combinations
+	rssi.Reset()
+	rssi.Set(-65, "0")
+	body = scrape(t, srv.URL)
+	if strings.Contains(body, `antenna="1"`) {
+		t.Error("Expected antenna 1 to be removed after reset")
+	}
+}
+
+func TestInstrumentTransport(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	reg := NewRegistry()
+	duration := reg.NewHistogram("proxy_duration_seconds", "Proxy latency.", DefaultLatencyBuckets, "code")
+	errors := reg.NewCounter("proxy_errors_total", "Proxy errors.", "reason")
+
+	client := &http.Client{Transport: InstrumentTransport(nil, duration, errors)}
+	for _, path := range []string{"/ok", "/fail"} {
+		resp, err := client.Get(backend.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if _, err := client.Get("http://127.0.0.1:1/unreachable"); err == nil {
+		t.Fatal("Expected connection error")
+	}
+
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+	body := scrape(t, srv.URL)
+
+	for _, line := range []string{
+		`proxy_duration_seconds_count{code="200"} 1`,
+		`proxy_duration_seconds_count{code="502"} 1`,
+		`proxy_duration_seconds_count{code="error"} 1`,
+		`proxy_errors_total{reason="status_5xx"} 1`,
+		`proxy_errors_total{reason="transport"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Missing line %q in:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"bufio"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RegisterSystemMetrics registers host health gauges read from /proc and /sys.
+// Values that can't be read on the current platform are omitted.
+func (r *Registry) RegisterSystemMetrics(prefix string) {
+	start := time.Now()
+
+	r.NewGaugeFunc(prefix+"_process_uptime_seconds", "Seconds since this process started.", func() float64 {
+		return time.Since(start).Seconds()
+	})
+	r.NewGaugeFunc(prefix+"_system_uptime_seconds", "Seconds since the system booted.", func() float64 {
+		return readProcField("/proc/uptime", 0)
+	})
+	r.NewGaugeFunc(prefix+"_system_load1", "1 minute load average.", func() float64 {
+		return readProcField("/proc/loadavg", 0)
+	})
+	r.NewGaugeFunc(prefix+"_system_memory_total_bytes", "Total system memory.", func() float64 {
+		return readMeminfo("MemTotal")
+	})
+	r.NewGaugeFunc(prefix+"_system_memory_available_bytes", "Memory available for new allocations.", func() float64 {
+		return readMeminfo("MemAvailable")
+	})
+	r.NewGaugeFunc(prefix+"_system_temperature_celsius", "SoC temperature from the first thermal zone.", func() float64 {
+		milli := readProcField("/sys/class/thermal/thermal_zone0/temp", 0)
+		return milli / 1000
+	})
+}
+
+// readProcField returns the n-th whitespace separated number in a file
+func readProcField(path string, n int) float64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return math.NaN()
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) <= n {
+		return math.NaN()
+	}
+	v, err := strconv.ParseFloat(fields[n], 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return v
+}
+
+// readMeminfo returns a /proc/meminfo entry in bytes
+func readMeminfo(key string) float64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return math.NaN()
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.TrimSuffix(fields[0], ":") != key {
+			continue
+		}
+		kb, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return kb * 1024
+	}
+	return math.NaN()
+}
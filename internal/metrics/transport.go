@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// instrumentedTransport records latency and errors of outgoing requests
+type instrumentedTransport struct {
+	next     http.RoundTripper
+	duration *Histogram
+	errors   *Counter
+}
+
+// InstrumentTransport wraps next so every request records its latency in
+// duration (labelled by status code) and transport failures or 5xx
+// responses in errors (labelled by reason). A nil next uses http.DefaultTransport.
+func InstrumentTransport(next http.RoundTripper, duration *Histogram, errors *Counter) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &instrumentedTransport{next: next, duration: duration, errors: errors}
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	elapsed := time.Since(start).Seconds()
+
+	if err != nil {
+		t.duration.Observe(elapsed, "error")
+		t.errors.Inc("transport")
+		return resp, err
+	}
+
+	t.duration.Observe(elapsed, strconv.Itoa(resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		t.errors.Inc("status_5xx")
+	}
+	return resp, nil
+}
@@ -1,24 +1,201 @@
 import { useEffect, useRef, useState } from 'react';
 
 type ConnectionState = 'disconnected' | 'connecting' | 'connected' | 'failed';
+type StreamMode = 'webrtc' | 'mse';
+type StreamInput = { id: string; label: string };
+
+// Browsers that can't decode the stream over WebRTC (H.265 in most of them)
+// may still do it through Media Source Extensions. iOS Safari only has
+// ManagedMediaSource.
+const MediaSourceImpl: typeof MediaSource | undefined =
+    (window as unknown as { ManagedMediaSource?: typeof MediaSource }).ManagedMediaSource ?? window.MediaSource;
+
+// Seconds of buffered video before the player jumps to the live edge
+const MSE_MAX_LATENCY = 0.5;
+// Seconds of played video kept in the buffer
+const MSE_KEEP_SECONDS = 10;
 
 export function VideoPlayer() {
     const videoRef = useRef<HTMLVideoElement>(null);
     const peerConnectionRef = useRef<RTCPeerConnection | null>(null);
+    const socketRef = useRef<WebSocket | null>(null);
+    // WebRTC unless the browser lacks it or can't decode the stream's codec
+    const modeRef = useRef<StreamMode>(typeof RTCPeerConnection === 'undefined' ? 'mse' : 'webrtc');
     const [connectionState, setConnectionState] = useState<ConnectionState>('disconnected');
+    const [errorMessage, setErrorMessage] = useState<string | null>(null);
+    const [inputs, setInputs] = useState<StreamInput[]>([]);
+    const [source, setSource] = useState('main');
+
+    // Other cameras or drones received by the ground station
+    useEffect(() => {
+        fetch('/api/v1/stream/inputs')
+            .then((response) => response.ok ? response.json() : [])
+            .then((list: StreamInput[]) => setInputs(list))
+            .catch(() => { });
+    }, []);
 
     useEffect(() => {
         let mounted = true;
+        let retryTimer: ReturnType<typeof setTimeout> | undefined;
+
+        const closeConnections = () => {
+            peerConnectionRef.current?.close();
+            peerConnectionRef.current = null;
+            if (socketRef.current) {
+                socketRef.current.onclose = null;
+                socketRef.current.close();
+                socketRef.current = null;
+            }
+        };
+
+        // The server closes peers when the stream codec changes, so dropped
+        // connections reconnect with a fresh offer
+        const scheduleReconnect = () => {
+            if (!mounted || retryTimer) return;
+            retryTimer = setTimeout(() => {
+                retryTimer = undefined;
+                closeConnections();
+                connect();
+            }, 2000);
+        };
+
+        const fail = (message: string) => {
+            closeConnections();
+            if (mounted) {
+                setErrorMessage(message);
+                setConnectionState('failed');
+            }
+        };
+
+        const connect = () => {
+            if (modeRef.current === 'mse') {
+                connectMSE();
+            } else {
+                connectWebRTC();
+            }
+        };
+
+        // Fragmented MP4 over a WebSocket: a JSON message announcing the
+        // track precedes each init segment, every other message is a frame
+        const connectMSE = () => {
+            if (!mounted) return;
+            if (!MediaSourceImpl) {
+                fail('This browser supports neither WebRTC for this stream nor Media Source Extensions');
+                return;
+            }
+            if (source !== 'main') {
+                fail('Only the main input can be played without WebRTC');
+                return;
+            }
+            setConnectionState('connecting');
+            setErrorMessage(null);
+
+            const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
+            const ws = new WebSocket(`${protocol}//${window.location.host}/api/v1/stream/fmp4`);
+            ws.binaryType = 'arraybuffer';
+            socketRef.current = ws;
+
+            let mimeType = '';
+            let sourceBuffer: SourceBuffer | null = null;
+            let queue: ArrayBuffer[] = [];
+            let segments = 0;
+
+            const appendNext = () => {
+                if (!sourceBuffer || sourceBuffer.updating || queue.length === 0) return;
+                try {
+                    sourceBuffer.appendBuffer(queue.shift()!);
+                } catch (error) {
+                    console.error('MSE append failed:', error);
+                    ws.close();
+                }
+            };
+
+            const onUpdateEnd = () => {
+                const video = videoRef.current;
+                if (video && sourceBuffer && sourceBuffer.buffered.length > 0) {
+                    const ranges = sourceBuffer.buffered;
+                    const end = ranges.end(ranges.length - 1);
+                    // Stay at the live edge
+                    if (end - video.currentTime > MSE_MAX_LATENCY) {
+                        video.currentTime = end - 0.05;
+                    }
+                    // Drop what has been played
+                    if (video.currentTime - ranges.start(0) > MSE_KEEP_SECONDS) {
+                        sourceBuffer.remove(ranges.start(0), video.currentTime - 1);
+                        return;
+                    }
+                }
+                appendNext();
+            };
+
+            const createSourceBuffer = (type: string) => {
+                const video = videoRef.current;
+                if (!video) return;
+                const mediaSource = new MediaSourceImpl();
+                mimeType = type;
+                sourceBuffer = null;
+                queue = [];
+
+                video.srcObject = null;
+                // ManagedMediaSource only plays with remote playback off
+                video.disableRemotePlayback = true;
+                video.src = URL.createObjectURL(mediaSource);
+                mediaSource.addEventListener('sourceopen', () => {
+                    URL.revokeObjectURL(video.src);
+                    sourceBuffer = mediaSource.addSourceBuffer(type);
+                    sourceBuffer.mode = 'segments';
+                    sourceBuffer.addEventListener('updateend', onUpdateEnd);
+                    appendNext();
+                }, { once: true });
+            };
 
-        const connect = async () => {
+            ws.onmessage = (event) => {
+                if (!mounted) return;
+                if (typeof event.data === 'string') {
+                    const { mime_type: type } = JSON.parse(event.data) as { mime_type: string };
+                    if (!MediaSourceImpl.isTypeSupported(type)) {
+                        fail(`This browser can't decode the stream (${type})`);
+                        return;
+                    }
+                    // A new init segment for the same codec is appended to
+                    // the same buffer
+                    if (type !== mimeType) {
+                        createSourceBuffer(type);
+                    }
+                    return;
+                }
+                queue.push(event.data as ArrayBuffer);
+                appendNext();
+                // The first frame follows the init segment
+                if (++segments === 2) {
+                    setConnectionState('connected');
+                }
+            };
+
+            ws.onclose = () => {
+                if (!mounted) return;
+                setConnectionState('disconnected');
+                scheduleReconnect();
+            };
+        };
+
+        const connectWebRTC = async () => {
             if (!mounted) return;
             setConnectionState('connecting');
+            setErrorMessage(null);
 
             try {
+                // Use the ground station's ICE servers, none when it's
+                // offline, so gathering doesn't wait on unreachable ones
+                const iceResponse = await fetch('/api/v1/stream/ice');
+                if (!iceResponse.ok) {
+                    throw new Error(`Server returned ${iceResponse.status}`);
+                }
+                const { ice_servers: iceServers } = await iceResponse.json() as { ice_servers: RTCIceServer[] };
+                if (!mounted) return;
+
                 // Create peer connection
-                const pc = new RTCPeerConnection({
-                    iceServers: [{ urls: 'stun:stun.l.google.com:19302' }]
-                });
+                const pc = new RTCPeerConnection({ iceServers });
                 peerConnectionRef.current = pc;
 
                 // Handle incoming tracks
@@ -39,9 +216,11 @@ export function VideoPlayer() {
                         case 'failed':
                         case 'closed':
                             setConnectionState('failed');
+                            scheduleReconnect();
                             break;
                         case 'disconnected':
                             setConnectionState('disconnected');
+                            scheduleReconnect();
                             break;
                     }
                 };
@@ -72,9 +251,36 @@ export function VideoPlayer() {
                 const response = await fetch('/api/v1/stream/offer', {
                     method: 'POST',
                     headers: { 'Content-Type': 'application/json' },
-                    body: JSON.stringify({ offer: pc.localDescription })
+                    body: JSON.stringify({ offer: pc.localDescription, sources: [source] })
                 });
 
+                if (response.status === 406) {
+                    // The browser can't decode the stream's codec over
+                    // WebRTC, retrying won't help but MSE might
+                    const message = await response.text();
+                    pc.close();
+                    peerConnectionRef.current = null;
+                    if (MediaSourceImpl) {
+                        modeRef.current = 'mse';
+                        connectMSE();
+                    } else if (mounted) {
+                        setErrorMessage(message.trim());
+                        setConnectionState('failed');
+                    }
+                    return;
+                }
+                if (response.status === 503) {
+                    // Too many viewers, keep trying until one leaves
+                    const message = await response.text();
+                    pc.close();
+                    peerConnectionRef.current = null;
+                    if (mounted) {
+                        setErrorMessage(message.trim());
+                        setConnectionState('failed');
+                        scheduleReconnect();
+                    }
+                    return;
+                }
                 if (!response.ok) {
                     throw new Error(`Server returned ${response.status}`);
                 }
@@ -86,6 +292,7 @@ export function VideoPlayer() {
                 console.error('WebRTC connection failed:', error);
                 if (mounted) {
                     setConnectionState('failed');
+                    scheduleReconnect();
                 }
             }
         };
@@ -94,18 +301,17 @@ export function VideoPlayer() {
 
         return () => {
             mounted = false;
-            if (peerConnectionRef.current) {
-                peerConnectionRef.current.close();
-                peerConnectionRef.current = null;
-            }
+            clearTimeout(retryTimer);
+            closeConnections();
         };
-    }, []);
+    }, [source]);
 
     const handleRetry = () => {
         if (peerConnectionRef.current) {
             peerConnectionRef.current.close();
             peerConnectionRef.current = null;
         }
+        socketRef.current?.close();
         setConnectionState('disconnected');
         // Trigger re-connect by forcing a re-render
         window.location.reload();
@@ -131,6 +337,28 @@ export function VideoPlayer() {
                 }}
             />
 
+            {inputs.length > 1 && (
+                <select
+                    value={source}
+                    onChange={(event) => setSource(event.target.value)}
+                    style={{
+                        position: 'absolute',
+                        top: 16,
+                        right: 16,
+                        zIndex: 10,
+                        padding: '4px 8px',
+                        backgroundColor: 'rgba(0, 0, 0, 0.6)',
+                        color: '#fff',
+                        border: '1px solid #555',
+                        borderRadius: '4px'
+                    }}
+                >
+                    {inputs.map((input) => (
+                        <option key={input.id} value={input.id}>{input.label || input.id}</option>
+                    ))}
+                </select>
+            )}
+
             {/* Connection Status Overlay */}
             {connectionState !== 'connected' && (
                 <div style={{
@@ -162,7 +390,7 @@ export function VideoPlayer() {
                     {connectionState === 'failed' && (
                         <>
                             <p style={{ color: '#ff6b6b', marginBottom: '16px' }}>
-                                Connection failed
+                                {errorMessage ?? 'Connection failed'}
                             </p>
                             <button
                                 onClick={handleRetry}
@@ -1,30 +1,54 @@
 import { ActionIcon, Box, Group, Paper, Text, Tooltip } from '@mantine/core';
-import { IconAccessPoint, IconAntenna, IconChartLine, IconEye, IconRefresh } from '@tabler/icons-react';
+import { IconAccessPoint, IconAlertTriangle, IconAntenna, IconChartLine, IconEye, IconRefresh } from '@tabler/icons-react';
 import { useEffect, useRef, useState } from 'react';
 // @ts-ignore
 import Draggable from 'react-draggable';
-import type { WFBStats as WFBStatsType } from '../types';
+import type { Alert, SignalEvent, WFBStats as WFBStatsType } from '../types';
 
 export function WFBStats() {
     const [stats, setStats] = useState<WFBStatsType | null>(null);
     const [visible, setVisible] = useState(true);
+    const [alerts, setAlerts] = useState<Alert[]>([]);
+    const [noSignal, setNoSignal] = useState<SignalEvent | null>(null);
     const nodeRef = useRef(null);
 
     useEffect(() => {
-        const interval = setInterval(async () => {
-            if (!visible) return;
+        if (!visible) return;
+
+        // Stats are pushed by the server on every wfb-ng update
+        const source = new EventSource('/api/v1/stats/stream');
+        source.addEventListener('stats', (event) => {
+            try {
+                setStats(JSON.parse((event as MessageEvent).data));
+            } catch (err) {
+                console.error("Failed to parse stats", err);
+            }
+        });
+        // Alerts share the stats stream; keep the firing ones and play their cue
+        source.addEventListener('alert', (event) => {
             try {
-                const res = await fetch('/api/v1/stats');
-                if (res.ok) {
-                    const data = await res.json();
-                    setStats(data);
+                const alert: Alert = JSON.parse((event as MessageEvent).data);
+                setAlerts((prev) => {
+                    const others = prev.filter((a) => a.rule_id !== alert.rule_id);
+                    return alert.state === 'firing' ? [...others, alert] : others;
+                });
+                if (alert.state === 'firing') {
+                    new Audio(`/api/v1/alerts/cue?severity=${alert.severity}`).play().catch(() => { });
                 }
             } catch (err) {
-                console.error("Failed to fetch stats", err);
+                console.error("Failed to parse alert", err);
             }
-        }, 1000);
+        });
+        // The server's stream watchdog reports the video stopping and coming back
+        source.addEventListener('no_signal', (event) => {
+            setNoSignal(JSON.parse((event as MessageEvent).data));
+        });
+        source.addEventListener('signal_restored', () => setNoSignal(null));
+        source.onerror = () => {
+            console.error("Stats stream disconnected, retrying");
+        };
 
-        return () => clearInterval(interval);
+        return () => source.close();
     }, [visible]);
 
     if (!visible) {
@@ -53,6 +77,19 @@ export function WFBStats() {
                         </ActionIcon>
                     </Group>
 
+                    {noSignal && (
+                        <Group gap={5} mb={4}>
+                            <IconAlertTriangle size={14} color="red" />
+                            <Text size="xs" fw={700}>No video signal ({noSignal.reason})</Text>
+                        </Group>
+                    )}
+                    {alerts.map((alert) => (
+                        <Group key={alert.rule_id} gap={5} mb={4}>
+                            <IconAlertTriangle size={14} color={alert.severity === 'critical' ? 'red' : alert.severity === 'warning' ? 'orange' : 'cyan'} />
+                            <Text size="xs" fw={700}>{alert.message}</Text>
+                        </Group>
+                    ))}
+
                     {stats ? (
                         <>
                             {/* Antenna Stats */}
@@ -48,15 +48,59 @@ export interface AdaptiveLinkSettings {
     osd_level: number;
 }
 
-export interface WFBStats {
+export interface WFBAntennaStats {
+    ant_id: number;
+    wlan_idx: number;
+    antenna: number;
+    frequency: number;
+    mcs_index: number;
+    bandwidth: number;
+    packets_per_sec: number;
+    packet_share: number;
+    rssi_min: number;
+    rssi_avg: number;
+    rssi_max: number;
+    snr_min: number;
+    snr_avg: number;
+    snr_max: number;
+    best: boolean;
+}
+
+export interface WFBAdapterStats {
+    wlan_idx: number;
+    antennas: number[];
+    packets_per_sec: number;
+    packet_share: number;
+    best_rssi: number;
+    best_snr: number;
+    best: boolean;
+}
+
+export interface WFBPacketTotals {
+    all: number;
+    lost: number;
+    fec_rec: number;
+    bad: number;
+    all_bytes: number;
+    dec_err: number;
+    out: number;
+}
+
+export interface WFBStreamStats {
+    id: string;
     rssi: number[];
     snr: number[];
+    antennas: WFBAntennaStats[] | null;
+    adapters: WFBAdapterStats[] | null;
+    best_antenna: number; // ant_id, -1 when none
     video_packets_per_sec: number;
     fec_packets_per_sec: number;
     lost_packets_per_sec: number;
     bad_blocks_per_sec: number;
     total_packets: number;
     total_lost: number;
+    totals: WFBPacketTotals;
+    loss_percent: number;
 
     // Transmission Info
     frequency: number;
@@ -66,3 +110,49 @@ export interface WFBStats {
     fec_n: number;
     link_flow_bytes_per_sec: number;
 }
+
+export interface WFBTxAntennaStats {
+    ant_id: number;
+    injected: number;
+    dropped: number;
+    latency_min_us: number;
+    latency_avg_us: number;
+    latency_max_us: number;
+}
+
+export interface WFBTxStats {
+    id: string;
+    incoming_packets_per_sec: number;
+    injected_packets_per_sec: number;
+    injected_bytes_per_sec: number;
+    dropped_packets_per_sec: number;
+    truncated_per_sec: number;
+    fec_timeouts_per_sec: number;
+    antennas: WFBTxAntennaStats[];
+}
+
+// Flat fields describe the video stream; every stream is listed in rx/tx
+export interface WFBStats extends WFBStreamStats {
+    rx: Record<string, WFBStreamStats>;
+    tx: Record<string, WFBTxStats>;
+    source: string;
+}
+
+export interface Alert {
+    id: number;
+    time: string;
+    rule_id: string;
+    rule_name: string;
+    metric: string;
+    severity: 'info' | 'warning' | 'critical';
+    state: 'firing' | 'resolved';
+    value: number;
+    threshold: number;
+    message: string;
+}
+
+export interface SignalEvent {
+    time: string;
+    reason?: string;
+    outage_sec?: number;
+}